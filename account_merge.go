@@ -0,0 +1,608 @@
+package firebasetools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"firebase.google.com/go/auth"
+	"google.golang.org/api/iterator"
+)
+
+// audit log type and operation of account merges
+const (
+	AccountAuditTypeName       = "account"
+	MergeAccountAuditOperation = "merge"
+)
+
+// AccountMergesCollectionName is the (unsuffixed) Firestore collection that keeps the progress of account merges
+const AccountMergesCollectionName = "account_merges"
+
+// DuplicateAccountGroup is a set of accounts that share a verified email address or phone number
+type DuplicateAccountGroup struct {
+	// Identifiers are the shared identifiers e.g `email:jane@example.com` or `phone:+254700000000`
+	Identifiers []string `json:"identifiers"`
+
+	// UIDs are ordered from the oldest account. The first is the suggested primary account.
+	UIDs []string `json:"uids"`
+}
+
+// verifiedIdentifiers lists the email addresses and phone numbers that the user has proven they own
+func verifiedIdentifiers(user *auth.UserRecord) []string {
+	identifiers := map[string]bool{}
+	if user.UserInfo != nil {
+		if user.Email != "" && user.EmailVerified {
+			identifiers["email:"+strings.ToLower(user.Email)] = true
+		}
+		if user.PhoneNumber != "" {
+			identifiers["phone:"+user.PhoneNumber] = true
+		}
+	}
+	// provider emails are left out: not every federated provider verifies them, and
+	// Firebase Auth already marks the user's email verified when one does
+	for _, info := range user.ProviderUserInfo {
+		if info.PhoneNumber != "" {
+			identifiers["phone:"+info.PhoneNumber] = true
+		}
+	}
+	sorted := []string{}
+	for identifier := range identifiers {
+		sorted = append(sorted, identifier)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// FindDuplicateAccounts groups the users that the iterator yields by shared
+// verified email addresses and phone numbers
+func FindDuplicateAccounts(it UserRecordIterator) ([]*DuplicateAccountGroup, error) {
+	owners := map[string][]string{}
+	created := map[string]int64{}
+	parent := map[string]string{}
+	var find func(uid string) string
+	find = func(uid string) string {
+		if parent[uid] != uid {
+			parent[uid] = find(parent[uid])
+		}
+		return parent[uid]
+	}
+
+	for {
+		record, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to list users: %w", err)
+		}
+		if record.UserRecord == nil || record.UserInfo == nil {
+			continue
+		}
+		uid := record.UID
+		parent[uid] = uid
+		if record.UserMetadata != nil {
+			created[uid] = record.UserMetadata.CreationTimestamp
+		}
+		for _, identifier := range verifiedIdentifiers(record.UserRecord) {
+			if existing := owners[identifier]; len(existing) > 0 {
+				parent[find(uid)] = find(existing[0])
+			}
+			owners[identifier] = append(owners[identifier], uid)
+		}
+	}
+
+	groups := map[string]*DuplicateAccountGroup{}
+	for identifier, uids := range owners {
+		if len(uids) < 2 {
+			continue
+		}
+		root := find(uids[0])
+		group, ok := groups[root]
+		if !ok {
+			group = &DuplicateAccountGroup{}
+			groups[root] = group
+		}
+		group.Identifiers = append(group.Identifiers, identifier)
+	}
+	for uid := range parent {
+		if group, ok := groups[find(uid)]; ok {
+			group.UIDs = append(group.UIDs, uid)
+		}
+	}
+
+	sorted := []*DuplicateAccountGroup{}
+	for _, group := range groups {
+		sort.Strings(group.Identifiers)
+		sort.Slice(group.UIDs, func(i, j int) bool {
+			a, b := group.UIDs[i], group.UIDs[j]
+			if created[a] != created[b] {
+				return created[a] < created[b]
+			}
+			return a < b
+		})
+		sorted = append(sorted, group)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].UIDs[0] < sorted[j].UIDs[0] })
+	return sorted, nil
+}
+
+// AccountMergeReport describes what a merge changed, or would change in a dry run
+type AccountMergeReport struct {
+	DryRun       bool   `json:"dryRun"`
+	PrimaryUID   string `json:"primaryUID"`
+	SecondaryUID string `json:"secondaryUID"`
+
+	// MovedEmail and MovedPhoneNumber are linked onto the primary account
+	MovedEmail       string `json:"movedEmail,omitempty"`
+	MovedPhoneNumber string `json:"movedPhoneNumber,omitempty"`
+
+	// UnlinkedProviders are sign in methods of the secondary account that can't be
+	// moved on the server. The user has to link them again by signing in with them.
+	UnlinkedProviders []string `json:"unlinkedProviders,omitempty"`
+
+	// Conflicts are details of the secondary account that the primary account
+	// already has different values for, and that are dropped
+	Conflicts []string `json:"conflicts,omitempty"`
+
+	// MigratedDocuments counts the documents per `collection.field` that are
+	// reassigned to the primary account
+	MigratedDocuments map[string]int `json:"migratedDocuments"`
+
+	// IdentifiersReleased is set once the moved identifiers were removed from the
+	// secondary account, and PrimaryUpdated once they were linked to the primary one
+	IdentifiersReleased bool `json:"identifiersReleased"`
+	PrimaryUpdated      bool `json:"primaryUpdated"`
+	SecondaryDeleted    bool `json:"secondaryDeleted"`
+
+	// RolledBack is set when the identifiers could not be linked to the primary
+	// account and were restored to the secondary account
+	RolledBack bool `json:"rolledBack,omitempty"`
+}
+
+// AccountMerger merges duplicate accounts of the project, or of the context's tenant
+type AccountMerger struct {
+	// Documents holds the documents that are reassigned to the primary account
+	Documents OwnedDocumentStore
+
+	// Collections lists the (suffixed) collections whose `createdByUID` and
+	// `updatedByUID` fields are migrated
+	Collections []string
+
+	// Users lists every user for duplicate detection. It defaults to Firebase Auth.
+	Users func(ctx context.Context) (UserRecordIterator, error)
+
+	// GetUser, UpdateUser and DeleteUser default to Firebase Auth
+	GetUser    func(ctx context.Context, tenantID string, uid string) (*auth.UserRecord, error)
+	UpdateUser func(ctx context.Context, tenantID string, uid string, user *auth.UserToUpdate) (*auth.UserRecord, error)
+	DeleteUser func(ctx context.Context, tenantID string, uid string) error
+
+	// Recorder receives an audit log entry for every merge, if set
+	Recorder AuditLogRecorder
+
+	// Progress keeps how far merges got, so that failed merges can be retried.
+	// It defaults to an in-memory store.
+	Progress AccountMergeProgressStore
+
+	progressOnce    sync.Once
+	defaultProgress AccountMergeProgressStore
+}
+
+func updateFirebaseUser(ctx context.Context, tenantID string, uid string, user *auth.UserToUpdate) (*auth.UserRecord, error) {
+	if tenantID != "" {
+		authClient, err := GetTenantAuthClient(ctx, tenantID)
+		if err != nil {
+			return nil, err
+		}
+		return authClient.UpdateUser(ctx, uid, user)
+	}
+	authClient, err := GetFirebaseAuthClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get or create Firebase client: %w", err)
+	}
+	return authClient.UpdateUser(ctx, uid, user)
+}
+
+func deleteFirebaseUser(ctx context.Context, tenantID string, uid string) error {
+	if tenantID != "" {
+		authClient, err := GetTenantAuthClient(ctx, tenantID)
+		if err != nil {
+			return err
+		}
+		return authClient.DeleteUser(ctx, uid)
+	}
+	authClient, err := GetFirebaseAuthClient(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get or create Firebase client: %w", err)
+	}
+	return authClient.DeleteUser(ctx, uid)
+}
+
+// FindDuplicates lists the groups of accounts that share verified identifiers
+func (m *AccountMerger) FindDuplicates(ctx context.Context) ([]*DuplicateAccountGroup, error) {
+	users := m.Users
+	if users == nil {
+		users = listFirebaseUsers
+	}
+	it, err := users(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return FindDuplicateAccounts(it)
+}
+
+// Merge folds the secondary account into the primary one. Documents that the
+// secondary account created or updated are reassigned, the email address and
+// phone number that move are released from the secondary account and linked
+// onto the primary account, and the secondary account is deleted last.
+//
+// Progress is saved after every step, so that retrying a merge that failed
+// resumes it. When linking the identifiers fails, they are given back to the
+// secondary account. Reassigned documents are not rolled back. Failures return
+// the report along with the error, describing how far the merge got.
+// Dry runs only report what would change.
+func (m *AccountMerger) Merge(ctx context.Context, primaryUID string, secondaryUID string, dryRun bool) (*AccountMergeReport, error) {
+	if primaryUID == "" || secondaryUID == "" || primaryUID == secondaryUID {
+		return nil, fmt.Errorf("two different accounts are required to merge")
+	}
+	if m.Documents == nil && len(m.Collections) > 0 {
+		return nil, fmt.Errorf("a document store is required to migrate documents")
+	}
+	getUser := m.GetUser
+	if getUser == nil {
+		getUser = getTenantUser
+	}
+	updateUser := m.UpdateUser
+	if updateUser == nil {
+		updateUser = updateFirebaseUser
+	}
+	deleteUser := m.DeleteUser
+	if deleteUser == nil {
+		deleteUser = deleteFirebaseUser
+	}
+	store := m.progressStore()
+	tenantID, _ := GetTenantIDFromContext(ctx)
+
+	primary, err := getUser(ctx, tenantID, primaryUID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the primary account %s: %w", primaryUID, err)
+	}
+	progress, err := store.GetAccountMergeProgress(ctx, tenantID, primaryUID, secondaryUID)
+	if err != nil {
+		return nil, err
+	}
+	if progress == nil {
+		secondary, err := getUser(ctx, tenantID, secondaryUID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get the secondary account %s: %w", secondaryUID, err)
+		}
+		progress = &AccountMergeProgress{
+			TenantID:           tenantID,
+			Report:             *planAccountMerge(primary, secondary),
+			MovedEmailVerified: secondary.EmailVerified,
+		}
+	}
+	report := progress.report()
+	report.DryRun = dryRun
+	report.RolledBack = false
+
+	save := func() error {
+		progress.Report = *report
+		progress.Report.DryRun = false
+		progress.UpdatedAt = time.Now().UTC()
+		return store.SaveAccountMergeProgress(ctx, progress)
+	}
+
+	// documents that were already reassigned are counted by the saved progress
+	for _, collection := range m.Collections {
+		for _, field := range []string{CreatedByUIDField, UpdatedByUIDField} {
+			docs, err := m.Documents.ListOwnedDocuments(ctx, collection, field, secondaryUID)
+			if err != nil {
+				return report, err
+			}
+			key := collection + "." + field
+			report.MigratedDocuments[key] += len(docs)
+			if dryRun || len(docs) == 0 {
+				continue
+			}
+			if err := m.Documents.UpdateOwnedDocuments(ctx, docs, map[string]interface{}{field: primaryUID}); err != nil {
+				report.MigratedDocuments[key] -= len(docs)
+				return report, fmt.Errorf("unable to migrate %s: %w", collection, err)
+			}
+			if err := save(); err != nil {
+				return report, err
+			}
+		}
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	// an email address or phone number can only belong to one account, so they
+	// are released from the secondary account before they are linked
+	if report.MovedEmail != "" || report.MovedPhoneNumber != "" {
+		if !report.IdentifiersReleased && !report.PrimaryUpdated {
+			release := &auth.UserToUpdate{}
+			if report.MovedEmail != "" {
+				// the Admin SDK can't remove an email address, so it is replaced
+				release = release.Email(releasedEmail(secondaryUID)).EmailVerified(false)
+			}
+			if report.MovedPhoneNumber != "" {
+				release = release.PhoneNumber("")
+			}
+			if _, err := updateUser(ctx, tenantID, secondaryUID, release); err != nil {
+				return report, fmt.Errorf(
+					"unable to release the identifiers of the secondary account %s: %w", secondaryUID, err)
+			}
+			report.IdentifiersReleased = true
+			if err := save(); err != nil {
+				return report, err
+			}
+		}
+
+		if !report.PrimaryUpdated {
+			link := &auth.UserToUpdate{}
+			if report.MovedEmail != "" {
+				link = link.Email(report.MovedEmail).EmailVerified(progress.MovedEmailVerified)
+			}
+			if report.MovedPhoneNumber != "" {
+				link = link.PhoneNumber(report.MovedPhoneNumber)
+			}
+			if _, err := updateUser(ctx, tenantID, primaryUID, link); err != nil {
+				return report, m.restoreIdentifiers(ctx, tenantID, secondaryUID, report, progress, save, err)
+			}
+			report.PrimaryUpdated = true
+			if err := save(); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if !report.SecondaryDeleted {
+		if err := deleteUser(ctx, tenantID, secondaryUID); err != nil {
+			return report, fmt.Errorf(
+				"the merge into %s is incomplete, the secondary account %s could not be deleted: %w",
+				primaryUID, secondaryUID, err)
+		}
+		report.SecondaryDeleted = true
+		if err := save(); err != nil {
+			return report, err
+		}
+	}
+
+	if m.Recorder != nil {
+		entry, err := NewAuditLog(AccountAuditTypeName, primaryUID, MergeAccountAuditOperation, primaryUID, report)
+		if err == nil {
+			err = m.Recorder.RecordAuditLog(ctx, entry)
+		}
+		if err != nil {
+			log.Printf("unable to audit the merge of %s into %s: %s", secondaryUID, primaryUID, err)
+		}
+	}
+	return report, nil
+}
+
+// restoreIdentifiers gives the released identifiers back to the secondary account
+// after they could not be linked to the primary account
+func (m *AccountMerger) restoreIdentifiers(
+	ctx context.Context,
+	tenantID string,
+	secondaryUID string,
+	report *AccountMergeReport,
+	progress *AccountMergeProgress,
+	save func() error,
+	linkErr error,
+) error {
+	updateUser := m.UpdateUser
+	if updateUser == nil {
+		updateUser = updateFirebaseUser
+	}
+	restore := &auth.UserToUpdate{}
+	if report.MovedEmail != "" {
+		restore = restore.Email(report.MovedEmail).EmailVerified(progress.MovedEmailVerified)
+	}
+	if report.MovedPhoneNumber != "" {
+		restore = restore.PhoneNumber(report.MovedPhoneNumber)
+	}
+	if _, err := updateUser(ctx, tenantID, secondaryUID, restore); err != nil {
+		return fmt.Errorf(
+			"unable to link the identifiers to %s (%s), and they could not be restored to the secondary account %s: %w",
+			report.PrimaryUID, linkErr, secondaryUID, err)
+	}
+	report.IdentifiersReleased = false
+	report.RolledBack = true
+	if err := save(); err != nil {
+		return err
+	}
+	return fmt.Errorf(
+		"unable to link the identifiers to %s, they were restored to the secondary account %s: %w",
+		report.PrimaryUID, secondaryUID, linkErr)
+}
+
+// releasedEmail is the placeholder address of a secondary account whose email address was moved
+func releasedEmail(uid string) string {
+	return "merged-" + uid + "@invalid"
+}
+
+func (m *AccountMerger) progressStore() AccountMergeProgressStore {
+	if m.Progress != nil {
+		return m.Progress
+	}
+	m.progressOnce.Do(func() {
+		m.defaultProgress = NewInMemoryAccountMergeProgressStore()
+	})
+	return m.defaultProgress
+}
+
+// AccountMergeProgress records how far a merge got, so that a retry resumes it
+type AccountMergeProgress struct {
+	TenantID string `json:"tenantId" firestore:"tenantId"`
+
+	// Report is planned when the merge starts. Its counts and flags are updated
+	// after every step.
+	Report AccountMergeReport `json:"report" firestore:"report"`
+
+	// MovedEmailVerified is whether the moved email address was verified before
+	// it was released from the secondary account
+	MovedEmailVerified bool `json:"movedEmailVerified" firestore:"movedEmailVerified"`
+
+	UpdatedAt time.Time `json:"updatedAt" firestore:"updatedAt"`
+}
+
+// report returns a copy of the saved report
+func (p *AccountMergeProgress) report() *AccountMergeReport {
+	report := p.Report
+	report.MigratedDocuments = map[string]int{}
+	for key, count := range p.Report.MigratedDocuments {
+		report.MigratedDocuments[key] = count
+	}
+	return &report
+}
+
+func accountMergeKey(tenantID string, primaryUID string, secondaryUID string) string {
+	return tenantID + Sep + primaryUID + Sep + secondaryUID
+}
+
+// AccountMergeProgressStore keeps the progress of account merges
+type AccountMergeProgressStore interface {
+	// GetAccountMergeProgress returns nil when the merge has not started
+	GetAccountMergeProgress(
+		ctx context.Context, tenantID string, primaryUID string, secondaryUID string,
+	) (*AccountMergeProgress, error)
+	SaveAccountMergeProgress(ctx context.Context, progress *AccountMergeProgress) error
+}
+
+// InMemoryAccountMergeProgressStore keeps merge progress in process memory.
+// Merges that fail can only be resumed by the same process.
+type InMemoryAccountMergeProgressStore struct {
+	mu       sync.Mutex
+	progress map[string]*AccountMergeProgress
+}
+
+// NewInMemoryAccountMergeProgressStore creates an empty in-memory progress store
+func NewInMemoryAccountMergeProgressStore() *InMemoryAccountMergeProgressStore {
+	return &InMemoryAccountMergeProgressStore{progress: map[string]*AccountMergeProgress{}}
+}
+
+// GetAccountMergeProgress returns a copy of the merge's progress
+func (s *InMemoryAccountMergeProgressStore) GetAccountMergeProgress(
+	ctx context.Context, tenantID string, primaryUID string, secondaryUID string,
+) (*AccountMergeProgress, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	progress, ok := s.progress[accountMergeKey(tenantID, primaryUID, secondaryUID)]
+	if !ok {
+		return nil, nil
+	}
+	copied := *progress
+	copied.Report = *progress.report()
+	return &copied, nil
+}
+
+// SaveAccountMergeProgress saves a copy of the merge's progress
+func (s *InMemoryAccountMergeProgressStore) SaveAccountMergeProgress(ctx context.Context, progress *AccountMergeProgress) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *progress
+	copied.Report = *progress.report()
+	s.progress[accountMergeKey(progress.TenantID, progress.Report.PrimaryUID, progress.Report.SecondaryUID)] = &copied
+	return nil
+}
+
+// FirestoreAccountMergeProgressStore keeps merge progress in a Firestore collection
+type FirestoreAccountMergeProgressStore struct {
+	client     *firestore.Client
+	collection string
+}
+
+// NewFirestoreAccountMergeProgressStore creates a Firestore backed progress store.
+// When no collection is supplied, the suffixed `account_merges` collection is used.
+func NewFirestoreAccountMergeProgressStore(client *firestore.Client, collection string) *FirestoreAccountMergeProgressStore {
+	if collection == "" {
+		collection = SuffixCollection(AccountMergesCollectionName)
+	}
+	return &FirestoreAccountMergeProgressStore{client: client, collection: collection}
+}
+
+// GetAccountMergeProgress returns the merge's progress
+func (s *FirestoreAccountMergeProgressStore) GetAccountMergeProgress(
+	ctx context.Context, tenantID string, primaryUID string, secondaryUID string,
+) (*AccountMergeProgress, error) {
+	ref := s.client.Collection(s.collection).Doc(accountMergeKey(tenantID, primaryUID, secondaryUID))
+	docs, err := s.client.GetAll(ctx, []*firestore.DocumentRef{ref})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the progress of the merge of %s into %s: %w", secondaryUID, primaryUID, err)
+	}
+	if !docs[0].Exists() {
+		return nil, nil
+	}
+	progress := &AccountMergeProgress{}
+	if err := docs[0].DataTo(progress); err != nil {
+		return nil, fmt.Errorf("unable to read the progress of the merge of %s into %s: %w", secondaryUID, primaryUID, err)
+	}
+	if progress.Report.MigratedDocuments == nil {
+		progress.Report.MigratedDocuments = map[string]int{}
+	}
+	return progress, nil
+}
+
+// SaveAccountMergeProgress saves the merge's progress
+func (s *FirestoreAccountMergeProgressStore) SaveAccountMergeProgress(ctx context.Context, progress *AccountMergeProgress) error {
+	key := accountMergeKey(progress.TenantID, progress.Report.PrimaryUID, progress.Report.SecondaryUID)
+	if _, err := s.client.Collection(s.collection).Doc(key).Set(ctx, progress); err != nil {
+		return fmt.Errorf("unable to save the progress of the merge of %s into %s: %w",
+			progress.Report.SecondaryUID, progress.Report.PrimaryUID, err)
+	}
+	return nil
+}
+
+// planAccountMerge decides which identifiers and sign in methods move to the primary account
+func planAccountMerge(primary *auth.UserRecord, secondary *auth.UserRecord) *AccountMergeReport {
+	report := &AccountMergeReport{
+		PrimaryUID:        primary.UID,
+		SecondaryUID:      secondary.UID,
+		MigratedDocuments: map[string]int{},
+	}
+	switch {
+	case secondary.Email == "" || strings.EqualFold(secondary.Email, primary.Email):
+	case primary.Email == "":
+		report.MovedEmail = secondary.Email
+	default:
+		report.Conflicts = append(report.Conflicts, fmt.Sprintf(
+			"the email address %s is dropped, the primary account uses %s", secondary.Email, primary.Email))
+	}
+	switch {
+	case secondary.PhoneNumber == "" || secondary.PhoneNumber == primary.PhoneNumber:
+	case primary.PhoneNumber == "":
+		report.MovedPhoneNumber = secondary.PhoneNumber
+	default:
+		report.Conflicts = append(report.Conflicts, fmt.Sprintf(
+			"the phone number %s is dropped, the primary account uses %s", secondary.PhoneNumber, primary.PhoneNumber))
+	}
+
+	linked := map[string]bool{}
+	for _, info := range primary.ProviderUserInfo {
+		linked[info.ProviderID] = true
+	}
+	for _, info := range secondary.ProviderUserInfo {
+		if linked[info.ProviderID] || (info.ProviderID == "phone" && report.MovedPhoneNumber != "") {
+			continue
+		}
+		linked[info.ProviderID] = true
+		report.UnlinkedProviders = append(report.UnlinkedProviders, info.ProviderID)
+	}
+	sort.Strings(report.UnlinkedProviders)
+
+	for name := range secondary.CustomClaims {
+		if _, ok := primary.CustomClaims[name]; !ok {
+			report.Conflicts = append(report.Conflicts, fmt.Sprintf("the custom claim %q is not carried over", name))
+		}
+	}
+	sort.Strings(report.Conflicts)
+	return report
+}
@@ -0,0 +1,250 @@
+package firebasetools_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func mergeTestUser(uid string, email string, verified bool, phone string, created int64, providers ...string) *auth.UserRecord {
+	user := &auth.UserRecord{
+		UserInfo:      &auth.UserInfo{UID: uid, Email: email, PhoneNumber: phone},
+		EmailVerified: verified,
+		UserMetadata:  &auth.UserMetadata{CreationTimestamp: created},
+	}
+	for _, provider := range providers {
+		info := &auth.UserInfo{ProviderID: provider, UID: uid + "-" + provider}
+		switch provider {
+		case "phone":
+			info.PhoneNumber = phone
+		default:
+			info.Email = email
+		}
+		user.ProviderUserInfo = append(user.ProviderUserInfo, info)
+	}
+	return user
+}
+
+func TestFindDuplicateAccounts(t *testing.T) {
+	users := []*auth.UserRecord{
+		mergeTestUser("newer", "Jane@example.com", true, "", 300, "password"),
+		mergeTestUser("oldest", "jane@example.com", true, "+254700000001", 100, "google.com"),
+		mergeTestUser("by-phone", "", false, "+254700000001", 200, "phone"),
+		// unverified password emails are not proof of ownership
+		mergeTestUser("unverified", "jane@example.com", false, "", 50, "password"),
+		// nor are the emails of federated providers that don't verify them
+		mergeTestUser("unverified-idp", "jane@example.com", false, "", 60, "facebook.com"),
+		mergeTestUser("unique", "solo@example.com", true, "", 10, "password"),
+	}
+	records := []*auth.ExportedUserRecord{}
+	for _, user := range users {
+		records = append(records, &auth.ExportedUserRecord{UserRecord: user})
+	}
+
+	groups, err := firebasetools.FindDuplicateAccounts(&stubUserIterator{records: records})
+	assert.Nil(t, err)
+	assert.Equal(t, []*firebasetools.DuplicateAccountGroup{{
+		Identifiers: []string{"email:jane@example.com", "phone:+254700000001"},
+		UIDs:        []string{"oldest", "by-phone", "newer"},
+	}}, groups)
+
+	_, err = firebasetools.FindDuplicateAccounts(&stubUserIterator{err: fmt.Errorf("boom")})
+	assert.NotNil(t, err)
+}
+
+type mergeAuth struct {
+	users   map[string]*auth.UserRecord
+	updated map[string]*auth.UserToUpdate
+	deleted []string
+
+	// calls lists the updates and deletions in order. The errors fail the next
+	// update of the UID, or the next deletion.
+	calls      []string
+	failUpdate map[string]error
+	failDelete error
+}
+
+func (a *mergeAuth) merger(docs firebasetools.OwnedDocumentStore, collections ...string) *firebasetools.AccountMerger {
+	return &firebasetools.AccountMerger{
+		Documents:   docs,
+		Collections: collections,
+		GetUser: func(ctx context.Context, tenantID string, uid string) (*auth.UserRecord, error) {
+			user, ok := a.users[uid]
+			if !ok {
+				return nil, fmt.Errorf("no user %s", uid)
+			}
+			return user, nil
+		},
+		UpdateUser: func(ctx context.Context, tenantID string, uid string, user *auth.UserToUpdate) (*auth.UserRecord, error) {
+			a.calls = append(a.calls, "update "+uid)
+			if err := a.failUpdate[uid]; err != nil {
+				delete(a.failUpdate, uid)
+				return nil, err
+			}
+			a.updated[uid] = user
+			return a.users[uid], nil
+		},
+		DeleteUser: func(ctx context.Context, tenantID string, uid string) error {
+			a.calls = append(a.calls, "delete "+uid)
+			if err := a.failDelete; err != nil {
+				a.failDelete = nil
+				return err
+			}
+			a.deleted = append(a.deleted, uid)
+			delete(a.users, uid)
+			return nil
+		},
+	}
+}
+
+func TestAccountMerger_Merge(t *testing.T) {
+	ctx := context.Background()
+	docs := firebasetools.NewInMemoryOwnedDocumentStore()
+	docs.Put("notes", "n1", map[string]interface{}{"createdByUID": "secondary", "updatedByUID": "secondary"})
+	docs.Put("notes", "n2", map[string]interface{}{"createdByUID": "primary", "updatedByUID": "secondary"})
+	docs.Put("notes", "n3", map[string]interface{}{"createdByUID": "someone-else"})
+
+	newAuth := func() *mergeAuth {
+		primary := mergeTestUser("primary", "jane@example.com", true, "", 100, "password")
+		primary.CustomClaims = map[string]interface{}{"role": "nurse"}
+		secondary := mergeTestUser("secondary", "jane@example.com", true, "+254700000001", 200, "google.com", "phone")
+		secondary.CustomClaims = map[string]interface{}{"admin": true}
+		return &mergeAuth{
+			users:   map[string]*auth.UserRecord{"primary": primary, "secondary": secondary},
+			updated: map[string]*auth.UserToUpdate{},
+		}
+	}
+
+	expected := &firebasetools.AccountMergeReport{
+		PrimaryUID:        "primary",
+		SecondaryUID:      "secondary",
+		MovedPhoneNumber:  "+254700000001",
+		UnlinkedProviders: []string{"google.com"},
+		Conflicts:         []string{`the custom claim "admin" is not carried over`},
+		MigratedDocuments: map[string]int{"notes.createdByUID": 1, "notes.updatedByUID": 2},
+	}
+
+	dry := newAuth()
+	report, err := dry.merger(docs, "notes").Merge(ctx, "primary", "secondary", true)
+	assert.Nil(t, err)
+	expected.DryRun = true
+	assert.Equal(t, expected, report)
+	assert.Empty(t, dry.deleted, "dry runs don't delete accounts")
+	assert.Empty(t, dry.updated)
+	assert.Equal(t, "secondary", docs.Get("notes", "n1")["createdByUID"], "dry runs don't migrate documents")
+
+	live := newAuth()
+	merger := live.merger(docs, "notes")
+	recorder := &firebasetools.InMemoryAuditLogRecorder{}
+	merger.Recorder = recorder
+	report, err = merger.Merge(ctx, "primary", "secondary", false)
+	assert.Nil(t, err)
+	expected.DryRun = false
+	expected.IdentifiersReleased = true
+	expected.PrimaryUpdated = true
+	expected.SecondaryDeleted = true
+	assert.Equal(t, expected, report)
+	assert.Equal(t, []string{"secondary"}, live.deleted)
+	assert.Equal(t, []string{"update secondary", "update primary", "delete secondary"}, live.calls,
+		"the phone number is released before it is linked, and the secondary account is deleted last")
+	assert.NotNil(t, live.updated["primary"])
+	assert.Len(t, recorder.Entries(), 1)
+	assert.Equal(t, firebasetools.MergeAccountAuditOperation, recorder.Entries()[0].Operation)
+
+	assert.Equal(t, map[string]interface{}{"createdByUID": "primary", "updatedByUID": "primary"}, docs.Get("notes", "n1"))
+	assert.Equal(t, map[string]interface{}{"createdByUID": "primary", "updatedByUID": "primary"}, docs.Get("notes", "n2"))
+	assert.Equal(t, map[string]interface{}{"createdByUID": "someone-else"}, docs.Get("notes", "n3"))
+}
+
+func TestAccountMerger_MergeInvalid(t *testing.T) {
+	ctx := context.Background()
+	a := &mergeAuth{users: map[string]*auth.UserRecord{
+		"primary": mergeTestUser("primary", "a@example.com", true, "", 1),
+	}, updated: map[string]*auth.UserToUpdate{}}
+
+	tests := []struct {
+		name      string
+		merger    *firebasetools.AccountMerger
+		primary   string
+		secondary string
+	}{
+		{"same account", a.merger(nil), "primary", "primary"},
+		{"missing uid", a.merger(nil), "primary", ""},
+		{"unknown secondary", a.merger(nil), "primary", "missing"},
+		{"collections without a store", a.merger(nil, "notes"), "primary", "secondary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.merger.Merge(ctx, tt.primary, tt.secondary, false)
+			assert.NotNil(t, err)
+			assert.Empty(t, a.deleted)
+		})
+	}
+}
+
+func TestAccountMerger_MergeFailures(t *testing.T) {
+	ctx := context.Background()
+	newAuth := func() *mergeAuth {
+		return &mergeAuth{
+			users: map[string]*auth.UserRecord{
+				"primary":   mergeTestUser("primary", "", false, "", 100, "password"),
+				"secondary": mergeTestUser("secondary", "jane@example.com", true, "+254700000001", 200, "phone"),
+			},
+			updated:    map[string]*auth.UserToUpdate{},
+			failUpdate: map[string]error{},
+		}
+	}
+
+	// linking fails: the identifiers are given back to the secondary account
+	a := newAuth()
+	a.failUpdate["primary"] = errors.New("boom")
+	merger := a.merger(nil)
+	report, err := merger.Merge(ctx, "primary", "secondary", false)
+	assert.NotNil(t, err)
+	assert.True(t, report.RolledBack)
+	assert.False(t, report.IdentifiersReleased)
+	assert.False(t, report.SecondaryDeleted)
+	assert.Equal(t, []string{"update secondary", "update primary", "update secondary"}, a.calls)
+	assert.Empty(t, a.deleted)
+
+	// a retry starts over
+	a.calls = nil
+	report, err = merger.Merge(ctx, "primary", "secondary", false)
+	assert.Nil(t, err)
+	assert.False(t, report.RolledBack)
+	assert.True(t, report.SecondaryDeleted)
+	assert.Equal(t, []string{"update secondary", "update primary", "delete secondary"}, a.calls)
+
+	// deleting fails: the report shows the partial state and a retry only deletes
+	docs := firebasetools.NewInMemoryOwnedDocumentStore()
+	docs.Put("notes", "n1", map[string]interface{}{"createdByUID": "secondary"})
+	a = newAuth()
+	a.failDelete = errors.New("boom")
+	merger = a.merger(docs, "notes")
+	progress := firebasetools.NewInMemoryAccountMergeProgressStore()
+	merger.Progress = progress
+	report, err = merger.Merge(ctx, "primary", "secondary", false)
+	assert.NotNil(t, err)
+	assert.True(t, report.PrimaryUpdated)
+	assert.False(t, report.SecondaryDeleted)
+	assert.Equal(t, "primary", docs.Get("notes", "n1")["createdByUID"])
+
+	saved, err := progress.GetAccountMergeProgress(ctx, "", "primary", "secondary")
+	assert.Nil(t, err)
+	assert.True(t, saved.Report.PrimaryUpdated)
+	assert.True(t, saved.MovedEmailVerified)
+
+	a.calls = nil
+	report, err = merger.Merge(ctx, "primary", "secondary", false)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"delete secondary"}, a.calls)
+	assert.Equal(t, "jane@example.com", report.MovedEmail)
+	assert.Equal(t, map[string]int{"notes.createdByUID": 1, "notes.updatedByUID": 0}, report.MigratedDocuments,
+		"documents migrated before the failure are still counted")
+	assert.True(t, report.SecondaryDeleted)
+}
@@ -0,0 +1,214 @@
+package firebasetools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"firebase.google.com/go/auth"
+	"google.golang.org/api/iterator"
+)
+
+// MaxUserDeleteBatchSize is the most users that Firebase Auth deletes in one request
+const MaxUserDeleteBatchSize = 1000
+
+// AnonymousCleanupConfig configures the removal of abandoned anonymous accounts
+type AnonymousCleanupConfig struct {
+	// MaxInactivity is how long an anonymous account can go without signing in
+	// or refreshing its tokens before it is removed. It is required.
+	MaxInactivity time.Duration
+
+	// DryRun reports the accounts that would be removed without removing them
+	DryRun bool
+
+	// IncludeUnmarked also treats the accounts that have no sign in methods but
+	// lack the AnonymousUserClaim as anonymous e.g those that a Firebase client
+	// SDK signed in anonymously, or that were created before the claim existed.
+	// Accounts that were created on the server without credentials look the same,
+	// so only enable it in projects that keep none.
+	IncludeUnmarked bool
+
+	// BatchSize defaults to, and can't exceed, MaxUserDeleteBatchSize.
+	// Firebase limits batch deletions to about one request per second.
+	BatchSize int
+
+	// DeleteUserData runs after each account is deleted e.g the DeleteUserData
+	// method of a UserDataDeleter, with a Signer to prove the deletions. The
+	// accounts go first so that no one can sign in to an account whose data is
+	// being deleted. Accounts whose data can't be deleted are reported as partial
+	// deletions; run DeleteUserData for them again, since later cleanups won't
+	// find them.
+	DeleteUserData func(ctx context.Context, uid string) (*UserDeletionReport, error)
+
+	// Users lists every user. It defaults to Firebase Auth.
+	Users func(ctx context.Context) (UserRecordIterator, error)
+
+	// DeleteUsers defaults to deleting from the project, or the context's tenant
+	DeleteUsers func(ctx context.Context, uids []string) (*auth.DeleteUsersResult, error)
+}
+
+// AnonymousCleanupError is an account that was not removed
+type AnonymousCleanupError struct {
+	UID    string `json:"uid"`
+	Reason string `json:"reason"`
+}
+
+// AnonymousCleanupReport summarizes a cleanup
+type AnonymousCleanupReport struct {
+	DryRun    bool `json:"dryRun"`
+	Checked   int  `json:"checked"`
+	Anonymous int  `json:"anonymous"`
+	Stale     int  `json:"stale"`
+	Deleted   int  `json:"deleted"`
+	Failed    int  `json:"failed"`
+
+	// Partial counts the deleted accounts whose data could not be deleted
+	Partial int                      `json:"partial"`
+	Errors  []*AnonymousCleanupError `json:"errors,omitempty"`
+}
+
+func (report *AnonymousCleanupReport) fail(uid string, reason string) {
+	report.Failed++
+	report.Errors = append(report.Errors, &AnonymousCleanupError{UID: uid, Reason: reason})
+}
+
+func (report *AnonymousCleanupReport) partial(uid string, reason string) {
+	report.Partial++
+	report.Errors = append(report.Errors, &AnonymousCleanupError{UID: uid, Reason: reason})
+}
+
+func deleteFirebaseUsers(ctx context.Context, uids []string) (*auth.DeleteUsersResult, error) {
+	if tenantID, _ := GetTenantIDFromContext(ctx); tenantID != "" {
+		authClient, err := GetTenantAuthClient(ctx, tenantID)
+		if err != nil {
+			return nil, err
+		}
+		return authClient.DeleteUsers(ctx, uids)
+	}
+	authClient, err := GetFirebaseAuthClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get or create Firebase client: %w", err)
+	}
+	return authClient.DeleteUsers(ctx, uids)
+}
+
+// lastActive returns when the account last signed in or refreshed its tokens, or
+// when it was created if it never did. It is zero when the metadata doesn't say.
+func lastActive(metadata *auth.UserMetadata) time.Time {
+	if metadata == nil {
+		return time.Time{}
+	}
+	millis := metadata.CreationTimestamp
+	for _, ts := range []int64{metadata.LastLogInTimestamp, metadata.LastRefreshTimestamp} {
+		if ts > millis {
+			millis = ts
+		}
+	}
+	if millis <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, millis*int64(time.Millisecond))
+}
+
+// CleanupStaleAnonymousUsers removes the anonymous accounts that have been inactive
+// for longer than the configured age, in batches. Only the accounts that are marked
+// anonymous (see IsAnonymousUserRecord), or unmarked ones with IncludeUnmarked,
+// and that have metadata to tell their age are removed. Accounts that fail to be
+// removed are listed in the report and don't stop the cleanup.
+func CleanupStaleAnonymousUsers(ctx context.Context, config AnonymousCleanupConfig) (*AnonymousCleanupReport, error) {
+	if config.MaxInactivity <= 0 {
+		return nil, fmt.Errorf("a maximum inactivity period is required to clean up anonymous users")
+	}
+	batchSize := config.BatchSize
+	if batchSize <= 0 || batchSize > MaxUserDeleteBatchSize {
+		batchSize = MaxUserDeleteBatchSize
+	}
+	users := config.Users
+	if users == nil {
+		users = listFirebaseUsers
+	}
+	deleteUsers := config.DeleteUsers
+	if deleteUsers == nil {
+		deleteUsers = deleteFirebaseUsers
+	}
+
+	it, err := users(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := &AnonymousCleanupReport{DryRun: config.DryRun}
+	cutoff := time.Now().Add(-config.MaxInactivity)
+	batch := []string{}
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		defer func() { batch = batch[:0] }()
+		result, err := deleteUsers(ctx, batch)
+		if err != nil {
+			return fmt.Errorf("unable to delete anonymous users: %w", err)
+		}
+		failed := map[int]bool{}
+		for _, e := range result.Errors {
+			if e.Index >= 0 && e.Index < len(batch) && !failed[e.Index] {
+				failed[e.Index] = true
+				report.fail(batch[e.Index], e.Reason)
+			}
+		}
+		for i, uid := range batch {
+			if failed[i] {
+				continue
+			}
+			report.Deleted++
+			if config.DeleteUserData == nil {
+				continue
+			}
+			if _, err := config.DeleteUserData(ctx, uid); err != nil {
+				report.partial(uid, fmt.Sprintf("the account was deleted but its data wasn't: %s", err))
+			}
+		}
+		return nil
+	}
+
+	for {
+		record, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return report, fmt.Errorf("unable to list users: %w", err)
+		}
+		if record.UserRecord == nil {
+			continue
+		}
+		report.Checked++
+		anonymous := IsAnonymousUserRecord(record.UserRecord) ||
+			(config.IncludeUnmarked && hasNoSignInMethods(record.UserRecord))
+		if !anonymous {
+			continue
+		}
+		report.Anonymous++
+		// accounts of unknown age are kept
+		active := lastActive(record.UserMetadata)
+		if active.IsZero() || !active.Before(cutoff) {
+			continue
+		}
+		report.Stale++
+		if config.DryRun {
+			continue
+		}
+
+		batch = append(batch, record.UID)
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return report, err
+	}
+	return report, nil
+}
@@ -0,0 +1,144 @@
+package firebasetools_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func cleanupTestUsers() func(ctx context.Context) (firebasetools.UserRecordIterator, error) {
+	millis := func(d time.Duration) int64 { return time.Now().Add(-d).UnixNano() / 1e6 }
+	month := 30 * 24 * time.Hour
+	anonymous := map[string]interface{}{firebasetools.AnonymousUserClaim: true}
+	records := []*auth.ExportedUserRecord{
+		{UserRecord: &auth.UserRecord{
+			UserInfo:     &auth.UserInfo{UID: "stale-1"},
+			CustomClaims: anonymous,
+			UserMetadata: &auth.UserMetadata{CreationTimestamp: millis(3 * month)},
+		}},
+		{UserRecord: &auth.UserRecord{
+			UserInfo:     &auth.UserInfo{UID: "stale-2"},
+			CustomClaims: anonymous,
+			UserMetadata: &auth.UserMetadata{CreationTimestamp: millis(6 * month), LastRefreshTimestamp: millis(2 * month)},
+		}},
+		{UserRecord: &auth.UserRecord{
+			UserInfo:     &auth.UserInfo{UID: "stale-3"},
+			CustomClaims: anonymous,
+			UserMetadata: &auth.UserMetadata{CreationTimestamp: millis(4 * month), LastLogInTimestamp: millis(3 * month)},
+		}},
+		{UserRecord: &auth.UserRecord{
+			UserInfo:     &auth.UserInfo{UID: "recently-refreshed"},
+			CustomClaims: anonymous,
+			UserMetadata: &auth.UserMetadata{CreationTimestamp: millis(6 * month), LastRefreshTimestamp: millis(time.Hour)},
+		}},
+		{UserRecord: &auth.UserRecord{
+			UserInfo:     &auth.UserInfo{UID: "unmarked"},
+			UserMetadata: &auth.UserMetadata{CreationTimestamp: millis(12 * month)},
+		}},
+		{UserRecord: &auth.UserRecord{
+			UserInfo:     &auth.UserInfo{UID: "no-metadata"},
+			CustomClaims: anonymous,
+		}},
+		{UserRecord: &auth.UserRecord{
+			UserInfo:         &auth.UserInfo{UID: "old-sso-user"},
+			ProviderUserInfo: []*auth.UserInfo{{ProviderID: "saml.hospital"}},
+			UserMetadata:     &auth.UserMetadata{CreationTimestamp: millis(12 * month)},
+		}},
+	}
+	return func(ctx context.Context) (firebasetools.UserRecordIterator, error) {
+		return &stubUserIterator{records: append([]*auth.ExportedUserRecord{}, records...)}, nil
+	}
+}
+
+func TestCleanupStaleAnonymousUsers(t *testing.T) {
+	ctx := context.Background()
+	batches := [][]string{}
+	deleteUsers := func(ctx context.Context, uids []string) (*auth.DeleteUsersResult, error) {
+		batches = append(batches, append([]string{}, uids...))
+		result := &auth.DeleteUsersResult{}
+		for i, uid := range uids {
+			if uid == "stale-3" {
+				result.Errors = append(result.Errors,
+					&auth.DeleteUsersErrorInfo{Index: i, Reason: "quota exceeded"},
+					&auth.DeleteUsersErrorInfo{Index: len(uids), Reason: "out of range"},
+				)
+			}
+		}
+		return result, nil
+	}
+	config := firebasetools.AnonymousCleanupConfig{
+		MaxInactivity: 30 * 24 * time.Hour,
+		DryRun:        true,
+		BatchSize:     2,
+		Users:         cleanupTestUsers(),
+		DeleteUsers:   deleteUsers,
+	}
+
+	report, err := firebasetools.CleanupStaleAnonymousUsers(ctx, config)
+	assert.Nil(t, err)
+	assert.Equal(t, firebasetools.AnonymousCleanupReport{DryRun: true, Checked: 7, Anonymous: 5, Stale: 3}, *report,
+		"unmarked accounts are not anonymous and accounts of unknown age are not stale")
+	assert.Empty(t, batches, "dry runs don't delete users")
+
+	dataDeleted := []string{}
+	config.DryRun = false
+	config.Users = cleanupTestUsers()
+	config.DeleteUserData = func(ctx context.Context, uid string) (*firebasetools.UserDeletionReport, error) {
+		if uid == "stale-2" {
+			return nil, fmt.Errorf("firestore unavailable")
+		}
+		dataDeleted = append(dataDeleted, uid)
+		return &firebasetools.UserDeletionReport{UID: uid}, nil
+	}
+	report, err = firebasetools.CleanupStaleAnonymousUsers(ctx, config)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"stale-1", "stale-2"}, {"stale-3"}}, batches)
+	assert.Equal(t, []string{"stale-1"}, dataDeleted, "data is only deleted once the account is")
+	assert.Equal(t, 3, report.Stale)
+	assert.Equal(t, 2, report.Deleted)
+	assert.Equal(t, 1, report.Failed)
+	assert.Equal(t, 1, report.Partial)
+	assert.Equal(t, []*firebasetools.AnonymousCleanupError{
+		{UID: "stale-2", Reason: "the account was deleted but its data wasn't: firestore unavailable"},
+		{UID: "stale-3", Reason: "quota exceeded"},
+	}, report.Errors)
+}
+
+func TestCleanupStaleAnonymousUsers_IncludeUnmarked(t *testing.T) {
+	deleted := []string{}
+	report, err := firebasetools.CleanupStaleAnonymousUsers(context.Background(), firebasetools.AnonymousCleanupConfig{
+		MaxInactivity:   30 * 24 * time.Hour,
+		IncludeUnmarked: true,
+		Users:           cleanupTestUsers(),
+		DeleteUsers: func(ctx context.Context, uids []string) (*auth.DeleteUsersResult, error) {
+			deleted = append(deleted, uids...)
+			return &auth.DeleteUsersResult{}, nil
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 6, report.Anonymous)
+	assert.Equal(t, 4, report.Stale)
+	assert.Equal(t, []string{"stale-1", "stale-2", "stale-3", "unmarked"}, deleted,
+		"accounts with sign in methods are kept")
+}
+
+func TestCleanupStaleAnonymousUsers_Errors(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := firebasetools.CleanupStaleAnonymousUsers(ctx, firebasetools.AnonymousCleanupConfig{Users: cleanupTestUsers()})
+	assert.NotNil(t, err, "a maximum inactivity period is required")
+
+	_, err = firebasetools.CleanupStaleAnonymousUsers(ctx, firebasetools.AnonymousCleanupConfig{
+		MaxInactivity: time.Hour,
+		Users:         cleanupTestUsers(),
+		DeleteUsers: func(ctx context.Context, uids []string) (*auth.DeleteUsersResult, error) {
+			return nil, fmt.Errorf("boom")
+		},
+	})
+	assert.NotNil(t, err)
+}
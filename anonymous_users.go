@@ -0,0 +1,281 @@
+package firebasetools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/serverutils"
+)
+
+// AnonymousSignInProvider is the `firebase.sign_in_provider` claim of anonymous sessions
+const AnonymousSignInProvider = "anonymous"
+
+// AnonymousUserClaim is the custom claim that marks the anonymous accounts that
+// are created on the server e.g by GetOrCreateAnonymousUser. Their sessions start
+// from custom tokens, which don't say how the account signs in.
+const AnonymousUserClaim = "anonymous"
+
+// isAnonymousToken reports whether the token belongs to an anonymous session: one
+// that Firebase signed in anonymously, or one of an account marked anonymous
+func isAnonymousToken(token *auth.Token) bool {
+	if token.Firebase.SignInProvider == AnonymousSignInProvider {
+		return true
+	}
+	marked, _ := token.Claims[AnonymousUserClaim].(bool)
+	return marked
+}
+
+// anonymousSession reports whether the context's session is an anonymous session of the user
+func anonymousSession(ctx context.Context, uid string) bool {
+	token, err := GetUserTokenFromContext(ctx)
+	return err == nil && token.UID == uid && isAnonymousToken(token)
+}
+
+// IsAnonymousUserRecord reports whether the account is marked anonymous with the
+// AnonymousUserClaim and still has no way to sign in i.e no linked providers,
+// email address or phone number. Accounts that a Firebase client SDK signed in
+// anonymously are not marked; only their sessions tell. Neither are accounts
+// created before the claim existed, until they are marked e.g with
+// MergeUserClaims.
+func IsAnonymousUserRecord(user *auth.UserRecord) bool {
+	if !hasNoSignInMethods(user) {
+		return false
+	}
+	marked, _ := user.CustomClaims[AnonymousUserClaim].(bool)
+	return marked
+}
+
+// hasNoSignInMethods reports whether the account has no linked providers, email address or phone number
+func hasNoSignInMethods(user *auth.UserRecord) bool {
+	if user == nil || user.UserInfo == nil {
+		return false
+	}
+	return len(user.ProviderUserInfo) == 0 && user.Email == "" && user.PhoneNumber == ""
+}
+
+// AnonymousUpgradeInput is the unmarshalling target for anonymous account upgrades.
+// An email address is linked with a password; a phone number with the OTP sent to it.
+type AnonymousUpgradeInput struct {
+	Email       string `json:"email,omitempty"`
+	Password    string `json:"password,omitempty"`
+	PhoneNumber string `json:"phoneNumber,omitempty"`
+	OTP         string `json:"otp,omitempty"`
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+// AnonymousUpgradeConfig configures anonymous account upgrades
+type AnonymousUpgradeConfig struct {
+	// PasswordPolicy defaults to DefaultPasswordPolicy when left empty
+	PasswordPolicy PasswordPolicy
+
+	// Verifier proves ownership of phone numbers. Phone numbers can't be linked without it.
+	Verifier OTPVerifier
+
+	// GetUser and UpdateUser default to (tenant aware) Firebase Auth calls
+	GetUser    func(ctx context.Context, tenantID string, uid string) (*auth.UserRecord, error)
+	UpdateUser func(ctx context.Context, tenantID string, uid string, user *auth.UserToUpdate) (*auth.UserRecord, error)
+
+	// Lease serializes the upgrade with the claims updates of the user across
+	// processes. It defaults to the lease that ClaimsManager takes.
+	Lease func(ctx context.Context, tenantID string, uid string) (func(), error)
+
+	// IssueTokens defaults to IssueFirebaseLoginTokens
+	IssueTokens func(ctx context.Context, user *auth.UserRecord) (*LoginResult, error)
+
+	// ProfileSync mirrors upgraded accounts into user profiles, if set
+	ProfileSync *ProfileSync
+
+	// SendVerificationEmail sends linked email addresses a verification email
+	SendVerificationEmail bool
+	SendEmailVerification func(ctx context.Context, idToken string) error
+}
+
+// validate checks the upgrade details, returning a 400 LoginError that wraps a
+// FieldValidationError when they are invalid
+func (input *AnonymousUpgradeInput) validate(policy PasswordPolicy) error {
+	input.Email = strings.TrimSpace(input.Email)
+	input.PhoneNumber = strings.TrimSpace(input.PhoneNumber)
+	input.DisplayName = strings.TrimSpace(input.DisplayName)
+
+	fields := map[string]string{}
+	if input.Email == "" && input.PhoneNumber == "" {
+		fields["email"] = "an email or phone number is required"
+		fields["phoneNumber"] = "an email or phone number is required"
+	}
+	if input.Email != "" {
+		if addr, err := mail.ParseAddress(input.Email); err != nil || addr.Address != input.Email {
+			fields["email"] = "invalid email address"
+		}
+		if input.Password == "" {
+			fields["password"] = "a password is required to link an email address"
+		} else if problem := policy.Validate(input.Password); problem != "" {
+			fields["password"] = problem
+		}
+	}
+	if input.PhoneNumber != "" {
+		if !e164PhoneNumber.MatchString(input.PhoneNumber) {
+			fields["phoneNumber"] = "invalid phone number, expected the international format e.g +254700000000"
+		}
+		if input.OTP == "" {
+			fields["otp"] = "an OTP is required to link a phone number"
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return NewLoginError(http.StatusBadRequest, "invalid upgrade details",
+		&FieldValidationError{Message: "invalid upgrade details", Fields: fields})
+}
+
+// UpgradeAnonymousUser links an email address and password and/or a phone number
+// to an anonymous account. The account keeps its UID, and with it any data that
+// was saved while it was anonymous, and loses the AnonymousUserClaim. Accounts
+// are anonymous when they are marked so, or when the context's session of the
+// user is anonymous, and have no sign in methods yet.
+//
+// Upgrades of a user are serialized with the updates of their claims, within the
+// process and across processes, so the claims that the upgrade rewrites are current.
+func UpgradeAnonymousUser(
+	ctx context.Context,
+	uid string,
+	input *AnonymousUpgradeInput,
+	config AnonymousUpgradeConfig,
+) (*auth.UserRecord, error) {
+	policy := config.PasswordPolicy
+	if policy == (PasswordPolicy{}) {
+		policy = DefaultPasswordPolicy()
+	}
+	if err := input.validate(policy); err != nil {
+		return nil, err
+	}
+	getUser := config.GetUser
+	if getUser == nil {
+		getUser = getTenantUser
+	}
+	updateUser := config.UpdateUser
+	if updateUser == nil {
+		updateUser = updateFirebaseUser
+	}
+	tenantID, _ := GetTenantIDFromContext(ctx)
+	unlock, err := lockClaims(ctx, tenantID, uid, config.Lease)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	user, err := getUser(ctx, tenantID, uid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get user %s: %w", uid, err)
+	}
+	if !IsAnonymousUserRecord(user) && !(hasNoSignInMethods(user) && anonymousSession(ctx, uid)) {
+		return nil, NewLoginError(http.StatusConflict, "only anonymous accounts can be upgraded", nil)
+	}
+
+	if input.PhoneNumber != "" {
+		if config.Verifier == nil {
+			return nil, fmt.Errorf("no OTP verifier is configured, phone numbers can't be linked")
+		}
+		valid, err := config.Verifier.VerifyOTP(ctx, input.PhoneNumber, input.OTP)
+		if err != nil {
+			return nil, fmt.Errorf("unable to verify OTP: %w", err)
+		}
+		if !valid {
+			return nil, NewLoginError(http.StatusUnauthorized, "invalid OTP", nil)
+		}
+	}
+
+	params := &auth.UserToUpdate{}
+	if input.Email != "" {
+		params = params.Email(input.Email).Password(input.Password).EmailVerified(false)
+	}
+	if input.PhoneNumber != "" {
+		params = params.PhoneNumber(input.PhoneNumber)
+	}
+	if input.DisplayName != "" {
+		params = params.DisplayName(input.DisplayName)
+	}
+	if _, marked := user.CustomClaims[AnonymousUserClaim]; marked {
+		claims := copyClaims(user.CustomClaims)
+		delete(claims, AnonymousUserClaim)
+		params = params.CustomClaims(claims)
+	}
+	upgraded, err := updateUser(ctx, tenantID, uid, params)
+	switch {
+	case auth.IsEmailAlreadyExists(err):
+		return nil, NewLoginError(http.StatusConflict, "unable to upgrade", &FieldValidationError{
+			Message: "unable to upgrade",
+			Fields:  map[string]string{"email": "an account with this email address already exists"},
+		})
+	case auth.IsPhoneNumberAlreadyExists(err):
+		return nil, NewLoginError(http.StatusConflict, "unable to upgrade", &FieldValidationError{
+			Message: "unable to upgrade",
+			Fields:  map[string]string{"phoneNumber": "an account with this phone number already exists"},
+		})
+	case err != nil:
+		return nil, fmt.Errorf("unable to upgrade user %s: %w", uid, err)
+	}
+
+	config.ProfileSync.syncAfterLogin(ctx, upgraded)
+	return upgraded, nil
+}
+
+// GetAnonymousUpgradeFunc returns a handler that upgrades the logged in anonymous
+// user and responds with fresh tokens, since the session's tokens still say that
+// it is anonymous. It expects an auth token in the request context.
+func GetAnonymousUpgradeFunc(config AnonymousUpgradeConfig) http.HandlerFunc {
+	issueTokens := config.IssueTokens
+	if issueTokens == nil {
+		issueTokens = IssueFirebaseLoginTokens
+	}
+	sendEmailVerification := config.SendEmailVerification
+	if sendEmailVerification == nil {
+		sendEmailVerification = SendFirebaseEmailVerification
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		uid, err := GetLoggedInUserUID(ctx)
+		if err != nil {
+			WriteLoginError(w, NewLoginError(http.StatusUnauthorized, "a logged in user is required", err))
+			return
+		}
+		input := &AnonymousUpgradeInput{}
+		if r.Body == nil || json.NewDecoder(r.Body).Decode(input) != nil {
+			serverutils.WriteJSONResponse(w, &FieldValidationError{
+				Message: "invalid upgrade details, expected a JSON object",
+			}, http.StatusBadRequest)
+			return
+		}
+
+		user, err := UpgradeAnonymousUser(ctx, uid, input, config)
+		if err != nil {
+			loginErr := &LoginError{}
+			fieldErr := &FieldValidationError{}
+			if errors.As(err, &loginErr) && errors.As(err, &fieldErr) {
+				serverutils.WriteJSONResponse(w, fieldErr, loginErr.Status)
+				return
+			}
+			WriteLoginError(w, err)
+			return
+		}
+
+		result, err := issueTokens(ctx, user)
+		if err != nil {
+			WriteLoginError(w, err)
+			return
+		}
+		if config.SendVerificationEmail && input.Email != "" {
+			if err := sendEmailVerification(ctx, result.Tokens.IDToken); err != nil {
+				log.Printf("unable to send a verification email to %s: %s", user.UID, err)
+			}
+		}
+		writeLoginResult(w, result)
+	}
+}
@@ -0,0 +1,139 @@
+package firebasetools_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckIsAnonymousUser_SignInProvider(t *testing.T) {
+	marked := map[string]interface{}{firebasetools.AnonymousUserClaim: true}
+	tests := []struct {
+		name           string
+		uid            string
+		signInProvider string
+		claims         map[string]interface{}
+		want           bool
+	}{
+		{"anonymous session", "missing-uid", "anonymous", nil, true},
+		{"SSO session without an email", "missing-uid", "saml.hospital", nil, false},
+		{"password session", "missing-uid", "password", nil, false},
+		{"custom token session of a marked account", "b-uid", "custom", marked, true},
+		{"custom token session of an unmarked account", "b-uid", "custom", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetcher := newCountingUserFetcher()
+			token := &auth.Token{UID: tt.uid, Firebase: auth.FirebaseInfo{SignInProvider: tt.signInProvider}, Claims: tt.claims}
+			ctx := context.WithValue(context.Background(), firebasetools.AuthTokenContextKey, token)
+			ctx = firebasetools.WithUserRecordLoader(ctx, firebasetools.NewUserRecordLoader(fetcher.fetch))
+
+			got, err := firebasetools.CheckIsAnonymousUser(ctx)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Zero(t, fetcher.calls, "the token settles it without a lookup")
+		})
+	}
+
+	_, err := firebasetools.CheckIsAnonymousUser(context.Background())
+	assert.NotNil(t, err)
+}
+
+func TestIsAnonymousUserRecord(t *testing.T) {
+	marked := map[string]interface{}{firebasetools.AnonymousUserClaim: true}
+	assert.True(t, firebasetools.IsAnonymousUserRecord(&auth.UserRecord{UserInfo: &auth.UserInfo{UID: "uid"}, CustomClaims: marked}))
+	assert.False(t, firebasetools.IsAnonymousUserRecord(&auth.UserRecord{UserInfo: &auth.UserInfo{UID: "uid"}}),
+		"accounts without sign in methods are not anonymous unless they are marked")
+	assert.False(t, firebasetools.IsAnonymousUserRecord(&auth.UserRecord{
+		UserInfo:         &auth.UserInfo{UID: "uid"},
+		ProviderUserInfo: []*auth.UserInfo{{ProviderID: "saml.hospital"}},
+		CustomClaims:     marked,
+	}), "SSO accounts without an email are not anonymous")
+	assert.False(t, firebasetools.IsAnonymousUserRecord(&auth.UserRecord{
+		UserInfo: &auth.UserInfo{UID: "uid", PhoneNumber: "+254700000001"}, CustomClaims: marked,
+	}))
+	assert.False(t, firebasetools.IsAnonymousUserRecord(nil))
+}
+
+func anonymousUpgradeConfig(users map[string]*auth.UserRecord, updates map[string]*auth.UserToUpdate) firebasetools.AnonymousUpgradeConfig {
+	return firebasetools.AnonymousUpgradeConfig{
+		Verifier: stubOTPVerifier{"+254700000001": "1234"},
+		GetUser: func(ctx context.Context, tenantID string, uid string) (*auth.UserRecord, error) {
+			return users[uid], nil
+		},
+		Lease: func(ctx context.Context, tenantID string, uid string) (func(), error) {
+			return func() {}, nil
+		},
+		UpdateUser: func(ctx context.Context, tenantID string, uid string, user *auth.UserToUpdate) (*auth.UserRecord, error) {
+			updates[uid] = user
+			upgraded := testLoginResult(uid).User
+			return upgraded, nil
+		},
+		IssueTokens: func(ctx context.Context, user *auth.UserRecord) (*firebasetools.LoginResult, error) {
+			return testLoginResult(user.UID), nil
+		},
+	}
+}
+
+func TestUpgradeAnonymousUser(t *testing.T) {
+	users := map[string]*auth.UserRecord{
+		"anon-uid":  {UserInfo: &auth.UserInfo{UID: "anon-uid"}},
+		"known-uid": testLoginResult("known-uid").User,
+		"marked-uid": {
+			UserInfo:     &auth.UserInfo{UID: "marked-uid"},
+			CustomClaims: map[string]interface{}{firebasetools.AnonymousUserClaim: true},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		uid            string
+		signInProvider string
+		input          firebasetools.AnonymousUpgradeInput
+		wantStatus     int
+	}{
+		{"email and password", "anon-uid", "", firebasetools.AnonymousUpgradeInput{Email: "jane@example.com", Password: "Correct1Horse"}, http.StatusOK},
+		{"verified phone number", "anon-uid", "", firebasetools.AnonymousUpgradeInput{PhoneNumber: "+254700000001", OTP: "1234"}, http.StatusOK},
+		{"wrong OTP", "anon-uid", "", firebasetools.AnonymousUpgradeInput{PhoneNumber: "+254700000001", OTP: "0000"}, http.StatusUnauthorized},
+		{"email without a password", "anon-uid", "", firebasetools.AnonymousUpgradeInput{Email: "jane@example.com"}, http.StatusBadRequest},
+		{"weak password", "anon-uid", "", firebasetools.AnonymousUpgradeInput{Email: "jane@example.com", Password: "short"}, http.StatusBadRequest},
+		{"no credentials", "anon-uid", "", firebasetools.AnonymousUpgradeInput{DisplayName: "Jane"}, http.StatusBadRequest},
+		{"account that is not anonymous", "known-uid", "", firebasetools.AnonymousUpgradeInput{PhoneNumber: "+254700000001", OTP: "1234"}, http.StatusConflict},
+		{"marked account in a custom token session", "marked-uid", "custom", firebasetools.AnonymousUpgradeInput{PhoneNumber: "+254700000001", OTP: "1234"}, http.StatusOK},
+		{"unmarked account in a custom token session", "anon-uid", "custom", firebasetools.AnonymousUpgradeInput{PhoneNumber: "+254700000001", OTP: "1234"}, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updates := map[string]*auth.UserToUpdate{}
+			handler := firebasetools.GetAnonymousUpgradeFunc(anonymousUpgradeConfig(users, updates))
+			signInProvider := tt.signInProvider
+			if signInProvider == "" {
+				signInProvider = firebasetools.AnonymousSignInProvider
+			}
+			ctx := context.WithValue(context.Background(), firebasetools.AuthTokenContextKey, &auth.Token{
+				UID: tt.uid, Firebase: auth.FirebaseInfo{SignInProvider: signInProvider},
+			})
+
+			body := &firebasetools.LoginResponse{}
+			status := postJSON(t, func(w http.ResponseWriter, r *http.Request) {
+				handler(w, r.WithContext(ctx))
+			}, tt.input, body)
+			assert.Equal(t, tt.wantStatus, status)
+			if tt.wantStatus != http.StatusOK {
+				assert.Empty(t, updates, "failed upgrades don't change the account")
+				return
+			}
+			assert.NotNil(t, updates[tt.uid], "the account keeps its UID")
+			assert.Equal(t, "id-token", body.IDToken)
+		})
+	}
+}
+
+func TestGetAnonymousUpgradeFunc_RequiresLogin(t *testing.T) {
+	handler := firebasetools.GetAnonymousUpgradeFunc(firebasetools.AnonymousUpgradeConfig{})
+	assert.Equal(t, http.StatusUnauthorized, postJSON(t, handler, map[string]string{"email": "a@example.com"}, nil))
+}
@@ -0,0 +1,444 @@
+package firebasetools
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/serverutils"
+)
+
+const (
+	// AppCheckHeaderName is the request header that carries a Firebase App Check token
+	AppCheckHeaderName = "X-Firebase-AppCheck"
+
+	// AppCheckJWKSURL publishes the keys that sign Firebase App Check tokens
+	AppCheckJWKSURL = "https://firebaseappcheck.googleapis.com/v1/jwks"
+
+	// AppCheckIssuerPrefix is combined with the project number to give the
+	// expected `iss` claim of App Check tokens
+	AppCheckIssuerPrefix = "https://firebaseappcheck.googleapis.com/"
+
+	// AppCheckTokenContextKey is used to add/retrieve the verified App Check token on the context
+	AppCheckTokenContextKey = ContextKey("AppCheckToken")
+
+	// DefaultAppCheckJWKSCacheTTL is how long App Check keys are cached when the
+	// key server does not send a `Cache-Control: max-age` directive
+	DefaultAppCheckJWKSCacheTTL = 6 * time.Hour
+
+	// DefaultAppCheckJWKSMinRefreshInterval is the least time between two JWKS
+	// fetches that are triggered by unknown key IDs
+	DefaultAppCheckJWKSMinRefreshInterval = time.Minute
+)
+
+// AppCheckMode determines what the App Check middleware does with requests
+// that fail verification
+type AppCheckMode string
+
+const (
+	// AppCheckModeEnforce rejects requests without a valid App Check token
+	AppCheckModeEnforce AppCheckMode = "ENFORCE"
+
+	// AppCheckModeMonitor logs requests without a valid App Check token but lets
+	// them through. It is useful when rolling out App Check to existing clients.
+	AppCheckModeMonitor AppCheckMode = "MONITOR"
+)
+
+// AppCheckToken is a verified Firebase App Check token
+type AppCheckToken struct {
+	AppID    string                 `json:"sub"`
+	Issuer   string                 `json:"iss"`
+	Audience []string               `json:"-"`
+	Expires  int64                  `json:"exp"`
+	IssuedAt int64                  `json:"iat"`
+	Claims   map[string]interface{} `json:"-"`
+}
+
+// AppCheckVerifier verifies Firebase App Check tokens against the App Check
+// JWKS and an allowlist of app IDs
+type AppCheckVerifier struct {
+	// ProjectNumber is the numeric Google Cloud project number that the
+	// App Check tokens are issued for
+	ProjectNumber string
+
+	// AllowedAppIDs lists the Firebase app IDs that may call the API.
+	// When it is empty, any app registered in the project is accepted.
+	AllowedAppIDs []string
+
+	// JWKSURL is where the signing keys are fetched from. It defaults to
+	// AppCheckJWKSURL and can be pointed at a local key server in tests.
+	JWKSURL string
+
+	HTTPClient *http.Client
+	CacheTTL   time.Duration
+
+	// MinRefreshInterval stops tokens with made up key IDs from triggering a
+	// JWKS fetch each. It defaults to DefaultAppCheckJWKSMinRefreshInterval.
+	MinRefreshInterval time.Duration
+
+	mu          sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	keysExpiry  time.Time
+	lastRefresh time.Time
+
+	// refreshMu lets one request fetch the JWKS while concurrent ones wait for it
+	refreshMu sync.Mutex
+}
+
+// NewAppCheckVerifier creates an App Check verifier for the indicated project
+func NewAppCheckVerifier(projectNumber string, allowedAppIDs []string) *AppCheckVerifier {
+	return &AppCheckVerifier{
+		ProjectNumber: projectNumber,
+		AllowedAppIDs: allowedAppIDs,
+		JWKSURL:       AppCheckJWKSURL,
+		HTTPClient:    &http.Client{Timeout: time.Second * HTTPClientTimeoutSecs},
+		CacheTTL:      DefaultAppCheckJWKSCacheTTL,
+
+		MinRefreshInterval: DefaultAppCheckJWKSMinRefreshInterval,
+	}
+}
+
+// NewAppCheckVerifierFromEnv creates an App Check verifier for the project whose
+// number is set in the `GOOGLE_PROJECT_NUMBER` environment variable
+func NewAppCheckVerifierFromEnv(allowedAppIDs []string) (*AppCheckVerifier, error) {
+	projectNumber, err := serverutils.GetEnvVar(GoogleProjectNumberEnvVarName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the Google project number: %w", err)
+	}
+	return NewAppCheckVerifier(projectNumber, allowedAppIDs), nil
+}
+
+// VerifyToken checks the signature, issuer, audience, expiry and app ID of the
+// supplied App Check token
+func (v *AppCheckVerifier) VerifyToken(ctx context.Context, token string) (*AppCheckToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid App Check token: expected 3 segments, got %d", len(parts))
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+		Type      string `json:"typ"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid App Check token header: %w", err)
+	}
+	if header.Algorithm != "RS256" {
+		return nil, fmt.Errorf("invalid App Check token: unexpected algorithm %q", header.Algorithm)
+	}
+	if header.Type != "JWT" {
+		return nil, fmt.Errorf("invalid App Check token: unexpected type %q", header.Type)
+	}
+
+	key, err := v.publicKey(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid App Check token signature encoding: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("invalid App Check token signature: %w", err)
+	}
+
+	appCheckToken := &AppCheckToken{}
+	if err := decodeJWTSegment(parts[1], appCheckToken); err != nil {
+		return nil, fmt.Errorf("invalid App Check token payload: %w", err)
+	}
+	if err := decodeJWTSegment(parts[1], &appCheckToken.Claims); err != nil {
+		return nil, fmt.Errorf("invalid App Check token payload: %w", err)
+	}
+	appCheckToken.Audience = jwtAudience(appCheckToken.Claims["aud"])
+
+	if err := v.verifyClaims(appCheckToken); err != nil {
+		return nil, err
+	}
+	return appCheckToken, nil
+}
+
+func (v *AppCheckVerifier) verifyClaims(token *AppCheckToken) error {
+	now := time.Now().Unix()
+	if token.Expires <= now {
+		return fmt.Errorf("invalid App Check token: token has expired")
+	}
+	if token.IssuedAt > now {
+		return fmt.Errorf("invalid App Check token: token was issued in the future")
+	}
+
+	expectedIssuer := AppCheckIssuerPrefix + v.ProjectNumber
+	if token.Issuer != expectedIssuer {
+		return fmt.Errorf("invalid App Check token: expected issuer %q, got %q", expectedIssuer, token.Issuer)
+	}
+
+	expectedAudience := "projects/" + v.ProjectNumber
+	if !containsString(token.Audience, expectedAudience) {
+		return fmt.Errorf("invalid App Check token: audience does not include %q", expectedAudience)
+	}
+
+	if token.AppID == "" {
+		return fmt.Errorf("invalid App Check token: missing app ID")
+	}
+	if len(v.AllowedAppIDs) > 0 && !containsString(v.AllowedAppIDs, token.AppID) {
+		return fmt.Errorf("App Check token was issued to app %q which is not allowed", token.AppID)
+	}
+	return nil
+}
+
+// publicKey returns the signing key with the given key ID, refreshing the cached
+// keys when they have expired or the key ID is unknown (e.g after key rotation).
+// Unknown key IDs are answered from the cached keys when they were fetched less
+// than MinRefreshInterval ago.
+func (v *AppCheckVerifier) publicKey(ctx context.Context, keyID string) (*rsa.PublicKey, error) {
+	key, found, refresh := v.cachedKey(keyID)
+	if !refresh {
+		if !found {
+			return nil, fmt.Errorf("invalid App Check token: unknown key ID %q", keyID)
+		}
+		return key, nil
+	}
+
+	v.refreshMu.Lock()
+	defer v.refreshMu.Unlock()
+	// another request may have refreshed the keys while this one waited
+	key, found, refresh = v.cachedKey(keyID)
+	if refresh {
+		if err := v.refreshKeys(ctx); err != nil {
+			return nil, err
+		}
+		key, found, _ = v.cachedKey(keyID)
+	}
+	if !found {
+		return nil, fmt.Errorf("invalid App Check token: unknown key ID %q", keyID)
+	}
+	return key, nil
+}
+
+// cachedKey looks the key up in the cache and reports whether the keys should be refetched
+func (v *AppCheckVerifier) cachedKey(keyID string) (*rsa.PublicKey, bool, bool) {
+	minInterval := v.minRefreshInterval()
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	key, found := v.keys[keyID]
+	now := time.Now()
+	if !now.Before(v.keysExpiry) {
+		return key, found, true
+	}
+	return key, found, !found && now.Sub(v.lastRefresh) >= minInterval
+}
+
+func (v *AppCheckVerifier) minRefreshInterval() time.Duration {
+	if v.MinRefreshInterval <= 0 {
+		return DefaultAppCheckJWKSMinRefreshInterval
+	}
+	return v.MinRefreshInterval
+}
+
+func (v *AppCheckVerifier) refreshKeys(ctx context.Context) error {
+	jwksURL := v.JWKSURL
+	if jwksURL == "" {
+		jwksURL = AppCheckJWKSURL
+	}
+	httpClient := v.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURL, nil)
+	if err != nil {
+		return fmt.Errorf("unable to compose App Check JWKS request: %w", err)
+	}
+	resp, err := httpClient.Do(req)
+	defer CloseRespBody(resp)
+	if err != nil {
+		return fmt.Errorf("unable to fetch App Check JWKS: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		bs, err := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf(
+			"App Check JWKS HTTP error, status code %d\nBody: %s\nBody read error: %s", resp.StatusCode, string(bs), err)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return fmt.Errorf("unable to decode App Check JWKS: %w", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.KeyType != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return fmt.Errorf("invalid modulus for App Check key %q: %w", jwk.KeyID, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return fmt.Errorf("invalid exponent for App Check key %q: %w", jwk.KeyID, err)
+		}
+		keys[jwk.KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	ttl := v.CacheTTL
+	if maxAge, ok := cacheControlMaxAge(resp.Header.Get("Cache-Control")); ok {
+		ttl = maxAge
+	}
+	// keys that expire at once (e.g `max-age=0`) would be fetched for every request
+	if minInterval := v.minRefreshInterval(); ttl < minInterval {
+		ttl = minInterval
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = keys
+	v.lastRefresh = time.Now()
+	v.keysExpiry = v.lastRefresh.Add(ttl)
+	return nil
+}
+
+// Check is an authCheckFn-style check that passes when the request carries a
+// valid App Check token. It does not identify a user, so the returned
+// *auth.Token is always nil; it suits app-only endpoints that are placed in
+// front of (or instead of) user authentication.
+func (v *AppCheckVerifier) Check(r *http.Request, firebaseApp IFirebaseApp) (bool, map[string]string, *auth.Token) {
+	_, err := v.verifyRequest(r)
+	if err != nil {
+		return false, authErrorMap(err, AuthErrorInvalidToken), nil
+	}
+	return true, nil, nil
+}
+
+func (v *AppCheckVerifier) verifyRequest(r *http.Request) (*AppCheckToken, error) {
+	if r == nil {
+		return nil, NewAuthError(AuthErrorInvalidRequest, "nil request")
+	}
+	token := r.Header.Get(AppCheckHeaderName)
+	if token == "" {
+		return nil, NewAuthError("", fmt.Sprintf("expected an `%s` request header", AppCheckHeaderName))
+	}
+	appCheckToken, err := v.VerifyToken(r.Context(), token)
+	if err != nil {
+		return nil, NewAuthError(AuthErrorInvalidToken, err.Error())
+	}
+	return appCheckToken, nil
+}
+
+// AppCheckMiddleware verifies the App Check token of every request and packs the
+// verified token into the context.
+//
+// In enforce mode, requests that fail verification are rejected with a 401
+// problem response and a `WWW-Authenticate` challenge. In monitor mode, the failure is logged and the request
+// proceeds without an App Check token on the context.
+func AppCheckMiddleware(verifier *AppCheckVerifier, mode AppCheckMode) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				appCheckToken, err := verifier.verifyRequest(r)
+				if err != nil {
+					if mode == AppCheckModeMonitor {
+						log.Printf("App Check verification failed for %s %s: %s", r.Method, r.URL.Path, err)
+						next.ServeHTTP(w, r)
+						return
+					}
+					NewDefaultAuthErrorRenderer("")(w, r, NewAuthError(AuthErrorInvalidToken, err.Error()))
+					return
+				}
+
+				ctx := context.WithValue(r.Context(), AppCheckTokenContextKey, appCheckToken)
+				next.ServeHTTP(w, r.WithContext(ctx))
+			},
+		)
+	}
+}
+
+// GetAppCheckTokenFromContext retrieves a verified *AppCheckToken from the supplied context
+func GetAppCheckTokenFromContext(ctx context.Context) (*AppCheckToken, error) {
+	val := ctx.Value(AppCheckTokenContextKey)
+	if val == nil {
+		return nil, fmt.Errorf(
+			"unable to get App Check token from context with key %#v", AppCheckTokenContextKey)
+	}
+
+	token, ok := val.(*AppCheckToken)
+	if !ok {
+		return nil, fmt.Errorf("wrong App Check token type, got %#v, expected an *AppCheckToken", val)
+	}
+	return token, nil
+}
+
+func decodeJWTSegment(segment string, target interface{}) error {
+	bs, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, target)
+}
+
+// jwtAudience normalizes the `aud` claim, which may be a string or a list of strings
+func jwtAudience(aud interface{}) []string {
+	switch val := aud.(type) {
+	case string:
+		return []string{val}
+	case []interface{}:
+		audience := []string{}
+		for _, item := range val {
+			if s, ok := item.(string); ok {
+				audience = append(audience, s)
+			}
+		}
+		return audience
+	default:
+		return nil
+	}
+}
+
+// cacheControlMaxAge extracts the `max-age` directive of a Cache-Control header
+func cacheControlMaxAge(cacheControl string) (time.Duration, bool) {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+		if err != nil || seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+func containsString(values []string, target string) bool {
+	for _, value := range values {
+		if value == target {
+			return true
+		}
+	}
+	return false
+}
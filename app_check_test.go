@@ -0,0 +1,293 @@
+package firebasetools_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testProjectNumber = "123456789"
+	testAppID         = "1:123456789:android:abcdef"
+	testKeyID         = "test-key"
+)
+
+// newTestAppCheckKeyServer serves a JWKS with a freshly generated RSA key and
+// returns a function that signs App Check tokens with it
+func newTestAppCheckKeyServer(t *testing.T) (*httptest.Server, func(claims map[string]interface{}) string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwks := map[string]interface{}{
+			"keys": []map[string]string{
+				{
+					"kty": "RSA",
+					"use": "sig",
+					"alg": "RS256",
+					"kid": testKeyID,
+					"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				},
+			},
+		}
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		assert.Nil(t, json.NewEncoder(w).Encode(jwks))
+	}))
+
+	sign := func(claims map[string]interface{}) string {
+		header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": testKeyID})
+		assert.Nil(t, err)
+		payload, err := json.Marshal(claims)
+		assert.Nil(t, err)
+		signingInput := base64.RawURLEncoding.EncodeToString(header) + "." +
+			base64.RawURLEncoding.EncodeToString(payload)
+		digest := sha256.Sum256([]byte(signingInput))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		assert.Nil(t, err)
+		return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+	return server, sign
+}
+
+func validAppCheckClaims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"sub": testAppID,
+		"iss": firebasetools.AppCheckIssuerPrefix + testProjectNumber,
+		"aud": []string{"projects/" + testProjectNumber, "projects/test-project"},
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+}
+
+func TestAppCheckVerifier_VerifyToken(t *testing.T) {
+	server, sign := newTestAppCheckKeyServer(t)
+	defer server.Close()
+
+	withClaim := func(key string, value interface{}) map[string]interface{} {
+		claims := validAppCheckClaims()
+		claims[key] = value
+		return claims
+	}
+	// tamper swaps the payload of a token for that of another token
+	tamper := func(token string, other string) string {
+		parts := strings.Split(token, ".")
+		parts[1] = strings.Split(other, ".")[1]
+		return strings.Join(parts, ".")
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{
+			name:    "valid token",
+			token:   sign(validAppCheckClaims()),
+			wantErr: false,
+		},
+		{
+			name:    "malformed token",
+			token:   "not-a-jwt",
+			wantErr: true,
+		},
+		{
+			name:    "expired token",
+			token:   sign(withClaim("exp", time.Now().Add(-time.Minute).Unix())),
+			wantErr: true,
+		},
+		{
+			name:    "wrong issuer",
+			token:   sign(withClaim("iss", firebasetools.AppCheckIssuerPrefix+"987654321")),
+			wantErr: true,
+		},
+		{
+			name:    "wrong audience",
+			token:   sign(withClaim("aud", "projects/987654321")),
+			wantErr: true,
+		},
+		{
+			name:    "app not in allowlist",
+			token:   sign(withClaim("sub", "1:123456789:ios:not-allowed")),
+			wantErr: true,
+		},
+		{
+			name:    "tampered payload",
+			token:   tamper(sign(validAppCheckClaims()), sign(withClaim("sub", "1:123456789:web:other"))),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := firebasetools.NewAppCheckVerifier(testProjectNumber, []string{testAppID})
+			verifier.JWKSURL = server.URL
+
+			got, err := verifier.VerifyToken(context.Background(), tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifyToken() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr {
+				assert.Equal(t, testAppID, got.AppID)
+				assert.Contains(t, got.Audience, "projects/"+testProjectNumber)
+			}
+		})
+	}
+}
+
+func TestAppCheckMiddleware(t *testing.T) {
+	server, sign := newTestAppCheckKeyServer(t)
+	defer server.Close()
+
+	verifier := firebasetools.NewAppCheckVerifier(testProjectNumber, []string{testAppID})
+	verifier.JWKSURL = server.URL
+	validToken := sign(validAppCheckClaims())
+
+	tests := []struct {
+		name         string
+		mode         firebasetools.AppCheckMode
+		token        string
+		wantStatus   int
+		wantNext     bool
+		wantAppToken bool
+	}{
+		{
+			name:         "enforce - valid token",
+			mode:         firebasetools.AppCheckModeEnforce,
+			token:        validToken,
+			wantStatus:   http.StatusOK,
+			wantNext:     true,
+			wantAppToken: true,
+		},
+		{
+			name:       "enforce - missing token",
+			mode:       firebasetools.AppCheckModeEnforce,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "monitor - missing token",
+			mode:       firebasetools.AppCheckModeMonitor,
+			wantStatus: http.StatusOK,
+			wantNext:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nextCalled := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextCalled = true
+				_, err := firebasetools.GetAppCheckTokenFromContext(r.Context())
+				assert.Equal(t, tt.wantAppToken, err == nil)
+			})
+			h := firebasetools.AppCheckMiddleware(verifier, tt.mode)(next)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.token != "" {
+				req.Header.Set(firebasetools.AppCheckHeaderName, tt.token)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.Equal(t, tt.wantNext, nextCalled)
+			if tt.wantStatus == http.StatusUnauthorized {
+				assert.True(t, strings.HasPrefix(rw.Header().Get("WWW-Authenticate"), "Bearer"))
+			}
+		})
+	}
+}
+
+func TestAppCheckVerifier_Check(t *testing.T) {
+	server, sign := newTestAppCheckKeyServer(t)
+	defer server.Close()
+
+	verifier := firebasetools.NewAppCheckVerifier(testProjectNumber, nil)
+	verifier.JWKSURL = server.URL
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	ok, errMap, _ := verifier.Check(req, &firebasetools.MockFirebaseApp{})
+	assert.False(t, ok)
+	assert.NotEmpty(t, errMap["error"])
+
+	req.Header.Set(firebasetools.AppCheckHeaderName, sign(validAppCheckClaims()))
+	ok, errMap, _ = verifier.Check(req, &firebasetools.MockFirebaseApp{})
+	assert.True(t, ok)
+	assert.Nil(t, errMap)
+}
+
+func TestAppCheckVerifier_UnknownKeyIDsAreThrottled(t *testing.T) {
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		_, _ = w.Write([]byte(`{"keys": []}`))
+	}))
+	defer server.Close()
+
+	verifier := firebasetools.NewAppCheckVerifier(testProjectNumber, nil)
+	verifier.JWKSURL = server.URL
+	withKeyID := func(kid string) string {
+		header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+		assert.Nil(t, err)
+		payload, err := json.Marshal(validAppCheckClaims())
+		assert.Nil(t, err)
+		return base64.RawURLEncoding.EncodeToString(header) + "." +
+			base64.RawURLEncoding.EncodeToString(payload) + ".c2lnbmF0dXJl"
+	}
+
+	for _, kid := range []string{"made-up-1", "made-up-2", "made-up-3"} {
+		_, err := verifier.VerifyToken(context.Background(), withKeyID(kid))
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "unknown key ID")
+	}
+	assert.Equal(t, 1, fetches, "unknown key IDs are answered from the cache between refreshes")
+
+	verifier.MinRefreshInterval = time.Nanosecond
+	_, err := verifier.VerifyToken(context.Background(), withKeyID("made-up-4"))
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, fetches)
+}
+
+func TestAppCheckVerifier_CacheTTLIsClamped(t *testing.T) {
+	for _, cacheControl := range []string{"max-age=0", ""} {
+		fetches := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fetches++
+			if cacheControl != "" {
+				w.Header().Set("Cache-Control", cacheControl)
+			}
+			_, _ = w.Write([]byte(`{"keys": []}`))
+		}))
+
+		verifier := firebasetools.NewAppCheckVerifier(testProjectNumber, nil)
+		verifier.JWKSURL = server.URL
+		verifier.CacheTTL = 0
+		header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "made-up"})
+		assert.Nil(t, err)
+		payload, err := json.Marshal(validAppCheckClaims())
+		assert.Nil(t, err)
+		token := base64.RawURLEncoding.EncodeToString(header) + "." +
+			base64.RawURLEncoding.EncodeToString(payload) + ".c2lnbmF0dXJl"
+
+		for i := 0; i < 3; i++ {
+			_, err := verifier.VerifyToken(context.Background(), token)
+			assert.NotNil(t, err)
+		}
+		assert.Equal(t, 1, fetches, "the keys are cached for at least the minimum refresh interval (%q)", cacheControl)
+		server.Close()
+	}
+}
@@ -0,0 +1,109 @@
+package firebasetools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gofrs/uuid"
+)
+
+// AuditLogCollectionName is the (unsuffixed) Firestore collection that holds audit logs
+const AuditLogCollectionName = "audit_logs"
+
+// NewAuditLog composes an audit log entry with a JSON snapshot of the supplied value.
+//
+// The audited record is identified by a name based (version 5) UUID derived from
+// the record's own ID, since Firebase UIDs and Firestore IDs are not UUIDs.
+func NewAuditLog(typeName string, recordID string, operation string, uid string, snapshot interface{}) (*AuditLog, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate an audit log ID: %w", err)
+	}
+	bs, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("unable to serialize the %s audit snapshot: %w", typeName, err)
+	}
+	raw := json.RawMessage(bs)
+	return &AuditLog{
+		ID:        id,
+		RecordID:  uuid.NewV5(uuid.NamespaceURL, typeName+Sep+recordID),
+		TypeName:  typeName,
+		Operation: operation,
+		When:      time.Now(),
+		UID:       uid,
+		JSON:      &raw,
+	}, nil
+}
+
+// AuditLogRecorder persists audit log entries
+type AuditLogRecorder interface {
+	RecordAuditLog(ctx context.Context, entry *AuditLog) error
+}
+
+// FirestoreAuditLogRecorder saves audit log entries to a Firestore collection
+type FirestoreAuditLogRecorder struct {
+	client     *firestore.Client
+	collection string
+}
+
+// NewFirestoreAuditLogRecorder creates a Firestore backed audit log recorder.
+// When no collection is supplied, the suffixed `audit_logs` collection is used.
+func NewFirestoreAuditLogRecorder(client *firestore.Client, collection string) *FirestoreAuditLogRecorder {
+	if collection == "" {
+		collection = SuffixCollection(AuditLogCollectionName)
+	}
+	return &FirestoreAuditLogRecorder{client: client, collection: collection}
+}
+
+// RecordAuditLog saves the audit log entry, using its ID as the document ID
+func (r *FirestoreAuditLogRecorder) RecordAuditLog(ctx context.Context, entry *AuditLog) error {
+	if entry == nil {
+		return fmt.Errorf("nil audit log entry")
+	}
+	// UUIDs are byte arrays, so they are saved in their canonical string form
+	doc := map[string]interface{}{
+		"id":        entry.ID.String(),
+		"recordID":  entry.RecordID.String(),
+		"typeName":  entry.TypeName,
+		"operation": entry.Operation,
+		"when":      entry.When,
+		"uid":       entry.UID,
+	}
+	if entry.JSON != nil {
+		doc["json"] = string(*entry.JSON)
+	}
+	_, err := r.client.Collection(r.collection).Doc(entry.ID.String()).Set(ctx, doc)
+	if err != nil {
+		return fmt.Errorf("unable to record %s audit log: %w", entry.TypeName, err)
+	}
+	return nil
+}
+
+// InMemoryAuditLogRecorder keeps audit log entries in process memory.
+// It is intended for tests and local development.
+type InMemoryAuditLogRecorder struct {
+	mu      sync.Mutex
+	entries []*AuditLog
+}
+
+// RecordAuditLog appends the entry to the in-memory log
+func (r *InMemoryAuditLogRecorder) RecordAuditLog(ctx context.Context, entry *AuditLog) error {
+	if entry == nil {
+		return fmt.Errorf("nil audit log entry")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, entry)
+	return nil
+}
+
+// Entries returns a copy of the recorded entries, oldest first
+func (r *InMemoryAuditLogRecorder) Entries() []*AuditLog {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*AuditLog{}, r.entries...)
+}
@@ -0,0 +1,44 @@
+package firebasetools_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAuditLog(t *testing.T) {
+	snapshot := map[string]string{"targetUID": "patient-uid"}
+	entry, err := firebasetools.NewAuditLog("impersonation", "patient-uid", "act_as", "admin-uid", snapshot)
+	assert.Nil(t, err)
+	assert.Equal(t, "impersonation", entry.TypeName)
+	assert.Equal(t, "act_as", entry.Operation)
+	assert.Equal(t, "admin-uid", entry.UID)
+	assert.False(t, entry.When.IsZero())
+
+	got := map[string]string{}
+	assert.Nil(t, json.Unmarshal(*entry.JSON, &got))
+	assert.Equal(t, snapshot, got)
+
+	// the record ID is stable for the same record
+	again, err := firebasetools.NewAuditLog("impersonation", "patient-uid", "act_as", "admin-uid", snapshot)
+	assert.Nil(t, err)
+	assert.Equal(t, entry.RecordID, again.RecordID)
+	assert.NotEqual(t, entry.ID, again.ID)
+
+	_, err = firebasetools.NewAuditLog("impersonation", "patient-uid", "act_as", "admin-uid", make(chan int))
+	assert.NotNil(t, err)
+}
+
+func TestInMemoryAuditLogRecorder(t *testing.T) {
+	ctx := context.Background()
+	recorder := &firebasetools.InMemoryAuditLogRecorder{}
+	assert.NotNil(t, recorder.RecordAuditLog(ctx, nil))
+
+	entry, err := firebasetools.NewAuditLog("login", "a-uid", "login", "a-uid", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, recorder.RecordAuditLog(ctx, entry))
+	assert.Equal(t, []*firebasetools.AuditLog{entry}, recorder.Entries())
+}
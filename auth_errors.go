@@ -0,0 +1,232 @@
+package firebasetools
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	// AuthErrorInvalidRequest is the RFC 6750 error code for requests that are
+	// missing a required parameter or are otherwise malformed
+	AuthErrorInvalidRequest = "invalid_request"
+
+	// AuthErrorInvalidToken is the RFC 6750 error code for access tokens that are
+	// expired, revoked, malformed or invalid for other reasons
+	AuthErrorInvalidToken = "invalid_token"
+
+	// AuthErrorInsufficientScope is the RFC 6750 error code for requests that need
+	// higher privileges than those granted by the access token
+	AuthErrorInsufficientScope = "insufficient_scope"
+
+	// ProblemJSONContentType is the RFC 7807 media type for problem details
+	ProblemJSONContentType = "application/problem+json"
+
+	// authErrorCodeKey is the error map key that carries an RFC 6750 error code
+	// from an auth check to the authentication middleware
+	authErrorCodeKey = "error_code"
+
+	rfc6750ErrorCodesURI = "https://www.rfc-editor.org/rfc/rfc6750#section-3.1"
+)
+
+// AuthError is an authentication or authorization failure that can be rendered
+// as an RFC 6750 `WWW-Authenticate` challenge and an RFC 7807 problem.
+//
+// Code is left empty when the request carried no credentials at all, as
+// recommended by RFC 6750 section 3.1.
+type AuthError struct {
+	Code        string
+	Description string
+	Scope       string
+	Status      int
+
+	// Details holds the messages of every auth check that failed
+	Details []string
+}
+
+// Error returns the human readable description of the auth error
+func (e *AuthError) Error() string {
+	return e.Description
+}
+
+// NewAuthError creates an auth error with the HTTP status that RFC 6750
+// assigns to the supplied error code
+func NewAuthError(code string, description string) *AuthError {
+	return &AuthError{
+		Code:        code,
+		Description: description,
+		Status:      authErrorStatus(code),
+	}
+}
+
+// NewInsufficientScopeError creates an auth error for a principal that is
+// authenticated but lacks the indicated scope (e.g a custom claim)
+func NewInsufficientScopeError(scope string, description string) *AuthError {
+	authErr := NewAuthError(AuthErrorInsufficientScope, description)
+	authErr.Scope = scope
+	return authErr
+}
+
+func authErrorStatus(code string) int {
+	switch code {
+	case AuthErrorInvalidRequest:
+		return http.StatusBadRequest
+	case AuthErrorInsufficientScope:
+		return http.StatusForbidden
+	default:
+		return http.StatusUnauthorized
+	}
+}
+
+// authErrorMap turns the supplied error into an auth check error map.
+// The RFC 6750 error code travels under the `error_code` key; it is left empty
+// for requests that carried no credentials.
+func authErrorMap(err error, defaultCode string) map[string]string {
+	errMap := map[string]string{"error": err.Error(), authErrorCodeKey: defaultCode}
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		errMap[authErrorCodeKey] = authErr.Code
+		if authErr.Scope != "" {
+			errMap["scope"] = authErr.Scope
+		}
+	}
+	return errMap
+}
+
+// authErrorFromMaps combines the error maps accumulated by failed auth checks into
+// a single auth error. The first check's error is the primary one since checks
+// are ordered from the most to the least permissive.
+func authErrorFromMaps(errs []map[string]string) *AuthError {
+	if len(errs) == 0 {
+		return NewAuthError(AuthErrorInvalidToken, "unable to authenticate the request")
+	}
+	details := []string{}
+	for _, errMap := range errs {
+		if msg, ok := errMap["error"]; ok {
+			details = append(details, msg)
+		}
+	}
+	primary := errs[0]
+	code, hasCode := primary[authErrorCodeKey]
+	if !hasCode {
+		// checks that predate error codes only report invalid credentials
+		code = AuthErrorInvalidToken
+	}
+	authErr := NewAuthError(code, primary["error"])
+	authErr.Scope = primary["scope"]
+	authErr.Details = details
+	return authErr
+}
+
+// ProblemDetails is an RFC 7807 problem details object
+type ProblemDetails struct {
+	Type     string   `json:"type"`
+	Title    string   `json:"title"`
+	Status   int      `json:"status"`
+	Detail   string   `json:"detail,omitempty"`
+	Instance string   `json:"instance,omitempty"`
+	Code     string   `json:"code,omitempty"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// NewAuthProblemDetails composes RFC 7807 problem details for an auth error
+func NewAuthProblemDetails(r *http.Request, authErr *AuthError) *ProblemDetails {
+	problem := &ProblemDetails{
+		Type:   "about:blank",
+		Title:  http.StatusText(authErr.Status),
+		Status: authErr.Status,
+		Detail: authErr.Description,
+		Code:   authErr.Code,
+		Errors: authErr.Details,
+	}
+	if authErr.Code != "" {
+		problem.Type = rfc6750ErrorCodesURI
+	}
+	if r != nil && r.URL != nil {
+		problem.Instance = r.URL.Path
+	}
+	return problem
+}
+
+// WriteProblemResponse writes the supplied problem details as an
+// `application/problem+json` response
+func WriteProblemResponse(w http.ResponseWriter, problem *ProblemDetails) {
+	content, err := json.Marshal(problem)
+	if err != nil {
+		msg := fmt.Sprintf("error when marshalling %#v to JSON bytes: %#v", problem, err)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ProblemJSONContentType)
+	w.WriteHeader(problem.Status)
+	_, err = w.Write(content)
+	if err != nil {
+		log.Printf("unable to write problem response: %s", err)
+	}
+}
+
+// writeProblem writes a plain problem response with the supplied status
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	WriteProblemResponse(w, &ProblemDetails{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	})
+}
+
+// writeInternalProblem writes a 500 problem response e.g when a store fails
+func writeInternalProblem(w http.ResponseWriter, r *http.Request, detail string) {
+	writeProblem(w, r, http.StatusInternalServerError, detail)
+}
+
+// WWWAuthenticateHeader composes an RFC 6750 `Bearer` challenge for the
+// supplied realm and auth error
+func WWWAuthenticateHeader(realm string, authErr *AuthError) string {
+	params := []string{}
+	if realm != "" {
+		params = append(params, authParam("realm", realm))
+	}
+	if authErr != nil && authErr.Code != "" {
+		params = append(params, authParam("error", authErr.Code))
+		if authErr.Description != "" {
+			params = append(params, authParam("error_description", authErr.Description))
+		}
+		if authErr.Scope != "" {
+			params = append(params, authParam("scope", authErr.Scope))
+		}
+	}
+	if len(params) == 0 {
+		return "Bearer"
+	}
+	return "Bearer " + strings.Join(params, ", ")
+}
+
+// authParam formats a quoted auth-param, dropping the characters that RFC 6750
+// does not allow in attribute values
+func authParam(name string, value string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return -1
+		}
+		return r
+	}, value)
+	return fmt.Sprintf("%s=%q", name, sanitized)
+}
+
+// AuthErrorRenderer writes the response for a request that failed authentication
+// or authorization
+type AuthErrorRenderer func(w http.ResponseWriter, r *http.Request, authErr *AuthError)
+
+// NewDefaultAuthErrorRenderer returns a renderer that sets an RFC 6750
+// `WWW-Authenticate` header and writes an RFC 7807 problem+json body
+func NewDefaultAuthErrorRenderer(realm string) AuthErrorRenderer {
+	return func(w http.ResponseWriter, r *http.Request, authErr *AuthError) {
+		w.Header().Set("WWW-Authenticate", WWWAuthenticateHeader(realm, authErr))
+		WriteProblemResponse(w, NewAuthProblemDetails(r, authErr))
+	}
+}
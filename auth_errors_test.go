@@ -0,0 +1,106 @@
+package firebasetools_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAuthError(t *testing.T) {
+	tests := []struct {
+		name       string
+		code       string
+		wantStatus int
+	}{
+		{
+			name:       "missing credentials",
+			code:       "",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "invalid request",
+			code:       firebasetools.AuthErrorInvalidRequest,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid token",
+			code:       firebasetools.AuthErrorInvalidToken,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "insufficient scope",
+			code:       firebasetools.AuthErrorInsufficientScope,
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := firebasetools.NewAuthError(tt.code, "description")
+			assert.Equal(t, tt.wantStatus, got.Status)
+			assert.Equal(t, "description", got.Error())
+		})
+	}
+}
+
+func TestWWWAuthenticateHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		realm   string
+		authErr *firebasetools.AuthError
+		want    string
+	}{
+		{
+			name:    "no realm, no error",
+			authErr: nil,
+			want:    "Bearer",
+		},
+		{
+			name:    "missing credentials",
+			realm:   "example",
+			authErr: firebasetools.NewAuthError("", "expected an `Authorization` request header"),
+			want:    `Bearer realm="example"`,
+		},
+		{
+			name:    "invalid token with unsafe characters",
+			realm:   "example",
+			authErr: firebasetools.NewAuthError(firebasetools.AuthErrorInvalidToken, "token \"expired\"\\\n"),
+			want:    `Bearer realm="example", error="invalid_token", error_description="token expired"`,
+		},
+		{
+			name:    "insufficient scope",
+			authErr: firebasetools.NewInsufficientScopeError("admin", "admin claim required"),
+			want:    `Bearer error="insufficient_scope", error_description="admin claim required", scope="admin"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, firebasetools.WWWAuthenticateHeader(tt.realm, tt.authErr))
+		})
+	}
+}
+
+func TestNewDefaultAuthErrorRenderer(t *testing.T) {
+	renderer := firebasetools.NewDefaultAuthErrorRenderer("example")
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	renderer(rw, req, firebasetools.NewInsufficientScopeError("admin", "admin claim required"))
+
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, firebasetools.ProblemJSONContentType, rw.Header().Get("Content-Type"))
+	assert.Equal(
+		t,
+		`Bearer realm="example", error="insufficient_scope", error_description="admin claim required", scope="admin"`,
+		rw.Header().Get("WWW-Authenticate"),
+	)
+
+	problem := firebasetools.ProblemDetails{}
+	assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &problem))
+	assert.Equal(t, http.StatusForbidden, problem.Status)
+	assert.Equal(t, "Forbidden", problem.Title)
+	assert.Equal(t, firebasetools.AuthErrorInsufficientScope, problem.Code)
+	assert.Equal(t, "/admin", problem.Instance)
+}
@@ -3,11 +3,11 @@ package firebasetools
 import (
 	"context"
 	"fmt"
+	"log"
 	"net/http"
 	"strings"
 
 	"firebase.google.com/go/auth"
-	"github.com/savannahghi/serverutils"
 )
 
 // authCheckFn is a function type for authorization and authentication checks
@@ -18,12 +18,74 @@ type authCheckFn = func(
 	firebaseApp IFirebaseApp,
 ) (bool, map[string]string, *auth.Token)
 
+// authenticationConfig holds the settings used by the authentication middleware
+type authenticationConfig struct {
+	checkFuncs    []authCheckFn
+	tokenSources  []TokenSource
+	realm         string
+	errorRenderer AuthErrorRenderer
+
+	// query parameters that carry tokens and should not reach handlers or logs
+	tokenQueryParams []string
+
+	// sessions that were signed out individually
+	revokedSessions RevokedSessionStore
+}
+
+// AuthenticationOption customizes the behavior of the authentication middleware
+type AuthenticationOption func(*authenticationConfig)
+
+// WithAuthRealm sets the realm advertised in `WWW-Authenticate` challenges
+func WithAuthRealm(realm string) AuthenticationOption {
+	return func(c *authenticationConfig) {
+		c.realm = realm
+	}
+}
+
+// WithAuthErrorRenderer replaces the default RFC 6750/RFC 7807 error response
+// with a custom one e.g to suit an API gateway
+func WithAuthErrorRenderer(renderer AuthErrorRenderer) AuthenticationOption {
+	return func(c *authenticationConfig) {
+		c.errorRenderer = renderer
+	}
+}
+
+// WithAuthChecks replaces the default bearer token check with the supplied checks.
+// They run in order and the first one to succeed authenticates the request
+// e.g `WithAuthChecks(HasValidFirebaseBearerToken, appCheckVerifier.Check)`.
+// Repeated options add to the checks.
+func WithAuthChecks(checks ...authCheckFn) AuthenticationOption {
+	return func(c *authenticationConfig) {
+		c.checkFuncs = append(c.checkFuncs, checks...)
+	}
+}
+
+// newAuthenticationConfig applies the supplied options over the defaults
+func newAuthenticationConfig(opts ...AuthenticationOption) *authenticationConfig {
+	config := &authenticationConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+	// the Firebase ID token check is the default, and runs after any custom
+	// checks when token sources are set, whatever the order of the options
+	switch {
+	case len(config.tokenSources) > 0:
+		config.checkFuncs = append(config.checkFuncs, FirebaseTokenCheck(config.tokenSources...))
+	case len(config.checkFuncs) == 0:
+		config.checkFuncs = []authCheckFn{HasValidFirebaseBearerToken}
+	}
+	if config.errorRenderer == nil {
+		config.errorRenderer = NewDefaultAuthErrorRenderer(config.realm)
+	}
+	return config
+}
+
 // AuthenticationMiddleware decodes the share session cookie and packs the session into context
-func AuthenticationMiddleware(firebaseApp IFirebaseApp) func(http.Handler) http.Handler {
+func AuthenticationMiddleware(firebaseApp IFirebaseApp, opts ...AuthenticationOption) func(http.Handler) http.Handler {
 	// multiple checks will be run in sequence (order matters)
 	// the first check to succeed will call `c.Next()` and `return`
 	// this means that more permissive checks (e.g exceptions) should come first
-	checkFuncs := []authCheckFn{HasValidFirebaseBearerToken}
+	config := newAuthenticationConfig(opts...)
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(
@@ -31,23 +93,41 @@ func AuthenticationMiddleware(firebaseApp IFirebaseApp) func(http.Handler) http.
 				errs := []map[string]string{}
 				// in case authorization does not succeed, accumulated errors
 				// are returned to the client
-				for _, checkFunc := range checkFuncs {
+				for _, checkFunc := range config.checkFuncs {
 					shouldContinue, errMap, authToken := checkFunc(r, firebaseApp)
 					if shouldContinue {
-						// put the auth token in the context
-						ctx := context.WithValue(r.Context(), AuthTokenContextKey, authToken)
+						// put the auth token and the principal derived from it in the context
+						// app-only checks (e.g App Check) do not identify a user
+						if authToken != nil {
+							revoked, err := config.isSessionRevoked(r.Context(), authToken)
+							if err != nil {
+								log.Printf("unable to check the session of %s: %s", authToken.UID, err)
+								writeInternalProblem(w, r, "unable to check the session")
+								return
+							}
+							if revoked {
+								config.errorRenderer(w, r, NewAuthError(
+									AuthErrorInvalidToken, "the session has been signed out"))
+								return
+							}
+
+							ctx := context.WithValue(r.Context(), AuthTokenContextKey, authToken)
+							if principal, err := NewPrincipal(authToken); err == nil {
+								ctx = WithPrincipal(ctx, principal)
+							}
+							r = r.WithContext(ctx)
+						}
 
 						// and call the next with our new context
-						r = r.WithContext(ctx)
-						next.ServeHTTP(w, r)
+						next.ServeHTTP(w, stripTokenQueryParams(r, config.tokenQueryParams))
 						return
 					}
 					errs = append(errs, errMap)
 				}
 
 				// if we got here, it is because we have errors.
-				// write an error response)
-				serverutils.WriteJSONResponse(w, errs, http.StatusUnauthorized)
+				// write an error response
+				config.errorRenderer(w, r, authErrorFromMaps(errs))
 			},
 		)
 	}
@@ -55,16 +135,17 @@ func AuthenticationMiddleware(firebaseApp IFirebaseApp) func(http.Handler) http.
 
 // HasValidFirebaseBearerToken returns true with no errors if the request has a valid bearer token in the authorization header.
 // Otherwise, it returns false and the error in a map with the key "error"
+// and the RFC 6750 error code, if any, under the key "error_code"
 func HasValidFirebaseBearerToken(r *http.Request, firebaseApp IFirebaseApp) (bool, map[string]string, *auth.Token) {
 	bearerToken, err := ExtractBearerToken(r)
 	if err != nil {
 		// this error here will only be returned to the user if all the verification functions in the chain fail
-		return false, serverutils.ErrorMap(err), nil
+		return false, authErrorMap(err, ""), nil
 	}
 
 	validToken, err := ValidateBearerToken(r.Context(), bearerToken)
 	if err != nil {
-		return false, serverutils.ErrorMap(err), nil
+		return false, authErrorMap(err, AuthErrorInvalidToken), nil
 	}
 
 	return true, nil, validToken
@@ -77,20 +158,26 @@ func ExtractBearerToken(r *http.Request) (string, error) {
 	return ExtractToken(r, "Authorization", "Bearer")
 }
 
-// ExtractToken extracts a token with the specified prefix from the specified header
+// ExtractToken extracts a token with the specified prefix from the specified header.
+//
+// The returned errors are *AuthError values. Their code is empty when the
+// header is absent and `invalid_request` when the header is malformed.
 func ExtractToken(r *http.Request, header string, prefix string) (string, error) {
 	if r == nil {
-		return "", fmt.Errorf("nil request")
+		return "", NewAuthError(AuthErrorInvalidRequest, "nil request")
 	}
 	if r.Header == nil {
-		return "", fmt.Errorf("no headers, can't extract bearer token")
+		return "", NewAuthError("", "no headers, can't extract bearer token")
 	}
 	authHeader := r.Header.Get(header)
 	if authHeader == "" {
-		return "", fmt.Errorf("expected an `%s` request header", header)
+		return "", NewAuthError("", fmt.Sprintf("expected an `%s` request header", header))
 	}
 	if !strings.HasPrefix(authHeader, prefix) {
-		return "", fmt.Errorf("the `Authorization` header contents should start with `Bearer`")
+		return "", NewAuthError(
+			AuthErrorInvalidRequest,
+			fmt.Sprintf("the `%s` header contents should start with `%s`", header, prefix),
+		)
 	}
 	tokenOnly := strings.TrimSpace(strings.TrimPrefix(authHeader, prefix))
 	return tokenOnly, nil
@@ -3,11 +3,14 @@ package firebasetools_test
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"firebase.google.com/go/auth"
 	"github.com/savannahghi/firebasetools"
 	"github.com/stretchr/testify/assert"
 )
@@ -57,3 +60,162 @@ func TestAuthenticationMiddleware(t *testing.T) {
 	req1 := httptest.NewRequest(http.MethodPost, "/", reader)
 	h.ServeHTTP(rw1, req1)
 }
+
+func TestExtractToken(t *testing.T) {
+	withCustomHeader := httptest.NewRequest(http.MethodGet, "/", nil)
+	withCustomHeader.Header.Set("X-Api-Token", "Token abc")
+
+	withWrongPrefix := httptest.NewRequest(http.MethodGet, "/", nil)
+	withWrongPrefix.Header.Set("X-Api-Token", "Bearer abc")
+
+	tests := []struct {
+		name     string
+		r        *http.Request
+		want     string
+		wantCode string
+		wantMsg  string
+		wantErr  bool
+	}{
+		{
+			name:     "nil request",
+			r:        nil,
+			wantCode: firebasetools.AuthErrorInvalidRequest,
+			wantMsg:  "nil request",
+			wantErr:  true,
+		},
+		{
+			name:     "missing header",
+			r:        httptest.NewRequest(http.MethodGet, "/", nil),
+			wantCode: "",
+			wantMsg:  "expected an `X-Api-Token` request header",
+			wantErr:  true,
+		},
+		{
+			name:     "wrong prefix",
+			r:        withWrongPrefix,
+			wantCode: firebasetools.AuthErrorInvalidRequest,
+			wantMsg:  "the `X-Api-Token` header contents should start with `Token`",
+			wantErr:  true,
+		},
+		{
+			name: "valid header",
+			r:    withCustomHeader,
+			want: "abc",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := firebasetools.ExtractToken(tt.r, "X-Api-Token", "Token")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ExtractToken() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				var authErr *firebasetools.AuthError
+				assert.True(t, errors.As(err, &authErr))
+				assert.Equal(t, tt.wantCode, authErr.Code)
+				assert.Equal(t, tt.wantMsg, authErr.Error())
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAuthenticationMiddleware_ErrorResponses(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("the next handler should not be called for unauthenticated requests")
+	})
+	fa := &firebasetools.MockFirebaseApp{}
+
+	malformedReq := httptest.NewRequest(http.MethodGet, "/graphql", nil)
+	malformedReq.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+
+	tests := []struct {
+		name          string
+		r             *http.Request
+		wantStatus    int
+		wantChallenge string
+		wantCode      string
+	}{
+		{
+			name:          "no credentials",
+			r:             httptest.NewRequest(http.MethodGet, "/graphql", nil),
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Bearer realm="api"`,
+			wantCode:      "",
+		},
+		{
+			name:          "malformed authorization header",
+			r:             malformedReq,
+			wantStatus:    http.StatusBadRequest,
+			wantChallenge: `Bearer realm="api", error="invalid_request", error_description="the ` + "`Authorization`" + ` header contents should start with ` + "`Bearer`" + `"`,
+			wantCode:      firebasetools.AuthErrorInvalidRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := firebasetools.AuthenticationMiddleware(fa, firebasetools.WithAuthRealm("api"))(next)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, tt.r)
+
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.Equal(t, tt.wantChallenge, rw.Header().Get("WWW-Authenticate"))
+			assert.Equal(t, firebasetools.ProblemJSONContentType, rw.Header().Get("Content-Type"))
+
+			problem := firebasetools.ProblemDetails{}
+			assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &problem))
+			assert.Equal(t, tt.wantStatus, problem.Status)
+			assert.Equal(t, tt.wantCode, problem.Code)
+			assert.Equal(t, "/graphql", problem.Instance)
+			assert.Len(t, problem.Errors, 1)
+		})
+	}
+}
+
+func TestAuthenticationMiddleware_CustomErrorRenderer(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	fa := &firebasetools.MockFirebaseApp{}
+
+	var rendered *firebasetools.AuthError
+	renderer := func(w http.ResponseWriter, r *http.Request, authErr *firebasetools.AuthError) {
+		rendered = authErr
+		w.WriteHeader(http.StatusTeapot)
+	}
+	h := firebasetools.AuthenticationMiddleware(fa, firebasetools.WithAuthErrorRenderer(renderer))(next)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, http.StatusTeapot, rw.Code)
+	assert.NotNil(t, rendered)
+	assert.Equal(t, http.StatusUnauthorized, rendered.Status)
+}
+
+func TestAuthenticationMiddleware_WithAuthChecks(t *testing.T) {
+	var gotToken *auth.Token
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := firebasetools.GetUserTokenFromContext(r.Context())
+		assert.Nil(t, err)
+		gotToken = token
+	})
+	fa := &firebasetools.MockFirebaseApp{}
+
+	failingCheck := func(r *http.Request, fa firebasetools.IFirebaseApp) (bool, map[string]string, *auth.Token) {
+		return false, map[string]string{"error": "first check failed"}, nil
+	}
+	passingCheck := func(r *http.Request, fa firebasetools.IFirebaseApp) (bool, map[string]string, *auth.Token) {
+		return true, nil, &auth.Token{UID: "a-uid"}
+	}
+
+	h := firebasetools.AuthenticationMiddleware(fa, firebasetools.WithAuthChecks(failingCheck, passingCheck))(next)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "a-uid", gotToken.UID)
+
+	h = firebasetools.AuthenticationMiddleware(fa, firebasetools.WithAuthChecks(failingCheck))(next)
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.Contains(t, rw.Header().Get("WWW-Authenticate"), `error="invalid_token"`)
+}
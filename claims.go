@@ -0,0 +1,426 @@
+package firebasetools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// MaxCustomClaimsBytes is the largest JSON payload of custom claims that Firebase Auth accepts
+	MaxCustomClaimsBytes = 1000
+
+	// defaultClaimsUpdateAttempts is how many times a claims update is retried after a conflict
+	defaultClaimsUpdateAttempts = 3
+
+	// ClaimsUpdatesCollectionName is the (unsuffixed) Firestore collection that holds
+	// a document per user, named by UID, with the refresh marker of their claims and
+	// the lease of their claims updates
+	ClaimsUpdatesCollectionName = "claims_updates"
+
+	// claimsLeaseDuration is how long a claims update may hold the user's lease,
+	// in case it is never released (e.g because the instance crashed)
+	claimsLeaseDuration = 30 * time.Second
+
+	// claimsLeaseWait is how long a claims update waits for the user's lease
+	claimsLeaseWait = 10 * time.Second
+)
+
+// reservedClaimNames are set by Firebase Auth and can't be used as custom claims
+var reservedClaimNames = map[string]bool{
+	"acr": true, "amr": true, "at_hash": true, "aud": true, "auth_time": true, "azp": true,
+	"cnf": true, "c_hash": true, "exp": true, "firebase": true, "iat": true, "iss": true,
+	"jti": true, "nbf": true, "nonce": true, "sub": true,
+}
+
+// ErrClaimsConflict is returned when a user's custom claims keep changing while
+// they are being updated
+var ErrClaimsConflict = errors.New("the custom claims were changed by someone else")
+
+// ValidateCustomClaims checks that the claims can be stored by Firebase Auth
+func ValidateCustomClaims(claims map[string]interface{}) error {
+	reserved := []string{}
+	for name := range claims {
+		if reservedClaimNames[name] {
+			reserved = append(reserved, name)
+		}
+	}
+	if len(reserved) > 0 {
+		sort.Strings(reserved)
+		return fmt.Errorf("reserved claim names can't be used: %s", strings.Join(reserved, ", "))
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return fmt.Errorf("the custom claims can't be serialized: %w", err)
+	}
+	if len(payload) > MaxCustomClaimsBytes {
+		return fmt.Errorf(
+			"the custom claims are %d bytes long, more than the %d bytes allowed", len(payload), MaxCustomClaimsBytes)
+	}
+	return nil
+}
+
+// ClaimsManager updates the persistent custom claims of users, in the project or
+// the context's tenant.
+//
+// Updates are read-modify-write. Firebase Auth has no conditional writes, so the
+// updates of a user are serialized within the process and, through a lease (see
+// Lease), across processes. The claims are also read back after every write to
+// retry updates that were overwritten before the read by writers that bypass the
+// manager, which can still overwrite an update after it was read back.
+type ClaimsManager struct {
+	// RefreshMarker, when set, is a field that holds the Unix time of the last
+	// update. It is written outside the claims (see MarkRefresh), since clients
+	// only see the claims once they refresh their ID token. Clients that see it
+	// change should refresh their ID token.
+	RefreshMarker string
+
+	// MarkRefresh writes the refresh marker. It defaults to setting the field on
+	// the user's document in the suffixed `claims_updates` Firestore collection,
+	// which security rules should let the user read and listen to.
+	MarkRefresh func(ctx context.Context, tenantID string, uid string, field string, updatedAt time.Time) error
+
+	// Attempts is how many times an update is tried before ErrClaimsConflict is
+	// returned. It defaults to 3.
+	Attempts int
+
+	// GetClaims defaults to reading the Firebase Auth user's custom claims
+	GetClaims func(ctx context.Context, tenantID string, uid string) (map[string]interface{}, error)
+
+	// SetClaims defaults to replacing the Firebase Auth user's custom claims
+	SetClaims func(ctx context.Context, tenantID string, uid string, claims map[string]interface{}) error
+
+	// Lease serializes the claims updates of a user across processes, returning
+	// the function that ends the lease. It defaults to a lease on the user's
+	// document in the suffixed `claims_updates` Firestore collection, which is
+	// taken in a transaction and expires after 30 seconds.
+	Lease func(ctx context.Context, tenantID string, uid string) (func(), error)
+}
+
+// claimsLocks serializes the claims updates of each user within the process,
+// whichever ClaimsManager makes them
+var claimsLocks = &keyedMutex{locks: map[string]*keyedMutexEntry{}}
+
+// keyedMutex is a set of mutexes that are created on demand and dropped once unused
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	mu    sync.Mutex
+	users int
+}
+
+// lock locks the key's mutex and returns the function that unlocks it
+func (k *keyedMutex) lock(key string) func() {
+	k.mu.Lock()
+	entry, ok := k.locks[key]
+	if !ok {
+		entry = &keyedMutexEntry{}
+		k.locks[key] = entry
+	}
+	entry.users++
+	k.mu.Unlock()
+
+	entry.mu.Lock()
+	return func() {
+		entry.mu.Unlock()
+		k.mu.Lock()
+		entry.users--
+		if entry.users == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// lockClaims serializes the claims updates of the user within the process, then
+// across processes with the lease, and returns the function that unlocks them
+func lockClaims(
+	ctx context.Context,
+	tenantID string,
+	uid string,
+	lease func(ctx context.Context, tenantID string, uid string) (func(), error),
+) (func(), error) {
+	if lease == nil {
+		lease = leaseFirestoreClaims
+	}
+	unlock := claimsLocks.lock(tenantID + Sep + uid)
+	release, err := lease(ctx, tenantID, uid)
+	if err != nil {
+		unlock()
+		return nil, fmt.Errorf("unable to lease the custom claims of %s: %w", uid, err)
+	}
+	return func() {
+		release()
+		unlock()
+	}, nil
+}
+
+// leaseFirestoreClaims takes the lease on the user's claims_updates document once
+// it is free or expired, waiting up to claimsLeaseWait for it
+func leaseFirestoreClaims(ctx context.Context, tenantID string, uid string) (func(), error) {
+	client, err := GetFirestoreClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	doc := client.Collection(SuffixCollection(ClaimsUpdatesCollectionName)).Doc(uid)
+	holder := uuid.New().String()
+	deadline := time.Now().Add(claimsLeaseWait)
+	for wait := 50 * time.Millisecond; ; wait *= 2 {
+		taken := false
+		err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			taken = false
+			snapshot, err := tx.Get(doc)
+			if err != nil && status.Code(err) != codes.NotFound {
+				return err
+			}
+			if snapshot != nil && snapshot.Exists() {
+				until, err := snapshot.DataAt("claimsLeaseUntil")
+				if expiry, ok := until.(time.Time); err == nil && ok && expiry.After(time.Now()) {
+					return nil
+				}
+			}
+			taken = true
+			return tx.Set(doc, map[string]interface{}{
+				"uid":              uid,
+				"tenantId":         tenantID,
+				"claimsLease":      holder,
+				"claimsLeaseUntil": time.Now().Add(claimsLeaseDuration),
+			}, firestore.MergeAll)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if taken {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrClaimsConflict
+		}
+		if wait > time.Second {
+			wait = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	return func() {
+		// the lease is only ended by its holder, since it may have expired and been taken
+		err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			snapshot, err := tx.Get(doc)
+			if err != nil {
+				return err
+			}
+			if current, err := snapshot.DataAt("claimsLease"); err != nil || current != holder {
+				return nil
+			}
+			return tx.Update(doc, []firestore.Update{
+				{Path: "claimsLease", Value: firestore.Delete},
+				{Path: "claimsLeaseUntil", Value: firestore.Delete},
+			})
+		})
+		if err != nil {
+			log.Printf("unable to end the claims lease of %s, it will expire: %s", uid, err)
+		}
+	}, nil
+}
+
+func markFirestoreClaimsRefresh(ctx context.Context, tenantID string, uid string, field string, updatedAt time.Time) error {
+	client, err := GetFirestoreClient(ctx)
+	if err != nil {
+		return err
+	}
+	doc := client.Collection(SuffixCollection(ClaimsUpdatesCollectionName)).Doc(uid)
+	_, err = doc.Set(ctx, map[string]interface{}{
+		"uid":      uid,
+		"tenantId": tenantID,
+		field:      updatedAt.Unix(),
+	}, firestore.MergeAll)
+	return err
+}
+
+func getFirebaseCustomClaims(ctx context.Context, tenantID string, uid string) (map[string]interface{}, error) {
+	user, err := getTenantUser(ctx, tenantID, uid)
+	if err != nil {
+		return nil, err
+	}
+	return user.CustomClaims, nil
+}
+
+func (m *ClaimsManager) getClaims(ctx context.Context, tenantID string, uid string) (map[string]interface{}, error) {
+	getClaims := m.GetClaims
+	if getClaims == nil {
+		getClaims = getFirebaseCustomClaims
+	}
+	claims, err := getClaims(ctx, tenantID, uid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the custom claims of %s: %w", uid, err)
+	}
+	if claims == nil {
+		claims = map[string]interface{}{}
+	}
+	return claims, nil
+}
+
+// GetUserClaims returns the user's custom claims
+func (m *ClaimsManager) GetUserClaims(ctx context.Context, uid string) (map[string]interface{}, error) {
+	tenantID, _ := GetTenantIDFromContext(ctx)
+	return m.getClaims(ctx, tenantID, uid)
+}
+
+// MergeUserClaims adds the claims to the user's custom claims, replacing claims
+// with the same names, and returns the updated claims
+func (m *ClaimsManager) MergeUserClaims(ctx context.Context, uid string, claims map[string]interface{}) (map[string]interface{}, error) {
+	return m.updateClaims(ctx, uid, func(current map[string]interface{}) {
+		for name, value := range claims {
+			current[name] = value
+		}
+	})
+}
+
+// RemoveUserClaims deletes the named claims from the user's custom claims and
+// returns the updated claims
+func (m *ClaimsManager) RemoveUserClaims(ctx context.Context, uid string, names ...string) (map[string]interface{}, error) {
+	return m.updateClaims(ctx, uid, func(current map[string]interface{}) {
+		for _, name := range names {
+			delete(current, name)
+		}
+	})
+}
+
+func (m *ClaimsManager) updateClaims(
+	ctx context.Context,
+	uid string,
+	change func(current map[string]interface{}),
+) (map[string]interface{}, error) {
+	tenantID, _ := GetTenantIDFromContext(ctx)
+	return m.updateTenantClaims(ctx, tenantID, uid, change)
+}
+
+// updateTenantClaims applies the change to the current claims and reads them back.
+// When someone else wrote in between, the change is applied again to their
+// claims. The refresh marker is written once the claims are.
+func (m *ClaimsManager) updateTenantClaims(
+	ctx context.Context,
+	tenantID string,
+	uid string,
+	change func(current map[string]interface{}),
+) (map[string]interface{}, error) {
+	setClaims := m.SetClaims
+	if setClaims == nil {
+		setClaims = setFirebaseCustomClaims
+	}
+	attempts := m.Attempts
+	if attempts <= 0 {
+		attempts = defaultClaimsUpdateAttempts
+	}
+	unlock, err := lockClaims(ctx, tenantID, uid, m.Lease)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	current, err := m.getClaims(ctx, tenantID, uid)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; attempt < attempts; attempt++ {
+		updated := copyClaims(current)
+		change(updated)
+		if err := ValidateCustomClaims(updated); err != nil {
+			return nil, err
+		}
+		if err := setClaims(ctx, tenantID, uid, updated); err != nil {
+			return nil, fmt.Errorf("unable to set the custom claims of %s: %w", uid, err)
+		}
+
+		latest, err := m.getClaims(ctx, tenantID, uid)
+		if err != nil {
+			return nil, err
+		}
+		if sameClaims(updated, latest) {
+			if err := m.markRefresh(ctx, tenantID, uid); err != nil {
+				return nil, err
+			}
+			return updated, nil
+		}
+		current = latest
+	}
+	return nil, fmt.Errorf("unable to update the custom claims of %s: %w", uid, ErrClaimsConflict)
+}
+
+func (m *ClaimsManager) markRefresh(ctx context.Context, tenantID string, uid string) error {
+	if m.RefreshMarker == "" {
+		return nil
+	}
+	markRefresh := m.MarkRefresh
+	if markRefresh == nil {
+		markRefresh = markFirestoreClaimsRefresh
+	}
+	if err := markRefresh(ctx, tenantID, uid, m.RefreshMarker, time.Now()); err != nil {
+		return fmt.Errorf("the custom claims of %s were updated but the refresh marker wasn't: %w", uid, err)
+	}
+	return nil
+}
+
+func copyClaims(claims map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(claims))
+	for name, value := range claims {
+		copied[name] = value
+	}
+	return copied
+}
+
+// sameClaims compares claims by their JSON form, since decoded numbers and
+// numbers set in Go have different types
+func sameClaims(a map[string]interface{}, b map[string]interface{}) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	if aErr != nil || bErr != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	return string(aJSON) == string(bJSON)
+}
+
+// mergeFirebaseCustomClaims adds the claims to the custom claims of the tenant's user
+func mergeFirebaseCustomClaims(ctx context.Context, tenantID string, uid string, claims map[string]interface{}) error {
+	_, err := (&ClaimsManager{}).updateTenantClaims(ctx, tenantID, uid, func(current map[string]interface{}) {
+		for name, value := range claims {
+			current[name] = value
+		}
+	})
+	return err
+}
+
+// GetUserClaims returns the custom claims of the user in the project or the context's tenant
+func GetUserClaims(ctx context.Context, uid string) (map[string]interface{}, error) {
+	return (&ClaimsManager{}).GetUserClaims(ctx, uid)
+}
+
+// MergeUserClaims adds the claims to the custom claims of the user in the project
+// or the context's tenant
+func MergeUserClaims(ctx context.Context, uid string, claims map[string]interface{}) (map[string]interface{}, error) {
+	return (&ClaimsManager{}).MergeUserClaims(ctx, uid, claims)
+}
+
+// RemoveUserClaims deletes the named claims from the custom claims of the user in
+// the project or the context's tenant
+func RemoveUserClaims(ctx context.Context, uid string, names ...string) (map[string]interface{}, error) {
+	return (&ClaimsManager{}).RemoveUserClaims(ctx, uid, names...)
+}
@@ -0,0 +1,164 @@
+package firebasetools_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+// claimsStore keeps claims in memory. afterSet runs after every write, to
+// simulate concurrent writers.
+type claimsStore struct {
+	claims   map[string]interface{}
+	writes   int
+	leases   int
+	afterSet func(s *claimsStore)
+}
+
+func (s *claimsStore) manager() *firebasetools.ClaimsManager {
+	return &firebasetools.ClaimsManager{
+		Lease: func(ctx context.Context, tenantID string, uid string) (func(), error) {
+			s.leases++
+			return func() { s.leases-- }, nil
+		},
+		GetClaims: func(ctx context.Context, tenantID string, uid string) (map[string]interface{}, error) {
+			copied := map[string]interface{}{}
+			for k, v := range s.claims {
+				copied[k] = v
+			}
+			return copied, nil
+		},
+		SetClaims: func(ctx context.Context, tenantID string, uid string, claims map[string]interface{}) error {
+			s.writes++
+			s.claims = claims
+			if s.afterSet != nil {
+				s.afterSet(s)
+			}
+			return nil
+		},
+	}
+}
+
+func TestValidateCustomClaims(t *testing.T) {
+	assert.Nil(t, firebasetools.ValidateCustomClaims(map[string]interface{}{"role": "nurse"}))
+
+	err := firebasetools.ValidateCustomClaims(map[string]interface{}{"sub": "x", "aud": "y", "role": "nurse"})
+	assert.EqualError(t, err, "reserved claim names can't be used: aud, sub")
+
+	err = firebasetools.ValidateCustomClaims(map[string]interface{}{"blob": strings.Repeat("x", 1000)})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "more than the 1000 bytes allowed")
+}
+
+func TestClaimsManager(t *testing.T) {
+	ctx := context.Background()
+	store := &claimsStore{claims: map[string]interface{}{"role": "nurse", "facility": "f1"}}
+	manager := store.manager()
+
+	claims, err := manager.MergeUserClaims(ctx, "uid", map[string]interface{}{"admin": true, "facility": "f2"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"role": "nurse", "facility": "f2", "admin": true}, claims)
+
+	claims, err = manager.RemoveUserClaims(ctx, "uid", "admin", "missing")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"role": "nurse", "facility": "f2"}, claims)
+
+	claims, err = manager.GetUserClaims(ctx, "uid")
+	assert.Nil(t, err)
+	assert.Equal(t, store.claims, claims)
+
+	_, err = manager.MergeUserClaims(ctx, "uid", map[string]interface{}{"iss": "me"})
+	assert.NotNil(t, err)
+	_, err = manager.MergeUserClaims(ctx, "uid", map[string]interface{}{"blob": strings.Repeat("x", 1000)})
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, store.writes, "invalid claims are not written")
+
+	marked := map[string]time.Time{}
+	manager.RefreshMarker = "claimsUpdatedAt"
+	manager.MarkRefresh = func(ctx context.Context, tenantID string, uid string, field string, updatedAt time.Time) error {
+		marked[uid+"/"+field] = updatedAt
+		return nil
+	}
+	claims, err = manager.MergeUserClaims(ctx, "uid", map[string]interface{}{"admin": true})
+	assert.Nil(t, err)
+	assert.NotContains(t, claims, "claimsUpdatedAt", "the marker is not a claim")
+	assert.NotZero(t, marked["uid/claimsUpdatedAt"])
+
+	manager.MarkRefresh = func(ctx context.Context, tenantID string, uid string, field string, updatedAt time.Time) error {
+		return errors.New("firestore is down")
+	}
+	_, err = manager.MergeUserClaims(ctx, "uid", map[string]interface{}{"admin": false})
+	assert.NotNil(t, err)
+	assert.Equal(t, false, store.claims["admin"], "the claims are still updated")
+}
+
+func TestClaimsManager_ConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+
+	// another writer replaces the claims right after the first write, dropping ours
+	store := &claimsStore{claims: map[string]interface{}{"role": "nurse"}}
+	store.afterSet = func(s *claimsStore) {
+		if s.writes == 1 {
+			s.claims = map[string]interface{}{"role": "nurse", "facility": "f1"}
+		}
+	}
+	claims, err := store.manager().MergeUserClaims(ctx, "uid", map[string]interface{}{"admin": true})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, store.writes)
+	assert.Equal(t, map[string]interface{}{"role": "nurse", "facility": "f1", "admin": true}, claims)
+	assert.Equal(t, claims, store.claims, "neither update is lost")
+
+	// claims that never settle are reported as a conflict
+	store = &claimsStore{claims: map[string]interface{}{}}
+	store.afterSet = func(s *claimsStore) {
+		s.claims = map[string]interface{}{"writer": fmt.Sprint(s.writes)}
+	}
+	_, err = store.manager().MergeUserClaims(ctx, "uid", map[string]interface{}{"admin": true})
+	assert.True(t, errors.Is(err, firebasetools.ErrClaimsConflict))
+	assert.Equal(t, 3, store.writes)
+}
+
+func TestClaimsManager_Lease(t *testing.T) {
+	ctx := context.Background()
+	store := &claimsStore{claims: map[string]interface{}{}}
+	store.afterSet = func(s *claimsStore) {
+		assert.Equal(t, 1, s.leases, "claims are written under the lease")
+	}
+	_, err := store.manager().MergeUserClaims(ctx, "uid", map[string]interface{}{"admin": true})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, store.leases, "the lease ends with the update")
+
+	manager := store.manager()
+	manager.Lease = func(ctx context.Context, tenantID string, uid string) (func(), error) {
+		return nil, firebasetools.ErrClaimsConflict
+	}
+	_, err = manager.MergeUserClaims(ctx, "uid", map[string]interface{}{"admin": false})
+	assert.True(t, errors.Is(err, firebasetools.ErrClaimsConflict))
+	assert.Equal(t, 1, store.writes, "claims are not written without the lease")
+}
+
+func TestClaimsManager_ParallelUpdates(t *testing.T) {
+	ctx := context.Background()
+	store := &claimsStore{claims: map[string]interface{}{}}
+
+	// the updates of a user are serialized, even across managers
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := store.manager().MergeUserClaims(ctx, "uid", map[string]interface{}{fmt.Sprint("claim", i): true})
+			assert.Nil(t, err)
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, store.claims, 10)
+	assert.Equal(t, 10, store.writes)
+}
@@ -9,6 +9,15 @@ const (
 	// FirebaseCustomTokenSigninURL is the Google Identity Toolkit API for signing in over REST
 	FirebaseCustomTokenSigninURL = "https://identitytoolkit.googleapis.com/v1/accounts:signInWithCustomToken?key="
 
+	// FirebasePasswordSigninURL is the Google Identity Toolkit API for signing in with an email and password
+	FirebasePasswordSigninURL = "https://identitytoolkit.googleapis.com/v1/accounts:signInWithPassword?key="
+
+	// FirebaseIdPSigninURL is the Google Identity Toolkit API for signing in with a federated identity provider
+	FirebaseIdPSigninURL = "https://identitytoolkit.googleapis.com/v1/accounts:signInWithIdp?key="
+
+	// FirebaseSendOobCodeURL is the Google Identity Toolkit API for sending email verification and password reset emails
+	FirebaseSendOobCodeURL = "https://identitytoolkit.googleapis.com/v1/accounts:sendOobCode?key="
+
 	// FirebaseRefreshTokenURL is used to request Firebase refresh tokens from Google APIs
 	FirebaseRefreshTokenURL = "https://securetoken.googleapis.com/v1/token?key="
 
@@ -23,6 +23,7 @@ import (
 type FirebaseTokenExchangePayload struct {
 	Token             string `json:"token"`
 	ReturnSecureToken bool   `json:"returnSecureToken"`
+	TenantID          string `json:"tenantId,omitempty"`
 }
 
 // FirebaseUserTokens is the unmarshalling target for the JSON response received from the Firebase Auth REST API
@@ -69,15 +70,20 @@ func (fc *FirebaseClient) InitFirebase() (IFirebaseApp, error) {
 // If successful, a pointer to the ID token is returned
 // Otherwise, an error is returned
 func AuthenticateCustomFirebaseToken(customAuthToken string) (*FirebaseUserTokens, error) {
+	return exchangeCustomFirebaseToken(FirebaseTokenExchangePayload{
+		Token:             customAuthToken,
+		ReturnSecureToken: true,
+	})
+}
+
+// exchangeCustomFirebaseToken sends the supplied payload to the Firebase Auth REST API
+// and returns the resulting ID and refresh tokens
+func exchangeCustomFirebaseToken(payload FirebaseTokenExchangePayload) (*FirebaseUserTokens, error) {
 	apiKey, apiKeyErr := serverutils.GetEnvVar(FirebaseWebAPIKeyEnvVarName)
 	if apiKeyErr != nil {
 		return nil, apiKeyErr
 	}
 
-	payload := FirebaseTokenExchangePayload{
-		Token:             customAuthToken,
-		ReturnSecureToken: true,
-	}
 	payloadBytes, _ := json.Marshal(payload) // err intentionally ignored, static typing makes it very hard to get this error
 
 	url := FirebaseCustomTokenSigninURL + apiKey
@@ -124,10 +130,45 @@ func GetOrCreateFirebaseUser(ctx context.Context, email string) (*auth.UserRecor
 	if err != nil {
 		return nil, fmt.Errorf("unable to get or create Firebase client: %w", err)
 	}
+	return getOrCreateUserByEmail(ctx, authClient, email, nil)
+}
+
+// GetOrCreateFirebaseUserWithPolicy retrieves the user record of the user with the
+// given email or, if the signup policy allows it, creates a new one
+func GetOrCreateFirebaseUserWithPolicy(ctx context.Context, email string, policy *SignupPolicy) (*auth.UserRecord, error) {
+	authClient, err := GetFirebaseAuthClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get or create Firebase client: %w", err)
+	}
+	return getOrCreateUserByEmail(ctx, authClient, email, policy)
+}
+
+// firebaseUserManager is the subset of user management methods that are shared by
+// project level (*auth.Client) and tenant level (*auth.TenantClient) clients
+type firebaseUserManager interface {
+	GetUserByEmail(ctx context.Context, email string) (*auth.UserRecord, error)
+	CreateUser(ctx context.Context, user *auth.UserToCreate) (*auth.UserRecord, error)
+}
+
+func getOrCreateUserByEmail(
+	ctx context.Context,
+	authClient firebaseUserManager,
+	email string,
+	policy *SignupPolicy,
+) (*auth.UserRecord, error) {
 	existingUser, userErr := authClient.GetUserByEmail(ctx, email)
 	if userErr == nil {
 		return existingUser, nil
 	}
+	if policy != nil {
+		if !auth.IsUserNotFound(userErr) {
+			return nil, userErr
+		}
+		tenantID, _ := GetTenantIDFromContext(ctx)
+		if err := policy.Check(ctx, &SignupCandidate{Email: email, TenantID: tenantID}); err != nil {
+			return nil, err
+		}
+	}
 
 	// try creating, assume the user could not be found
 	params := (&auth.UserToCreate{}).
@@ -226,31 +267,18 @@ func GetUserTokenFromContext(ctx context.Context) (*auth.Token, error) {
 	return token, nil
 }
 
-// CheckIsAnonymousUser determines if the logged in user is an anonymous user
+// CheckIsAnonymousUser determines if the logged in user is an anonymous user,
+// from the token alone: anonymous sessions have the anonymous sign in provider,
+// and sessions that started from custom tokens carry the AnonymousUserClaim of
+// accounts that were created anonymous. The user's record is no longer looked
+// up, so custom token sessions of accounts created before the claim existed are
+// not anonymous until the accounts are marked and the tokens refreshed.
 func CheckIsAnonymousUser(ctx context.Context) (bool, error) {
 	authToken, err := GetUserTokenFromContext(ctx)
 	if err != nil {
 		return false, fmt.Errorf("user auth token not found in context: %w", err)
 	}
-
-	authClient, err := GetFirebaseAuthClient(ctx)
-	if err != nil {
-		return false, fmt.Errorf("unable to get or create Firebase client: %w", err)
-	}
-
-	user, err := authClient.GetUser(ctx, authToken.UID)
-	if err != nil {
-		return false, fmt.Errorf("unable to get user: %w", err)
-	}
-
-	// The firebase SDK doesn't provide an isAnonymous field in a user account
-	// We're making assumptions that the other fields will be null/empty making a user anonymous
-	// i.e no email,phoneNumber only a uid
-	if user.Email != "" || user.PhoneNumber != "" {
-		return false, nil
-	}
-
-	return true, nil
+	return isAnonymousToken(authToken), nil
 }
 
 // GetLoggedInUserUID retrieves the logged in user's Firebase UID from the
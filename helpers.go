@@ -24,22 +24,12 @@ func CloseRespBody(resp *http.Response) {
 // (.and to shut up golint).
 type ContextKey string
 
-// GetLoggedInUser retrieves logged in user information
+// GetLoggedInUser retrieves logged in user information.
+// The user record is served from the request scoped loader when one is installed.
 func GetLoggedInUser(ctx context.Context) (*UserInfo, error) {
-	authToken, err := GetUserTokenFromContext(ctx)
+	user, err := getLoggedInUserRecord(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("user auth token not found in context: %w", err)
-	}
-
-	authClient, err := GetFirebaseAuthClient(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("unable to get or create Firebase client: %w", err)
-	}
-
-	user, err := authClient.GetUser(ctx, authToken.UID)
-	if err != nil {
-
-		return nil, fmt.Errorf("unable to get user: %w", err)
+		return nil, err
 	}
 	return &UserInfo{
 		UID:         user.UID,
@@ -0,0 +1,155 @@
+package firebasetools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// IdPSignInInput is an OAuth credential, issued by a federated identity provider
+// e.g `google.com` or `microsoft.com`, to exchange for Firebase tokens
+type IdPSignInInput struct {
+	ProviderID  string
+	IDToken     string
+	AccessToken string
+
+	// RequestURI is the URI that the IdP redirected to. It defaults to `http://localhost`.
+	RequestURI string
+
+	TenantID string
+}
+
+// IdPSignInResult is a successful federated sign in
+type IdPSignInResult struct {
+	UID           string
+	Email         string
+	EmailVerified bool
+	DisplayName   string
+	PhotoURL      string
+	ProviderID    string
+	FederatedID   string
+	IsNewUser     bool
+	Tokens        *FirebaseUserTokens
+}
+
+// AccountExistsWithDifferentCredentialError is returned when the IdP account's email
+// address belongs to an existing user who signs in some other way. The user has to
+// sign in with one of their existing providers then link the new one.
+type AccountExistsWithDifferentCredentialError struct {
+	Email      string
+	ProviderID string
+
+	// ExistingProviders are the providers that the existing user can sign in with, when known
+	ExistingProviders []string
+}
+
+func (e *AccountExistsWithDifferentCredentialError) Error() string {
+	email := e.Email
+	if email == "" {
+		email = "this email address"
+	}
+	message := fmt.Sprintf(
+		"an account with %s already exists and signs in differently than with %s", email, e.ProviderID)
+	if len(e.ExistingProviders) > 0 {
+		message += ", sign in with " + strings.Join(e.ExistingProviders, " or ") + " then link this provider"
+	}
+	return message
+}
+
+// identityToolkitIdPResponse is the signInWithIdp response. When an IdP credential is
+// requested, conflicts are reported in errorMessage with a 200 status.
+type identityToolkitIdPResponse struct {
+	identityToolkitSignInResponse
+	EmailVerified    bool     `json:"emailVerified"`
+	DisplayName      string   `json:"displayName"`
+	PhotoURL         string   `json:"photoUrl"`
+	ProviderID       string   `json:"providerId"`
+	FederatedID      string   `json:"federatedId"`
+	IsNewUser        bool     `json:"isNewUser"`
+	NeedConfirmation bool     `json:"needConfirmation"`
+	VerifiedProvider []string `json:"verifiedProvider"`
+	ErrorMessage     string   `json:"errorMessage"`
+}
+
+// SignInWithIdp exchanges an OAuth ID token or access token for Firebase ID and refresh tokens
+func SignInWithIdp(ctx context.Context, input *IdPSignInInput) (*IdPSignInResult, error) {
+	return signInWithIdp(ctx, FirebaseIdPSigninURL, input)
+}
+
+func signInWithIdp(ctx context.Context, endpoint string, input *IdPSignInInput) (*IdPSignInResult, error) {
+	if input == nil || input.ProviderID == "" || (input.IDToken == "" && input.AccessToken == "") {
+		return nil, NewLoginError(
+			http.StatusBadRequest, "invalid credentials, expected a provider ID AND an ID or access token", nil)
+	}
+	requestURI := input.RequestURI
+	if requestURI == "" {
+		requestURI = "http://localhost"
+	}
+	postBody := url.Values{"providerId": {input.ProviderID}}
+	if input.IDToken != "" {
+		postBody.Set("id_token", input.IDToken)
+	}
+	if input.AccessToken != "" {
+		postBody.Set("access_token", input.AccessToken)
+	}
+	payload := map[string]interface{}{
+		"postBody":            postBody.Encode(),
+		"requestUri":          requestURI,
+		"returnSecureToken":   true,
+		"returnIdpCredential": true,
+	}
+	if input.TenantID != "" {
+		payload["tenantId"] = input.TenantID
+	}
+
+	resp := &identityToolkitIdPResponse{}
+	if err := postIdentityToolkit(ctx, endpoint, payload, resp); err != nil {
+		apiErr := &IdentityToolkitError{}
+		if errors.As(err, &apiErr) && apiErr.Code == "EMAIL_EXISTS" {
+			return nil, accountExistsLoginError(&AccountExistsWithDifferentCredentialError{
+				ProviderID: input.ProviderID,
+			})
+		}
+		return nil, loginErrorFromIdentityToolkit(err)
+	}
+
+	providerID := firstNonEmpty(resp.ProviderID, input.ProviderID)
+	switch {
+	case resp.NeedConfirmation || resp.ErrorMessage == "EMAIL_EXISTS":
+		return nil, accountExistsLoginError(&AccountExistsWithDifferentCredentialError{
+			Email:             resp.Email,
+			ProviderID:        providerID,
+			ExistingProviders: resp.VerifiedProvider,
+		})
+	case resp.ErrorMessage == "FEDERATED_USER_ID_ALREADY_LINKED":
+		return nil, NewLoginError(
+			http.StatusConflict,
+			fmt.Sprintf("this %s account is already linked to another user", providerID),
+			fmt.Errorf("%s", resp.ErrorMessage),
+		)
+	case resp.ErrorMessage != "":
+		return nil, fmt.Errorf("unable to sign in with %s: %s", providerID, resp.ErrorMessage)
+	case resp.IDToken == "":
+		return nil, fmt.Errorf("unable to sign in with %s: no ID token was returned", providerID)
+	}
+
+	return &IdPSignInResult{
+		UID:           resp.LocalID,
+		Email:         resp.Email,
+		EmailVerified: resp.EmailVerified,
+		DisplayName:   resp.DisplayName,
+		PhotoURL:      resp.PhotoURL,
+		ProviderID:    providerID,
+		FederatedID:   resp.FederatedID,
+		IsNewUser:     resp.IsNewUser,
+		Tokens:        resp.tokens(),
+	}, nil
+}
+
+// accountExistsLoginError reports account conflicts with a 409 status
+func accountExistsLoginError(err *AccountExistsWithDifferentCredentialError) error {
+	return NewLoginError(http.StatusConflict, err.Error(), err)
+}
@@ -0,0 +1,117 @@
+package firebasetools_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdPLoginProvider_LoginHandler(t *testing.T) {
+	endpoint := newTestIdentityToolkit(t, func(payload map[string]interface{}) (int, interface{}) {
+		assert.Equal(t, true, payload["returnIdpCredential"])
+		switch payload["postBody"] {
+		case "id_token=workspace-token&providerId=google.com":
+			return http.StatusOK, map[string]interface{}{
+				"localId":      "staff-uid",
+				"email":        "staff@example.com",
+				"providerId":   "google.com",
+				"idToken":      "id-token",
+				"refreshToken": "refresh-token",
+				"expiresIn":    "3600",
+			}
+		case "access_token=microsoft-token&providerId=microsoft.com":
+			return http.StatusOK, map[string]interface{}{
+				"email":            "staff@example.com",
+				"providerId":       "microsoft.com",
+				"needConfirmation": true,
+				"verifiedProvider": []string{"google.com"},
+			}
+		case "id_token=linked-token&providerId=google.com":
+			return http.StatusOK, map[string]interface{}{
+				"providerId":   "google.com",
+				"errorMessage": "FEDERATED_USER_ID_ALREADY_LINKED",
+			}
+		case "id_token=existing-token&providerId=google.com":
+			return identityToolkitError("EMAIL_EXISTS")
+		default:
+			return identityToolkitError("INVALID_IDP_RESPONSE : invalid token")
+		}
+	})
+	login := firebasetools.NewLoginHandler([]firebasetools.LoginProvider{&firebasetools.IdPLoginProvider{
+		Endpoint:           endpoint,
+		AllowedProviderIDs: []string{"google.com", "microsoft.com"},
+		GetUser:            stubGetUser,
+	}})
+
+	tests := []struct {
+		name        string
+		body        map[string]string
+		wantStatus  int
+		wantMessage string
+	}{
+		{
+			name:       "google workspace",
+			body:       map[string]string{"providerId": "google.com", "idToken": "workspace-token"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:        "account exists with a different credential",
+			body:        map[string]string{"providerId": "microsoft.com", "accessToken": "microsoft-token"},
+			wantStatus:  http.StatusConflict,
+			wantMessage: "an account with staff@example.com already exists and signs in differently than with microsoft.com, sign in with google.com then link this provider",
+		},
+		{
+			name:       "email exists",
+			body:       map[string]string{"providerId": "google.com", "idToken": "existing-token"},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:        "federated account linked to another user",
+			body:        map[string]string{"providerId": "google.com", "idToken": "linked-token"},
+			wantStatus:  http.StatusConflict,
+			wantMessage: "this google.com account is already linked to another user",
+		},
+		{
+			name:       "invalid token",
+			body:       map[string]string{"providerId": "google.com", "idToken": "forged"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "provider not allowed",
+			body:       map[string]string{"providerId": "facebook.com", "accessToken": "facebook-token"},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.body["provider"] = firebasetools.LoginProviderIdP
+			rw := httptest.NewRecorder()
+			login(rw, loginRequest(t, tt.body))
+			assert.Equal(t, tt.wantStatus, rw.Code)
+
+			if tt.wantStatus == http.StatusOK {
+				resp := firebasetools.LoginResponse{}
+				assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &resp))
+				assert.Equal(t, "staff-uid", resp.UID)
+				assert.Equal(t, "id-token", resp.IDToken)
+			}
+			if tt.wantMessage != "" {
+				assert.Contains(t, rw.Body.String(), tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestAccountExistsWithDifferentCredentialError(t *testing.T) {
+	var err error = firebasetools.NewLoginError(http.StatusConflict, "conflict", &firebasetools.AccountExistsWithDifferentCredentialError{
+		ProviderID: "google.com",
+	})
+	conflict := &firebasetools.AccountExistsWithDifferentCredentialError{}
+	assert.True(t, errors.As(err, &conflict))
+	assert.Equal(t, "an account with this email address already exists and signs in differently than with google.com", conflict.Error())
+}
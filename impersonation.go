@@ -0,0 +1,250 @@
+package firebasetools
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"firebase.google.com/go/auth"
+)
+
+const (
+	// ImpersonationHeaderName is the default request header that names the UID to act as
+	ImpersonationHeaderName = "X-Act-As"
+
+	// DefaultImpersonationClaim is the custom claim that allows a principal to act as other users
+	DefaultImpersonationClaim = "admin"
+
+	// ActorContextKey is used to add/retrieve the real (impersonating) *Principal on the context
+	ActorContextKey = ContextKey("Actor")
+
+	// ImpersonationAuditTypeName is the audit log type name for impersonated requests
+	ImpersonationAuditTypeName = "impersonation"
+
+	// ImpersonationAuditOperation is the audit log operation for impersonated requests
+	ImpersonationAuditOperation = "act_as"
+)
+
+// ImpersonationConfig configures the impersonation middleware
+type ImpersonationConfig struct {
+	// Header names the UID to act as. It defaults to `X-Act-As`.
+	Header string
+
+	// Claim must be `true` on the actor's token. It defaults to `admin`.
+	Claim string
+
+	// Recorder receives an audit log entry for every impersonated request.
+	// It is required; requests are rejected if they cannot be recorded.
+	Recorder AuditLogRecorder
+
+	// GetUser looks up the target user. It defaults to a Firebase Auth lookup.
+	GetUser func(ctx context.Context, uid string) (*auth.UserRecord, error)
+
+	// ProtectedClaims are claims that make their holders impossible to act as, so
+	// that impersonation can't be used to gain privileges. The impersonation claim
+	// and `admin` are always protected.
+	ProtectedClaims []string
+}
+
+// impersonationAuditSnapshot is the JSON snapshot saved with impersonation audit logs
+type impersonationAuditSnapshot struct {
+	ActorUID  string `json:"actorUID"`
+	TargetUID string `json:"targetUID"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	RemoteIP  string `json:"remoteIP"`
+	UserAgent string `json:"userAgent"`
+}
+
+func getFirebaseUser(ctx context.Context, uid string) (*auth.UserRecord, error) {
+	authClient, err := GetFirebaseAuthClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get or create Firebase client: %w", err)
+	}
+	return authClient.GetUser(ctx, uid)
+}
+
+// ImpersonationMiddleware lets a principal that holds the impersonation claim act
+// as another user by sending that user's UID in the impersonation header.
+// It should run after AuthenticationMiddleware.
+//
+// The target user's principal replaces the actor's on the context, and the auth
+// token is replaced by a copy that carries the target's UID and custom claims with
+// an `act` claim naming the actor (as in RFC 8693). The actor stays available
+// through ActorFromContext. Every impersonated request is audited.
+func ImpersonationMiddleware(config ImpersonationConfig, opts ...AuthenticationOption) func(http.Handler) http.Handler {
+	authConfig := newAuthenticationConfig(opts...)
+	header := config.Header
+	if header == "" {
+		header = ImpersonationHeaderName
+	}
+	claim := config.Claim
+	if claim == "" {
+		claim = DefaultImpersonationClaim
+	}
+	getUser := config.GetUser
+	if getUser == nil {
+		getUser = getFirebaseUser
+	}
+	protectedClaims := []string{claim}
+	for _, name := range append([]string{DefaultImpersonationClaim}, config.ProtectedClaims...) {
+		if !containsString(protectedClaims, name) {
+			protectedClaims = append(protectedClaims, name)
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				targetUID := strings.TrimSpace(r.Header.Get(header))
+				if targetUID == "" {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				actor, err := PrincipalFromContext(r.Context())
+				if err != nil {
+					authConfig.errorRenderer(w, r, NewAuthError("", err.Error()))
+					return
+				}
+				if isAdmin, _ := actor.BoolClaim(claim); !isAdmin {
+					authConfig.errorRenderer(w, r, NewInsufficientScopeError(
+						claim,
+						fmt.Sprintf("the `%s` claim is required to act as another user", claim),
+					))
+					return
+				}
+				if config.Recorder == nil {
+					log.Printf("impersonation rejected: no audit log recorder is configured")
+					authConfig.errorRenderer(w, r, NewAuthError(
+						AuthErrorInvalidRequest, "impersonation is not available"))
+					return
+				}
+
+				targetUser, err := getUser(r.Context(), targetUID)
+				if err != nil {
+					authConfig.errorRenderer(w, r, NewAuthError(
+						AuthErrorInvalidRequest,
+						fmt.Sprintf("unable to act as user %s: %s", targetUID, err),
+					))
+					return
+				}
+				if targetUser.Disabled {
+					authConfig.errorRenderer(w, r, NewAuthError(
+						AuthErrorInvalidRequest, fmt.Sprintf("unable to act as user %s: the account is disabled", targetUID)))
+					return
+				}
+				target, err := NewPrincipalFromUserRecord(targetUser)
+				if err != nil {
+					authConfig.errorRenderer(w, r, NewAuthError(AuthErrorInvalidRequest, err.Error()))
+					return
+				}
+				for _, name := range protectedClaims {
+					if enabled, isBool := target.BoolClaim(name); target.HasClaim(name) && (!isBool || enabled) {
+						authConfig.errorRenderer(w, r, NewInsufficientScopeError(
+							name,
+							fmt.Sprintf("users that hold the `%s` claim can't be acted as", name),
+						))
+						return
+					}
+				}
+
+				token := impersonatedToken(r.Context(), target, actor)
+				revoked, err := authConfig.isSessionRevoked(r.Context(), token)
+				if err != nil {
+					log.Printf("unable to check the impersonation of %s by %s: %s", target.UID, actor.UID, err)
+					writeInternalProblem(w, r, "unable to check the session")
+					return
+				}
+				if revoked {
+					authConfig.errorRenderer(w, r, NewAuthError(
+						AuthErrorInvalidToken, "the impersonation session has been signed out"))
+					return
+				}
+
+				entry, err := NewAuditLog(
+					ImpersonationAuditTypeName,
+					target.UID,
+					ImpersonationAuditOperation,
+					actor.UID,
+					impersonationAuditSnapshot{
+						ActorUID:  actor.UID,
+						TargetUID: target.UID,
+						Method:    r.Method,
+						Path:      r.URL.Path,
+						RemoteIP:  clientIP(r, false),
+						UserAgent: r.UserAgent(),
+					},
+				)
+				if err == nil {
+					err = config.Recorder.RecordAuditLog(r.Context(), entry)
+				}
+				if err != nil {
+					log.Printf("unable to audit impersonation of %s by %s: %s", target.UID, actor.UID, err)
+					writeInternalProblem(w, r, "unable to audit the impersonated request")
+					return
+				}
+
+				ctx := context.WithValue(r.Context(), ActorContextKey, actor)
+				ctx = WithPrincipal(ctx, target)
+				ctx = context.WithValue(ctx, AuthTokenContextKey, token)
+				next.ServeHTTP(w, r.WithContext(ctx))
+			},
+		)
+	}
+}
+
+// impersonatedToken derives the token that legacy helpers (e.g GetLoggedInUserUID)
+// read during an impersonated request. Its identity comes from the target's record
+// alone; only the session's timing (issuer, audience, issue, auth and expiry times)
+// is carried over from the actor's token.
+func impersonatedToken(ctx context.Context, target *Principal, actor *Principal) *auth.Token {
+	token := &auth.Token{}
+	if actorToken, err := GetUserTokenFromContext(ctx); err == nil {
+		token.AuthTime = actorToken.AuthTime
+		token.Issuer = actorToken.Issuer
+		token.Audience = actorToken.Audience
+		token.Expires = actorToken.Expires
+		token.IssuedAt = actorToken.IssuedAt
+	}
+	claims := map[string]interface{}{}
+	for k, v := range target.Claims {
+		claims[k] = v
+	}
+	if target.Email != "" {
+		claims["email"] = target.Email
+		claims["email_verified"] = target.EmailVerified
+	}
+	if target.PhoneNumber != "" {
+		claims["phone_number"] = target.PhoneNumber
+	}
+	claims["act"] = map[string]interface{}{"sub": actor.UID}
+	token.UID = target.UID
+	token.Subject = target.UID
+	token.Claims = claims
+	token.Firebase.Tenant = target.TenantID
+	return token
+}
+
+// ActorFromContext retrieves the principal that is acting as another user, if the
+// request is impersonated
+func ActorFromContext(ctx context.Context) (*Principal, error) {
+	val := ctx.Value(ActorContextKey)
+	if val == nil {
+		return nil, fmt.Errorf("unable to get actor from context with key %#v", ActorContextKey)
+	}
+
+	actor, ok := val.(*Principal)
+	if !ok || actor == nil {
+		return nil, fmt.Errorf("wrong actor type, got %#v, expected a *Principal", val)
+	}
+	return actor, nil
+}
+
+// IsImpersonated reports whether the request behind the context is impersonated
+func IsImpersonated(ctx context.Context) bool {
+	_, err := ActorFromContext(ctx)
+	return err == nil
+}
@@ -0,0 +1,187 @@
+package firebasetools_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImpersonationMiddleware(t *testing.T) {
+	patient := &auth.UserRecord{
+		UserInfo: &auth.UserInfo{
+			UID:         "patient-uid",
+			PhoneNumber: "+254700000000",
+			ProviderID:  "firebase",
+		},
+		CustomClaims: map[string]interface{}{"role": "patient"},
+	}
+	otherAdmin := &auth.UserRecord{
+		UserInfo:     &auth.UserInfo{UID: "other-admin-uid", ProviderID: "firebase"},
+		CustomClaims: map[string]interface{}{"admin": true},
+	}
+	superuser := &auth.UserRecord{
+		UserInfo:     &auth.UserInfo{UID: "superuser-uid", ProviderID: "firebase"},
+		CustomClaims: map[string]interface{}{"superuser": "yes"},
+	}
+	disabled := &auth.UserRecord{
+		UserInfo:     &auth.UserInfo{UID: "disabled-uid", ProviderID: "firebase"},
+		CustomClaims: map[string]interface{}{"role": "patient"},
+		Disabled:     true,
+	}
+	getUser := func(ctx context.Context, uid string) (*auth.UserRecord, error) {
+		for _, user := range []*auth.UserRecord{patient, otherAdmin, superuser, disabled} {
+			if uid == user.UID {
+				return user, nil
+			}
+		}
+		return nil, fmt.Errorf("user %s not found", uid)
+	}
+
+	authenticated := func(r *http.Request, token *auth.Token) *http.Request {
+		ctx := context.WithValue(r.Context(), firebasetools.AuthTokenContextKey, token)
+		return r.WithContext(ctx)
+	}
+	actAs := func(uid string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/graphql", nil)
+		r.Header.Set(firebasetools.ImpersonationHeaderName, uid)
+		return r
+	}
+	admin := &auth.Token{
+		UID:      "admin-uid",
+		Claims:   map[string]interface{}{"admin": true, "email": "admin@example.com"},
+		Firebase: auth.FirebaseInfo{SignInProvider: "password", Identities: map[string]interface{}{"email": []string{"admin@example.com"}}},
+	}
+	clinician := &auth.Token{UID: "clinician-uid", Claims: map[string]interface{}{}}
+
+	tests := []struct {
+		name        string
+		r           *http.Request
+		wantStatus  int
+		wantUID     string
+		wantActor   string
+		wantAudited bool
+	}{
+		{
+			name:       "no impersonation header",
+			r:          authenticated(httptest.NewRequest(http.MethodGet, "/graphql", nil), clinician),
+			wantStatus: http.StatusOK,
+			wantUID:    "clinician-uid",
+		},
+		{
+			name:        "admin acts as patient",
+			r:           authenticated(actAs("patient-uid"), admin),
+			wantStatus:  http.StatusOK,
+			wantUID:     "patient-uid",
+			wantActor:   "admin-uid",
+			wantAudited: true,
+		},
+		{
+			name:       "non admin can't act as patient",
+			r:          authenticated(actAs("patient-uid"), clinician),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "admin can't act as another admin",
+			r:          authenticated(actAs("other-admin-uid"), admin),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "admin can't act as a holder of a protected claim",
+			r:          authenticated(actAs("superuser-uid"), admin),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "admin can't act as a disabled user",
+			r:          authenticated(actAs("disabled-uid"), admin),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown target user",
+			r:          authenticated(actAs("unknown-uid"), admin),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unauthenticated request",
+			r:          actAs("patient-uid"),
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &firebasetools.InMemoryAuditLogRecorder{}
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				uid, err := firebasetools.GetLoggedInUserUID(r.Context())
+				assert.Nil(t, err)
+				assert.Equal(t, tt.wantUID, uid)
+
+				p, err := firebasetools.PrincipalFromContext(r.Context())
+				assert.Nil(t, err)
+				assert.Equal(t, tt.wantUID, p.UID)
+
+				actor, err := firebasetools.ActorFromContext(r.Context())
+				if tt.wantActor == "" {
+					assert.NotNil(t, err)
+					assert.False(t, firebasetools.IsImpersonated(r.Context()))
+					return
+				}
+				assert.Nil(t, err)
+				assert.Equal(t, tt.wantActor, actor.UID)
+				assert.True(t, firebasetools.IsImpersonated(r.Context()))
+
+				// nothing of the actor's identity leaks into the target's token
+				token, err := firebasetools.GetUserTokenFromContext(r.Context())
+				assert.Nil(t, err)
+				assert.Empty(t, token.Firebase.SignInProvider)
+				assert.Empty(t, token.Firebase.Identities)
+				assert.Nil(t, token.Claims["admin"])
+				assert.Nil(t, token.Claims["email"])
+				assert.Equal(t, "+254700000000", token.Claims["phone_number"])
+			})
+			mw := firebasetools.ImpersonationMiddleware(firebasetools.ImpersonationConfig{
+				Recorder:        recorder,
+				GetUser:         getUser,
+				ProtectedClaims: []string{"superuser"},
+			})
+			rw := httptest.NewRecorder()
+			mw(next).ServeHTTP(rw, tt.r)
+			assert.Equal(t, tt.wantStatus, rw.Code)
+
+			entries := recorder.Entries()
+			if !tt.wantAudited {
+				assert.Empty(t, entries)
+				return
+			}
+			assert.Len(t, entries, 1)
+			assert.Equal(t, firebasetools.ImpersonationAuditTypeName, entries[0].TypeName)
+			assert.Equal(t, tt.wantActor, entries[0].UID)
+
+			snapshot := map[string]string{}
+			assert.Nil(t, json.Unmarshal(*entries[0].JSON, &snapshot))
+			assert.Equal(t, tt.wantUID, snapshot["targetUID"])
+			assert.Equal(t, "/graphql", snapshot["path"])
+		})
+	}
+}
+
+func TestImpersonationMiddleware_RequiresRecorder(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unaudited impersonation should not reach the handler")
+	})
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(firebasetools.ImpersonationHeaderName, "patient-uid")
+	r = r.WithContext(firebasetools.WithPrincipal(r.Context(), &firebasetools.Principal{
+		UID:    "admin-uid",
+		Claims: map[string]interface{}{"admin": true},
+	}))
+
+	rw := httptest.NewRecorder()
+	firebasetools.ImpersonationMiddleware(firebasetools.ImpersonationConfig{})(next).ServeHTTP(rw, r)
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+}
@@ -2,6 +2,7 @@ package firebasetools
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -28,70 +29,130 @@ func ValidateLoginCreds(w http.ResponseWriter, r *http.Request) (*LoginCredentia
 // GetFirebaseUser logs in the user with the supplied credentials and returns their
 // Firebase auth user record
 func GetFirebaseUser(ctx context.Context, creds *LoginCredentials) (*auth.UserRecord, error) {
+	return GetFirebaseUserWithPolicy(ctx, creds, nil)
+}
+
+// GetFirebaseUserWithPolicy logs in the user with the supplied credentials and
+// returns their Firebase auth user record. Unknown users are only created when the
+// signup policy allows it; a nil policy lets everyone sign up.
+func GetFirebaseUserWithPolicy(ctx context.Context, creds *LoginCredentials, policy *SignupPolicy) (*auth.UserRecord, error) {
 	if creds == nil {
 		return nil, fmt.Errorf("nil creds, can't get firebase user")
 	}
-	user, err := GetOrCreateFirebaseUser(ctx, creds.Username)
+	user, err := GetOrCreateFirebaseUserWithPolicy(ctx, creds.Username, policy)
 	if err != nil {
 		return nil, err
 	}
 	return user, nil
 }
 
-// GetLoginFunc returns a function that can authenticate against Firebase
-func GetLoginFunc(ctx context.Context, fc IFirebaseClient) http.HandlerFunc {
+// WithPasswordCheck replaces how GetLoginFunc checks passwords, which defaults to
+// signing in to Firebase Auth. The check reports whether the user exists and
+// returns a 401 LoginError for wrong passwords.
+func WithPasswordCheck(check func(ctx context.Context, creds *LoginCredentials) (bool, error)) LoginOption {
+	return func(c *loginConfig) {
+		c.checkPassword = check
+	}
+}
+
+// checkFirebasePassword signs in to Firebase Auth with the credentials. Projects
+// with email enumeration protection don't tell unknown users apart, so they are
+// rejected like wrong passwords.
+func checkFirebasePassword(ctx context.Context, creds *LoginCredentials) (bool, error) {
+	payload := map[string]interface{}{
+		"email":             creds.Username,
+		"password":          creds.Password,
+		"returnSecureToken": false,
+	}
+	err := postIdentityToolkit(ctx, FirebasePasswordSigninURL, payload, &identityToolkitSignInResponse{})
+	apiErr := &IdentityToolkitError{}
+	if errors.As(err, &apiErr) && apiErr.Code == "EMAIL_NOT_FOUND" {
+		return false, nil
+	}
+	if err != nil {
+		return false, loginErrorFromIdentityToolkit(err)
+	}
+	return true, nil
+}
+
+// createFirebasePasswordUser signs up a user with the credentials, when the policy
+// allows it. Accounts that were created since the password was checked are
+// not taken over.
+func createFirebasePasswordUser(ctx context.Context, creds *LoginCredentials, policy *SignupPolicy) (*auth.UserRecord, error) {
+	authClient, err := GetFirebaseAuthClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get or create Firebase client: %w", err)
+	}
+	if policy != nil {
+		if err := policy.Check(ctx, &SignupCandidate{Email: creds.Username}); err != nil {
+			return nil, err
+		}
+	}
+	params := (&auth.UserToCreate{}).
+		Email(creds.Username).
+		Password(creds.Password).
+		EmailVerified(false).
+		Disabled(false)
+	user, err := authClient.CreateUser(ctx, params)
+	if auth.IsEmailAlreadyExists(err) {
+		return nil, NewLoginError(http.StatusUnauthorized, "invalid credentials", err)
+	}
+	return user, err
+}
+
+// GetLoginFunc returns a function that can authenticate against Firebase. The
+// password is checked first and wrong ones get a 401 response, so the handler
+// can be protected with LoginThrottleMiddleware. Unknown users are signed up
+// with the password when the signup policy allows it. Accounts that have no
+// password yet have to set one e.g with a password reset.
+func GetLoginFunc(ctx context.Context, fc IFirebaseClient, opts ...LoginOption) http.HandlerFunc {
+	config := newLoginConfig(opts...)
+	checkPassword := config.checkPassword
+	if checkPassword == nil {
+		checkPassword = checkFirebasePassword
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
+		event := newLoginEvent(r, LoginEventLogin, config.trustForwardedFor)
+		event.Provider = LoginProviderPassword
 		creds, err := ValidateLoginCreds(w, r)
 		if err != nil {
-			serverutils.WriteJSONResponse(w, errorcodeutil.CustomError{
-				Err:     err,
-				Message: err.Error(),
-			}, http.StatusBadRequest)
-			return
+			config.recordLogin(r, event.fail(err))
+			return // ValidateLoginCreds has already written the error response
 		}
+		event.Username = creds.Username
 
-		firebaseUser, err := GetFirebaseUser(ctx, creds)
+		known, err := checkPassword(ctx, creds)
 		if err != nil {
-			serverutils.WriteJSONResponse(w, errorcodeutil.CustomError{
-				Err:     err,
-				Message: err.Error(),
-			}, http.StatusInternalServerError)
+			config.recordLogin(r, event.fail(err))
+			WriteLoginError(w, err)
 			return
 		}
-
-		customToken, err := CreateFirebaseCustomToken(ctx, firebaseUser.UID)
+		var firebaseUser *auth.UserRecord
+		if known {
+			firebaseUser, err = GetFirebaseUserWithPolicy(ctx, creds, config.signup)
+		} else {
+			firebaseUser, err = createFirebasePasswordUser(ctx, creds, config.signup)
+		}
 		if err != nil {
-			serverutils.WriteJSONResponse(w, errorcodeutil.CustomError{
-				Err:     err,
-				Message: err.Error(),
-			}, http.StatusInternalServerError)
+			config.recordLogin(r, event.fail(err))
+			WriteLoginError(w, err)
 			return
 		}
+		event.UID = firebaseUser.UID
+		config.profiles.syncAfterLogin(ctx, firebaseUser)
 
-		userTokens, err := AuthenticateCustomFirebaseToken(customToken)
-		if err != nil {
-			serverutils.WriteJSONResponse(w, errorcodeutil.CustomError{
-				Err:     err,
-				Message: err.Error(),
-			}, http.StatusInternalServerError)
-			return
+		if config.interrupted(ctx, w, firebaseUser) {
+			return // the login is recorded once the second factor is verified
 		}
 
-		loginResp := LoginResponse{
-			CustomToken:   customToken,
-			ExpiresIn:     serverutils.ConvertStringToInt(w, userTokens.ExpiresIn),
-			IDToken:       userTokens.IDToken,
-			RefreshToken:  userTokens.RefreshToken,
-			UID:           firebaseUser.UID,
-			Email:         firebaseUser.Email,
-			DisplayName:   firebaseUser.DisplayName,
-			EmailVerified: firebaseUser.EmailVerified,
-			PhoneNumber:   firebaseUser.PhoneNumber,
-			PhotoURL:      firebaseUser.PhotoURL,
-			Disabled:      firebaseUser.Disabled,
-			TenantID:      firebaseUser.TenantID,
-			ProviderID:    firebaseUser.ProviderID,
+		result, err := IssueFirebaseLoginTokens(ctx, firebaseUser)
+		if err != nil {
+			config.recordLogin(r, event.fail(err))
+			WriteLoginError(w, err)
+			return
 		}
-		serverutils.WriteJSONResponse(w, loginResp, http.StatusOK)
+		event.Success = true
+		config.recordLogin(r, event)
+		writeLoginResult(w, result)
 	}
 }
@@ -0,0 +1,571 @@
+package firebasetools
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// LoginAttemptsCollectionName is the (unsuffixed) Firestore collection that holds failed login attempts
+const LoginAttemptsCollectionName = "login_attempts"
+
+// LockoutPolicy determines how repeated login failures are slowed down
+type LockoutPolicy struct {
+	// MaxFailures consecutive failures block further attempts for LockoutDuration.
+	// Zero disables lockout.
+	MaxFailures     int
+	LockoutDuration time.Duration
+
+	// BaseDelay is the wait after the first failure. It doubles with every further
+	// failure, up to MaxDelay (an hour if unset). Zero disables progressive delays.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// ResetAfter forgets earlier failures when none occurred for this long
+	ResetAfter time.Duration
+}
+
+// LoginThrottleConfig sets the lockout policies for usernames and client IPs
+type LoginThrottleConfig struct {
+	Username LockoutPolicy
+	IP       LockoutPolicy
+
+	// TrustForwardedFor makes clients be identified by the first `X-Forwarded-For`
+	// address. Only enable it behind a proxy that sets the header.
+	TrustForwardedFor bool
+}
+
+// DefaultLoginThrottleConfig locks a username for 15 minutes after 5 consecutive
+// failures, with delays of 1s, 2s, 4s... in between, and an IP for 15 minutes after 50
+func DefaultLoginThrottleConfig() LoginThrottleConfig {
+	return LoginThrottleConfig{
+		Username: LockoutPolicy{
+			MaxFailures:     5,
+			LockoutDuration: 15 * time.Minute,
+			BaseDelay:       time.Second,
+			MaxDelay:        30 * time.Second,
+			ResetAfter:      time.Hour,
+		},
+		IP: LockoutPolicy{
+			MaxFailures:     50,
+			LockoutDuration: 15 * time.Minute,
+			ResetAfter:      time.Hour,
+		},
+	}
+}
+
+// loginAttemptTimeout is how long an attempt that was let through but never settled
+// (e.g because the instance crashed) keeps counting towards the lockout
+const loginAttemptTimeout = time.Minute
+
+// LoginAttempts is the persisted record of a key's consecutive login failures
+type LoginAttempts struct {
+	Failures     int       `json:"failures" firestore:"failures"`
+	LastFailure  time.Time `json:"lastFailure" firestore:"lastFailure"`
+	BlockedUntil time.Time `json:"blockedUntil" firestore:"blockedUntil"`
+
+	// Pending counts the attempts that are in progress. They count as failures
+	// until they are settled so that parallel attempts can't exceed the lockout.
+	Pending     int       `json:"pending" firestore:"pending"`
+	LastAttempt time.Time `json:"lastAttempt" firestore:"lastAttempt"`
+
+	// UID is the user that the key belongs to, when it is known, so that the
+	// record is deleted with the user's data
+	UID string `json:"uid,omitempty" firestore:"uid,omitempty"`
+}
+
+// expire forgets failures and pending attempts that are too old to count
+func (a *LoginAttempts) expire(now time.Time, policy LockoutPolicy) {
+	if policy.ResetAfter > 0 && now.Sub(a.LastFailure) > policy.ResetAfter {
+		a.Failures = 0
+	}
+	if now.Sub(a.LastAttempt) > loginAttemptTimeout {
+		a.Pending = 0
+	}
+}
+
+// fail records a failure at the supplied time and blocks further attempts as the policy requires
+func (a *LoginAttempts) fail(now time.Time, policy LockoutPolicy) {
+	a.expire(now, policy)
+	a.Failures++
+	a.LastFailure = now
+
+	switch {
+	case policy.MaxFailures > 0 && a.Failures >= policy.MaxFailures:
+		a.BlockedUntil = now.Add(policy.LockoutDuration)
+	case policy.BaseDelay > 0:
+		maxDelay := policy.MaxDelay
+		if maxDelay <= 0 {
+			maxDelay = time.Hour
+		}
+		delay := policy.BaseDelay
+		for i := 1; i < a.Failures && delay < maxDelay; i++ {
+			delay *= 2
+		}
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+		a.BlockedUntil = now.Add(delay)
+	}
+}
+
+// begin counts an attempt as pending, unless it must wait, and returns the wait.
+// An attempt must wait while the key is blocked, when it would take the failures
+// and pending attempts past the policy's maximum, or when the policy has
+// progressive delays and another attempt is pending.
+func (a *LoginAttempts) begin(now time.Time, policy LockoutPolicy) time.Duration {
+	a.expire(now, policy)
+	if wait := a.RetryAfter(now); wait > 0 {
+		return wait
+	}
+	if policy.MaxFailures > 0 && a.Failures+a.Pending+1 > policy.MaxFailures ||
+		policy.BaseDelay > 0 && a.Pending > 0 {
+		return time.Second
+	}
+	a.Pending++
+	a.LastAttempt = now
+	return 0
+}
+
+// finish settles a pending attempt, recording a failure if it failed
+func (a *LoginAttempts) finish(now time.Time, policy LockoutPolicy, failed bool) {
+	if a.Pending > 0 {
+		a.Pending--
+	}
+	if failed {
+		a.fail(now, policy)
+	}
+}
+
+// RetryAfter is how long attempts remain blocked, rounded up to whole seconds
+func (a *LoginAttempts) RetryAfter(now time.Time) time.Duration {
+	if a == nil || !a.BlockedUntil.After(now) {
+		return 0
+	}
+	return secondsToDuration(a.BlockedUntil.Sub(now).Seconds())
+}
+
+// LoginAttemptStore keeps the login failures of usernames and IPs.
+// Implementations must be safe for concurrent use.
+type LoginAttemptStore interface {
+	// Get returns the key's attempts, or empty attempts if it has none
+	Get(ctx context.Context, key string) (*LoginAttempts, error)
+
+	// Update applies the change to the key's attempts and saves them atomically,
+	// so that concurrent updates of a key don't overwrite each other
+	Update(ctx context.Context, key string, change func(attempts *LoginAttempts)) (*LoginAttempts, error)
+
+	Reset(ctx context.Context, key string) error
+}
+
+// InMemoryLoginAttemptStore keeps login failures in process memory.
+// It suits single instance deployments and tests.
+type InMemoryLoginAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]*LoginAttempts
+}
+
+// NewInMemoryLoginAttemptStore creates an empty in-memory login attempt store
+func NewInMemoryLoginAttemptStore() *InMemoryLoginAttemptStore {
+	return &InMemoryLoginAttemptStore{attempts: map[string]*LoginAttempts{}}
+}
+
+// Get returns a copy of the key's attempts
+func (s *InMemoryLoginAttemptStore) Get(ctx context.Context, key string) (*LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempts := LoginAttempts{}
+	if existing, ok := s.attempts[key]; ok {
+		attempts = *existing
+	}
+	return &attempts, nil
+}
+
+// Update changes the key's attempts while holding the store's lock
+func (s *InMemoryLoginAttemptStore) Update(
+	ctx context.Context, key string, change func(attempts *LoginAttempts)) (*LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempts, ok := s.attempts[key]
+	if !ok {
+		attempts = &LoginAttempts{}
+		s.attempts[key] = attempts
+	}
+	change(attempts)
+	copied := *attempts
+	return &copied, nil
+}
+
+// Reset forgets the key's attempts
+func (s *InMemoryLoginAttemptStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+// FirestoreLoginAttemptStore keeps login failures in a Firestore collection so that
+// lockouts are shared by all the instances of a service
+type FirestoreLoginAttemptStore struct {
+	client     *firestore.Client
+	collection string
+}
+
+// NewFirestoreLoginAttemptStore creates a Firestore backed login attempt store.
+// When no collection is supplied, the suffixed `login_attempts` collection is used.
+func NewFirestoreLoginAttemptStore(client *firestore.Client, collection string) *FirestoreLoginAttemptStore {
+	if collection == "" {
+		collection = SuffixCollection(LoginAttemptsCollectionName)
+	}
+	return &FirestoreLoginAttemptStore{client: client, collection: collection}
+}
+
+func (s *FirestoreLoginAttemptStore) ref(key string) *firestore.DocumentRef {
+	// keys contain usernames, which may have characters that are not allowed in document IDs
+	digest := sha256.Sum256([]byte(key))
+	return s.client.Collection(s.collection).Doc(hex.EncodeToString(digest[:]))
+}
+
+// Get returns the key's attempts
+func (s *FirestoreLoginAttemptStore) Get(ctx context.Context, key string) (*LoginAttempts, error) {
+	docs, err := s.client.GetAll(ctx, []*firestore.DocumentRef{s.ref(key)})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get login attempts for %s: %w", key, err)
+	}
+	attempts := &LoginAttempts{}
+	if docs[0].Exists() {
+		if err := docs[0].DataTo(attempts); err != nil {
+			return nil, fmt.Errorf("unable to read login attempts for %s: %w", key, err)
+		}
+	}
+	return attempts, nil
+}
+
+// Update changes the key's attempts inside a transaction
+func (s *FirestoreLoginAttemptStore) Update(
+	ctx context.Context, key string, change func(attempts *LoginAttempts)) (*LoginAttempts, error) {
+	ref := s.ref(key)
+	var attempts *LoginAttempts
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docs, err := tx.GetAll([]*firestore.DocumentRef{ref})
+		if err != nil {
+			return err
+		}
+		attempts = &LoginAttempts{}
+		if docs[0].Exists() {
+			if err := docs[0].DataTo(attempts); err != nil {
+				return err
+			}
+		}
+		change(attempts)
+		return tx.Set(ref, attempts)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to update login attempts for %s: %w", key, err)
+	}
+	return attempts, nil
+}
+
+// Reset forgets the key's attempts
+func (s *FirestoreLoginAttemptStore) Reset(ctx context.Context, key string) error {
+	if _, err := s.ref(key).Delete(ctx); err != nil {
+		return fmt.Errorf("unable to reset login attempts for %s: %w", key, err)
+	}
+	return nil
+}
+
+// LoginThrottle slows down and locks out repeated login failures per username and per client IP
+type LoginThrottle struct {
+	store  LoginAttemptStore
+	config LoginThrottleConfig
+}
+
+// NewLoginThrottle creates a login throttle that keeps its state in the supplied store
+func NewLoginThrottle(store LoginAttemptStore, config LoginThrottleConfig) *LoginThrottle {
+	return &LoginThrottle{store: store, config: config}
+}
+
+func loginUsernameKey(username string) string {
+	return "login" + Sep + "username:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+func loginIPKey(ip string) string {
+	return "login" + Sep + "ip:" + ip
+}
+
+// loginThrottleKey is a store key and the policy that applies to it
+type loginThrottleKey struct {
+	key    string
+	policy LockoutPolicy
+	uid    string
+}
+
+// keys returns the store keys and policies that apply to a login attempt
+func (t *LoginThrottle) keys(username string, ip string) []loginThrottleKey {
+	keys := []loginThrottleKey{}
+	if strings.TrimSpace(username) != "" {
+		keys = append(keys, loginThrottleKey{key: loginUsernameKey(username), policy: t.config.Username})
+	}
+	if ip != "" {
+		keys = append(keys, loginThrottleKey{key: loginIPKey(ip), policy: t.config.IP})
+	}
+	return keys
+}
+
+// Check returns how long the username and IP must wait before attempting to log in again
+func (t *LoginThrottle) Check(ctx context.Context, username string, ip string) (time.Duration, error) {
+	now := time.Now()
+	var retryAfter time.Duration
+	for _, k := range t.keys(username, ip) {
+		attempts, err := t.store.Get(ctx, k.key)
+		if err != nil {
+			return 0, err
+		}
+		if wait := attempts.RetryAfter(now); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	return retryAfter, nil
+}
+
+// Begin lets a login attempt by the username from the IP through, unless it must
+// wait, and returns the wait. Attempts that are let through count as failures
+// until they are settled with Finish, so that parallel attempts can't get past
+// the lockout.
+func (t *LoginThrottle) Begin(ctx context.Context, username string, ip string) (time.Duration, error) {
+	wait, _, err := beginAttempts(ctx, t.store, t.keys(username, ip))
+	return wait, err
+}
+
+// Finish settles an attempt that Begin let through. Failed attempts count towards the lockout.
+func (t *LoginThrottle) Finish(ctx context.Context, username string, ip string, failed bool) error {
+	return finishAttempts(ctx, t.store, t.keys(username, ip), failed)
+}
+
+// beginAttempts counts an attempt as pending on every key, unless one of them
+// must wait. It then returns the wait and the index of the key that must wait,
+// after releasing the keys that it had counted the attempt on.
+func beginAttempts(ctx context.Context, store LoginAttemptStore, keys []loginThrottleKey) (time.Duration, int, error) {
+	for i, k := range keys {
+		policy := k.policy
+		var wait time.Duration
+		uid := k.uid
+		_, err := store.Update(ctx, k.key, func(attempts *LoginAttempts) {
+			wait = attempts.begin(time.Now(), policy)
+			if uid != "" {
+				attempts.UID = uid
+			}
+		})
+		if err == nil && wait == 0 {
+			continue
+		}
+		if releaseErr := finishAttempts(ctx, store, keys[:i], false); releaseErr != nil && err == nil {
+			err = releaseErr
+		}
+		return wait, i, err
+	}
+	return 0, -1, nil
+}
+
+// finishAttempts settles an attempt that beginAttempts let through
+func finishAttempts(ctx context.Context, store LoginAttemptStore, keys []loginThrottleKey, failed bool) error {
+	for _, k := range keys {
+		policy := k.policy
+		_, err := store.Update(ctx, k.key, func(attempts *LoginAttempts) {
+			attempts.finish(time.Now(), policy, failed)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordFailure records a failed login by the username from the IP
+func (t *LoginThrottle) RecordFailure(ctx context.Context, username string, ip string) error {
+	for _, k := range t.keys(username, ip) {
+		policy := k.policy
+		_, err := t.store.Update(ctx, k.key, func(attempts *LoginAttempts) {
+			attempts.fail(time.Now(), policy)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordSuccess clears the username's failures. The IP's failures are kept since
+// one address can try many usernames.
+func (t *LoginThrottle) RecordSuccess(ctx context.Context, username string) error {
+	if strings.TrimSpace(username) == "" {
+		return nil
+	}
+	return t.store.Reset(ctx, loginUsernameKey(username))
+}
+
+// Unlock clears the failures of a username and/or an IP e.g at an administrator's request
+func (t *LoginThrottle) Unlock(ctx context.Context, username string, ip string) error {
+	keys := t.keys(username, ip)
+	if len(keys) == 0 {
+		return fmt.Errorf("a username or IP is required")
+	}
+	for _, k := range keys {
+		if err := t.store.Reset(ctx, k.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statusRecorder captures the status that a handler responds with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// peekLoginUsername reads the username (or phone number) of a login request
+// and restores the request body for the login handler
+func peekLoginUsername(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxLoginRequestBytes))
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	req := &LoginRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return ""
+	}
+	if req.Username != "" {
+		return req.Username
+	}
+	return req.PhoneNumber
+}
+
+// LoginThrottleMiddleware protects a login handler that responds with a 401 status
+// to invalid credentials (e.g GetLoginFunc, or GetProviderLoginFunc with a
+// PasswordLoginProvider) from brute force attacks.
+//
+// Blocked attempts get a 429 response with a `Retry-After` header. Attempts are
+// counted before the login handler runs, so parallel attempts can't get past
+// the lockout. Responses with a 401 status count as failures and successful
+// responses clear the username's failures, except for 202 MFA challenges: the
+// failures are only cleared once the second factor passes (see
+// MFAConfig.LoginThrottle). If the store fails, the error is logged and the
+// attempt is let through.
+func LoginThrottleMiddleware(throttle *LoginThrottle) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				username := peekLoginUsername(r)
+				ip := clientIP(r, throttle.config.TrustForwardedFor)
+
+				retryAfter, err := throttle.Begin(r.Context(), username, ip)
+				if err != nil {
+					log.Printf("login throttling skipped: %s", err)
+					next.ServeHTTP(w, r)
+					return
+				}
+				if retryAfter > 0 {
+					WriteLoginError(w, &LoginError{
+						Status:     http.StatusTooManyRequests,
+						Message:    "too many failed login attempts, try again later",
+						RetryAfter: retryAfter,
+					})
+					return
+				}
+
+				rec := &statusRecorder{ResponseWriter: w}
+				next.ServeHTTP(rec, r)
+
+				failed := rec.status == http.StatusUnauthorized
+				if err := throttle.Finish(r.Context(), username, ip, failed); err != nil {
+					log.Printf("unable to record login attempt: %s", err)
+				}
+				if rec.status >= 200 && rec.status < 300 && rec.status != http.StatusAccepted {
+					if err := throttle.RecordSuccess(r.Context(), username); err != nil {
+						log.Printf("unable to record login attempt: %s", err)
+					}
+				}
+			},
+		)
+	}
+}
+
+// loginUnlockRequest is the unmarshalling target for login unlock requests
+type loginUnlockRequest struct {
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+}
+
+// GetUnlockLoginFunc returns a handler that lets administrators clear the login
+// failures of a username and/or IP. The principal must hold the supplied claim,
+// which defaults to `admin`. It should run after AuthenticationMiddleware.
+func GetUnlockLoginFunc(throttle *LoginThrottle, claim string, opts ...AuthenticationOption) http.HandlerFunc {
+	authConfig := newAuthenticationConfig(opts...)
+	if claim == "" {
+		claim = DefaultImpersonationClaim
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, err := PrincipalFromContext(r.Context())
+		if err != nil {
+			authConfig.errorRenderer(w, r, NewAuthError("", err.Error()))
+			return
+		}
+		if isAdmin, _ := principal.BoolClaim(claim); !isAdmin {
+			authConfig.errorRenderer(w, r, NewInsufficientScopeError(
+				claim,
+				fmt.Sprintf("the `%s` claim is required to unlock logins", claim),
+			))
+			return
+		}
+
+		req := &loginUnlockRequest{}
+		if r.Body == nil || json.NewDecoder(r.Body).Decode(req) != nil {
+			authConfig.errorRenderer(w, r, NewAuthError(AuthErrorInvalidRequest, "invalid unlock request"))
+			return
+		}
+		if req.Username == "" && req.IP == "" {
+			authConfig.errorRenderer(w, r, NewAuthError(
+				AuthErrorInvalidRequest, "a username or IP is required"))
+			return
+		}
+
+		if err := throttle.Unlock(r.Context(), req.Username, req.IP); err != nil {
+			log.Printf("unable to unlock logins for %q/%q: %s", req.Username, req.IP, err)
+			writeInternalProblem(w, r, "unable to unlock logins")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
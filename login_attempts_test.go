@@ -0,0 +1,308 @@
+package firebasetools_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	ctx := context.Background()
+	throttle := firebasetools.NewLoginThrottle(
+		firebasetools.NewInMemoryLoginAttemptStore(),
+		firebasetools.LoginThrottleConfig{
+			Username: firebasetools.LockoutPolicy{
+				MaxFailures:     3,
+				LockoutDuration: time.Minute,
+				BaseDelay:       2 * time.Second,
+				MaxDelay:        3 * time.Second,
+			},
+			IP: firebasetools.LockoutPolicy{MaxFailures: 10, LockoutDuration: time.Hour},
+		},
+	)
+
+	wait, err := throttle.Check(ctx, "user@example.com", "10.0.0.1")
+	assert.Nil(t, err)
+	assert.Zero(t, wait)
+
+	// progressive delays: 2s after the first failure, then capped at 3s
+	assert.Nil(t, throttle.RecordFailure(ctx, "user@example.com", "10.0.0.1"))
+	wait, err = throttle.Check(ctx, "User@Example.com", "10.0.0.2")
+	assert.Nil(t, err)
+	assert.Equal(t, 2*time.Second, wait, "usernames are case insensitive")
+
+	assert.Nil(t, throttle.RecordFailure(ctx, "user@example.com", "10.0.0.1"))
+	wait, _ = throttle.Check(ctx, "user@example.com", "")
+	assert.Equal(t, 3*time.Second, wait)
+
+	// lockout
+	assert.Nil(t, throttle.RecordFailure(ctx, "user@example.com", "10.0.0.1"))
+	wait, _ = throttle.Check(ctx, "user@example.com", "")
+	assert.Equal(t, time.Minute, wait)
+
+	// other usernames from another IP are unaffected
+	wait, _ = throttle.Check(ctx, "other@example.com", "10.0.0.2")
+	assert.Zero(t, wait)
+
+	assert.Nil(t, throttle.Unlock(ctx, "user@example.com", ""))
+	wait, _ = throttle.Check(ctx, "user@example.com", "")
+	assert.Zero(t, wait)
+
+	assert.NotNil(t, throttle.Unlock(ctx, "", ""))
+}
+
+func TestLoginThrottle_IPLockout(t *testing.T) {
+	ctx := context.Background()
+	throttle := firebasetools.NewLoginThrottle(
+		firebasetools.NewInMemoryLoginAttemptStore(),
+		firebasetools.LoginThrottleConfig{
+			IP: firebasetools.LockoutPolicy{MaxFailures: 2, LockoutDuration: time.Hour},
+		},
+	)
+	assert.Nil(t, throttle.RecordFailure(ctx, "a@example.com", "10.0.0.1"))
+	assert.Nil(t, throttle.RecordFailure(ctx, "b@example.com", "10.0.0.1"))
+
+	wait, _ := throttle.Check(ctx, "c@example.com", "10.0.0.1")
+	assert.Equal(t, time.Hour, wait)
+
+	// successful logins don't clear the IP's failures
+	assert.Nil(t, throttle.RecordSuccess(ctx, "c@example.com"))
+	wait, _ = throttle.Check(ctx, "c@example.com", "10.0.0.1")
+	assert.Equal(t, time.Hour, wait)
+}
+
+func TestLoginThrottleMiddleware(t *testing.T) {
+	throttle := firebasetools.NewLoginThrottle(
+		firebasetools.NewInMemoryLoginAttemptStore(),
+		firebasetools.LoginThrottleConfig{
+			Username: firebasetools.LockoutPolicy{MaxFailures: 2, LockoutDuration: time.Minute},
+		},
+	)
+	login := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := firebasetools.LoginRequest{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&req), "the body is restored for the login handler")
+		if req.Password != "correct" {
+			firebasetools.WriteLoginError(w, firebasetools.NewLoginError(http.StatusUnauthorized, "invalid credentials", nil))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	h := firebasetools.LoginThrottleMiddleware(throttle)(login)
+	attempt := func(password string) *httptest.ResponseRecorder {
+		bs, _ := json.Marshal(map[string]string{"username": "user@example.com", "password": password})
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(bs)))
+		return rw
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, attempt("wrong").Code)
+	assert.Equal(t, http.StatusOK, attempt("correct").Code, "a success clears earlier failures")
+	assert.Equal(t, http.StatusUnauthorized, attempt("wrong").Code)
+	assert.Equal(t, http.StatusUnauthorized, attempt("wrong").Code)
+
+	rw := attempt("correct")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	retryAfter, err := strconv.Atoi(rw.Header().Get("Retry-After"))
+	assert.Nil(t, err)
+	assert.Equal(t, 60, retryAfter)
+}
+
+func TestLoginThrottleMiddleware_GetLoginFunc(t *testing.T) {
+	ctx := context.Background()
+	throttle := firebasetools.NewLoginThrottle(
+		firebasetools.NewInMemoryLoginAttemptStore(),
+		firebasetools.LoginThrottleConfig{
+			Username: firebasetools.LockoutPolicy{MaxFailures: 3, LockoutDuration: time.Minute},
+		},
+	)
+	checks := 0
+	wrongPassword := func(ctx context.Context, creds *firebasetools.LoginCredentials) (bool, error) {
+		checks++
+		return false, firebasetools.NewLoginError(http.StatusUnauthorized, "invalid credentials", nil)
+	}
+	h := firebasetools.LoginThrottleMiddleware(throttle)(
+		firebasetools.GetLoginFunc(ctx, &firebasetools.FirebaseClient{}, firebasetools.WithPasswordCheck(wrongPassword)),
+	)
+	attempt := func() int {
+		bs, _ := json.Marshal(map[string]string{"username": "user@example.com", "password": "wrong"})
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(bs)))
+		return rw.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, attempt())
+	}
+	assert.Equal(t, http.StatusTooManyRequests, attempt())
+	assert.Equal(t, 3, checks, "locked out attempts don't reach the password check")
+}
+
+func TestLoginThrottleMiddleware_ParallelAttempts(t *testing.T) {
+	throttle := firebasetools.NewLoginThrottle(
+		firebasetools.NewInMemoryLoginAttemptStore(),
+		firebasetools.LoginThrottleConfig{
+			Username: firebasetools.LockoutPolicy{MaxFailures: 3, LockoutDuration: time.Minute},
+		},
+	)
+	release := make(chan struct{})
+	login := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		firebasetools.WriteLoginError(w, firebasetools.NewLoginError(http.StatusUnauthorized, "invalid credentials", nil))
+	})
+	h := firebasetools.LoginThrottleMiddleware(throttle)(login)
+
+	const attempts = 10
+	statuses := make(chan int, attempts)
+	wg := sync.WaitGroup{}
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bs, _ := json.Marshal(map[string]string{"username": "user@example.com", "password": "wrong"})
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(bs)))
+			statuses <- rw.Code
+		}()
+	}
+
+	// the attempts beyond the lockout are turned away while the others are in progress
+	for i := 0; i < attempts-3; i++ {
+		select {
+		case status := <-statuses:
+			assert.Equal(t, http.StatusTooManyRequests, status)
+		case <-time.After(5 * time.Second):
+			t.Fatal("more attempts than the lockout allows reached the login handler")
+		}
+	}
+	close(release)
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		assert.Equal(t, http.StatusUnauthorized, status)
+	}
+
+	wait, err := throttle.Check(context.Background(), "user@example.com", "")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, wait)
+}
+
+func TestLoginThrottleMiddleware_MFAChallenge(t *testing.T) {
+	ctx := context.Background()
+	throttle := firebasetools.NewLoginThrottle(
+		firebasetools.NewInMemoryLoginAttemptStore(),
+		firebasetools.LoginThrottleConfig{
+			Username: firebasetools.LockoutPolicy{MaxFailures: 3, LockoutDuration: time.Minute},
+		},
+	)
+	config := newTestMFAConfig(t, map[string]bool{"nurse-uid": true})
+	config.LoginThrottle = throttle
+	password := &stubLoginProvider{name: firebasetools.LoginProviderPassword}
+	login := firebasetools.LoginThrottleMiddleware(throttle)(
+		firebasetools.NewLoginHandler([]firebasetools.LoginProvider{password}, firebasetools.WithMFA(config)))
+	creds := map[string]string{"username": "nurse-uid@example.com", "password": "secret"}
+	attempt := func(target interface{}) int {
+		return postJSON(t, login.ServeHTTP, creds, target)
+	}
+
+	password.err = firebasetools.NewLoginError(http.StatusUnauthorized, "invalid credentials", nil)
+	assert.Equal(t, http.StatusUnauthorized, attempt(nil))
+	assert.Equal(t, http.StatusUnauthorized, attempt(nil))
+
+	password.err, password.result = nil, testLoginResult("nurse-uid")
+	challenge := firebasetools.MFAChallengeResponse{}
+	assert.Equal(t, http.StatusAccepted, attempt(&challenge))
+	wait, err := throttle.Check(ctx, "nurse-uid@example.com", "")
+	assert.Nil(t, err)
+	assert.Zero(t, wait)
+
+	password.err = firebasetools.NewLoginError(http.StatusUnauthorized, "invalid credentials", nil)
+	assert.Equal(t, http.StatusUnauthorized, attempt(nil))
+	wait, _ = throttle.Check(ctx, "nurse-uid@example.com", "")
+	assert.Equal(t, time.Minute, wait, "an MFA challenge doesn't clear earlier failures")
+
+	// passing the second factor does
+	setup := firebasetools.TOTPSetup{}
+	assert.Equal(t, http.StatusOK, postJSON(t, firebasetools.GetTOTPEnrollmentFunc(config), map[string]string{
+		"challengeToken": challenge.ChallengeToken,
+	}, &setup))
+	assert.Equal(t, http.StatusOK, postJSON(t, firebasetools.GetTOTPConfirmEnrollmentFunc(config), map[string]string{
+		"challengeToken": challenge.ChallengeToken,
+		"code":           currentTOTPCode(t, setup.Secret, 0),
+	}, nil))
+	wait, _ = throttle.Check(ctx, "nurse-uid@example.com", "")
+	assert.Zero(t, wait)
+}
+
+func TestGetUnlockLoginFunc(t *testing.T) {
+	ctx := context.Background()
+	throttle := firebasetools.NewLoginThrottle(
+		firebasetools.NewInMemoryLoginAttemptStore(),
+		firebasetools.LoginThrottleConfig{
+			Username: firebasetools.LockoutPolicy{MaxFailures: 1, LockoutDuration: time.Minute},
+		},
+	)
+	unlock := firebasetools.GetUnlockLoginFunc(throttle, "")
+	unlockRequest := func(claims map[string]interface{}, body string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/admin/unlock", bytes.NewBufferString(body))
+		if claims != nil {
+			r = r.WithContext(firebasetools.WithPrincipal(r.Context(), &firebasetools.Principal{
+				UID:    "uid",
+				Claims: claims,
+			}))
+		}
+		return r
+	}
+
+	tests := []struct {
+		name       string
+		r          *http.Request
+		wantStatus int
+		wantLocked bool
+	}{
+		{
+			name:       "unauthenticated",
+			r:          unlockRequest(nil, `{"username": "user@example.com"}`),
+			wantStatus: http.StatusUnauthorized,
+			wantLocked: true,
+		},
+		{
+			name:       "not an admin",
+			r:          unlockRequest(map[string]interface{}{}, `{"username": "user@example.com"}`),
+			wantStatus: http.StatusForbidden,
+			wantLocked: true,
+		},
+		{
+			name:       "nothing to unlock",
+			r:          unlockRequest(map[string]interface{}{"admin": true}, `{}`),
+			wantStatus: http.StatusBadRequest,
+			wantLocked: true,
+		},
+		{
+			name:       "admin unlocks the username",
+			r:          unlockRequest(map[string]interface{}{"admin": true}, `{"username": "user@example.com"}`),
+			wantStatus: http.StatusNoContent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Nil(t, throttle.RecordFailure(ctx, "user@example.com", ""))
+
+			rw := httptest.NewRecorder()
+			unlock(rw, tt.r)
+			assert.Equal(t, tt.wantStatus, rw.Code)
+
+			wait, err := throttle.Check(ctx, "user@example.com", "")
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantLocked, wait > 0)
+		})
+	}
+}
@@ -0,0 +1,468 @@
+package firebasetools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gofrs/uuid"
+	"github.com/savannahghi/serverutils"
+)
+
+// LoginEventsCollectionName is the (unsuffixed) Firestore collection that holds login events
+const LoginEventsCollectionName = "login_events"
+
+// LoginEventType is what happened to a user's session
+type LoginEventType string
+
+// login event types
+const (
+	LoginEventLogin   LoginEventType = "login"
+	LoginEventRefresh LoginEventType = "refresh"
+	LoginEventLogout  LoginEventType = "logout"
+)
+
+// LoginEvent records a login, token refresh or logout, successful or not
+type LoginEvent struct {
+	ID   string         `json:"id" firestore:"id"`
+	Type LoginEventType `json:"type" firestore:"type"`
+
+	// UID is empty for failures where the user could not be identified
+	UID string `json:"uid" firestore:"uid"`
+
+	// Username is the email or phone number that a login was attempted with
+	Username string `json:"username,omitempty" firestore:"username"`
+
+	Provider      string    `json:"provider,omitempty" firestore:"provider"`
+	TenantID      string    `json:"tenantId,omitempty" firestore:"tenantId"`
+	IP            string    `json:"ip" firestore:"ip"`
+	UserAgent     string    `json:"userAgent" firestore:"userAgent"`
+	Success       bool      `json:"success" firestore:"success"`
+	FailureReason string    `json:"failureReason,omitempty" firestore:"failureReason"`
+	Timestamp     time.Time `json:"timestamp" firestore:"timestamp"`
+}
+
+// newLoginEvent starts an event for the request
+func newLoginEvent(r *http.Request, eventType LoginEventType, trustForwardedFor bool) *LoginEvent {
+	event := &LoginEvent{
+		Type:      eventType,
+		IP:        clientIP(r, trustForwardedFor),
+		UserAgent: r.UserAgent(),
+		Timestamp: time.Now(),
+	}
+	if tenantID, err := GetTenantIDFromContext(r.Context()); err == nil {
+		event.TenantID = tenantID
+	}
+	return event
+}
+
+// fail marks the event as failed with the reason that a client would be given
+func (e *LoginEvent) fail(err error) *LoginEvent {
+	e.Success = false
+	e.FailureReason = err.Error()
+	loginErr := &LoginError{}
+	if errors.As(err, &loginErr) {
+		e.FailureReason = loginErr.Message
+	}
+	return e
+}
+
+// LoginEventFilter narrows down login event queries. Empty fields match every event.
+type LoginEventFilter struct {
+	UID     string
+	Type    LoginEventType
+	Success *bool
+	Since   time.Time
+	Until   time.Time
+}
+
+func (f *LoginEventFilter) matches(e *LoginEvent) bool {
+	if f == nil {
+		return true
+	}
+	switch {
+	case f.UID != "" && e.UID != f.UID:
+		return false
+	case f.Type != "" && e.Type != f.Type:
+		return false
+	case f.Success != nil && e.Success != *f.Success:
+		return false
+	case !f.Since.IsZero() && e.Timestamp.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Timestamp.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// LoginEventSink receives login events
+type LoginEventSink interface {
+	RecordLoginEvent(ctx context.Context, event *LoginEvent) error
+}
+
+// LoginEventStore is a login event sink that can be queried. Events are returned
+// newest first and their IDs are the page cursors.
+type LoginEventStore interface {
+	LoginEventSink
+	QueryLoginEvents(
+		ctx context.Context, filter *LoginEventFilter, pagination *PaginationInput,
+	) ([]*LoginEvent, *PageInfo, error)
+
+	// LastLogin returns the user's latest successful login, or nil if they never logged in
+	LastLogin(ctx context.Context, uid string) (*LoginEvent, error)
+}
+
+// lastLogin finds the user's latest successful login with a one event query
+func lastLogin(ctx context.Context, store LoginEventStore, uid string) (*LoginEvent, error) {
+	if uid == "" {
+		return nil, fmt.Errorf("a UID is required to find the last login")
+	}
+	success := true
+	events, _, err := store.QueryLoginEvents(
+		ctx,
+		&LoginEventFilter{UID: uid, Type: LoginEventLogin, Success: &success},
+		&PaginationInput{First: 1},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find the last login of %s: %w", uid, err)
+	}
+	if len(events) == 0 {
+		return nil, nil
+	}
+	return events[0], nil
+}
+
+// recordLoginEvent sends the event to the sink, if any. Failures are logged
+// since they should not affect the user's session.
+func recordLoginEvent(ctx context.Context, sink LoginEventSink, event *LoginEvent) {
+	if sink == nil {
+		return
+	}
+	if event.ID == "" {
+		id, err := uuid.NewV4()
+		if err != nil {
+			log.Printf("unable to generate a login event ID: %s", err)
+			return
+		}
+		event.ID = id.String()
+	}
+	if err := sink.RecordLoginEvent(ctx, event); err != nil {
+		log.Printf("unable to record %s event for %q: %s", event.Type, event.UID, err)
+	}
+}
+
+func loginEventPageSize(pagination *PaginationInput) (int, bool) {
+	if pagination != nil && pagination.Last > 0 {
+		return pagination.Last, true
+	}
+	if pagination != nil && pagination.First > 0 {
+		return pagination.First, false
+	}
+	return DefaultPageSize, false
+}
+
+// newLoginEventPageInfo describes a page of events. `hasMore` reports whether there
+// were more events past the page in the direction of travel.
+func newLoginEventPageInfo(events []*LoginEvent, pagination *PaginationInput, hasMore bool) *PageInfo {
+	_, backwards := loginEventPageSize(pagination)
+	pageInfo := &PageInfo{
+		StartCursor: new(string),
+		EndCursor:   new(string),
+	}
+	if backwards {
+		pageInfo.HasPreviousPage = hasMore
+		pageInfo.HasNextPage = pagination.Before != ""
+	} else {
+		pageInfo.HasNextPage = hasMore
+		pageInfo.HasPreviousPage = pagination != nil && pagination.After != ""
+	}
+	if len(events) > 0 {
+		pageInfo.StartCursor = NewString(events[0].ID)
+		pageInfo.EndCursor = NewString(events[len(events)-1].ID)
+	}
+	return pageInfo
+}
+
+// newerLoginEvent orders events newest first, by timestamp then ID
+func newerLoginEvent(a *LoginEvent, b *LoginEvent) bool {
+	if a.Timestamp.Equal(b.Timestamp) {
+		return a.ID > b.ID
+	}
+	return a.Timestamp.After(b.Timestamp)
+}
+
+// InMemoryLoginEventStore keeps login events in process memory.
+// It suits tests; events are lost when the process exits.
+type InMemoryLoginEventStore struct {
+	mu     sync.Mutex
+	events []*LoginEvent
+}
+
+// RecordLoginEvent saves a copy of the event
+func (s *InMemoryLoginEventStore) RecordLoginEvent(ctx context.Context, event *LoginEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *event
+	s.events = append(s.events, &copied)
+	return nil
+}
+
+// QueryLoginEvents returns a page of the events that match the filter
+func (s *InMemoryLoginEventStore) QueryLoginEvents(
+	ctx context.Context, filter *LoginEventFilter, pagination *PaginationInput,
+) ([]*LoginEvent, *PageInfo, error) {
+	if err := ValidatePaginationParameters(pagination); err != nil {
+		return nil, nil, err
+	}
+	s.mu.Lock()
+	matched := []*LoginEvent{}
+	var after, before *LoginEvent
+	for _, event := range s.events {
+		if filter.matches(event) {
+			copied := *event
+			matched = append(matched, &copied)
+		}
+		if pagination != nil && pagination.After != "" && event.ID == pagination.After {
+			after = event
+		}
+		if pagination != nil && pagination.Before != "" && event.ID == pagination.Before {
+			before = event
+		}
+	}
+	s.mu.Unlock()
+	if pagination != nil && pagination.After != "" && after == nil {
+		return nil, nil, fmt.Errorf("invalid `after` cursor: no login event %q", pagination.After)
+	}
+	if pagination != nil && pagination.Before != "" && before == nil {
+		return nil, nil, fmt.Errorf("invalid `before` cursor: no login event %q", pagination.Before)
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return newerLoginEvent(matched[i], matched[j])
+	})
+
+	// like Firestore cursors, the cursor events don't have to match the filter
+	start, end := 0, len(matched)
+	if before != nil {
+		end = 0
+	}
+	for i, event := range matched {
+		if after != nil && !newerLoginEvent(after, event) {
+			start = i + 1
+		}
+		if before != nil && newerLoginEvent(event, before) {
+			end = i + 1
+		}
+	}
+	if start > end {
+		start = end
+	}
+	page := matched[start:end]
+
+	size, backwards := loginEventPageSize(pagination)
+	hasMore := len(page) > size
+	if hasMore && backwards {
+		page = page[len(page)-size:]
+	} else if hasMore {
+		page = page[:size]
+	}
+	return page, newLoginEventPageInfo(page, pagination, hasMore), nil
+}
+
+// LastLogin returns the user's latest successful login
+func (s *InMemoryLoginEventStore) LastLogin(ctx context.Context, uid string) (*LoginEvent, error) {
+	return lastLogin(ctx, s, uid)
+}
+
+// FirestoreLoginEventStore keeps login events in a Firestore collection.
+// Filtered queries need composite indexes on the filtered fields plus
+// `timestamp` and `id` (both descending).
+type FirestoreLoginEventStore struct {
+	client     *firestore.Client
+	collection string
+}
+
+// NewFirestoreLoginEventStore creates a Firestore backed login event store.
+// When no collection is supplied, the suffixed `login_events` collection is used.
+func NewFirestoreLoginEventStore(client *firestore.Client, collection string) *FirestoreLoginEventStore {
+	if collection == "" {
+		collection = SuffixCollection(LoginEventsCollectionName)
+	}
+	return &FirestoreLoginEventStore{client: client, collection: collection}
+}
+
+// RecordLoginEvent saves the event, using its ID as the document ID
+func (s *FirestoreLoginEventStore) RecordLoginEvent(ctx context.Context, event *LoginEvent) error {
+	if _, err := s.client.Collection(s.collection).Doc(event.ID).Set(ctx, event); err != nil {
+		return fmt.Errorf("unable to save login event: %w", err)
+	}
+	return nil
+}
+
+// QueryLoginEvents returns a page of the events that match the filter
+func (s *FirestoreLoginEventStore) QueryLoginEvents(
+	ctx context.Context, filter *LoginEventFilter, pagination *PaginationInput,
+) ([]*LoginEvent, *PageInfo, error) {
+	if err := ValidatePaginationParameters(pagination); err != nil {
+		return nil, nil, err
+	}
+	collection := s.client.Collection(s.collection)
+	query := collection.Query
+	if filter != nil {
+		if filter.UID != "" {
+			query = query.Where("uid", "==", filter.UID)
+		}
+		if filter.Type != "" {
+			query = query.Where("type", "==", string(filter.Type))
+		}
+		if filter.Success != nil {
+			query = query.Where("success", "==", *filter.Success)
+		}
+		if !filter.Since.IsZero() {
+			query = query.Where("timestamp", ">=", filter.Since)
+		}
+		if !filter.Until.IsZero() {
+			query = query.Where("timestamp", "<", filter.Until)
+		}
+	}
+	query = query.OrderBy("timestamp", firestore.Desc).OrderBy("id", firestore.Desc)
+
+	if pagination != nil && pagination.After != "" {
+		cursor, err := collection.Doc(pagination.After).Get(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid `after` cursor: %w", err)
+		}
+		query = query.StartAfter(cursor)
+	}
+	if pagination != nil && pagination.Before != "" {
+		cursor, err := collection.Doc(pagination.Before).Get(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid `before` cursor: %w", err)
+		}
+		query = query.EndBefore(cursor)
+	}
+
+	// one extra event is fetched to tell whether there is another page
+	size, backwards := loginEventPageSize(pagination)
+	if backwards {
+		query = query.LimitToLast(size + 1)
+	} else {
+		query = query.Limit(size + 1)
+	}
+	docs, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to query login events: %w", err)
+	}
+
+	events := []*LoginEvent{}
+	for _, doc := range docs {
+		event := &LoginEvent{}
+		if err := doc.DataTo(event); err != nil {
+			return nil, nil, fmt.Errorf("unable to read login event %s: %w", doc.Ref.ID, err)
+		}
+		events = append(events, event)
+	}
+	hasMore := len(events) > size
+	if hasMore && backwards {
+		events = events[1:]
+	} else if hasMore {
+		events = events[:size]
+	}
+	return events, newLoginEventPageInfo(events, pagination, hasMore), nil
+}
+
+// LastLogin returns the user's latest successful login. It needs a composite
+// index on `uid`, `type`, `success`, `timestamp` and `id`.
+func (s *FirestoreLoginEventStore) LastLogin(ctx context.Context, uid string) (*LoginEvent, error) {
+	return lastLogin(ctx, s, uid)
+}
+
+// WithLoginEvents makes login handlers record every login attempt in the sink.
+// Clients are identified by the first `X-Forwarded-For` address when it is trusted.
+func WithLoginEvents(sink LoginEventSink, trustForwardedFor bool) LoginOption {
+	return func(c *loginConfig) {
+		c.events = sink
+		c.trustForwardedFor = trustForwardedFor
+	}
+}
+
+// recordLogin records the outcome of a login attempt, if a sink is configured
+func (c *loginConfig) recordLogin(r *http.Request, event *LoginEvent) {
+	if c.events == nil {
+		return
+	}
+	recordLoginEvent(r.Context(), c.events, event)
+}
+
+// RefreshConfig configures the token refresh handler
+type RefreshConfig struct {
+	// Endpoint defaults to FirebaseRefreshTokenURL
+	Endpoint string
+
+	// Events receives a refresh event for every attempt, if set
+	Events            LoginEventSink
+	TrustForwardedFor bool
+}
+
+// RefreshRequest is the unmarshalling target for token refresh requests
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// GetRefreshFunc returns a handler that exchanges a refresh token for a new ID token
+func GetRefreshFunc(config RefreshConfig) http.HandlerFunc {
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = FirebaseRefreshTokenURL
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		event := newLoginEvent(r, LoginEventRefresh, config.TrustForwardedFor)
+		req := &RefreshRequest{}
+		if r.Body == nil || json.NewDecoder(r.Body).Decode(req) != nil || req.RefreshToken == "" {
+			err := NewLoginError(http.StatusBadRequest, "a refresh token is required", nil)
+			recordLoginEvent(r.Context(), config.Events, event.fail(err))
+			WriteLoginError(w, err)
+			return
+		}
+
+		resp := &FirebaseRefreshResponse{}
+		err := postIdentityToolkit(r.Context(), endpoint, map[string]string{
+			"grant_type":    "refresh_token",
+			"refresh_token": req.RefreshToken,
+		}, resp)
+		if err != nil {
+			err = loginErrorFromRefresh(err)
+			recordLoginEvent(r.Context(), config.Events, event.fail(err))
+			WriteLoginError(w, err)
+			return
+		}
+
+		event.UID = resp.UserID
+		event.Success = true
+		recordLoginEvent(r.Context(), config.Events, event)
+		serverutils.WriteJSONResponse(w, resp, http.StatusOK)
+	}
+}
+
+// loginErrorFromRefresh maps Secure Token API errors to login errors
+func loginErrorFromRefresh(err error) error {
+	apiErr := &IdentityToolkitError{}
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	switch apiErr.Code {
+	case "TOKEN_EXPIRED", "INVALID_REFRESH_TOKEN", "USER_NOT_FOUND", "INVALID_GRANT_TYPE":
+		return NewLoginError(http.StatusUnauthorized, "the session has expired, log in again", err)
+	case "USER_DISABLED":
+		return NewLoginError(http.StatusForbidden, "this account has been disabled", err)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,217 @@
+package firebasetools_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func queryAllLoginEvents(t *testing.T, store firebasetools.LoginEventStore) []*firebasetools.LoginEvent {
+	events, _, err := store.QueryLoginEvents(context.Background(), nil, nil)
+	assert.Nil(t, err)
+	return events
+}
+
+func TestNewLoginHandler_WithLoginEvents(t *testing.T) {
+	store := &firebasetools.InMemoryLoginEventStore{}
+	password := &stubLoginProvider{name: firebasetools.LoginProviderPassword, result: testLoginResult("nurse-uid")}
+	login := firebasetools.NewLoginHandler(
+		[]firebasetools.LoginProvider{password}, firebasetools.WithLoginEvents(store, true))
+
+	r := loginRequest(t, map[string]string{"username": "nurse@example.com", "password": "secret"})
+	r.Header.Set("User-Agent", "be-well/1.0")
+	r.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+	rw := httptest.NewRecorder()
+	login(rw, r)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	password.err = firebasetools.NewLoginError(http.StatusUnauthorized, "invalid credentials", fmt.Errorf("INVALID_PASSWORD"))
+	rw = httptest.NewRecorder()
+	login(rw, loginRequest(t, map[string]string{"username": "nurse@example.com", "password": "wrong"}))
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+
+	events := queryAllLoginEvents(t, store)
+	assert.Len(t, events, 2)
+	failure, success := events[0], events[1]
+	if failure.Success {
+		failure, success = success, failure
+	}
+
+	assert.True(t, success.Success)
+	assert.Equal(t, firebasetools.LoginEventLogin, success.Type)
+	assert.Equal(t, "nurse-uid", success.UID)
+	assert.Equal(t, firebasetools.LoginProviderPassword, success.Provider)
+	assert.Equal(t, "203.0.113.7", success.IP)
+	assert.Equal(t, "be-well/1.0", success.UserAgent)
+	assert.NotEmpty(t, success.ID)
+
+	assert.False(t, failure.Success)
+	assert.Empty(t, failure.UID)
+	assert.Equal(t, "nurse@example.com", failure.Username)
+	assert.Equal(t, "invalid credentials", failure.FailureReason, "clients' messages are recorded, not internal errors")
+}
+
+func TestGetRefreshFunc(t *testing.T) {
+	endpoint := newTestIdentityToolkit(t, func(payload map[string]interface{}) (int, interface{}) {
+		assert.Equal(t, "refresh_token", payload["grant_type"])
+		if payload["refresh_token"] != "refresh-token" {
+			return identityToolkitError("INVALID_REFRESH_TOKEN")
+		}
+		return http.StatusOK, firebasetools.FirebaseRefreshResponse{
+			IDToken:      "new-id-token",
+			RefreshToken: "new-refresh-token",
+			ExpiresIn:    "3600",
+			UserID:       "nurse-uid",
+		}
+	})
+	store := &firebasetools.InMemoryLoginEventStore{}
+	refresh := firebasetools.GetRefreshFunc(firebasetools.RefreshConfig{Endpoint: endpoint, Events: store})
+
+	resp := firebasetools.FirebaseRefreshResponse{}
+	assert.Equal(t, http.StatusOK, postJSON(t, refresh, map[string]string{"refreshToken": "refresh-token"}, &resp))
+	assert.Equal(t, "new-id-token", resp.IDToken)
+	assert.Equal(t, http.StatusUnauthorized, postJSON(t, refresh, map[string]string{"refreshToken": "stolen"}, nil))
+	assert.Equal(t, http.StatusBadRequest, postJSON(t, refresh, map[string]string{}, nil))
+
+	failed := false
+	events, _, err := store.QueryLoginEvents(context.Background(), &firebasetools.LoginEventFilter{
+		Type:    firebasetools.LoginEventRefresh,
+		Success: &failed,
+	}, nil)
+	assert.Nil(t, err)
+	assert.Len(t, events, 2)
+
+	events, _, err = store.QueryLoginEvents(context.Background(), &firebasetools.LoginEventFilter{UID: "nurse-uid"}, nil)
+	assert.Nil(t, err)
+	assert.Len(t, events, 1)
+	assert.True(t, events[0].Success)
+}
+
+func TestGetLogoutFunc_LoginEvents(t *testing.T) {
+	store := &firebasetools.InMemoryLoginEventStore{}
+	logout := firebasetools.GetLogoutFunc(firebasetools.LogoutConfig{
+		Events: store,
+		RevokeRefreshTokens: func(ctx context.Context, tenantID string, uid string) error {
+			return nil
+		},
+	})
+	token := &auth.Token{UID: "nurse-uid"}
+	token.Firebase.SignInProvider = "password"
+
+	rw := httptest.NewRecorder()
+	logout(rw, logoutRequest(token, ""))
+	assert.Equal(t, http.StatusNoContent, rw.Code)
+
+	events := queryAllLoginEvents(t, store)
+	assert.Len(t, events, 1)
+	assert.Equal(t, firebasetools.LoginEventLogout, events[0].Type)
+	assert.Equal(t, "nurse-uid", events[0].UID)
+	assert.Equal(t, "password", events[0].Provider)
+	assert.True(t, events[0].Success)
+}
+
+func TestInMemoryLoginEventStore_QueryLoginEvents(t *testing.T) {
+	ctx := context.Background()
+	store := &firebasetools.InMemoryLoginEventStore{}
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, store.RecordLoginEvent(ctx, &firebasetools.LoginEvent{
+			ID:        fmt.Sprintf("event-%d", i),
+			UID:       "nurse-uid",
+			Type:      firebasetools.LoginEventLogin,
+			Success:   true,
+			Timestamp: start.Add(time.Duration(i) * time.Hour),
+		}))
+	}
+	assert.Nil(t, store.RecordLoginEvent(ctx, &firebasetools.LoginEvent{
+		ID: "other", UID: "other-uid", Timestamp: start,
+	}))
+	filter := &firebasetools.LoginEventFilter{UID: "nurse-uid"}
+
+	// newest first
+	events, pageInfo, err := store.QueryLoginEvents(ctx, filter, &firebasetools.PaginationInput{First: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"event-4", "event-3"}, loginEventIDs(events))
+	assert.True(t, pageInfo.HasNextPage)
+	assert.False(t, pageInfo.HasPreviousPage)
+	assert.Equal(t, "event-3", *pageInfo.EndCursor)
+
+	events, pageInfo, err = store.QueryLoginEvents(ctx, filter, &firebasetools.PaginationInput{
+		First: 2, After: *pageInfo.EndCursor,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"event-2", "event-1"}, loginEventIDs(events))
+	assert.True(t, pageInfo.HasNextPage)
+	assert.True(t, pageInfo.HasPreviousPage)
+
+	events, pageInfo, err = store.QueryLoginEvents(ctx, filter, &firebasetools.PaginationInput{
+		Last: 2, Before: *pageInfo.StartCursor,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"event-4", "event-3"}, loginEventIDs(events))
+	assert.False(t, pageInfo.HasPreviousPage)
+	assert.True(t, pageInfo.HasNextPage)
+
+	events, _, err = store.QueryLoginEvents(ctx, &firebasetools.LoginEventFilter{
+		UID:   "nurse-uid",
+		Since: start.Add(time.Hour),
+		Until: start.Add(3 * time.Hour),
+	}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"event-2", "event-1"}, loginEventIDs(events))
+
+	_, _, err = store.QueryLoginEvents(ctx, filter, &firebasetools.PaginationInput{First: 1, Last: 1})
+	assert.NotNil(t, err)
+
+	_, _, err = store.QueryLoginEvents(ctx, filter, &firebasetools.PaginationInput{First: 1, After: "no-such-event"})
+	assert.NotNil(t, err, "unknown cursors are rejected")
+	_, _, err = store.QueryLoginEvents(ctx, filter, &firebasetools.PaginationInput{Last: 1, Before: "no-such-event"})
+	assert.NotNil(t, err)
+
+	events, _, err = store.QueryLoginEvents(ctx, filter, &firebasetools.PaginationInput{First: 1, After: "other"})
+	assert.Nil(t, err, "cursors don't have to match the filter")
+	assert.Equal(t, []string{"event-0"}, loginEventIDs(events))
+}
+
+func TestInMemoryLoginEventStore_LastLogin(t *testing.T) {
+	ctx := context.Background()
+	store := &firebasetools.InMemoryLoginEventStore{}
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, event := range []*firebasetools.LoginEvent{
+		{UID: "nurse-uid", Type: firebasetools.LoginEventLogin, Success: true},
+		{UID: "nurse-uid", Type: firebasetools.LoginEventLogin, Success: true},
+		{UID: "nurse-uid", Type: firebasetools.LoginEventLogin},
+		{UID: "nurse-uid", Type: firebasetools.LoginEventRefresh, Success: true},
+		{UID: "other-uid", Type: firebasetools.LoginEventLogin, Success: true},
+	} {
+		event.ID = fmt.Sprintf("event-%d", i)
+		event.Timestamp = start.Add(time.Duration(i) * time.Hour)
+		assert.Nil(t, store.RecordLoginEvent(ctx, event))
+	}
+
+	last, err := store.LastLogin(ctx, "nurse-uid")
+	assert.Nil(t, err)
+	assert.Equal(t, "event-1", last.ID, "failed logins and refreshes don't count")
+
+	last, err = store.LastLogin(ctx, "new-uid")
+	assert.Nil(t, err)
+	assert.Nil(t, last)
+
+	_, err = store.LastLogin(ctx, "")
+	assert.NotNil(t, err)
+}
+
+func loginEventIDs(events []*firebasetools.LoginEvent) []string {
+	ids := []string{}
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
@@ -0,0 +1,691 @@
+package firebasetools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/errorcodeutil"
+	"github.com/savannahghi/serverutils"
+)
+
+const (
+	// LoginProviderPassword is the name of the email and password login provider
+	LoginProviderPassword = "password"
+
+	// LoginProviderPhoneOTP is the name of the phone number and one time PIN login provider
+	LoginProviderPhoneOTP = "phone"
+
+	// LoginProviderCustomToken is the name of the custom token login provider
+	LoginProviderCustomToken = "custom_token"
+
+	// LoginProviderIdP is the name of the federated identity provider login provider
+	LoginProviderIdP = "idp"
+
+	// maxLoginRequestBytes caps the size of login request bodies
+	maxLoginRequestBytes = 1 << 20
+)
+
+// LoginRequest is the unmarshalling target for login requests.
+// Each provider reads the fields that it needs.
+type LoginRequest struct {
+	// Provider names the login provider that should handle the request
+	Provider string `json:"provider"`
+
+	Username    string `json:"username,omitempty"`
+	Password    string `json:"password,omitempty"`
+	PhoneNumber string `json:"phoneNumber,omitempty"`
+	OTP         string `json:"otp,omitempty"`
+	CustomToken string `json:"customToken,omitempty"`
+
+	// IdP credentials e.g a Google ID token or a Facebook access token
+	IDToken     string `json:"idToken,omitempty"`
+	AccessToken string `json:"accessToken,omitempty"`
+	ProviderID  string `json:"providerId,omitempty"`
+
+	// TenantID is set from the request context when TenantMiddleware runs first
+	TenantID string `json:"-"`
+
+	// SignupPolicy is the login handler's policy (see WithSignupPolicy), for
+	// providers that create users to consult before they do
+	SignupPolicy *SignupPolicy `json:"-"`
+
+	// Raw is the request body, for custom providers that need extra fields
+	Raw json.RawMessage `json:"-"`
+}
+
+// LoginResult is the outcome of a successful login
+type LoginResult struct {
+	User        *auth.UserRecord
+	CustomToken string
+	Tokens      *FirebaseUserTokens
+
+	// IsNewUser reports that the login created the user e.g on their first IdP
+	// sign in. The login handler's signup policy is then applied to them.
+	IsNewUser bool
+
+	// signupChecked reports that the provider applied the signup policy before creating the user
+	signupChecked bool
+}
+
+// LoginProvider authenticates login requests for one sign in method
+type LoginProvider interface {
+	// Name is matched against the `provider` field of login requests
+	Name() string
+
+	// Login authenticates the request. Errors should be *LoginError values so
+	// that they are mapped to the right HTTP status.
+	Login(ctx context.Context, req *LoginRequest) (*LoginResult, error)
+}
+
+// LoginError is a login failure with the HTTP status that it should be reported with
+type LoginError struct {
+	Status  int
+	Message string
+	Err     error
+
+	// RetryAfter is sent in the `Retry-After` header of throttled logins
+	RetryAfter time.Duration
+}
+
+func (e *LoginError) Error() string {
+	if e.Err != nil && e.Err.Error() != e.Message {
+		return fmt.Sprintf("%s: %s", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func (e *LoginError) Unwrap() error {
+	return e.Err
+}
+
+// NewLoginError creates a login error that is reported with the supplied status
+func NewLoginError(status int, message string, err error) *LoginError {
+	return &LoginError{Status: status, Message: message, Err: err}
+}
+
+// IdentityToolkitError is an error response from the Firebase Auth REST API
+// e.g `INVALID_PASSWORD` or `USER_DISABLED`
+type IdentityToolkitError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *IdentityToolkitError) Error() string {
+	return fmt.Sprintf("firebase HTTP error, status code %d: %s", e.StatusCode, e.Message)
+}
+
+// identityToolkitSignInResponse is the unmarshalling target for Firebase Auth REST API sign in responses
+type identityToolkitSignInResponse struct {
+	LocalID      string `json:"localId"`
+	Email        string `json:"email"`
+	IDToken      string `json:"idToken"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    string `json:"expiresIn"`
+}
+
+func (r *identityToolkitSignInResponse) tokens() *FirebaseUserTokens {
+	return &FirebaseUserTokens{
+		IDToken:      r.IDToken,
+		RefreshToken: r.RefreshToken,
+		ExpiresIn:    r.ExpiresIn,
+	}
+}
+
+// postIdentityToolkit sends the payload to a Firebase Auth REST API endpoint, whose URL
+// ends with `key=`, and decodes the response into target
+func postIdentityToolkit(ctx context.Context, endpoint string, payload interface{}, target interface{}) error {
+	apiKey, err := serverutils.GetEnvVar(FirebaseWebAPIKeyEnvVarName)
+	if err != nil {
+		return err
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("unable to marshal Firebase Auth request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*HTTPClientTimeoutSecs)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+apiKey, bytes.NewReader(payloadBytes))
+	if err != nil {
+		return fmt.Errorf("unable to compose Firebase Auth request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	defer CloseRespBody(resp)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		bs, _ := ioutil.ReadAll(resp.Body)
+		apiErr := struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}{}
+		message := string(bs)
+		if json.Unmarshal(bs, &apiErr) == nil && apiErr.Error.Message != "" {
+			message = apiErr.Error.Message
+		}
+		// messages look like `WEAK_PASSWORD : Password should be at least 6 characters`
+		code := strings.TrimSpace(strings.SplitN(message, ":", 2)[0])
+		return &IdentityToolkitError{StatusCode: resp.StatusCode, Code: code, Message: message}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(target); err != nil {
+		return fmt.Errorf("unable to decode Firebase Auth response: %w", err)
+	}
+	return nil
+}
+
+// loginErrorFromIdentityToolkit maps Firebase Auth REST API errors to login errors
+func loginErrorFromIdentityToolkit(err error) error {
+	apiErr := &IdentityToolkitError{}
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	switch apiErr.Code {
+	case "EMAIL_NOT_FOUND", "INVALID_PASSWORD", "INVALID_LOGIN_CREDENTIALS",
+		"INVALID_EMAIL", "INVALID_IDP_RESPONSE", "INVALID_CUSTOM_TOKEN",
+		"CREDENTIAL_MISMATCH", "INVALID_ID_TOKEN":
+		return NewLoginError(http.StatusUnauthorized, "invalid credentials", err)
+	case "USER_DISABLED":
+		return NewLoginError(http.StatusForbidden, "this account has been disabled", err)
+	case "TOO_MANY_ATTEMPTS_TRY_LATER":
+		return NewLoginError(http.StatusTooManyRequests, "too many login attempts, try again later", err)
+	default:
+		return err
+	}
+}
+
+// getTenantUser fetches a project level user, or a tenant user when a tenant ID is supplied
+func getTenantUser(ctx context.Context, tenantID string, uid string) (*auth.UserRecord, error) {
+	if tenantID == "" {
+		return getFirebaseUser(ctx, uid)
+	}
+	authClient, err := GetTenantAuthClient(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return authClient.GetUser(ctx, uid)
+}
+
+// IssueFirebaseLoginTokens mints a custom token for the user and exchanges it for
+// ID and refresh tokens, in the user's tenant if they belong to one
+func IssueFirebaseLoginTokens(ctx context.Context, user *auth.UserRecord) (*LoginResult, error) {
+	if user == nil || user.UserInfo == nil {
+		return nil, fmt.Errorf("nil user record, can't issue login tokens")
+	}
+	var (
+		customToken string
+		tokens      *FirebaseUserTokens
+		err         error
+	)
+	if user.TenantID != "" {
+		customToken, err = CreateTenantFirebaseCustomToken(ctx, user.TenantID, user.UID)
+	} else {
+		customToken, err = CreateFirebaseCustomToken(ctx, user.UID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.TenantID != "" {
+		tokens, err = AuthenticateTenantCustomFirebaseToken(user.TenantID, customToken)
+	} else {
+		tokens, err = AuthenticateCustomFirebaseToken(customToken)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{User: user, CustomToken: customToken, Tokens: tokens}, nil
+}
+
+// NewLoginResponse composes the login response that is sent to clients
+func NewLoginResponse(result *LoginResult) (*LoginResponse, error) {
+	if result == nil || result.User == nil || result.User.UserInfo == nil || result.Tokens == nil {
+		return nil, fmt.Errorf("incomplete login result, can't compose a login response")
+	}
+	expiresIn, err := strconv.Atoi(result.Tokens.ExpiresIn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token expiry %q: %w", result.Tokens.ExpiresIn, err)
+	}
+	user := result.User
+	return &LoginResponse{
+		CustomToken:   result.CustomToken,
+		ExpiresIn:     expiresIn,
+		IDToken:       result.Tokens.IDToken,
+		RefreshToken:  result.Tokens.RefreshToken,
+		UID:           user.UID,
+		Email:         user.Email,
+		DisplayName:   user.DisplayName,
+		EmailVerified: user.EmailVerified,
+		PhoneNumber:   user.PhoneNumber,
+		PhotoURL:      user.PhotoURL,
+		Disabled:      user.Disabled,
+		TenantID:      user.TenantID,
+		ProviderID:    user.ProviderID,
+	}, nil
+}
+
+// WriteLoginError writes a login failure. *LoginError values are reported with their
+// status, other errors as internal server errors.
+func WriteLoginError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	message := err.Error()
+	loginErr := &LoginError{}
+	if errors.As(err, &loginErr) {
+		status = loginErr.Status
+		message = loginErr.Message
+		if loginErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(loginErr.RetryAfter.Seconds())))
+		}
+	}
+	serverutils.WriteJSONResponse(w, errorcodeutil.CustomError{
+		Err:     err,
+		Message: message,
+	}, status)
+}
+
+// writeLoginResult writes the login response for a successful login
+func writeLoginResult(w http.ResponseWriter, result *LoginResult) {
+	loginResp, err := NewLoginResponse(result)
+	if err != nil {
+		WriteLoginError(w, err)
+		return
+	}
+	serverutils.WriteJSONResponse(w, loginResp, http.StatusOK)
+}
+
+// decodeLoginRequest reads a login request from the request body
+func decodeLoginRequest(r *http.Request) (*LoginRequest, error) {
+	if r == nil || r.Body == nil {
+		return nil, NewLoginError(http.StatusBadRequest, "a login request body is required", nil)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxLoginRequestBytes))
+	if err != nil {
+		return nil, NewLoginError(http.StatusBadRequest, "unable to read the login request", err)
+	}
+	req := &LoginRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, NewLoginError(http.StatusBadRequest, "invalid login request", err)
+	}
+	req.Raw = body
+	if tenantID, err := GetTenantIDFromContext(r.Context()); err == nil {
+		req.TenantID = tenantID
+	}
+	return req, nil
+}
+
+// loginConfig holds the settings used by the login handlers
+type loginConfig struct {
+	mfa               *MFAConfig
+	signup            *SignupPolicy
+	profiles          *ProfileSync
+	events            LoginEventSink
+	trustForwardedFor bool
+	checkPassword     func(ctx context.Context, creds *LoginCredentials) (bool, error)
+}
+
+// LoginOption customizes the behavior of the login handlers
+type LoginOption func(*loginConfig)
+
+func newLoginConfig(opts ...LoginOption) *loginConfig {
+	config := &loginConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+	return config
+}
+
+// interrupted reports whether the login of the user was answered with another
+// step (e.g an MFA challenge) instead of tokens
+func (c *loginConfig) interrupted(ctx context.Context, w http.ResponseWriter, user *auth.UserRecord) bool {
+	if c.mfa != nil {
+		return c.mfa.challenge(ctx, w, user)
+	}
+	return false
+}
+
+// GetProviderLoginFunc returns a login handler that dispatches each request to the
+// provider named in its `provider` field. Requests that don't name a provider are
+// handled by the first one.
+func GetProviderLoginFunc(providers ...LoginProvider) http.HandlerFunc {
+	return NewLoginHandler(providers)
+}
+
+// NewLoginHandler is GetProviderLoginFunc with options e.g WithMFA
+func NewLoginHandler(providers []LoginProvider, opts ...LoginOption) http.HandlerFunc {
+	config := newLoginConfig(opts...)
+	byName := map[string]LoginProvider{}
+	for _, provider := range providers {
+		byName[provider.Name()] = provider
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		event := newLoginEvent(r, LoginEventLogin, config.trustForwardedFor)
+		req, err := decodeLoginRequest(r)
+		if err != nil {
+			config.recordLogin(r, event.fail(err))
+			WriteLoginError(w, err)
+			return
+		}
+		if req.Provider == "" && len(providers) > 0 {
+			req.Provider = providers[0].Name()
+		}
+		event.Provider = req.Provider
+		event.Username = firstNonEmpty(req.Username, req.PhoneNumber)
+		provider, ok := byName[req.Provider]
+		if !ok {
+			err := NewLoginError(
+				http.StatusBadRequest, fmt.Sprintf("unsupported login provider %q", req.Provider), nil)
+			config.recordLogin(r, event.fail(err))
+			WriteLoginError(w, err)
+			return
+		}
+
+		req.SignupPolicy = config.signup
+		result, err := provider.Login(r.Context(), req)
+		if err == nil {
+			err = config.checkNewUser(r.Context(), req.TenantID, result)
+		}
+		if err != nil {
+			config.recordLogin(r, event.fail(err))
+			WriteLoginError(w, err)
+			return
+		}
+		config.profiles.syncAfterLogin(r.Context(), result.User)
+		if result.User != nil && config.interrupted(r.Context(), w, result.User) {
+			return // the login is recorded once the second factor is verified
+		}
+		if result.User != nil {
+			event.UID = result.User.UID
+		}
+		event.Success = true
+		config.recordLogin(r, event)
+		writeLoginResult(w, result)
+	}
+}
+
+// PasswordLoginProvider signs users in with their email and password
+type PasswordLoginProvider struct {
+	// Endpoint defaults to FirebasePasswordSigninURL
+	Endpoint string
+
+	// GetUser looks up the signed in user. It defaults to a Firebase Auth lookup.
+	GetUser func(ctx context.Context, tenantID string, uid string) (*auth.UserRecord, error)
+}
+
+// Name returns the provider's name
+func (p *PasswordLoginProvider) Name() string {
+	return LoginProviderPassword
+}
+
+// Login checks the user's email and password with Firebase Auth
+func (p *PasswordLoginProvider) Login(ctx context.Context, req *LoginRequest) (*LoginResult, error) {
+	if req.Username == "" || req.Password == "" {
+		return nil, NewLoginError(
+			http.StatusBadRequest, "invalid credentials, expected a username AND password", nil)
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = FirebasePasswordSigninURL
+	}
+	payload := map[string]interface{}{
+		"email":             req.Username,
+		"password":          req.Password,
+		"returnSecureToken": true,
+	}
+	if req.TenantID != "" {
+		payload["tenantId"] = req.TenantID
+	}
+	resp := &identityToolkitSignInResponse{}
+	if err := postIdentityToolkit(ctx, endpoint, payload, resp); err != nil {
+		return nil, loginErrorFromIdentityToolkit(err)
+	}
+	return signedInResult(ctx, p.GetUser, req.TenantID, resp.LocalID, resp.tokens())
+}
+
+// OTPVerifier checks one time PINs that were sent to phone numbers
+type OTPVerifier interface {
+	VerifyOTP(ctx context.Context, phoneNumber string, otp string) (bool, error)
+}
+
+// PhoneOTPLoginProvider signs users in with their phone number and a one time PIN.
+// Users that don't exist yet are created if the login handler's signup policy
+// allows it.
+type PhoneOTPLoginProvider struct {
+	Verifier OTPVerifier
+
+	// GetOrCreateUser defaults to a Firebase Auth lookup by phone number
+	GetOrCreateUser func(ctx context.Context, tenantID string, phoneNumber string) (*auth.UserRecord, error)
+
+	// SignupPolicy is consulted before the default GetOrCreateUser creates unknown
+	// users when the login handler has no policy.
+	//
+	// Deprecated: use WithSignupPolicy, which applies to every provider.
+	SignupPolicy *SignupPolicy
+
+	// IssueTokens defaults to IssueFirebaseLoginTokens
+	IssueTokens func(ctx context.Context, user *auth.UserRecord) (*LoginResult, error)
+}
+
+// Name returns the provider's name
+func (p *PhoneOTPLoginProvider) Name() string {
+	return LoginProviderPhoneOTP
+}
+
+// Login verifies the one time PIN then issues tokens for the phone number's user
+func (p *PhoneOTPLoginProvider) Login(ctx context.Context, req *LoginRequest) (*LoginResult, error) {
+	if req.PhoneNumber == "" || req.OTP == "" {
+		return nil, NewLoginError(
+			http.StatusBadRequest, "invalid credentials, expected a phone number AND OTP", nil)
+	}
+	if p.Verifier == nil {
+		return nil, fmt.Errorf("no OTP verifier is configured")
+	}
+	valid, err := p.Verifier.VerifyOTP(ctx, req.PhoneNumber, req.OTP)
+	if err != nil {
+		return nil, fmt.Errorf("unable to verify OTP: %w", err)
+	}
+	if !valid {
+		return nil, NewLoginError(http.StatusUnauthorized, "invalid credentials", nil)
+	}
+
+	var (
+		user    *auth.UserRecord
+		created bool
+	)
+	if p.GetOrCreateUser != nil {
+		user, err = p.GetOrCreateUser(ctx, req.TenantID, req.PhoneNumber)
+	} else {
+		policy := req.SignupPolicy
+		if policy == nil {
+			policy = p.SignupPolicy
+		}
+		user, created, err = getOrCreateUserByPhone(ctx, req.TenantID, req.PhoneNumber, policy)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, NewLoginError(http.StatusForbidden, "this account has been disabled", nil)
+	}
+	issueTokens := p.IssueTokens
+	if issueTokens == nil {
+		issueTokens = IssueFirebaseLoginTokens
+	}
+	result, err := issueTokens(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	// the policy was consulted before the user was created
+	result.IsNewUser, result.signupChecked = created, created
+	return result, nil
+}
+
+// getOrCreateUserByPhone also reports whether it created the user
+func getOrCreateUserByPhone(
+	ctx context.Context,
+	tenantID string,
+	phoneNumber string,
+	policy *SignupPolicy,
+) (*auth.UserRecord, bool, error) {
+	var (
+		existingUser *auth.UserRecord
+		userErr      error
+		createUser   func(ctx context.Context, user *auth.UserToCreate) (*auth.UserRecord, error)
+	)
+	if tenantID != "" {
+		authClient, err := GetTenantAuthClient(ctx, tenantID)
+		if err != nil {
+			return nil, false, err
+		}
+		existingUser, userErr = authClient.GetUserByPhoneNumber(ctx, phoneNumber)
+		createUser = authClient.CreateUser
+	} else {
+		authClient, err := GetFirebaseAuthClient(ctx)
+		if err != nil {
+			return nil, false, fmt.Errorf("unable to get or create Firebase client: %w", err)
+		}
+		existingUser, userErr = authClient.GetUserByPhoneNumber(ctx, phoneNumber)
+		createUser = authClient.CreateUser
+	}
+	if userErr == nil {
+		return existingUser, false, nil
+	}
+	if !auth.IsUserNotFound(userErr) {
+		return nil, false, userErr
+	}
+	candidate := &SignupCandidate{PhoneNumber: phoneNumber, TenantID: tenantID}
+	if err := policy.Check(ctx, candidate); err != nil {
+		return nil, false, err
+	}
+	user, err := createUser(ctx, (&auth.UserToCreate{}).PhoneNumber(phoneNumber).Disabled(false))
+	if err != nil {
+		return nil, false, err
+	}
+	return user, true, nil
+}
+
+// CustomTokenLoginProvider signs users in with a custom token minted by a trusted service
+type CustomTokenLoginProvider struct {
+	// VerifyIDToken verifies the exchanged ID token. It defaults to ValidateBearerToken.
+	VerifyIDToken func(ctx context.Context, idToken string) (*auth.Token, error)
+
+	// GetUser looks up the signed in user. It defaults to a Firebase Auth lookup.
+	GetUser func(ctx context.Context, tenantID string, uid string) (*auth.UserRecord, error)
+}
+
+// Name returns the provider's name
+func (p *CustomTokenLoginProvider) Name() string {
+	return LoginProviderCustomToken
+}
+
+// Login exchanges the custom token for ID and refresh tokens
+func (p *CustomTokenLoginProvider) Login(ctx context.Context, req *LoginRequest) (*LoginResult, error) {
+	if req.CustomToken == "" {
+		return nil, NewLoginError(http.StatusBadRequest, "invalid credentials, expected a custom token", nil)
+	}
+	tokens, err := exchangeCustomFirebaseToken(FirebaseTokenExchangePayload{
+		Token:             req.CustomToken,
+		ReturnSecureToken: true,
+		TenantID:          req.TenantID,
+	})
+	if err != nil {
+		return nil, NewLoginError(http.StatusUnauthorized, "invalid credentials", err)
+	}
+	verify := p.VerifyIDToken
+	if verify == nil {
+		verify = ValidateBearerToken
+	}
+	token, err := verify(ctx, tokens.IDToken)
+	if err != nil {
+		return nil, fmt.Errorf("unable to verify the exchanged ID token: %w", err)
+	}
+	result, err := signedInResult(ctx, p.GetUser, req.TenantID, token.UID, tokens)
+	if err != nil {
+		return nil, err
+	}
+	result.CustomToken = req.CustomToken
+	return result, nil
+}
+
+// IdPLoginProvider signs users in with an OAuth ID token or access token issued by a
+// federated identity provider that is enabled on the Firebase project e.g `google.com`.
+// Users whose email address belongs to an account that signs in differently get
+// a 409 response; see AccountExistsWithDifferentCredentialError.
+type IdPLoginProvider struct {
+	// Endpoint defaults to FirebaseIdPSigninURL
+	Endpoint string
+
+	// RequestURI is the URI that the IdP redirected to. It defaults to `http://localhost`.
+	RequestURI string
+
+	// AllowedProviderIDs limits sign in to some providers e.g `google.com` and
+	// `microsoft.com`. Every provider enabled on the project is allowed when empty.
+	AllowedProviderIDs []string
+
+	// GetUser looks up the signed in user. It defaults to a Firebase Auth lookup.
+	GetUser func(ctx context.Context, tenantID string, uid string) (*auth.UserRecord, error)
+}
+
+// Name returns the provider's name
+func (p *IdPLoginProvider) Name() string {
+	return LoginProviderIdP
+}
+
+// Login exchanges the IdP credential for Firebase ID and refresh tokens
+func (p *IdPLoginProvider) Login(ctx context.Context, req *LoginRequest) (*LoginResult, error) {
+	if req.ProviderID != "" && len(p.AllowedProviderIDs) > 0 && !containsString(p.AllowedProviderIDs, req.ProviderID) {
+		return nil, NewLoginError(
+			http.StatusBadRequest, fmt.Sprintf("signing in with %q is not supported", req.ProviderID), nil)
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = FirebaseIdPSigninURL
+	}
+	resp, err := signInWithIdp(ctx, endpoint, &IdPSignInInput{
+		ProviderID:  req.ProviderID,
+		IDToken:     req.IDToken,
+		AccessToken: req.AccessToken,
+		RequestURI:  p.RequestURI,
+		TenantID:    req.TenantID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	result, err := signedInResult(ctx, p.GetUser, req.TenantID, resp.UID, resp.Tokens)
+	if err != nil {
+		return nil, err
+	}
+	result.IsNewUser = resp.IsNewUser
+	return result, nil
+}
+
+// signedInResult looks up a user who was signed in over the Firebase Auth REST API
+func signedInResult(
+	ctx context.Context,
+	getUser func(ctx context.Context, tenantID string, uid string) (*auth.UserRecord, error),
+	tenantID string,
+	uid string,
+	tokens *FirebaseUserTokens,
+) (*LoginResult, error) {
+	if getUser == nil {
+		getUser = getTenantUser
+	}
+	user, err := getUser(ctx, tenantID, uid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get signed in user %s: %w", uid, err)
+	}
+	return &LoginResult{User: user, Tokens: tokens}, nil
+}
@@ -0,0 +1,291 @@
+package firebasetools_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+// stubLoginProvider returns a canned result or error
+type stubLoginProvider struct {
+	name   string
+	result *firebasetools.LoginResult
+	err    error
+	got    *firebasetools.LoginRequest
+}
+
+func (p *stubLoginProvider) Name() string {
+	return p.name
+}
+
+func (p *stubLoginProvider) Login(ctx context.Context, req *firebasetools.LoginRequest) (*firebasetools.LoginResult, error) {
+	p.got = req
+	return p.result, p.err
+}
+
+func testLoginResult(uid string) *firebasetools.LoginResult {
+	return &firebasetools.LoginResult{
+		User: &auth.UserRecord{
+			UserInfo: &auth.UserInfo{UID: uid, Email: uid + "@example.com", ProviderID: "firebase"},
+		},
+		Tokens: &firebasetools.FirebaseUserTokens{
+			IDToken:      "id-token",
+			RefreshToken: "refresh-token",
+			ExpiresIn:    "3600",
+		},
+	}
+}
+
+func loginRequest(t *testing.T, body interface{}) *http.Request {
+	bs, err := json.Marshal(body)
+	assert.Nil(t, err)
+	return httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(bs))
+}
+
+// newTestIdentityToolkit serves Firebase Auth REST API sign in responses
+func newTestIdentityToolkit(t *testing.T, handler func(payload map[string]interface{}) (int, interface{})) string {
+	t.Setenv(firebasetools.FirebaseWebAPIKeyEnvVarName, "test-api-key")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "test-api-key", r.URL.Query().Get("key"))
+		payload := map[string]interface{}{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&payload))
+		status, body := handler(payload)
+		w.WriteHeader(status)
+		assert.Nil(t, json.NewEncoder(w).Encode(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/?key="
+}
+
+func identityToolkitError(message string) (int, interface{}) {
+	return http.StatusBadRequest, map[string]interface{}{
+		"error": map[string]interface{}{"code": 400, "message": message},
+	}
+}
+
+func stubGetUser(ctx context.Context, tenantID string, uid string) (*auth.UserRecord, error) {
+	return testLoginResult(uid).User, nil
+}
+
+func TestGetProviderLoginFunc(t *testing.T) {
+	password := &stubLoginProvider{name: firebasetools.LoginProviderPassword, result: testLoginResult("password-uid")}
+	phone := &stubLoginProvider{
+		name: firebasetools.LoginProviderPhoneOTP,
+		err:  firebasetools.NewLoginError(http.StatusUnauthorized, "invalid credentials", nil),
+	}
+	broken := &stubLoginProvider{name: "broken", err: fmt.Errorf("unavailable")}
+	loginFunc := firebasetools.GetProviderLoginFunc(password, phone, broken)
+
+	tests := []struct {
+		name       string
+		r          *http.Request
+		wantStatus int
+		wantUID    string
+	}{
+		{
+			name:       "named provider",
+			r:          loginRequest(t, map[string]string{"provider": "password", "username": "a", "password": "b"}),
+			wantStatus: http.StatusOK,
+			wantUID:    "password-uid",
+		},
+		{
+			name:       "defaults to the first provider",
+			r:          loginRequest(t, map[string]string{"username": "a", "password": "b"}),
+			wantStatus: http.StatusOK,
+			wantUID:    "password-uid",
+		},
+		{
+			name:       "login errors keep their status",
+			r:          loginRequest(t, map[string]string{"provider": "phone"}),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "other errors are internal",
+			r:          loginRequest(t, map[string]string{"provider": "broken"}),
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "unknown provider",
+			r:          loginRequest(t, map[string]string{"provider": "carrier-pigeon"}),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "malformed body",
+			r:          httptest.NewRequest(http.MethodPost, "/login", bytes.NewBufferString("{")),
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			loginFunc(rw, tt.r)
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			if tt.wantUID == "" {
+				return
+			}
+			resp := firebasetools.LoginResponse{}
+			assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &resp))
+			assert.Equal(t, tt.wantUID, resp.UID)
+			assert.Equal(t, 3600, resp.ExpiresIn)
+			assert.Equal(t, "id-token", resp.IDToken)
+		})
+	}
+	assert.Equal(t, "a", password.got.Username)
+	assert.NotEmpty(t, password.got.Raw)
+}
+
+func TestGetProviderLoginFunc_TenantFromContext(t *testing.T) {
+	provider := &stubLoginProvider{name: firebasetools.LoginProviderPassword, result: testLoginResult("uid")}
+	r := loginRequest(t, map[string]string{"username": "a", "password": "b"})
+	r = r.WithContext(context.WithValue(r.Context(), firebasetools.TenantIDContextKey, "tenant-a"))
+
+	rw := httptest.NewRecorder()
+	firebasetools.GetProviderLoginFunc(provider)(rw, r)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "tenant-a", provider.got.TenantID)
+}
+
+func TestPasswordLoginProvider(t *testing.T) {
+	endpoint := newTestIdentityToolkit(t, func(payload map[string]interface{}) (int, interface{}) {
+		switch payload["password"] {
+		case "correct":
+			return http.StatusOK, map[string]interface{}{
+				"localId":      "password-uid",
+				"idToken":      "id-token",
+				"refreshToken": "refresh-token",
+				"expiresIn":    "3600",
+			}
+		case "disabled":
+			return identityToolkitError("USER_DISABLED")
+		case "throttled":
+			return identityToolkitError("TOO_MANY_ATTEMPTS_TRY_LATER : Access to this account has been temporarily disabled")
+		default:
+			return identityToolkitError("INVALID_PASSWORD")
+		}
+	})
+	provider := &firebasetools.PasswordLoginProvider{Endpoint: endpoint, GetUser: stubGetUser}
+
+	tests := []struct {
+		name       string
+		password   string
+		wantStatus int
+	}{
+		{name: "correct password", password: "correct"},
+		{name: "wrong password", password: "wrong", wantStatus: http.StatusUnauthorized},
+		{name: "disabled account", password: "disabled", wantStatus: http.StatusForbidden},
+		{name: "throttled account", password: "throttled", wantStatus: http.StatusTooManyRequests},
+		{name: "missing password", password: "", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := provider.Login(context.Background(), &firebasetools.LoginRequest{
+				Username: "user@example.com",
+				Password: tt.password,
+			})
+			if tt.wantStatus == 0 {
+				assert.Nil(t, err)
+				assert.Equal(t, "password-uid", result.User.UID)
+				assert.Equal(t, "refresh-token", result.Tokens.RefreshToken)
+				return
+			}
+			loginErr := &firebasetools.LoginError{}
+			assert.True(t, errors.As(err, &loginErr))
+			assert.Equal(t, tt.wantStatus, loginErr.Status)
+		})
+	}
+}
+
+type stubOTPVerifier map[string]string
+
+func (v stubOTPVerifier) VerifyOTP(ctx context.Context, phoneNumber string, otp string) (bool, error) {
+	return v[phoneNumber] == otp, nil
+}
+
+func TestPhoneOTPLoginProvider(t *testing.T) {
+	provider := &firebasetools.PhoneOTPLoginProvider{
+		Verifier: stubOTPVerifier{"+254700000000": "1234"},
+		GetOrCreateUser: func(ctx context.Context, tenantID string, phoneNumber string) (*auth.UserRecord, error) {
+			return &auth.UserRecord{UserInfo: &auth.UserInfo{UID: "phone-uid", PhoneNumber: phoneNumber}}, nil
+		},
+		IssueTokens: func(ctx context.Context, user *auth.UserRecord) (*firebasetools.LoginResult, error) {
+			result := testLoginResult(user.UID)
+			result.User = user
+			return result, nil
+		},
+	}
+
+	result, err := provider.Login(context.Background(), &firebasetools.LoginRequest{
+		PhoneNumber: "+254700000000",
+		OTP:         "1234",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "phone-uid", result.User.UID)
+	assert.Equal(t, "+254700000000", result.User.PhoneNumber)
+
+	_, err = provider.Login(context.Background(), &firebasetools.LoginRequest{
+		PhoneNumber: "+254700000000",
+		OTP:         "0000",
+	})
+	loginErr := &firebasetools.LoginError{}
+	assert.True(t, errors.As(err, &loginErr))
+	assert.Equal(t, http.StatusUnauthorized, loginErr.Status)
+
+	_, err = provider.Login(context.Background(), &firebasetools.LoginRequest{PhoneNumber: "+254700000000"})
+	assert.True(t, errors.As(err, &loginErr))
+	assert.Equal(t, http.StatusBadRequest, loginErr.Status)
+}
+
+func TestIdPLoginProvider(t *testing.T) {
+	var gotPostBody url.Values
+	endpoint := newTestIdentityToolkit(t, func(payload map[string]interface{}) (int, interface{}) {
+		gotPostBody, _ = url.ParseQuery(payload["postBody"].(string))
+		assert.Equal(t, "tenant-a", payload["tenantId"])
+		return http.StatusOK, map[string]interface{}{
+			"localId":      "google-uid",
+			"idToken":      "id-token",
+			"refreshToken": "refresh-token",
+			"expiresIn":    "3600",
+		}
+	})
+	provider := &firebasetools.IdPLoginProvider{Endpoint: endpoint, GetUser: stubGetUser}
+
+	result, err := provider.Login(context.Background(), &firebasetools.LoginRequest{
+		ProviderID: "google.com",
+		IDToken:    "google-id-token",
+		TenantID:   "tenant-a",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "google-uid", result.User.UID)
+	assert.Equal(t, "google.com", gotPostBody.Get("providerId"))
+	assert.Equal(t, "google-id-token", gotPostBody.Get("id_token"))
+
+	_, err = provider.Login(context.Background(), &firebasetools.LoginRequest{ProviderID: "google.com"})
+	loginErr := &firebasetools.LoginError{}
+	assert.True(t, errors.As(err, &loginErr))
+	assert.Equal(t, http.StatusBadRequest, loginErr.Status)
+}
+
+func TestNewLoginResponse(t *testing.T) {
+	resp, err := firebasetools.NewLoginResponse(testLoginResult("uid"))
+	assert.Nil(t, err)
+	assert.Equal(t, "uid", resp.UID)
+	assert.Equal(t, "uid@example.com", resp.Email)
+
+	result := testLoginResult("uid")
+	result.Tokens.ExpiresIn = "an hour"
+	_, err = firebasetools.NewLoginResponse(result)
+	assert.NotNil(t, err)
+
+	_, err = firebasetools.NewLoginResponse(&firebasetools.LoginResult{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,352 @@
+package firebasetools
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"firebase.google.com/go/auth"
+)
+
+const (
+	// DefaultSessionCookieName is the session cookie cleared on logout. Firebase
+	// Hosting only forwards cookies with this name to backends.
+	DefaultSessionCookieName = "__session"
+
+	// RevokedSessionsCollectionName is the (unsuffixed) Firestore collection that holds signed out sessions
+	RevokedSessionsCollectionName = "revoked_sessions"
+
+	// SessionAuditTypeName is the audit log type name for session events
+	SessionAuditTypeName = "session"
+
+	// LogoutAuditOperation is the audit log operation for logouts
+	LogoutAuditOperation = "logout"
+)
+
+// RevokedSessionStore keeps the sessions that were signed out.
+//
+// Firebase can only revoke all of a user's refresh tokens, so a session is
+// identified by the UID and the `auth_time` that all its ID tokens share.
+// Revoking refresh tokens doesn't stop the ID tokens that were already issued
+// either, so signing out of all sessions also records when it happened and
+// the ID tokens that were issued earlier are rejected.
+type RevokedSessionStore interface {
+	RevokeSession(ctx context.Context, uid string, authTime int64) error
+
+	// RevokeAllSessions signs out every session of the user whose ID tokens were issued before revokedAt
+	RevokeAllSessions(ctx context.Context, uid string, revokedAt time.Time) error
+
+	// IsSessionRevoked reports whether the token's session was signed out
+	IsSessionRevoked(ctx context.Context, token *auth.Token) (bool, error)
+}
+
+func revokedSessionKey(uid string, authTime int64) string {
+	return uid + Sep + strconv.FormatInt(authTime, 10)
+}
+
+func revokedUserKey(uid string) string {
+	return uid + Sep + "all"
+}
+
+// InMemoryRevokedSessionStore keeps signed out sessions in process memory.
+// It suits single instance deployments and tests.
+type InMemoryRevokedSessionStore struct {
+	mu        sync.Mutex
+	sessions  map[string]bool
+	revokedAt map[string]int64
+}
+
+// NewInMemoryRevokedSessionStore creates an empty in-memory revoked session store
+func NewInMemoryRevokedSessionStore() *InMemoryRevokedSessionStore {
+	return &InMemoryRevokedSessionStore{sessions: map[string]bool{}, revokedAt: map[string]int64{}}
+}
+
+// RevokeSession signs out the session
+func (s *InMemoryRevokedSessionStore) RevokeSession(ctx context.Context, uid string, authTime int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[revokedSessionKey(uid, authTime)] = true
+	return nil
+}
+
+// RevokeAllSessions signs out the user's sessions
+func (s *InMemoryRevokedSessionStore) RevokeAllSessions(ctx context.Context, uid string, revokedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if revokedAt.Unix() > s.revokedAt[uid] {
+		s.revokedAt[uid] = revokedAt.Unix()
+	}
+	return nil
+}
+
+// IsSessionRevoked reports whether the token's session was signed out
+func (s *InMemoryRevokedSessionStore) IsSessionRevoked(ctx context.Context, token *auth.Token) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[revokedSessionKey(token.UID, token.AuthTime)] || token.IssuedAt < s.revokedAt[token.UID], nil
+}
+
+// FirestoreRevokedSessionStore keeps signed out sessions in a Firestore collection
+// so that they are rejected by all the instances of a service
+type FirestoreRevokedSessionStore struct {
+	client     *firestore.Client
+	collection string
+}
+
+// NewFirestoreRevokedSessionStore creates a Firestore backed revoked session store.
+// When no collection is supplied, the suffixed `revoked_sessions` collection is used.
+func NewFirestoreRevokedSessionStore(client *firestore.Client, collection string) *FirestoreRevokedSessionStore {
+	if collection == "" {
+		collection = SuffixCollection(RevokedSessionsCollectionName)
+	}
+	return &FirestoreRevokedSessionStore{client: client, collection: collection}
+}
+
+func (s *FirestoreRevokedSessionStore) ref(key string) *firestore.DocumentRef {
+	digest := sha256.Sum256([]byte(key))
+	return s.client.Collection(s.collection).Doc(hex.EncodeToString(digest[:]))
+}
+
+// RevokeSession signs out the session
+func (s *FirestoreRevokedSessionStore) RevokeSession(ctx context.Context, uid string, authTime int64) error {
+	_, err := s.ref(revokedSessionKey(uid, authTime)).Set(ctx, map[string]interface{}{
+		"uid":       uid,
+		"authTime":  authTime,
+		"revokedAt": time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to revoke session of %s: %w", uid, err)
+	}
+	return nil
+}
+
+// RevokeAllSessions signs out the user's sessions
+func (s *FirestoreRevokedSessionStore) RevokeAllSessions(ctx context.Context, uid string, revokedAt time.Time) error {
+	_, err := s.ref(revokedUserKey(uid)).Set(ctx, map[string]interface{}{
+		"uid":       uid,
+		"revokedAt": revokedAt.Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to revoke the sessions of %s: %w", uid, err)
+	}
+	return nil
+}
+
+// IsSessionRevoked reports whether the token's session was signed out
+func (s *FirestoreRevokedSessionStore) IsSessionRevoked(ctx context.Context, token *auth.Token) (bool, error) {
+	docs, err := s.client.GetAll(ctx, []*firestore.DocumentRef{
+		s.ref(revokedSessionKey(token.UID, token.AuthTime)),
+		s.ref(revokedUserKey(token.UID)),
+	})
+	if err != nil {
+		return false, fmt.Errorf("unable to check session of %s: %w", token.UID, err)
+	}
+	if docs[0].Exists() {
+		return true, nil
+	}
+	if !docs[1].Exists() {
+		return false, nil
+	}
+	revokedAt, err := docs[1].DataAt("revokedAt")
+	if err != nil {
+		return false, fmt.Errorf("unable to read the session revocation of %s: %w", token.UID, err)
+	}
+	unix, _ := revokedAt.(int64)
+	return token.IssuedAt < unix, nil
+}
+
+// WithRevokedSessions makes the authentication and impersonation middleware reject
+// ID tokens whose session was signed out with GetLogoutFunc
+func WithRevokedSessions(store RevokedSessionStore) AuthenticationOption {
+	return func(c *authenticationConfig) {
+		c.revokedSessions = store
+	}
+}
+
+// LogoutConfig configures the logout handler
+type LogoutConfig struct {
+	// CurrentSessionOnly signs out the session of the token that the request was
+	// made with, instead of revoking all the user's refresh tokens. The request
+	// can still ask for all sessions to be signed out.
+	CurrentSessionOnly bool
+
+	// RevokedSessions records signed out sessions. It should also be passed to
+	// the authentication and impersonation middleware with WithRevokedSessions.
+	// It is required when CurrentSessionOnly is set and to sign out of
+	// impersonation. Without it, the ID tokens of signed out sessions keep
+	// working until they expire, in up to an hour.
+	RevokedSessions RevokedSessionStore
+
+	// SessionCookieName defaults to `__session`
+	SessionCookieName string
+
+	// UnregisterDeviceToken removes the push notification device token that
+	// the client supplied, if any
+	UnregisterDeviceToken func(ctx context.Context, uid string, deviceToken string) error
+
+	// Recorder receives an audit log entry for every logout, if set
+	Recorder AuditLogRecorder
+
+	// RevokeRefreshTokens defaults to revoking the user's Firebase refresh tokens
+	RevokeRefreshTokens func(ctx context.Context, tenantID string, uid string) error
+
+	// Events receives a logout event for every logout, if set
+	Events            LoginEventSink
+	TrustForwardedFor bool
+}
+
+// LogoutRequest is the (optional) body of logout requests
+type LogoutRequest struct {
+	// DeviceToken is the push notification token of the device that is signing out
+	DeviceToken string `json:"deviceToken,omitempty"`
+
+	// AllSessions signs the user out of every device
+	AllSessions bool `json:"allSessions,omitempty"`
+}
+
+// logoutAuditSnapshot is the JSON snapshot saved with logout audit logs
+type logoutAuditSnapshot struct {
+	AllSessions bool   `json:"allSessions"`
+	AuthTime    int64  `json:"authTime"`
+	ActorUID    string `json:"actorUID,omitempty"`
+	RemoteIP    string `json:"remoteIP"`
+	UserAgent   string `json:"userAgent"`
+}
+
+func revokeFirebaseRefreshTokens(ctx context.Context, tenantID string, uid string) error {
+	if tenantID != "" {
+		authClient, err := GetTenantAuthClient(ctx, tenantID)
+		if err != nil {
+			return err
+		}
+		return authClient.RevokeRefreshTokens(ctx, uid)
+	}
+	authClient, err := GetFirebaseAuthClient(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get or create Firebase client: %w", err)
+	}
+	return authClient.RevokeRefreshTokens(ctx, uid)
+}
+
+// GetLogoutFunc returns a handler that signs the caller out. It should run after
+// AuthenticationMiddleware.
+//
+// It revokes the caller's refresh tokens (or only the current session), clears
+// the session cookie and unregisters the supplied push device token. Failing to
+// unregister the device token or to audit the logout doesn't fail the logout.
+//
+// Impersonated requests only end the impersonation session: the impersonated
+// user stays signed in, and the actor has to sign in again to act as them.
+func GetLogoutFunc(config LogoutConfig, opts ...AuthenticationOption) http.HandlerFunc {
+	authConfig := newAuthenticationConfig(opts...)
+	cookieName := config.SessionCookieName
+	if cookieName == "" {
+		cookieName = DefaultSessionCookieName
+	}
+	revokeRefreshTokens := config.RevokeRefreshTokens
+	if revokeRefreshTokens == nil {
+		revokeRefreshTokens = revokeFirebaseRefreshTokens
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := GetUserTokenFromContext(r.Context())
+		if err != nil {
+			authConfig.errorRenderer(w, r, NewAuthError("", err.Error()))
+			return
+		}
+
+		req := &LogoutRequest{}
+		if r.Body != nil {
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil && !errors.Is(err, io.EOF) {
+				authConfig.errorRenderer(w, r, NewAuthError(AuthErrorInvalidRequest, "invalid logout request"))
+				return
+			}
+		}
+
+		event := newLoginEvent(r, LoginEventLogout, config.TrustForwardedFor)
+		event.UID = token.UID
+		event.Provider = token.Firebase.SignInProvider
+		event.TenantID = token.Firebase.Tenant
+
+		actor, _ := ActorFromContext(r.Context())
+		allSessions := (req.AllSessions || !config.CurrentSessionOnly) && actor == nil
+		switch {
+		case allSessions:
+			revokedAt := time.Now()
+			err = revokeRefreshTokens(r.Context(), token.Firebase.Tenant, token.UID)
+			if err == nil && config.RevokedSessions != nil {
+				err = config.RevokedSessions.RevokeAllSessions(r.Context(), token.UID, revokedAt)
+			}
+		case config.RevokedSessions == nil:
+			err = fmt.Errorf("no revoked session store is configured")
+		default:
+			err = config.RevokedSessions.RevokeSession(r.Context(), token.UID, token.AuthTime)
+		}
+		if err != nil {
+			log.Printf("unable to sign out %s: %s", token.UID, err)
+			recordLoginEvent(r.Context(), config.Events, event.fail(fmt.Errorf("unable to sign out")))
+			writeInternalProblem(w, r, "unable to sign out")
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookieName,
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			Expires:  time.Unix(0, 0),
+			HttpOnly: true,
+			Secure:   true,
+		})
+
+		if req.DeviceToken != "" && config.UnregisterDeviceToken != nil {
+			if err := config.UnregisterDeviceToken(r.Context(), token.UID, req.DeviceToken); err != nil {
+				log.Printf("unable to unregister the device token of %s: %s", token.UID, err)
+			}
+		}
+
+		event.Success = true
+		recordLoginEvent(r.Context(), config.Events, event)
+
+		if config.Recorder != nil {
+			performedBy := token.UID
+			snapshot := logoutAuditSnapshot{
+				AllSessions: allSessions,
+				AuthTime:    token.AuthTime,
+				RemoteIP:    clientIP(r, false),
+				UserAgent:   r.UserAgent(),
+			}
+			if actor != nil {
+				performedBy = actor.UID
+				snapshot.ActorUID = actor.UID
+			}
+			entry, err := NewAuditLog(SessionAuditTypeName, token.UID, LogoutAuditOperation, performedBy, snapshot)
+			if err == nil {
+				err = config.Recorder.RecordAuditLog(r.Context(), entry)
+			}
+			if err != nil {
+				log.Printf("unable to audit the logout of %s: %s", token.UID, err)
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// isSessionRevoked checks a token against the configured revoked session store, if any
+func (c *authenticationConfig) isSessionRevoked(ctx context.Context, token *auth.Token) (bool, error) {
+	if c.revokedSessions == nil || token == nil {
+		return false, nil
+	}
+	return c.revokedSessions.IsSessionRevoked(ctx, token)
+}
@@ -0,0 +1,223 @@
+package firebasetools_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func logoutRequest(token *auth.Token, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/logout", bytes.NewBufferString(body))
+	if token != nil {
+		r = r.WithContext(context.WithValue(r.Context(), firebasetools.AuthTokenContextKey, token))
+	}
+	return r
+}
+
+func TestGetLogoutFunc(t *testing.T) {
+	token := &auth.Token{UID: "a-uid", AuthTime: 1600000000, IssuedAt: 1600000000}
+	token.Firebase.Tenant = "tenant-a"
+	// a session that starts after the logout
+	later := &auth.Token{UID: "a-uid", AuthTime: 1700000000, IssuedAt: time.Now().Add(time.Minute).Unix()}
+
+	tests := []struct {
+		name            string
+		currentOnly     bool
+		r               *http.Request
+		wantStatus      int
+		wantRevokedAll  bool
+		wantRevokedThis bool
+		wantDevice      string
+	}{
+		{
+			name:           "revokes all sessions by default",
+			r:              logoutRequest(token, ""),
+			wantStatus:     http.StatusNoContent,
+			wantRevokedAll: true,
+		},
+		{
+			name:            "current session only",
+			currentOnly:     true,
+			r:               logoutRequest(token, `{"deviceToken": "device-a"}`),
+			wantStatus:      http.StatusNoContent,
+			wantRevokedThis: true,
+			wantDevice:      "device-a",
+		},
+		{
+			name:           "client asks for all sessions",
+			currentOnly:    true,
+			r:              logoutRequest(token, `{"allSessions": true}`),
+			wantStatus:     http.StatusNoContent,
+			wantRevokedAll: true,
+		},
+		{
+			name:       "unauthenticated",
+			r:          logoutRequest(nil, ""),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "malformed body",
+			r:          logoutRequest(token, "{"),
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessions := firebasetools.NewInMemoryRevokedSessionStore()
+			recorder := &firebasetools.InMemoryAuditLogRecorder{}
+			revokedAll := false
+			unregistered := ""
+			logout := firebasetools.GetLogoutFunc(firebasetools.LogoutConfig{
+				CurrentSessionOnly: tt.currentOnly,
+				RevokedSessions:    sessions,
+				Recorder:           recorder,
+				RevokeRefreshTokens: func(ctx context.Context, tenantID string, uid string) error {
+					assert.Equal(t, "tenant-a", tenantID)
+					assert.Equal(t, "a-uid", uid)
+					revokedAll = true
+					return nil
+				},
+				UnregisterDeviceToken: func(ctx context.Context, uid string, deviceToken string) error {
+					unregistered = deviceToken
+					return nil
+				},
+			})
+
+			rw := httptest.NewRecorder()
+			logout(rw, tt.r)
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			assert.Equal(t, tt.wantRevokedAll, revokedAll)
+			assert.Equal(t, tt.wantDevice, unregistered)
+
+			revoked, err := sessions.IsSessionRevoked(context.Background(), token)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.wantRevokedAll || tt.wantRevokedThis, revoked, "the ID token stops working")
+			revoked, err = sessions.IsSessionRevoked(context.Background(), later)
+			assert.Nil(t, err)
+			assert.False(t, revoked)
+
+			if tt.wantStatus != http.StatusNoContent {
+				assert.Empty(t, recorder.Entries())
+				return
+			}
+			cookies := rw.Result().Cookies()
+			assert.Len(t, cookies, 1)
+			assert.Equal(t, firebasetools.DefaultSessionCookieName, cookies[0].Name)
+			assert.True(t, cookies[0].MaxAge < 0)
+
+			entries := recorder.Entries()
+			assert.Len(t, entries, 1)
+			assert.Equal(t, firebasetools.LogoutAuditOperation, entries[0].Operation)
+			snapshot := map[string]interface{}{}
+			assert.Nil(t, json.Unmarshal(*entries[0].JSON, &snapshot))
+			assert.Equal(t, tt.wantRevokedAll, snapshot["allSessions"])
+		})
+	}
+}
+
+func TestGetLogoutFunc_Impersonated(t *testing.T) {
+	ctx := context.Background()
+	sessions := firebasetools.NewInMemoryRevokedSessionStore()
+	recorder := &firebasetools.InMemoryAuditLogRecorder{}
+	adminToken := &auth.Token{UID: "admin-uid", AuthTime: 1600000000, IssuedAt: 1600000000}
+	admin := &firebasetools.Principal{UID: "admin-uid", Claims: map[string]interface{}{"admin": true}}
+	patient := &auth.UserRecord{UserInfo: &auth.UserInfo{UID: "patient-uid", ProviderID: "firebase"}}
+	impersonation := firebasetools.ImpersonationMiddleware(firebasetools.ImpersonationConfig{
+		Recorder: recorder,
+		GetUser: func(ctx context.Context, uid string) (*auth.UserRecord, error) {
+			return patient, nil
+		},
+	}, firebasetools.WithRevokedSessions(sessions))
+	logout := firebasetools.GetLogoutFunc(firebasetools.LogoutConfig{
+		RevokedSessions: sessions,
+		Recorder:        recorder,
+		RevokeRefreshTokens: func(ctx context.Context, tenantID string, uid string) error {
+			t.Errorf("signing out of impersonation must not sign %s out", uid)
+			return nil
+		},
+	})
+	actAsPatient := func(body string) *http.Request {
+		r := logoutRequest(adminToken, body)
+		r.Header.Set(firebasetools.ImpersonationHeaderName, "patient-uid")
+		return r.WithContext(firebasetools.WithPrincipal(r.Context(), admin))
+	}
+
+	rw := httptest.NewRecorder()
+	impersonation(logout).ServeHTTP(rw, actAsPatient(`{"allSessions": true}`))
+	assert.Equal(t, http.StatusNoContent, rw.Code)
+
+	// the patient's own sessions are untouched
+	revoked, err := sessions.IsSessionRevoked(ctx, &auth.Token{UID: "patient-uid", AuthTime: 1650000000, IssuedAt: 1650000000})
+	assert.Nil(t, err)
+	assert.False(t, revoked)
+
+	entries := recorder.Entries()
+	assert.Equal(t, "admin-uid", entries[len(entries)-1].UID, "the logout is attributed to the actor")
+
+	// the impersonation session has ended
+	rw = httptest.NewRecorder()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("signed out impersonation should not reach the handler")
+	})
+	impersonation(next).ServeHTTP(rw, actAsPatient(""))
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+}
+
+func TestGetLogoutFunc_CurrentSessionRequiresStore(t *testing.T) {
+	logout := firebasetools.GetLogoutFunc(firebasetools.LogoutConfig{CurrentSessionOnly: true})
+	rw := httptest.NewRecorder()
+	logout(rw, logoutRequest(&auth.Token{UID: "a-uid"}, ""))
+	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+}
+
+func TestAuthenticationMiddleware_WithRevokedSessions(t *testing.T) {
+	ctx := context.Background()
+	sessions := firebasetools.NewInMemoryRevokedSessionStore()
+	assert.Nil(t, sessions.RevokeSession(ctx, "a-uid", 1600000000))
+	assert.Nil(t, sessions.RevokeAllSessions(ctx, "b-uid", time.Unix(1650000000, 0)))
+
+	withToken := func(uid string, authTime int64, issuedAt int64) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		token := &auth.Token{UID: uid, AuthTime: authTime, IssuedAt: issuedAt}
+		return r.WithContext(context.WithValue(r.Context(), firebasetools.ContextKey("token"), token))
+	}
+	check := func(r *http.Request, fa firebasetools.IFirebaseApp) (bool, map[string]string, *auth.Token) {
+		token, _ := r.Context().Value(firebasetools.ContextKey("token")).(*auth.Token)
+		return true, nil, token
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := firebasetools.AuthenticationMiddleware(
+		&firebasetools.MockFirebaseApp{},
+		firebasetools.WithAuthChecks(check),
+		firebasetools.WithRevokedSessions(sessions),
+	)(next)
+
+	tests := []struct {
+		name       string
+		r          *http.Request
+		wantStatus int
+	}{
+		{"signed out session", withToken("a-uid", 1600000000, 1600003600), http.StatusUnauthorized},
+		{"the user's other sessions are still valid", withToken("a-uid", 1700000000, 1700000000), http.StatusOK},
+		{"token issued before signing out of all sessions", withToken("b-uid", 1700000000, 1649999999), http.StatusUnauthorized},
+		{"token issued after signing out of all sessions", withToken("b-uid", 1700000000, 1650000000), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, tt.r)
+			assert.Equal(t, tt.wantStatus, rw.Code)
+			if tt.wantStatus == http.StatusUnauthorized {
+				assert.Contains(t, rw.Header().Get("WWW-Authenticate"), `error="invalid_token"`)
+			}
+		})
+	}
+}
@@ -0,0 +1,845 @@
+package firebasetools
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" // #nosec G505 RFC 6238 TOTP codes are HMAC-SHA1 based
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/serverutils"
+)
+
+const (
+	// MFAEnrollmentsCollectionName is the (unsuffixed) Firestore collection that holds TOTP enrollments
+	MFAEnrollmentsCollectionName = "mfa_enrollments"
+
+	// TOTPPeriod is the lifetime of each TOTP code
+	TOTPPeriod = 30 * time.Second
+
+	// TOTPDigits is the length of TOTP codes
+	TOTPDigits = 6
+
+	// RecoveryCodeCount is the number of recovery codes issued on enrollment
+	RecoveryCodeCount = 10
+
+	// DefaultMFAChallengeTTL is how long users have to enter their second factor
+	DefaultMFAChallengeTTL = 5 * time.Minute
+
+	// DefaultMFAChallengeMaxFailures is how many wrong codes invalidate an MFA challenge
+	DefaultMFAChallengeMaxFailures = 5
+
+	// totpSecretBytes is the size of generated TOTP secrets, as recommended by RFC 4226
+	totpSecretBytes = 20
+)
+
+// base32NoPadding encodes TOTP secrets the way authenticator apps expect them
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret creates a random, base32 encoded, TOTP secret
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("unable to generate a TOTP secret: %w", err)
+	}
+	return base32NoPadding.EncodeToString(secret), nil
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	normalized := strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := base32NoPadding.DecodeString(strings.TrimRight(normalized, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TOTP secret: %w", err)
+	}
+	return key, nil
+}
+
+// hotp computes the RFC 4226 one time password for the counter
+func hotp(key []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	_, _ = mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(TOTPPeriod.Seconds())
+}
+
+// TOTPCode computes the TOTP code of the secret at the supplied time
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(totpStep(t))), nil
+}
+
+// matchTOTPCode returns the time step that the code is valid for, allowing one step
+// of clock skew either way, or -1 if the code is invalid
+func matchTOTPCode(secret string, code string, t time.Time) int64 {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != TOTPDigits {
+		return -1
+	}
+	step := totpStep(t)
+	for _, candidate := range []int64{step, step - 1, step + 1} {
+		if hmac.Equal([]byte(hotp(key, uint64(candidate))), []byte(code)) {
+			return candidate
+		}
+	}
+	return -1
+}
+
+// TOTPURI composes the `otpauth://` URI that authenticator apps enroll with,
+// usually shown as a QR code
+func TOTPURI(issuer string, accountName string, secret string) string {
+	label := url.PathEscape(accountName)
+	if issuer != "" {
+		label = url.PathEscape(issuer) + ":" + label
+	}
+	params := url.Values{
+		"secret":    {secret},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(TOTPDigits)},
+		"period":    {fmt.Sprint(int(TOTPPeriod.Seconds()))},
+	}
+	if issuer != "" {
+		params.Set("issuer", issuer)
+	}
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// MFAEnrollment is a user's TOTP second factor.
+// Recovery codes are only kept as SHA-256 hashes.
+type MFAEnrollment struct {
+	UID                string    `json:"uid" firestore:"uid"`
+	Secret             string    `json:"secret" firestore:"secret"`
+	Verified           bool      `json:"verified" firestore:"verified"`
+	RecoveryCodeHashes []string  `json:"recoveryCodeHashes" firestore:"recoveryCodeHashes"`
+	LastUsedStep       int64     `json:"lastUsedStep" firestore:"lastUsedStep"`
+	CreatedAt          time.Time `json:"createdAt" firestore:"createdAt"`
+	VerifiedAt         time.Time `json:"verifiedAt" firestore:"verifiedAt"`
+}
+
+// MFAStore keeps TOTP enrollments. Implementations must be safe for concurrent use.
+type MFAStore interface {
+	// Get returns the user's enrollment, or nil if they have none
+	Get(ctx context.Context, uid string) (*MFAEnrollment, error)
+
+	// Update atomically replaces the user's enrollment with the one returned by fn,
+	// which receives nil if the user has none
+	Update(ctx context.Context, uid string, fn func(current *MFAEnrollment) (*MFAEnrollment, error)) error
+
+	// Delete removes the user's enrollment e.g when an administrator resets it
+	Delete(ctx context.Context, uid string) error
+}
+
+// InMemoryMFAStore keeps TOTP enrollments in process memory.
+// It suits tests; enrollments are lost when the process exits.
+type InMemoryMFAStore struct {
+	mu          sync.Mutex
+	enrollments map[string]MFAEnrollment
+}
+
+// NewInMemoryMFAStore creates an empty in-memory MFA store
+func NewInMemoryMFAStore() *InMemoryMFAStore {
+	return &InMemoryMFAStore{enrollments: map[string]MFAEnrollment{}}
+}
+
+// Get returns a copy of the user's enrollment
+func (s *InMemoryMFAStore) Get(ctx context.Context, uid string) (*MFAEnrollment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	enrollment, ok := s.enrollments[uid]
+	if !ok {
+		return nil, nil
+	}
+	enrollment.RecoveryCodeHashes = append([]string{}, enrollment.RecoveryCodeHashes...)
+	return &enrollment, nil
+}
+
+// Update replaces the user's enrollment while holding the store's lock
+func (s *InMemoryMFAStore) Update(
+	ctx context.Context, uid string, fn func(current *MFAEnrollment) (*MFAEnrollment, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var current *MFAEnrollment
+	if enrollment, ok := s.enrollments[uid]; ok {
+		enrollment.RecoveryCodeHashes = append([]string{}, enrollment.RecoveryCodeHashes...)
+		current = &enrollment
+	}
+	updated, err := fn(current)
+	if err != nil {
+		return err
+	}
+	s.enrollments[uid] = *updated
+	return nil
+}
+
+// Delete removes the user's enrollment
+func (s *InMemoryMFAStore) Delete(ctx context.Context, uid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.enrollments, uid)
+	return nil
+}
+
+// FirestoreMFAStore keeps TOTP enrollments in a Firestore collection, one document per UID.
+// The collection holds TOTP secrets so security rules must deny all client access to it.
+type FirestoreMFAStore struct {
+	client     *firestore.Client
+	collection string
+}
+
+// NewFirestoreMFAStore creates a Firestore backed MFA store.
+// When no collection is supplied, the suffixed `mfa_enrollments` collection is used.
+func NewFirestoreMFAStore(client *firestore.Client, collection string) *FirestoreMFAStore {
+	if collection == "" {
+		collection = SuffixCollection(MFAEnrollmentsCollectionName)
+	}
+	return &FirestoreMFAStore{client: client, collection: collection}
+}
+
+// Get returns the user's enrollment
+func (s *FirestoreMFAStore) Get(ctx context.Context, uid string) (*MFAEnrollment, error) {
+	docs, err := s.client.GetAll(ctx, []*firestore.DocumentRef{s.client.Collection(s.collection).Doc(uid)})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the MFA enrollment of %s: %w", uid, err)
+	}
+	if !docs[0].Exists() {
+		return nil, nil
+	}
+	enrollment := &MFAEnrollment{}
+	if err := docs[0].DataTo(enrollment); err != nil {
+		return nil, fmt.Errorf("unable to read the MFA enrollment of %s: %w", uid, err)
+	}
+	return enrollment, nil
+}
+
+// Update replaces the user's enrollment inside a transaction
+func (s *FirestoreMFAStore) Update(
+	ctx context.Context, uid string, fn func(current *MFAEnrollment) (*MFAEnrollment, error)) error {
+	ref := s.client.Collection(s.collection).Doc(uid)
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docs, err := tx.GetAll([]*firestore.DocumentRef{ref})
+		if err != nil {
+			return err
+		}
+		var current *MFAEnrollment
+		if docs[0].Exists() {
+			current = &MFAEnrollment{}
+			if err := docs[0].DataTo(current); err != nil {
+				return err
+			}
+		}
+		updated, err := fn(current)
+		if err != nil {
+			return err
+		}
+		return tx.Set(ref, updated)
+	})
+}
+
+// Delete removes the user's enrollment
+func (s *FirestoreMFAStore) Delete(ctx context.Context, uid string) error {
+	if _, err := s.client.Collection(s.collection).Doc(uid).Delete(ctx); err != nil {
+		return fmt.Errorf("unable to delete the MFA enrollment of %s: %w", uid, err)
+	}
+	return nil
+}
+
+// TOTPSetup is what a user needs to add their account to an authenticator app
+type TOTPSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// TOTPManager enrolls users in TOTP and verifies their codes
+type TOTPManager struct {
+	Store MFAStore
+
+	// Issuer names the service in authenticator apps
+	Issuer string
+}
+
+// NewTOTPManager creates a TOTP manager that keeps enrollments in the supplied store
+func NewTOTPManager(store MFAStore, issuer string) *TOTPManager {
+	return &TOTPManager{Store: store, Issuer: issuer}
+}
+
+// BeginEnrollment generates a new secret for the user. It only takes effect once
+// ConfirmEnrollment is called with a code generated from it.
+func (m *TOTPManager) BeginEnrollment(ctx context.Context, uid string, accountName string) (*TOTPSetup, error) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	err = m.Store.Update(ctx, uid, func(current *MFAEnrollment) (*MFAEnrollment, error) {
+		if current != nil && current.Verified {
+			return nil, NewLoginError(http.StatusConflict, "a second factor is already enrolled", nil)
+		}
+		return &MFAEnrollment{UID: uid, Secret: secret, CreatedAt: time.Now()}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if accountName == "" {
+		accountName = uid
+	}
+	return &TOTPSetup{Secret: secret, URI: TOTPURI(m.Issuer, accountName, secret)}, nil
+}
+
+// ConfirmEnrollment verifies the first code from the user's authenticator app and
+// returns their recovery codes. The recovery codes can't be retrieved again.
+func (m *TOTPManager) ConfirmEnrollment(ctx context.Context, uid string, code string) ([]string, error) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	err = m.Store.Update(ctx, uid, func(current *MFAEnrollment) (*MFAEnrollment, error) {
+		if current == nil {
+			return nil, NewLoginError(http.StatusBadRequest, "no TOTP enrollment is in progress", nil)
+		}
+		if current.Verified {
+			return nil, NewLoginError(http.StatusConflict, "a second factor is already enrolled", nil)
+		}
+		step := matchTOTPCode(current.Secret, normalizeMFACode(code), now)
+		if step < 0 {
+			return nil, NewLoginError(http.StatusUnauthorized, "invalid verification code", nil)
+		}
+		current.Verified = true
+		current.VerifiedAt = now
+		current.LastUsedStep = step
+		current.RecoveryCodeHashes = hashes
+		return current, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// IsEnrolled reports whether the user has a confirmed TOTP enrollment
+func (m *TOTPManager) IsEnrolled(ctx context.Context, uid string) (bool, error) {
+	enrollment, err := m.Store.Get(ctx, uid)
+	if err != nil {
+		return false, err
+	}
+	return enrollment != nil && enrollment.Verified, nil
+}
+
+// Verify checks a TOTP code, or a recovery code which is then used up.
+// Each TOTP code is only accepted once.
+func (m *TOTPManager) Verify(ctx context.Context, uid string, code string) error {
+	code = normalizeMFACode(code)
+	now := time.Now()
+	return m.Store.Update(ctx, uid, func(current *MFAEnrollment) (*MFAEnrollment, error) {
+		if current == nil || !current.Verified {
+			return nil, NewLoginError(http.StatusForbidden, "no second factor is enrolled", nil)
+		}
+		if step := matchTOTPCode(current.Secret, code, now); step >= 0 {
+			if step <= current.LastUsedStep {
+				return nil, NewLoginError(http.StatusUnauthorized, "the verification code has already been used", nil)
+			}
+			current.LastUsedStep = step
+			return current, nil
+		}
+		hash := hashRecoveryCode(code)
+		for i, candidate := range current.RecoveryCodeHashes {
+			if hmac.Equal([]byte(candidate), []byte(hash)) {
+				current.RecoveryCodeHashes = append(current.RecoveryCodeHashes[:i], current.RecoveryCodeHashes[i+1:]...)
+				return current, nil
+			}
+		}
+		return nil, NewLoginError(http.StatusUnauthorized, "invalid verification code", nil)
+	})
+}
+
+func normalizeMFACode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+func hashRecoveryCode(code string) string {
+	digest := sha256.Sum256([]byte(normalizeMFACode(code)))
+	return hex.EncodeToString(digest[:])
+}
+
+// generateRecoveryCodes creates recovery codes formatted as `xxxxx-xxxxx` and their hashes
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := []string{}
+	hashes := []string{}
+	for i := 0; i < RecoveryCodeCount; i++ {
+		raw := make([]byte, 7)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, fmt.Errorf("unable to generate recovery codes: %w", err)
+		}
+		encoded := strings.ToLower(base32NoPadding.EncodeToString(raw))[:10]
+		codes = append(codes, encoded[:5]+"-"+encoded[5:])
+		hashes = append(hashes, hashRecoveryCode(encoded))
+	}
+	return codes, hashes, nil
+}
+
+// MFAChallengeSigner issues and verifies the short-lived tokens that identify a
+// user who has passed their first factor
+type MFAChallengeSigner struct {
+	key []byte
+	ttl time.Duration
+}
+
+// NewMFAChallengeSigner creates a challenge signer with a secret key of at least 32 bytes.
+// The TTL defaults to DefaultMFAChallengeTTL.
+func NewMFAChallengeSigner(key []byte, ttl time.Duration) (*MFAChallengeSigner, error) {
+	if len(key) < 32 {
+		return nil, fmt.Errorf("the MFA challenge key must be at least 32 bytes long")
+	}
+	if ttl <= 0 {
+		ttl = DefaultMFAChallengeTTL
+	}
+	return &MFAChallengeSigner{key: key, ttl: ttl}, nil
+}
+
+// mfaChallengeClaims is the payload of MFA challenge tokens
+type mfaChallengeClaims struct {
+	Purpose   string `json:"pur"`
+	UID       string `json:"uid"`
+	TenantID  string `json:"tid,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+
+	// ID tells apart the challenges issued to a user within the same second,
+	// since wrong codes are counted per challenge
+	ID string `json:"jti"`
+}
+
+func (s *MFAChallengeSigner) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	_, _ = mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue creates a challenge token for the user
+func (s *MFAChallengeSigner) Issue(uid string, tenantID string) (string, error) {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("unable to generate an MFA challenge ID: %w", err)
+	}
+	payloadBytes, err := json.Marshal(mfaChallengeClaims{
+		Purpose:   "mfa",
+		UID:       uid,
+		TenantID:  tenantID,
+		ExpiresAt: time.Now().Add(s.ttl).Unix(),
+		ID:        base64.RawURLEncoding.EncodeToString(id),
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to compose an MFA challenge: %w", err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(payloadBytes)
+	return payload + "." + s.sign(payload), nil
+}
+
+// Verify checks the challenge token and returns the UID and tenant ID that it was issued for
+func (s *MFAChallengeSigner) Verify(token string) (string, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(s.sign(parts[0])), []byte(parts[1])) {
+		return "", "", fmt.Errorf("invalid MFA challenge")
+	}
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", fmt.Errorf("invalid MFA challenge: %w", err)
+	}
+	claims := mfaChallengeClaims{}
+	if err := json.Unmarshal(payloadBytes, &claims); err != nil || claims.Purpose != "mfa" {
+		return "", "", fmt.Errorf("invalid MFA challenge")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return "", "", fmt.Errorf("the MFA challenge has expired")
+	}
+	return claims.UID, claims.TenantID, nil
+}
+
+// MFAConfig turns on the second login step
+type MFAConfig struct {
+	TOTP       *TOTPManager
+	Challenges *MFAChallengeSigner
+
+	// Required reports whether the user must pass a second factor to log in.
+	// It defaults to users who have enrolled one.
+	Required func(ctx context.Context, user *auth.UserRecord) (bool, error)
+
+	// GetUser looks up users by UID. It defaults to a Firebase Auth lookup.
+	GetUser func(ctx context.Context, tenantID string, uid string) (*auth.UserRecord, error)
+
+	// IssueTokens defaults to IssueFirebaseLoginTokens
+	IssueTokens func(ctx context.Context, user *auth.UserRecord) (*LoginResult, error)
+
+	// Events receives a login event for every second factor verification, if set
+	Events            LoginEventSink
+	TrustForwardedFor bool
+
+	// LoginThrottle, if set, has the login failures of a user's email and phone
+	// number cleared once they pass their second factor, since
+	// LoginThrottleMiddleware doesn't clear them for MFA challenges
+	LoginThrottle *LoginThrottle
+
+	// Attempts counts wrong second factor codes. It defaults to an in-memory
+	// store, which only counts the attempts made on one instance.
+	Attempts LoginAttemptStore
+
+	// ChallengeMaxFailures wrong codes invalidate a challenge, so that the user
+	// has to log in again. It defaults to DefaultMFAChallengeMaxFailures.
+	ChallengeMaxFailures int
+
+	// UserLockout locks users out of MFA verification after repeated wrong codes,
+	// across challenges. It defaults to DefaultMFALockoutPolicy.
+	UserLockout LockoutPolicy
+
+	attemptsOnce    sync.Once
+	defaultAttempts LoginAttemptStore
+}
+
+// DefaultMFALockoutPolicy locks a user out of MFA verification for 15 minutes
+// after 10 consecutive wrong codes
+func DefaultMFALockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		MaxFailures:     10,
+		LockoutDuration: 15 * time.Minute,
+		ResetAfter:      time.Hour,
+	}
+}
+
+func (c *MFAConfig) attempts() LoginAttemptStore {
+	if c.Attempts != nil {
+		return c.Attempts
+	}
+	c.attemptsOnce.Do(func() {
+		c.defaultAttempts = NewInMemoryLoginAttemptStore()
+	})
+	return c.defaultAttempts
+}
+
+// verifyCode runs the verification of a second factor code, limiting the wrong
+// codes per challenge and per user. Only failures with a 401 status count.
+func (c *MFAConfig) verifyCode(ctx context.Context, uid string, challengeToken string, verify func() error) error {
+	userLockout := c.UserLockout
+	if userLockout == (LockoutPolicy{}) {
+		userLockout = DefaultMFALockoutPolicy()
+	}
+	keys := []loginThrottleKey{{key: "mfa" + Sep + "uid:" + uid, policy: userLockout, uid: uid}}
+	if challengeToken != "" {
+		maxFailures := c.ChallengeMaxFailures
+		if maxFailures <= 0 {
+			maxFailures = DefaultMFAChallengeMaxFailures
+		}
+		keys = append(keys, loginThrottleKey{
+			key:    "mfa" + Sep + "challenge:" + challengeToken,
+			policy: LockoutPolicy{MaxFailures: maxFailures, LockoutDuration: c.Challenges.ttl},
+			uid:    uid,
+		})
+	}
+
+	store := c.attempts()
+	wait, blocked, err := beginAttempts(ctx, store, keys)
+	if err != nil {
+		return fmt.Errorf("unable to check the MFA attempts of %s: %w", uid, err)
+	}
+	if wait > 0 {
+		message := "too many wrong verification codes, try again later"
+		if blocked > 0 {
+			message = "too many wrong verification codes for this challenge, log in again"
+		}
+		return &LoginError{Status: http.StatusTooManyRequests, Message: message, RetryAfter: wait}
+	}
+
+	verifyErr := verify()
+	loginErr := &LoginError{}
+	failed := errors.As(verifyErr, &loginErr) && loginErr.Status == http.StatusUnauthorized
+	if err := finishAttempts(ctx, store, keys, failed); err != nil {
+		log.Printf("unable to record the MFA attempt of %s: %s", uid, err)
+	}
+	if verifyErr == nil {
+		if err := store.Reset(ctx, keys[0].key); err != nil {
+			log.Printf("unable to clear the MFA failures of %s: %s", uid, err)
+		}
+	}
+	return verifyErr
+}
+
+// RequireMFAForClaim requires a second factor from users who hold the custom claim
+// (e.g `clinician`) or who have enrolled one
+func RequireMFAForClaim(manager *TOTPManager, claim string) func(ctx context.Context, user *auth.UserRecord) (bool, error) {
+	return func(ctx context.Context, user *auth.UserRecord) (bool, error) {
+		if enabled, ok := user.CustomClaims[claim].(bool); ok && enabled {
+			return true, nil
+		}
+		return manager.IsEnrolled(ctx, user.UID)
+	}
+}
+
+func (c *MFAConfig) required(ctx context.Context, user *auth.UserRecord) (bool, error) {
+	if c.Required != nil {
+		return c.Required(ctx, user)
+	}
+	return c.TOTP.IsEnrolled(ctx, user.UID)
+}
+
+func (c *MFAConfig) getUser(ctx context.Context, tenantID string, uid string) (*auth.UserRecord, error) {
+	if c.GetUser != nil {
+		return c.GetUser(ctx, tenantID, uid)
+	}
+	return getTenantUser(ctx, tenantID, uid)
+}
+
+func (c *MFAConfig) issueTokens(ctx context.Context, user *auth.UserRecord) (*LoginResult, error) {
+	if c.IssueTokens != nil {
+		return c.IssueTokens(ctx, user)
+	}
+	return IssueFirebaseLoginTokens(ctx, user)
+}
+
+// WithMFA makes login handlers ask users who require a second factor for it
+// before they are issued tokens
+func WithMFA(config *MFAConfig) LoginOption {
+	return func(c *loginConfig) {
+		c.mfa = config
+	}
+}
+
+// MFAChallengeResponse is sent, with a 202 status, instead of a login response to
+// users who must pass a second factor. The challenge token is then sent to the
+// MFA verification handler, or to the TOTP enrollment handlers by users who
+// must enroll a second factor first.
+type MFAChallengeResponse struct {
+	MFARequired        bool   `json:"mfaRequired"`
+	EnrollmentRequired bool   `json:"enrollmentRequired"`
+	ChallengeToken     string `json:"challengeToken"`
+	ExpiresIn          int    `json:"expiresIn"`
+}
+
+// challenge writes an MFA challenge for users who must pass a second factor. It
+// reports whether it did so, in which case login must not continue.
+func (c *MFAConfig) challenge(ctx context.Context, w http.ResponseWriter, user *auth.UserRecord) bool {
+	required, err := c.required(ctx, user)
+	if err != nil {
+		WriteLoginError(w, fmt.Errorf("unable to check whether %s requires MFA: %w", user.UID, err))
+		return true
+	}
+	if !required {
+		return false
+	}
+	enrolled, err := c.TOTP.IsEnrolled(ctx, user.UID)
+	if err != nil {
+		WriteLoginError(w, err)
+		return true
+	}
+	token, err := c.Challenges.Issue(user.UID, user.TenantID)
+	if err != nil {
+		WriteLoginError(w, err)
+		return true
+	}
+	serverutils.WriteJSONResponse(w, MFAChallengeResponse{
+		MFARequired:        true,
+		EnrollmentRequired: !enrolled,
+		ChallengeToken:     token,
+		ExpiresIn:          int(c.Challenges.ttl.Seconds()),
+	}, http.StatusAccepted)
+	return true
+}
+
+// MFAVerificationRequest is the unmarshalling target for MFA verification and TOTP enrollment requests
+type MFAVerificationRequest struct {
+	ChallengeToken string `json:"challengeToken,omitempty"`
+	Code           string `json:"code,omitempty"`
+}
+
+// mfaSubject identifies the user behind an MFA request, from its challenge token
+// or else the authenticated principal
+func (c *MFAConfig) mfaSubject(r *http.Request, req *MFAVerificationRequest) (string, string, bool, error) {
+	if req.ChallengeToken != "" {
+		uid, tenantID, err := c.Challenges.Verify(req.ChallengeToken)
+		if err != nil {
+			return "", "", false, NewLoginError(http.StatusUnauthorized, err.Error(), err)
+		}
+		return uid, tenantID, true, nil
+	}
+	principal, err := PrincipalFromContext(r.Context())
+	if err != nil {
+		return "", "", false, NewLoginError(http.StatusUnauthorized, "a challenge token or authentication is required", err)
+	}
+	return principal.UID, principal.TenantID, false, nil
+}
+
+func decodeMFAVerificationRequest(r *http.Request) (*MFAVerificationRequest, error) {
+	req := &MFAVerificationRequest{}
+	if r.Body == nil || json.NewDecoder(r.Body).Decode(req) != nil {
+		return nil, NewLoginError(http.StatusBadRequest, "invalid MFA request", nil)
+	}
+	return req, nil
+}
+
+// completeMFALogin issues tokens to a user who passed their second factor
+func (c *MFAConfig) completeMFALogin(ctx context.Context, tenantID string, uid string) (*LoginResponse, error) {
+	user, err := c.getUser(ctx, tenantID, uid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get user %s: %w", uid, err)
+	}
+	result, err := c.issueTokens(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if c.LoginThrottle != nil {
+		for _, username := range []string{user.Email, user.PhoneNumber} {
+			if err := c.LoginThrottle.RecordSuccess(ctx, username); err != nil {
+				log.Printf("unable to clear the login failures of %s: %s", user.UID, err)
+			}
+		}
+	}
+	return NewLoginResponse(result)
+}
+
+// GetMFAVerifyFunc returns the handler for the second login step. It takes the
+// challenge token and a TOTP or recovery code, and responds like a login.
+func GetMFAVerifyFunc(config *MFAConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, err := decodeMFAVerificationRequest(r)
+		if err != nil {
+			WriteLoginError(w, err)
+			return
+		}
+		if req.ChallengeToken == "" || req.Code == "" {
+			WriteLoginError(w, NewLoginError(
+				http.StatusBadRequest, "a challenge token AND verification code are required", nil))
+			return
+		}
+		event := newLoginEvent(r, LoginEventLogin, config.TrustForwardedFor)
+		event.Provider = "totp"
+		uid, tenantID, _, err := config.mfaSubject(r, req)
+		if err != nil {
+			recordLoginEvent(r.Context(), config.Events, event.fail(err))
+			WriteLoginError(w, err)
+			return
+		}
+		event.UID = uid
+		err = config.verifyCode(r.Context(), uid, req.ChallengeToken, func() error {
+			return config.TOTP.Verify(r.Context(), uid, req.Code)
+		})
+		if err != nil {
+			recordLoginEvent(r.Context(), config.Events, event.fail(err))
+			WriteLoginError(w, err)
+			return
+		}
+		loginResp, err := config.completeMFALogin(r.Context(), tenantID, uid)
+		if err != nil {
+			recordLoginEvent(r.Context(), config.Events, event.fail(err))
+			WriteLoginError(w, err)
+			return
+		}
+		event.Success = true
+		recordLoginEvent(r.Context(), config.Events, event)
+		serverutils.WriteJSONResponse(w, loginResp, http.StatusOK)
+	}
+}
+
+// GetTOTPEnrollmentFunc returns a handler that starts TOTP enrollment for the
+// authenticated user, or the user of a challenge token, and responds with the
+// secret and `otpauth://` URI
+func GetTOTPEnrollmentFunc(config *MFAConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &MFAVerificationRequest{}
+		if r.Body != nil {
+			_ = json.NewDecoder(r.Body).Decode(req) // the body is optional for authenticated users
+		}
+		uid, tenantID, _, err := config.mfaSubject(r, req)
+		if err != nil {
+			WriteLoginError(w, err)
+			return
+		}
+
+		accountName := uid
+		if principal, err := PrincipalFromContext(r.Context()); err == nil && principal.UID == uid {
+			accountName = firstNonEmpty(principal.Email, principal.PhoneNumber, uid)
+		} else if user, err := config.getUser(r.Context(), tenantID, uid); err == nil {
+			accountName = firstNonEmpty(user.Email, user.PhoneNumber, uid)
+		}
+
+		setup, err := config.TOTP.BeginEnrollment(r.Context(), uid, accountName)
+		if err != nil {
+			WriteLoginError(w, err)
+			return
+		}
+		serverutils.WriteJSONResponse(w, setup, http.StatusOK)
+	}
+}
+
+// TOTPEnrollmentResponse is sent when a TOTP enrollment is confirmed. Users who
+// enrolled with a challenge token are also logged in.
+type TOTPEnrollmentResponse struct {
+	RecoveryCodes []string       `json:"recoveryCodes"`
+	Login         *LoginResponse `json:"login,omitempty"`
+}
+
+// GetTOTPConfirmEnrollmentFunc returns a handler that confirms a TOTP enrollment
+// with the first code from the user's authenticator app
+func GetTOTPConfirmEnrollmentFunc(config *MFAConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, err := decodeMFAVerificationRequest(r)
+		if err != nil {
+			WriteLoginError(w, err)
+			return
+		}
+		uid, tenantID, challenged, err := config.mfaSubject(r, req)
+		if err != nil {
+			WriteLoginError(w, err)
+			return
+		}
+		var codes []string
+		err = config.verifyCode(r.Context(), uid, req.ChallengeToken, func() error {
+			codes, err = config.TOTP.ConfirmEnrollment(r.Context(), uid, req.Code)
+			return err
+		})
+		if err != nil {
+			WriteLoginError(w, err)
+			return
+		}
+
+		resp := TOTPEnrollmentResponse{RecoveryCodes: codes}
+		if challenged {
+			resp.Login, err = config.completeMFALogin(r.Context(), tenantID, uid)
+			if err != nil {
+				WriteLoginError(w, err)
+				return
+			}
+		}
+		serverutils.WriteJSONResponse(w, resp, http.StatusOK)
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,287 @@
+package firebasetools_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B test vectors, truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // base32 of "12345678901234567890"
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+	}
+	for _, tt := range tests {
+		code, err := firebasetools.TOTPCode(secret, time.Unix(tt.unix, 0))
+		assert.Nil(t, err)
+		assert.Equal(t, tt.want, code)
+	}
+
+	_, err := firebasetools.TOTPCode("not base32!", time.Now())
+	assert.NotNil(t, err)
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := firebasetools.TOTPURI("Be.Well", "nurse@example.com", "ABCDEF")
+	parsed, err := url.Parse(uri)
+	assert.Nil(t, err)
+	assert.Equal(t, "otpauth", parsed.Scheme)
+	assert.Equal(t, "totp", parsed.Host)
+	assert.Equal(t, "/Be.Well:nurse@example.com", parsed.Path)
+	assert.Equal(t, "ABCDEF", parsed.Query().Get("secret"))
+	assert.Equal(t, "Be.Well", parsed.Query().Get("issuer"))
+}
+
+func currentTOTPCode(t *testing.T, secret string, offset time.Duration) string {
+	code, err := firebasetools.TOTPCode(secret, time.Now().Add(offset))
+	assert.Nil(t, err)
+	return code
+}
+
+func loginErrorStatus(err error) int {
+	loginErr := &firebasetools.LoginError{}
+	if errors.As(err, &loginErr) {
+		return loginErr.Status
+	}
+	return 0
+}
+
+func TestTOTPManager(t *testing.T) {
+	ctx := context.Background()
+	store := firebasetools.NewInMemoryMFAStore()
+	manager := firebasetools.NewTOTPManager(store, "Be.Well")
+
+	setup, err := manager.BeginEnrollment(ctx, "nurse-uid", "nurse@example.com")
+	assert.Nil(t, err)
+	assert.Contains(t, setup.URI, setup.Secret)
+
+	enrolled, err := manager.IsEnrolled(ctx, "nurse-uid")
+	assert.Nil(t, err)
+	assert.False(t, enrolled, "unconfirmed enrollments don't count")
+
+	_, err = manager.ConfirmEnrollment(ctx, "nurse-uid", "000000")
+	assert.Equal(t, http.StatusUnauthorized, loginErrorStatus(err))
+
+	code := currentTOTPCode(t, setup.Secret, 0)
+	recoveryCodes, err := manager.ConfirmEnrollment(ctx, "nurse-uid", code)
+	assert.Nil(t, err)
+	assert.Len(t, recoveryCodes, firebasetools.RecoveryCodeCount)
+
+	enrollment, err := store.Get(ctx, "nurse-uid")
+	assert.Nil(t, err)
+	assert.True(t, enrollment.Verified)
+	for _, hash := range enrollment.RecoveryCodeHashes {
+		assert.NotContains(t, recoveryCodes, hash, "recovery codes are stored hashed")
+	}
+
+	_, err = manager.BeginEnrollment(ctx, "nurse-uid", "")
+	assert.Equal(t, http.StatusConflict, loginErrorStatus(err))
+
+	// codes can't be replayed
+	err = manager.Verify(ctx, "nurse-uid", code)
+	assert.Equal(t, http.StatusUnauthorized, loginErrorStatus(err))
+	assert.Nil(t, manager.Verify(ctx, "nurse-uid", currentTOTPCode(t, setup.Secret, firebasetools.TOTPPeriod)))
+
+	// recovery codes work once, with or without formatting
+	assert.Nil(t, manager.Verify(ctx, "nurse-uid", strings.ToUpper(recoveryCodes[0])))
+	assert.NotNil(t, manager.Verify(ctx, "nurse-uid", recoveryCodes[0]))
+	assert.Nil(t, manager.Verify(ctx, "nurse-uid", strings.ReplaceAll(recoveryCodes[1], "-", "")))
+
+	err = manager.Verify(ctx, "other-uid", code)
+	assert.Equal(t, http.StatusForbidden, loginErrorStatus(err))
+}
+
+func TestMFAChallengeSigner(t *testing.T) {
+	_, err := firebasetools.NewMFAChallengeSigner([]byte("short"), 0)
+	assert.NotNil(t, err)
+
+	signer, err := firebasetools.NewMFAChallengeSigner(bytes.Repeat([]byte("k"), 32), 0)
+	assert.Nil(t, err)
+	token, err := signer.Issue("nurse-uid", "tenant-a")
+	assert.Nil(t, err)
+
+	uid, tenantID, err := signer.Verify(token)
+	assert.Nil(t, err)
+	assert.Equal(t, "nurse-uid", uid)
+	assert.Equal(t, "tenant-a", tenantID)
+
+	other, _ := firebasetools.NewMFAChallengeSigner(bytes.Repeat([]byte("x"), 32), 0)
+	_, _, err = other.Verify(token)
+	assert.NotNil(t, err, "tokens signed with another key are rejected")
+
+	_, _, err = signer.Verify(token + "x")
+	assert.NotNil(t, err)
+}
+
+func newTestMFAConfig(t *testing.T, required map[string]bool) *firebasetools.MFAConfig {
+	signer, err := firebasetools.NewMFAChallengeSigner(bytes.Repeat([]byte("k"), 32), time.Minute)
+	assert.Nil(t, err)
+	return &firebasetools.MFAConfig{
+		TOTP:       firebasetools.NewTOTPManager(firebasetools.NewInMemoryMFAStore(), "Be.Well"),
+		Challenges: signer,
+		Required: func(ctx context.Context, user *auth.UserRecord) (bool, error) {
+			return required[user.UID], nil
+		},
+		GetUser: stubGetUser,
+		IssueTokens: func(ctx context.Context, user *auth.UserRecord) (*firebasetools.LoginResult, error) {
+			result := testLoginResult(user.UID)
+			result.User = user
+			return result, nil
+		},
+	}
+}
+
+func postJSON(t *testing.T, h http.HandlerFunc, body interface{}, target interface{}) int {
+	bs, err := json.Marshal(body)
+	assert.Nil(t, err)
+	rw := httptest.NewRecorder()
+	h(rw, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(bs)))
+	if target != nil {
+		assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), target))
+	}
+	return rw.Code
+}
+
+func TestLoginWithMFA(t *testing.T) {
+	config := newTestMFAConfig(t, map[string]bool{"nurse-uid": true})
+	password := &stubLoginProvider{name: firebasetools.LoginProviderPassword}
+	login := firebasetools.NewLoginHandler([]firebasetools.LoginProvider{password}, firebasetools.WithMFA(config))
+	creds := map[string]string{"username": "nurse@example.com", "password": "secret"}
+
+	// users that don't require MFA log in directly
+	password.result = testLoginResult("patient-uid")
+	loginResp := firebasetools.LoginResponse{}
+	assert.Equal(t, http.StatusOK, postJSON(t, login, creds, &loginResp))
+	assert.Equal(t, "patient-uid", loginResp.UID)
+
+	// staff that haven't enrolled are asked to
+	password.result = testLoginResult("nurse-uid")
+	challenge := firebasetools.MFAChallengeResponse{}
+	assert.Equal(t, http.StatusAccepted, postJSON(t, login, creds, &challenge))
+	assert.True(t, challenge.MFARequired)
+	assert.True(t, challenge.EnrollmentRequired)
+	assert.Equal(t, 60, challenge.ExpiresIn)
+
+	setup := firebasetools.TOTPSetup{}
+	enroll := firebasetools.GetTOTPEnrollmentFunc(config)
+	assert.Equal(t, http.StatusOK, postJSON(t, enroll, map[string]string{
+		"challengeToken": challenge.ChallengeToken,
+	}, &setup))
+	assert.Contains(t, setup.URI, "Be.Well:nurse-uid@example.com")
+
+	confirmed := firebasetools.TOTPEnrollmentResponse{}
+	confirm := firebasetools.GetTOTPConfirmEnrollmentFunc(config)
+	assert.Equal(t, http.StatusOK, postJSON(t, confirm, map[string]string{
+		"challengeToken": challenge.ChallengeToken,
+		"code":           currentTOTPCode(t, setup.Secret, 0),
+	}, &confirmed))
+	assert.Len(t, confirmed.RecoveryCodes, firebasetools.RecoveryCodeCount)
+	assert.Equal(t, "nurse-uid", confirmed.Login.UID, "enrolling with a challenge completes the login")
+
+	// enrolled staff must verify a code
+	challenge = firebasetools.MFAChallengeResponse{}
+	assert.Equal(t, http.StatusAccepted, postJSON(t, login, creds, &challenge))
+	assert.False(t, challenge.EnrollmentRequired)
+
+	verify := firebasetools.GetMFAVerifyFunc(config)
+	assert.Equal(t, http.StatusUnauthorized, postJSON(t, verify, map[string]string{
+		"challengeToken": challenge.ChallengeToken,
+		"code":           "000000",
+	}, nil))
+	assert.Equal(t, http.StatusUnauthorized, postJSON(t, verify, map[string]string{
+		"challengeToken": "forged",
+		"code":           confirmed.RecoveryCodes[0],
+	}, nil))
+
+	loginResp = firebasetools.LoginResponse{}
+	assert.Equal(t, http.StatusOK, postJSON(t, verify, map[string]string{
+		"challengeToken": challenge.ChallengeToken,
+		"code":           confirmed.RecoveryCodes[0],
+	}, &loginResp))
+	assert.Equal(t, "nurse-uid", loginResp.UID)
+	assert.Equal(t, "id-token", loginResp.IDToken)
+}
+
+func TestGetMFAVerifyFunc_AttemptLimits(t *testing.T) {
+	ctx := context.Background()
+	config := newTestMFAConfig(t, map[string]bool{"nurse-uid": true})
+	config.Attempts = firebasetools.NewInMemoryLoginAttemptStore()
+	config.ChallengeMaxFailures = 2
+	config.UserLockout = firebasetools.LockoutPolicy{MaxFailures: 3, LockoutDuration: time.Minute}
+	setup, err := config.TOTP.BeginEnrollment(ctx, "nurse-uid", "nurse@example.com")
+	assert.Nil(t, err)
+	recoveryCodes, err := config.TOTP.ConfirmEnrollment(ctx, "nurse-uid", currentTOTPCode(t, setup.Secret, 0))
+	assert.Nil(t, err)
+
+	verify := firebasetools.GetMFAVerifyFunc(config)
+	attempt := func(challenge string, code string) int {
+		return postJSON(t, verify, map[string]string{"challengeToken": challenge, "code": code}, nil)
+	}
+	newChallenge := func() string {
+		token, err := config.Challenges.Issue("nurse-uid", "")
+		assert.Nil(t, err)
+		return token
+	}
+
+	// wrong codes invalidate the challenge, even for the right code
+	challenge := newChallenge()
+	assert.Equal(t, http.StatusUnauthorized, attempt(challenge, "000000"))
+	assert.Equal(t, http.StatusUnauthorized, attempt(challenge, "000000"))
+	assert.Equal(t, http.StatusTooManyRequests, attempt(challenge, recoveryCodes[0]))
+
+	// and lock the user out across challenges
+	assert.Equal(t, http.StatusUnauthorized, attempt(newChallenge(), "000000"))
+	assert.Equal(t, http.StatusTooManyRequests, attempt(newChallenge(), recoveryCodes[0]))
+
+	// the attempts name the user so that they are deleted with the user's data
+	attempts, err := config.Attempts.Get(ctx, "mfa"+firebasetools.Sep+"uid:nurse-uid")
+	assert.Nil(t, err)
+	assert.Equal(t, "nurse-uid", attempts.UID)
+}
+
+func TestTOTPEnrollment_Authenticated(t *testing.T) {
+	config := newTestMFAConfig(t, nil)
+	authenticated := func(body string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+		return r.WithContext(firebasetools.WithPrincipal(r.Context(), &firebasetools.Principal{
+			UID:   "nurse-uid",
+			Email: "nurse@example.com",
+		}))
+	}
+
+	rw := httptest.NewRecorder()
+	firebasetools.GetTOTPEnrollmentFunc(config)(rw, authenticated(""))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	setup := firebasetools.TOTPSetup{}
+	assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &setup))
+	assert.Contains(t, setup.URI, "Be.Well:nurse@example.com")
+
+	rw = httptest.NewRecorder()
+	bs, _ := json.Marshal(map[string]string{"code": currentTOTPCode(t, setup.Secret, 0)})
+	firebasetools.GetTOTPConfirmEnrollmentFunc(config)(rw, authenticated(string(bs)))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	confirmed := firebasetools.TOTPEnrollmentResponse{}
+	assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &confirmed))
+	assert.Nil(t, confirmed.Login, "authenticated users are already logged in")
+
+	// unauthenticated requests without a challenge are rejected
+	assert.Equal(t, http.StatusUnauthorized, postJSON(t, firebasetools.GetTOTPEnrollmentFunc(config), map[string]string{}, nil))
+}
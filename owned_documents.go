@@ -0,0 +1,232 @@
+package firebasetools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// default owner fields of documents that embed Model
+const (
+	CreatedByUIDField = "createdByUID"
+	UpdatedByUIDField = "updatedByUID"
+)
+
+// maxFirestoreBatchWrites is the most writes that a Firestore batch can hold
+const maxFirestoreBatchWrites = 500
+
+// OwnedDocument is a document that a user field points at a user
+type OwnedDocument struct {
+	Collection string                 `json:"collection"`
+	ID         string                 `json:"id"`
+	Data       map[string]interface{} `json:"data"`
+}
+
+// OwnedDocumentStore finds and changes the documents that belong to users
+type OwnedDocumentStore interface {
+	// ListOwnedDocuments returns the documents in the collection whose field is the UID
+	ListOwnedDocuments(ctx context.Context, collection string, field string, uid string) ([]*OwnedDocument, error)
+
+	// EachOwnedDocument streams the documents that ListOwnedDocuments would return
+	EachOwnedDocument(
+		ctx context.Context, collection string, field string, uid string, fn func(doc *OwnedDocument) error,
+	) error
+
+	// UpdateOwnedDocuments sets the fields of the documents
+	UpdateOwnedDocuments(ctx context.Context, docs []*OwnedDocument, fields map[string]interface{}) error
+
+	DeleteOwnedDocuments(ctx context.Context, docs []*OwnedDocument) error
+}
+
+// InMemoryOwnedDocumentStore keeps documents in process memory. It suits tests.
+type InMemoryOwnedDocumentStore struct {
+	mu          sync.Mutex
+	collections map[string]map[string]map[string]interface{}
+}
+
+// NewInMemoryOwnedDocumentStore creates an empty in-memory document store
+func NewInMemoryOwnedDocumentStore() *InMemoryOwnedDocumentStore {
+	return &InMemoryOwnedDocumentStore{collections: map[string]map[string]map[string]interface{}{}}
+}
+
+// Put saves a copy of a document
+func (s *InMemoryOwnedDocumentStore) Put(collection string, id string, data map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.collections[collection] == nil {
+		s.collections[collection] = map[string]map[string]interface{}{}
+	}
+	s.collections[collection][id] = copyDocumentData(data)
+}
+
+// Get returns a copy of a document, or nil if it does not exist
+func (s *InMemoryOwnedDocumentStore) Get(collection string, id string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.collections[collection][id]
+	if !ok {
+		return nil
+	}
+	return copyDocumentData(data)
+}
+
+// ListOwnedDocuments returns copies of the matching documents, in ID order
+func (s *InMemoryOwnedDocumentStore) ListOwnedDocuments(
+	ctx context.Context, collection string, field string, uid string,
+) ([]*OwnedDocument, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	docs := []*OwnedDocument{}
+	for id, data := range s.collections[collection] {
+		if value, ok := data[field].(string); ok && value == uid {
+			docs = append(docs, &OwnedDocument{Collection: collection, ID: id, Data: copyDocumentData(data)})
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].ID < docs[j].ID })
+	return docs, nil
+}
+
+// EachOwnedDocument calls fn with every matching document, in ID order
+func (s *InMemoryOwnedDocumentStore) EachOwnedDocument(
+	ctx context.Context, collection string, field string, uid string, fn func(doc *OwnedDocument) error,
+) error {
+	docs, err := s.ListOwnedDocuments(ctx, collection, field, uid)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if err := fn(doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateOwnedDocuments sets the fields of the documents that still exist
+func (s *InMemoryOwnedDocumentStore) UpdateOwnedDocuments(
+	ctx context.Context, docs []*OwnedDocument, fields map[string]interface{},
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, doc := range docs {
+		data, ok := s.collections[doc.Collection][doc.ID]
+		if !ok {
+			return fmt.Errorf("document %s/%s does not exist", doc.Collection, doc.ID)
+		}
+		for field, value := range fields {
+			data[field] = value
+		}
+	}
+	return nil
+}
+
+// DeleteOwnedDocuments removes the documents
+func (s *InMemoryOwnedDocumentStore) DeleteOwnedDocuments(ctx context.Context, docs []*OwnedDocument) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, doc := range docs {
+		delete(s.collections[doc.Collection], doc.ID)
+	}
+	return nil
+}
+
+func copyDocumentData(data map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		copied[k] = v
+	}
+	return copied
+}
+
+// FirestoreOwnedDocumentStore finds documents in Firestore collections. Collection
+// names are used as they are, so suffix them with SuffixCollection or
+// GetCollectionName first.
+type FirestoreOwnedDocumentStore struct {
+	client *firestore.Client
+}
+
+// NewFirestoreOwnedDocumentStore creates a Firestore backed document store
+func NewFirestoreOwnedDocumentStore(client *firestore.Client) *FirestoreOwnedDocumentStore {
+	return &FirestoreOwnedDocumentStore{client: client}
+}
+
+// ListOwnedDocuments queries the collection for documents whose field is the UID
+func (s *FirestoreOwnedDocumentStore) ListOwnedDocuments(
+	ctx context.Context, collection string, field string, uid string,
+) ([]*OwnedDocument, error) {
+	snapshots, err := s.client.Collection(collection).Where(field, "==", uid).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the %s documents of %s: %w", collection, uid, err)
+	}
+	docs := []*OwnedDocument{}
+	for _, snapshot := range snapshots {
+		docs = append(docs, &OwnedDocument{Collection: collection, ID: snapshot.Ref.ID, Data: snapshot.Data()})
+	}
+	return docs, nil
+}
+
+// EachOwnedDocument streams the matching documents without loading them all at once
+func (s *FirestoreOwnedDocumentStore) EachOwnedDocument(
+	ctx context.Context, collection string, field string, uid string, fn func(doc *OwnedDocument) error,
+) error {
+	docs := s.client.Collection(collection).Where(field, "==", uid).Documents(ctx)
+	defer docs.Stop()
+	for {
+		snapshot, err := docs.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to list the %s documents of %s: %w", collection, uid, err)
+		}
+		if err := fn(&OwnedDocument{Collection: collection, ID: snapshot.Ref.ID, Data: snapshot.Data()}); err != nil {
+			return err
+		}
+	}
+}
+
+// UpdateOwnedDocuments sets the fields of the documents, in batches
+func (s *FirestoreOwnedDocumentStore) UpdateOwnedDocuments(
+	ctx context.Context, docs []*OwnedDocument, fields map[string]interface{},
+) error {
+	updates := []firestore.Update{}
+	for field, value := range fields {
+		updates = append(updates, firestore.Update{Path: field, Value: value})
+	}
+	return s.commitInBatches(ctx, docs, func(batch *firestore.WriteBatch, ref *firestore.DocumentRef) {
+		batch.Update(ref, updates)
+	})
+}
+
+// DeleteOwnedDocuments deletes the documents, in batches
+func (s *FirestoreOwnedDocumentStore) DeleteOwnedDocuments(ctx context.Context, docs []*OwnedDocument) error {
+	return s.commitInBatches(ctx, docs, func(batch *firestore.WriteBatch, ref *firestore.DocumentRef) {
+		batch.Delete(ref)
+	})
+}
+
+func (s *FirestoreOwnedDocumentStore) commitInBatches(
+	ctx context.Context,
+	docs []*OwnedDocument,
+	write func(batch *firestore.WriteBatch, ref *firestore.DocumentRef),
+) error {
+	for start := 0; start < len(docs); start += maxFirestoreBatchWrites {
+		end := start + maxFirestoreBatchWrites
+		if end > len(docs) {
+			end = len(docs)
+		}
+		batch := s.client.Batch()
+		for _, doc := range docs[start:end] {
+			write(batch, s.client.Collection(doc.Collection).Doc(doc.ID))
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return fmt.Errorf("unable to write documents %d to %d: %w", start, end, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package firebasetools
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"firebase.google.com/go/auth"
+)
+
+// PrincipalContextKey is used to add/retrieve the authenticated *Principal on the context
+const PrincipalContextKey = ContextKey("Principal")
+
+// Principal is the authenticated identity behind a request, derived from a
+// verified Firebase ID token
+type Principal struct {
+	UID            string                 `json:"uid"`
+	Email          string                 `json:"email,omitempty"`
+	PhoneNumber    string                 `json:"phoneNumber,omitempty"`
+	EmailVerified  bool                   `json:"emailVerified"`
+	SignInProvider string                 `json:"signInProvider,omitempty"`
+	TenantID       string                 `json:"tenantId,omitempty"`
+	Claims         map[string]interface{} `json:"claims,omitempty"`
+	AuthTime       time.Time              `json:"authTime"`
+}
+
+// NewPrincipal derives a principal from a verified Firebase ID token
+func NewPrincipal(token *auth.Token) (*Principal, error) {
+	if token == nil {
+		return nil, fmt.Errorf("nil auth token, can't derive a principal")
+	}
+	claims := token.Claims
+	if claims == nil {
+		claims = map[string]interface{}{}
+	}
+	p := &Principal{
+		UID:            token.UID,
+		SignInProvider: token.Firebase.SignInProvider,
+		TenantID:       token.Firebase.Tenant,
+		Claims:         claims,
+	}
+	if token.AuthTime > 0 {
+		p.AuthTime = time.Unix(token.AuthTime, 0)
+	}
+	p.Email, _ = p.StringClaim("email")
+	p.PhoneNumber, _ = p.StringClaim("phone_number")
+	p.EmailVerified, _ = p.BoolClaim("email_verified")
+	return p, nil
+}
+
+// WithPrincipal returns a copy of the supplied context that carries the principal
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, PrincipalContextKey, p)
+}
+
+// PrincipalFromContext retrieves the authenticated principal from the supplied context.
+//
+// Contexts that only carry a Firebase *auth.Token (e.g those composed before the
+// principal was introduced) have the principal derived from the token.
+func PrincipalFromContext(ctx context.Context) (*Principal, error) {
+	val := ctx.Value(PrincipalContextKey)
+	if val == nil {
+		authToken, err := GetUserTokenFromContext(ctx)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"unable to get principal from context with key %#v: %w", PrincipalContextKey, err)
+		}
+		return NewPrincipal(authToken)
+	}
+
+	p, ok := val.(*Principal)
+	if !ok || p == nil {
+		return nil, fmt.Errorf("wrong principal type, got %#v, expected a *Principal", val)
+	}
+	return p, nil
+}
+
+// HasClaim reports whether the principal's token carries the named claim
+func (p *Principal) HasClaim(name string) bool {
+	_, ok := p.Claims[name]
+	return ok
+}
+
+// StringClaim returns the named claim if it is a string
+func (p *Principal) StringClaim(name string) (string, bool) {
+	val, ok := p.Claims[name].(string)
+	return val, ok
+}
+
+// BoolClaim returns the named claim if it is a boolean
+func (p *Principal) BoolClaim(name string) (bool, bool) {
+	val, ok := p.Claims[name].(bool)
+	return val, ok
+}
+
+// Int64Claim returns the named claim if it is a whole number.
+// JSON numbers are decoded as float64 so both representations are accepted.
+func (p *Principal) Int64Claim(name string) (int64, bool) {
+	switch val := p.Claims[name].(type) {
+	case float64:
+		if val != float64(int64(val)) {
+			return 0, false
+		}
+		return int64(val), true
+	case int64:
+		return val, true
+	case int:
+		return int64(val), true
+	default:
+		return 0, false
+	}
+}
+
+// StringSliceClaim returns the named claim if it is a list of strings
+func (p *Principal) StringSliceClaim(name string) ([]string, bool) {
+	switch val := p.Claims[name].(type) {
+	case []string:
+		return val, true
+	case []interface{}:
+		values := []string{}
+		for _, item := range val {
+			s, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			values = append(values, s)
+		}
+		return values, true
+	default:
+		return nil, false
+	}
+}
+
+// NewPrincipalFromUserRecord derives a principal from a Firebase user record
+// e.g when acting as another user. Its claims are the user's custom claims.
+// SignInProvider is left empty since a user record does not say how the user
+// signed in; its ProviderID is always `firebase`.
+func NewPrincipalFromUserRecord(user *auth.UserRecord) (*Principal, error) {
+	if user == nil || user.UserInfo == nil {
+		return nil, fmt.Errorf("nil user record, can't derive a principal")
+	}
+	claims := map[string]interface{}{}
+	for k, v := range user.CustomClaims {
+		claims[k] = v
+	}
+	return &Principal{
+		UID:           user.UID,
+		Email:         user.Email,
+		PhoneNumber:   user.PhoneNumber,
+		EmailVerified: user.EmailVerified,
+		TenantID:      user.TenantID,
+		Claims:        claims,
+	}, nil
+}
@@ -0,0 +1,123 @@
+package firebasetools_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func testAuthToken() *auth.Token {
+	return &auth.Token{
+		UID:      "a-uid",
+		AuthTime: 1600000000,
+		Firebase: auth.FirebaseInfo{
+			SignInProvider: "password",
+			Tenant:         "tenant-a",
+		},
+		Claims: map[string]interface{}{
+			"email":          "patient@example.com",
+			"phone_number":   "+254700000000",
+			"email_verified": true,
+			"level":          float64(3),
+			"ratio":          0.5,
+			"roles":          []interface{}{"clinician", "admin"},
+		},
+	}
+}
+
+func TestNewPrincipal(t *testing.T) {
+	_, err := firebasetools.NewPrincipal(nil)
+	assert.NotNil(t, err)
+
+	p, err := firebasetools.NewPrincipal(testAuthToken())
+	assert.Nil(t, err)
+	assert.Equal(t, "a-uid", p.UID)
+	assert.Equal(t, "patient@example.com", p.Email)
+	assert.Equal(t, "+254700000000", p.PhoneNumber)
+	assert.True(t, p.EmailVerified)
+	assert.Equal(t, "password", p.SignInProvider)
+	assert.Equal(t, "tenant-a", p.TenantID)
+	assert.Equal(t, time.Unix(1600000000, 0), p.AuthTime)
+}
+
+func TestNewPrincipalFromUserRecord(t *testing.T) {
+	p, err := firebasetools.NewPrincipalFromUserRecord(&auth.UserRecord{
+		UserInfo:     &auth.UserInfo{UID: "a-uid", Email: "a@example.com", ProviderID: "firebase"},
+		CustomClaims: map[string]interface{}{"role": "nurse"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "a-uid", p.UID)
+	assert.Empty(t, p.SignInProvider, "user records don't say how the user signed in")
+	assert.Equal(t, "nurse", p.Claims["role"])
+}
+
+func TestPrincipal_ClaimAccessors(t *testing.T) {
+	p, err := firebasetools.NewPrincipal(testAuthToken())
+	assert.Nil(t, err)
+
+	assert.True(t, p.HasClaim("roles"))
+	assert.False(t, p.HasClaim("missing"))
+
+	email, ok := p.StringClaim("email")
+	assert.True(t, ok)
+	assert.Equal(t, "patient@example.com", email)
+	_, ok = p.StringClaim("level")
+	assert.False(t, ok)
+
+	verified, ok := p.BoolClaim("email_verified")
+	assert.True(t, ok)
+	assert.True(t, verified)
+
+	level, ok := p.Int64Claim("level")
+	assert.True(t, ok)
+	assert.Equal(t, int64(3), level)
+	_, ok = p.Int64Claim("ratio")
+	assert.False(t, ok)
+
+	roles, ok := p.StringSliceClaim("roles")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"clinician", "admin"}, roles)
+	_, ok = p.StringSliceClaim("email")
+	assert.False(t, ok)
+}
+
+func TestPrincipalFromContext(t *testing.T) {
+	_, err := firebasetools.PrincipalFromContext(context.Background())
+	assert.NotNil(t, err)
+
+	principal := &firebasetools.Principal{UID: "explicit-uid"}
+	got, err := firebasetools.PrincipalFromContext(firebasetools.WithPrincipal(context.Background(), principal))
+	assert.Nil(t, err)
+	assert.Equal(t, principal, got)
+
+	// contexts that only carry a token have the principal derived from it
+	tokenCtx := context.WithValue(context.Background(), firebasetools.AuthTokenContextKey, testAuthToken())
+	got, err = firebasetools.PrincipalFromContext(tokenCtx)
+	assert.Nil(t, err)
+	assert.Equal(t, "a-uid", got.UID)
+}
+
+func TestAuthenticationMiddleware_SetsPrincipal(t *testing.T) {
+	var got *firebasetools.Principal
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := firebasetools.PrincipalFromContext(r.Context())
+		assert.Nil(t, err)
+		got = p
+	})
+	check := func(r *http.Request, fa firebasetools.IFirebaseApp) (bool, map[string]string, *auth.Token) {
+		return true, nil, testAuthToken()
+	}
+	h := firebasetools.AuthenticationMiddleware(
+		&firebasetools.MockFirebaseApp{}, firebasetools.WithAuthChecks(check))(next)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.NotNil(t, got)
+	assert.Equal(t, "a-uid", got.UID)
+	assert.Equal(t, "tenant-a", got.TenantID)
+}
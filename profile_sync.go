@@ -0,0 +1,437 @@
+package firebasetools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"firebase.google.com/go/auth"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// User is the Firestore profile of a Firebase Auth user. Its document ID is the
+// user's UID and it lives in the collection that GetCollectionName picks for it.
+// Firebase Auth is the source of truth for the fields that are copied from it.
+type User struct {
+	Model
+
+	UID           string    `json:"uid" firestore:"uid"`
+	Email         string    `json:"email,omitempty" firestore:"email"`
+	EmailVerified bool      `json:"emailVerified" firestore:"emailVerified"`
+	PhoneNumber   string    `json:"phoneNumber,omitempty" firestore:"phoneNumber"`
+	DisplayName   string    `json:"displayName,omitempty" firestore:"displayName"`
+	PhotoURL      string    `json:"photoURL,omitempty" firestore:"photoURL"`
+	Disabled      bool      `json:"disabled" firestore:"disabled"`
+	ProviderIDs   []string  `json:"providerIDs,omitempty" firestore:"providerIDs"`
+	TenantID      string    `json:"tenantId,omitempty" firestore:"tenantId"`
+	CreatedAt     time.Time `json:"createdAt" firestore:"createdAt"`
+	LastLoginAt   time.Time `json:"lastLoginAt" firestore:"lastLoginAt"`
+	SyncedAt      time.Time `json:"syncedAt" firestore:"syncedAt"`
+}
+
+// NewUserProfile builds the profile of a Firebase Auth user
+func NewUserProfile(record *auth.UserRecord) *User {
+	profile := &User{
+		Disabled:      record.Disabled,
+		EmailVerified: record.EmailVerified,
+		TenantID:      record.TenantID,
+		ProviderIDs:   []string{},
+	}
+	if record.UserInfo != nil {
+		profile.ID = record.UID
+		profile.UID = record.UID
+		profile.Email = record.Email
+		profile.PhoneNumber = record.PhoneNumber
+		profile.DisplayName = record.DisplayName
+		profile.PhotoURL = record.PhotoURL
+		profile.Name = firstNonEmpty(record.DisplayName, "-")
+	}
+	if record.UserMetadata != nil {
+		if record.UserMetadata.CreationTimestamp > 0 {
+			profile.CreatedAt = time.Unix(0, record.UserMetadata.CreationTimestamp*int64(time.Millisecond)).UTC()
+		}
+		if record.UserMetadata.LastLogInTimestamp > 0 {
+			profile.LastLoginAt = time.Unix(0, record.UserMetadata.LastLogInTimestamp*int64(time.Millisecond)).UTC()
+		}
+	}
+	for _, info := range record.ProviderUserInfo {
+		profile.ProviderIDs = append(profile.ProviderIDs, info.ProviderID)
+	}
+	sort.Strings(profile.ProviderIDs)
+	return profile
+}
+
+// syncFrom copies the fields that Firebase Auth owns and reports whether any changed.
+// Fields that the application owns, like the description, are kept.
+func (u *User) syncFrom(source *User) bool {
+	changed := u.UID != source.UID ||
+		u.Email != source.Email ||
+		u.EmailVerified != source.EmailVerified ||
+		u.PhoneNumber != source.PhoneNumber ||
+		u.DisplayName != source.DisplayName ||
+		u.PhotoURL != source.PhotoURL ||
+		u.Disabled != source.Disabled ||
+		u.TenantID != source.TenantID ||
+		u.Deleted ||
+		!u.CreatedAt.Equal(source.CreatedAt) ||
+		!u.LastLoginAt.Equal(source.LastLoginAt) ||
+		!sameStrings(u.ProviderIDs, source.ProviderIDs)
+
+	u.ID = source.ID
+	u.UID = source.UID
+	u.Email = source.Email
+	u.EmailVerified = source.EmailVerified
+	u.PhoneNumber = source.PhoneNumber
+	u.DisplayName = source.DisplayName
+	u.PhotoURL = source.PhotoURL
+	u.Disabled = source.Disabled
+	u.TenantID = source.TenantID
+	u.Deleted = false
+	u.CreatedAt = source.CreatedAt
+	u.LastLoginAt = source.LastLoginAt
+	u.ProviderIDs = source.ProviderIDs
+	if u.Name == "" || u.Name == "-" {
+		u.Name = source.Name
+	}
+	return changed
+}
+
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// UserProfileStore keeps user profiles
+type UserProfileStore interface {
+	// GetUserProfile returns nil when the user has no profile
+	GetUserProfile(ctx context.Context, uid string) (*User, error)
+	SaveUserProfile(ctx context.Context, profile *User) error
+
+	// EachUserProfile calls fn with every profile, stopping at the first error
+	EachUserProfile(ctx context.Context, fn func(profile *User) error) error
+}
+
+// InMemoryUserProfileStore keeps user profiles in process memory.
+// It suits tests; profiles are lost when the process exits.
+type InMemoryUserProfileStore struct {
+	mu       sync.Mutex
+	profiles map[string]User
+}
+
+// NewInMemoryUserProfileStore creates an empty in-memory profile store
+func NewInMemoryUserProfileStore() *InMemoryUserProfileStore {
+	return &InMemoryUserProfileStore{profiles: map[string]User{}}
+}
+
+// GetUserProfile returns a copy of the user's profile
+func (s *InMemoryUserProfileStore) GetUserProfile(ctx context.Context, uid string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	profile, ok := s.profiles[uid]
+	if !ok {
+		return nil, nil
+	}
+	return &profile, nil
+}
+
+// SaveUserProfile saves a copy of the profile
+func (s *InMemoryUserProfileStore) SaveUserProfile(ctx context.Context, profile *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.profiles[profile.UID] = *profile
+	return nil
+}
+
+// EachUserProfile calls fn with a copy of every profile, in UID order
+func (s *InMemoryUserProfileStore) EachUserProfile(ctx context.Context, fn func(profile *User) error) error {
+	s.mu.Lock()
+	profiles := make([]User, 0, len(s.profiles))
+	for _, profile := range s.profiles {
+		profiles = append(profiles, profile)
+	}
+	s.mu.Unlock()
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].UID < profiles[j].UID })
+	for i := range profiles {
+		if err := fn(&profiles[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FirestoreUserProfileStore keeps user profiles in a Firestore collection, one document per UID
+type FirestoreUserProfileStore struct {
+	client     *firestore.Client
+	collection string
+}
+
+// NewFirestoreUserProfileStore creates a Firestore backed profile store.
+// When no collection is supplied, the collection that GetCollectionName picks for User is used.
+func NewFirestoreUserProfileStore(client *firestore.Client, collection string) *FirestoreUserProfileStore {
+	if collection == "" {
+		collection = GetCollectionName(&User{})
+	}
+	return &FirestoreUserProfileStore{client: client, collection: collection}
+}
+
+// GetUserProfile returns the user's profile
+func (s *FirestoreUserProfileStore) GetUserProfile(ctx context.Context, uid string) (*User, error) {
+	docs, err := s.client.GetAll(ctx, []*firestore.DocumentRef{s.client.Collection(s.collection).Doc(uid)})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the profile of %s: %w", uid, err)
+	}
+	if !docs[0].Exists() {
+		return nil, nil
+	}
+	profile := &User{}
+	if err := docs[0].DataTo(profile); err != nil {
+		return nil, fmt.Errorf("unable to read the profile of %s: %w", uid, err)
+	}
+	return profile, nil
+}
+
+// SaveUserProfile creates the user's profile, or merges the fields that Firebase
+// Auth owns into it. Fields that the application owns are left as stored, except
+// for a placeholder name.
+func (s *FirestoreUserProfileStore) SaveUserProfile(ctx context.Context, profile *User) error {
+	ref := s.client.Collection(s.collection).Doc(profile.UID)
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if doc == nil || !doc.Exists() {
+			return tx.Create(ref, profile)
+		}
+		fields := profile.authFields()
+		if name, err := doc.DataAt("name"); err != nil || name == "" || name == "-" {
+			fields["name"] = profile.Name
+		}
+		paths := make([]firestore.FieldPath, 0, len(fields))
+		for path := range fields {
+			paths = append(paths, firestore.FieldPath{path})
+		}
+		return tx.Set(ref, fields, firestore.Merge(paths...))
+	})
+	if err != nil {
+		return fmt.Errorf("unable to save the profile of %s: %w", profile.UID, err)
+	}
+	return nil
+}
+
+// authFields returns the stored fields that are copied from Firebase Auth, or
+// that sync and reconciliation maintain
+func (u *User) authFields() map[string]interface{} {
+	return map[string]interface{}{
+		"id":            u.ID,
+		"uid":           u.UID,
+		"email":         u.Email,
+		"emailVerified": u.EmailVerified,
+		"phoneNumber":   u.PhoneNumber,
+		"displayName":   u.DisplayName,
+		"photoURL":      u.PhotoURL,
+		"disabled":      u.Disabled,
+		"providerIDs":   u.ProviderIDs,
+		"tenantId":      u.TenantID,
+		"createdAt":     u.CreatedAt,
+		"lastLoginAt":   u.LastLoginAt,
+		"syncedAt":      u.SyncedAt,
+		"deleted":       u.Deleted,
+	}
+}
+
+// EachUserProfile streams every profile in the collection
+func (s *FirestoreUserProfileStore) EachUserProfile(ctx context.Context, fn func(profile *User) error) error {
+	docs := s.client.Collection(s.collection).Documents(ctx)
+	defer docs.Stop()
+	for {
+		doc, err := docs.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to list user profiles: %w", err)
+		}
+		profile := &User{}
+		if err := doc.DataTo(profile); err != nil {
+			return fmt.Errorf("unable to read the profile %s: %w", doc.Ref.ID, err)
+		}
+		if err := fn(profile); err != nil {
+			return err
+		}
+	}
+}
+
+// ProfileSync mirrors Firebase Auth users into user profiles
+type ProfileSync struct {
+	Store UserProfileStore
+
+	// Users lists every Firebase Auth user for reconciliation. It defaults to the
+	// users of the project, or of the context's tenant.
+	Users func(ctx context.Context) (UserRecordIterator, error)
+}
+
+// NewProfileSync creates a profile sync that keeps profiles in the supplied store
+func NewProfileSync(store UserProfileStore) *ProfileSync {
+	return &ProfileSync{Store: store}
+}
+
+func listFirebaseUsers(ctx context.Context) (UserRecordIterator, error) {
+	authClient, err := getUserTransferClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return authClient.Users(ctx, ""), nil
+}
+
+// SyncUser creates or updates the user's profile. Profiles that are already in
+// sync are not written.
+func (s *ProfileSync) SyncUser(ctx context.Context, record *auth.UserRecord) (*User, error) {
+	_, profile, err := s.syncUser(ctx, record, false)
+	return profile, err
+}
+
+// syncUser returns what happened to the profile: created, updated or unchanged
+func (s *ProfileSync) syncUser(ctx context.Context, record *auth.UserRecord, dryRun bool) (string, *User, error) {
+	if record == nil || record.UserInfo == nil || record.UID == "" {
+		return "", nil, fmt.Errorf("a user record with a UID is required")
+	}
+	source := NewUserProfile(record)
+	profile, err := s.Store.GetUserProfile(ctx, record.UID)
+	if err != nil {
+		return "", nil, err
+	}
+	outcome := "updated"
+	if profile == nil {
+		profile = &User{}
+		outcome = "created"
+	}
+	if !profile.syncFrom(source) && outcome != "created" {
+		return "unchanged", profile, nil
+	}
+	profile.SyncedAt = time.Now().UTC()
+	if dryRun {
+		return outcome, profile, nil
+	}
+	if err := s.Store.SaveUserProfile(ctx, profile); err != nil {
+		return "", nil, err
+	}
+	return outcome, profile, nil
+}
+
+// syncAfterLogin syncs the profile of a user who just signed in. Failures are
+// logged since they should not stop the user from signing in.
+func (s *ProfileSync) syncAfterLogin(ctx context.Context, user *auth.UserRecord) {
+	if s == nil || user == nil {
+		return
+	}
+	if _, err := s.SyncUser(ctx, user); err != nil {
+		log.Printf("unable to sync the profile of %s: %s", user.UID, err)
+	}
+}
+
+// WithProfileSync makes login handlers create or update the profile of every user who signs in
+func WithProfileSync(sync *ProfileSync) LoginOption {
+	return func(c *loginConfig) {
+		c.profiles = sync
+	}
+}
+
+// ProfileReconciliationReport summarizes a reconciliation
+type ProfileReconciliationReport struct {
+	DryRun    bool `json:"dryRun"`
+	Checked   int  `json:"checked"`
+	Created   int  `json:"created"`
+	Updated   int  `json:"updated"`
+	Unchanged int  `json:"unchanged"`
+
+	// Orphaned profiles belong to users who no longer exist in Firebase Auth.
+	// They are marked as deleted.
+	Orphaned int `json:"orphaned"`
+
+	// Errors lists the users whose profiles could not be synced
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Reconcile walks every Firebase Auth user and fixes drift in both directions:
+// missing and stale profiles are written from Firebase Auth, and profiles whose
+// user no longer exists are marked as deleted. Profiles that were created or
+// synced after the listing started are left alone, since their user may have
+// signed up after the listing passed them. Dry runs only report the changes.
+func (s *ProfileSync) Reconcile(ctx context.Context, dryRun bool) (*ProfileReconciliationReport, error) {
+	users := s.Users
+	if users == nil {
+		users = listFirebaseUsers
+	}
+	started := time.Now().UTC()
+	it, err := users(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ProfileReconciliationReport{DryRun: dryRun}
+	existing := map[string]bool{}
+	for {
+		record, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return report, fmt.Errorf("unable to list users: %w", err)
+		}
+		if record.UserRecord == nil || record.UserInfo == nil {
+			continue
+		}
+		existing[record.UID] = true
+		report.Checked++
+
+		outcome, _, err := s.syncUser(ctx, record.UserRecord, dryRun)
+		switch {
+		case err != nil:
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", record.UID, err))
+		case outcome == "created":
+			report.Created++
+		case outcome == "updated":
+			report.Updated++
+		default:
+			report.Unchanged++
+		}
+	}
+
+	err = s.Store.EachUserProfile(ctx, func(profile *User) error {
+		if existing[profile.UID] || profile.Deleted {
+			return nil
+		}
+		if profile.CreatedAt.After(started) || profile.SyncedAt.After(started) {
+			return nil
+		}
+		report.Orphaned++
+		if dryRun {
+			return nil
+		}
+		profile.Deleted = true
+		profile.SyncedAt = time.Now().UTC()
+		if err := s.Store.SaveUserProfile(ctx, profile); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", profile.UID, err))
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	return report, nil
+}
@@ -0,0 +1,158 @@
+package firebasetools_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewUserProfile(t *testing.T) {
+	profile := firebasetools.NewUserProfile(&auth.UserRecord{
+		UserInfo:      &auth.UserInfo{UID: "nurse-uid", Email: "nurse@example.com", DisplayName: "Jane"},
+		EmailVerified: true,
+		ProviderUserInfo: []*auth.UserInfo{
+			{ProviderID: "password"}, {ProviderID: "google.com"},
+		},
+		UserMetadata: &auth.UserMetadata{CreationTimestamp: 1600000000123},
+	})
+	assert.Equal(t, "nurse-uid", profile.ID)
+	assert.Equal(t, "Jane", profile.Name)
+	assert.Equal(t, []string{"google.com", "password"}, profile.ProviderIDs)
+	assert.Equal(t, int64(1600000000123), profile.CreatedAt.UnixNano()/1e6)
+	assert.True(t, profile.LastLoginAt.IsZero())
+}
+
+func TestProfileSync_SyncUser(t *testing.T) {
+	ctx := context.Background()
+	store := firebasetools.NewInMemoryUserProfileStore()
+	sync := firebasetools.NewProfileSync(store)
+	record := testLoginResult("nurse-uid").User
+
+	profile, err := sync.SyncUser(ctx, record)
+	assert.Nil(t, err)
+	assert.Equal(t, "nurse-uid@example.com", profile.Email)
+	firstSync := profile.SyncedAt
+
+	// application owned fields survive syncs
+	profile.Description = "night shift"
+	assert.Nil(t, store.SaveUserProfile(ctx, profile))
+
+	profile, err = sync.SyncUser(ctx, record)
+	assert.Nil(t, err)
+	assert.Equal(t, firstSync, profile.SyncedAt, "profiles in sync are not rewritten")
+
+	record.DisplayName = "Jane"
+	record.Disabled = true
+	_, err = sync.SyncUser(ctx, record)
+	assert.Nil(t, err)
+	saved, err := store.GetUserProfile(ctx, "nurse-uid")
+	assert.Nil(t, err)
+	assert.Equal(t, "Jane", saved.DisplayName)
+	assert.True(t, saved.Disabled)
+	assert.Equal(t, "night shift", saved.Description)
+
+	_, err = sync.SyncUser(ctx, &auth.UserRecord{})
+	assert.NotNil(t, err)
+}
+
+func TestProfileSync_OnLoginAndRegistration(t *testing.T) {
+	store := firebasetools.NewInMemoryUserProfileStore()
+	sync := firebasetools.NewProfileSync(store)
+
+	password := &stubLoginProvider{name: firebasetools.LoginProviderPassword, result: testLoginResult("nurse-uid")}
+	login := firebasetools.NewLoginHandler([]firebasetools.LoginProvider{password}, firebasetools.WithProfileSync(sync))
+	assert.Equal(t, http.StatusOK, postJSON(t, login, map[string]string{"username": "a", "password": "b"}, nil))
+
+	register := firebasetools.GetRegistrationFunc(firebasetools.RegistrationConfig{
+		ProfileSync: sync,
+		CreateUser: func(ctx context.Context, tenantID string, user *auth.UserToCreate) (*auth.UserRecord, error) {
+			return testLoginResult("new-uid").User, nil
+		},
+		IssueTokens: func(ctx context.Context, user *auth.UserRecord) (*firebasetools.LoginResult, error) {
+			return testLoginResult(user.UID), nil
+		},
+	})
+	rw := httptest.NewRecorder()
+	register(rw, httptest.NewRequest(http.MethodPost, "/register",
+		bytes.NewBufferString(`{"email": "new-uid@example.com", "password": "Correct1Horse"}`)))
+	assert.Equal(t, http.StatusCreated, rw.Code)
+
+	for _, uid := range []string{"nurse-uid", "new-uid"} {
+		profile, err := store.GetUserProfile(context.Background(), uid)
+		assert.Nil(t, err)
+		assert.NotNil(t, profile, uid)
+	}
+}
+
+func TestProfileSync_Reconcile(t *testing.T) {
+	ctx := context.Background()
+	store := firebasetools.NewInMemoryUserProfileStore()
+	sync := firebasetools.NewProfileSync(store)
+
+	inSync := testLoginResult("in-sync").User
+	_, err := sync.SyncUser(ctx, inSync)
+	assert.Nil(t, err)
+	stale := testLoginResult("stale").User
+	_, err = sync.SyncUser(ctx, stale)
+	assert.Nil(t, err)
+	_, err = sync.SyncUser(ctx, testLoginResult("orphan").User)
+	assert.Nil(t, err)
+
+	stale.Email = "changed@example.com"
+	sync.Users = func(ctx context.Context) (firebasetools.UserRecordIterator, error) {
+		return &stubUserIterator{records: []*auth.ExportedUserRecord{
+			{UserRecord: inSync},
+			{UserRecord: stale},
+			{UserRecord: testLoginResult("missing").User},
+		}}, nil
+	}
+
+	report, err := sync.Reconcile(ctx, true)
+	assert.Nil(t, err)
+	assert.Equal(t, firebasetools.ProfileReconciliationReport{
+		DryRun: true, Checked: 3, Created: 1, Updated: 1, Unchanged: 1, Orphaned: 1,
+	}, *report)
+	missing, _ := store.GetUserProfile(ctx, "missing")
+	assert.Nil(t, missing, "dry runs don't write")
+
+	report, err = sync.Reconcile(ctx, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Created)
+	assert.Equal(t, 1, report.Orphaned)
+
+	orphan, _ := store.GetUserProfile(ctx, "orphan")
+	assert.True(t, orphan.Deleted)
+	updated, _ := store.GetUserProfile(ctx, "stale")
+	assert.Equal(t, "changed@example.com", updated.Email)
+
+	// a second pass finds nothing to fix
+	report, err = sync.Reconcile(ctx, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Unchanged)
+	assert.Zero(t, report.Orphaned)
+}
+
+func TestProfileSync_Reconcile_SignupDuringListing(t *testing.T) {
+	ctx := context.Background()
+	store := firebasetools.NewInMemoryUserProfileStore()
+	sync := firebasetools.NewProfileSync(store)
+
+	// the user signs up after the listing started, so it doesn't include them
+	sync.Users = func(ctx context.Context) (firebasetools.UserRecordIterator, error) {
+		_, err := sync.SyncUser(ctx, testLoginResult("new").User)
+		assert.Nil(t, err)
+		return &stubUserIterator{}, nil
+	}
+
+	report, err := sync.Reconcile(ctx, false)
+	assert.Nil(t, err)
+	assert.Zero(t, report.Orphaned)
+	profile, _ := store.GetUserProfile(ctx, "new")
+	assert.False(t, profile.Deleted)
+}
@@ -0,0 +1,368 @@
+package firebasetools
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// RateLimitCollectionName is the (unsuffixed) Firestore collection that holds rate limit buckets
+const RateLimitCollectionName = "rate_limits"
+
+// DefaultRateLimitSweepInterval is how often the in-memory store drops idle buckets
+const DefaultRateLimitSweepInterval = time.Minute
+
+// RateLimit allows bursts of up to Limit requests that are replenished evenly over Period
+type RateLimit struct {
+	Limit  int
+	Period time.Duration
+}
+
+// RateLimitRule applies a rate limit to the requests that match its path prefix
+// and claim. Empty fields match every request.
+type RateLimitRule struct {
+	// Name identifies the rule's buckets. It defaults to the rule's position.
+	Name string
+
+	PathPrefix string
+
+	// Claim is a custom claim that the principal must hold with a value other than
+	// `false` e.g a "premium" or "partner" tier
+	Claim string
+
+	Limit RateLimit
+}
+
+func (rule RateLimitRule) matches(r *http.Request, principal *Principal) bool {
+	if rule.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, rule.PathPrefix) {
+		return false
+	}
+	if rule.Claim != "" {
+		if principal == nil || !principal.HasClaim(rule.Claim) {
+			return false
+		}
+		if enabled, isBool := principal.BoolClaim(rule.Claim); isBool && !enabled {
+			return false
+		}
+	}
+	return true
+}
+
+// RateLimitConfig determines which limit applies to a request
+type RateLimitConfig struct {
+	// Rules are evaluated in order and the first match wins.
+	// More specific rules (e.g route + claim) should come first.
+	Rules []RateLimitRule
+
+	// Default applies to requests that match no rule
+	Default RateLimit
+
+	// TrustForwardedFor makes unauthenticated requests be keyed by the first
+	// `X-Forwarded-For` address. Only enable it behind a proxy that sets the header.
+	TrustForwardedFor bool
+}
+
+// Validate checks that the default limit and the limit of every rule are usable
+func (c RateLimitConfig) Validate() error {
+	if err := validateRateLimit(c.Default); err != nil {
+		return fmt.Errorf("default: %w", err)
+	}
+	for i, rule := range c.Rules {
+		if err := validateRateLimit(rule.Limit); err != nil {
+			name := rule.Name
+			if name == "" {
+				name = strconv.Itoa(i)
+			}
+			return fmt.Errorf("rule %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// RateLimitResult is the outcome of taking a token from a bucket
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	ResetAfter time.Duration
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps token buckets. Implementations must be safe for concurrent use.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit) (*RateLimitResult, error)
+}
+
+// rateLimitBucket is the persisted state of a token bucket
+type rateLimitBucket struct {
+	Tokens    float64   `json:"tokens" firestore:"tokens"`
+	UpdatedAt time.Time `json:"updatedAt" firestore:"updatedAt"`
+
+	// ExpiresAt is when the bucket will have refilled completely, after which it
+	// is no different from a new one and can be dropped
+	ExpiresAt time.Time `json:"expiresAt" firestore:"expiresAt"`
+}
+
+// take refills the bucket for the time elapsed since it was last updated then
+// tries to take a single token from it
+func (b *rateLimitBucket) take(now time.Time, limit RateLimit) *RateLimitResult {
+	capacity := float64(limit.Limit)
+	ratePerSec := capacity / limit.Period.Seconds()
+
+	elapsed := now.Sub(b.UpdatedAt).Seconds()
+	if elapsed > 0 {
+		b.Tokens = math.Min(capacity, b.Tokens+elapsed*ratePerSec)
+	}
+	b.UpdatedAt = now
+
+	result := &RateLimitResult{Limit: limit.Limit}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - b.Tokens) / ratePerSec)
+	}
+	result.Remaining = int(math.Floor(b.Tokens))
+	result.ResetAfter = secondsToDuration((capacity - b.Tokens) / ratePerSec)
+	b.ExpiresAt = now.Add(result.ResetAfter)
+	return result
+}
+
+func newRateLimitBucket(now time.Time, limit RateLimit) *rateLimitBucket {
+	return &rateLimitBucket{Tokens: float64(limit.Limit), UpdatedAt: now}
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(math.Ceil(seconds)) * time.Second
+}
+
+func validateRateLimit(limit RateLimit) error {
+	if limit.Limit <= 0 || limit.Period <= 0 {
+		return fmt.Errorf("invalid rate limit %d per %s: both must be positive", limit.Limit, limit.Period)
+	}
+	return nil
+}
+
+// InMemoryRateLimitStore keeps token buckets in process memory.
+// It suits single instance deployments and tests.
+//
+// Buckets that have been idle long enough to refill completely are dropped,
+// since they are no different from new ones, so memory only grows with the
+// number of recently active clients.
+type InMemoryRateLimitStore struct {
+	// SweepInterval defaults to DefaultRateLimitSweepInterval
+	SweepInterval time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*inMemoryRateLimitBucket
+	lastSweep time.Time
+}
+
+type inMemoryRateLimitBucket struct {
+	*rateLimitBucket
+	period time.Duration
+}
+
+// NewInMemoryRateLimitStore creates an empty in-memory rate limit store
+func NewInMemoryRateLimitStore() *InMemoryRateLimitStore {
+	return &InMemoryRateLimitStore{
+		SweepInterval: DefaultRateLimitSweepInterval,
+		buckets:       map[string]*inMemoryRateLimitBucket{},
+		lastSweep:     time.Now(),
+	}
+}
+
+// Take takes a token from the bucket with the indicated key
+func (s *InMemoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (*RateLimitResult, error) {
+	if err := validateRateLimit(limit); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &inMemoryRateLimitBucket{rateLimitBucket: newRateLimitBucket(now, limit)}
+		s.buckets[key] = bucket
+	}
+	bucket.period = limit.Period
+	return bucket.take(now, limit), nil
+}
+
+// Len returns the number of buckets held
+func (s *InMemoryRateLimitStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buckets)
+}
+
+// sweep drops the buckets that have refilled completely. The caller holds the lock.
+func (s *InMemoryRateLimitStore) sweep(now time.Time) {
+	interval := s.SweepInterval
+	if interval <= 0 {
+		interval = DefaultRateLimitSweepInterval
+	}
+	if now.Sub(s.lastSweep) < interval {
+		return
+	}
+	s.lastSweep = now
+	for key, bucket := range s.buckets {
+		if now.Sub(bucket.UpdatedAt) >= bucket.period {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// FirestoreRateLimitStore keeps token buckets in a Firestore collection so that
+// limits are shared by all the instances of a service.
+//
+// Every bucket document has an `expiresAt` timestamp after which it has refilled
+// completely. Configure a Firestore TTL policy on that field so that idle
+// buckets are deleted.
+type FirestoreRateLimitStore struct {
+	client     *firestore.Client
+	collection string
+}
+
+// NewFirestoreRateLimitStore creates a Firestore backed rate limit store.
+// When no collection is supplied, the suffixed `rate_limits` collection is used.
+func NewFirestoreRateLimitStore(client *firestore.Client, collection string) *FirestoreRateLimitStore {
+	if collection == "" {
+		collection = SuffixCollection(RateLimitCollectionName)
+	}
+	return &FirestoreRateLimitStore{client: client, collection: collection}
+}
+
+// Take takes a token from the bucket with the indicated key inside a transaction
+func (s *FirestoreRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (*RateLimitResult, error) {
+	if err := validateRateLimit(limit); err != nil {
+		return nil, err
+	}
+	// keys contain characters (e.g `/` in routes) that are not allowed in document IDs
+	digest := sha256.Sum256([]byte(key))
+	ref := s.client.Collection(s.collection).Doc(hex.EncodeToString(digest[:]))
+
+	var result *RateLimitResult
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		now := time.Now()
+		docs, err := tx.GetAll([]*firestore.DocumentRef{ref})
+		if err != nil {
+			return err
+		}
+		bucket := newRateLimitBucket(now, limit)
+		if docs[0].Exists() {
+			if err := docs[0].DataTo(bucket); err != nil {
+				return err
+			}
+		}
+		result = bucket.take(now, limit)
+		return tx.Set(ref, bucket)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to take a rate limit token for %s: %w", key, err)
+	}
+	return result, nil
+}
+
+// rateLimitKey identifies the bucket that the request draws from. Authenticated
+// requests are keyed by Firebase UID and unauthenticated ones by client IP.
+func rateLimitKey(r *http.Request, principal *Principal, trustForwardedFor bool) string {
+	if principal != nil && principal.UID != "" {
+		return "uid:" + principal.UID
+	}
+	return "ip:" + clientIP(r, trustForwardedFor)
+}
+
+// clientIP returns the address of the client that sent the request. The
+// `X-Forwarded-For` header is only consulted when it is trusted.
+func clientIP(r *http.Request, trustForwardedFor bool) string {
+	if trustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// SetRateLimitHeaders sets the `RateLimit-*` headers (and `Retry-After` when the
+// request was throttled) that describe the supplied result
+func SetRateLimitHeaders(w http.ResponseWriter, result *RateLimitResult) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(result.ResetAfter.Seconds())))
+	if !result.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(result.RetryAfter.Seconds())))
+	}
+}
+
+// RateLimitMiddleware throttles requests using token buckets keyed by the
+// principal's Firebase UID, falling back to the client IP for unauthenticated
+// requests. It should run after AuthenticationMiddleware.
+//
+// Throttled requests get a 429 problem response. If the store fails, the
+// error is logged and the request is let through. Configs with unusable limits
+// are rejected up front.
+func RateLimitMiddleware(store RateLimitStore, config RateLimitConfig) (func(http.Handler) http.Handler, error) {
+	if store == nil {
+		return nil, fmt.Errorf("a rate limit store is required")
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid rate limit config: %w", err)
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				// unauthenticated requests have no principal and are keyed by IP
+				principal, _ := PrincipalFromContext(r.Context())
+
+				// the default limit's bucket can't clash with a rule's, whatever its name
+				limit := config.Default
+				bucket := "default"
+				for i, rule := range config.Rules {
+					if rule.matches(r, principal) {
+						limit = rule.Limit
+						ruleName := rule.Name
+						if ruleName == "" {
+							ruleName = strconv.Itoa(i)
+						}
+						bucket = "rule:" + ruleName
+						break
+					}
+				}
+
+				key := rateLimitKey(r, principal, config.TrustForwardedFor) + Sep + bucket
+				result, err := store.Take(r.Context(), key, limit)
+				if err != nil {
+					log.Printf("rate limiting skipped for %s: %s", key, err)
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				SetRateLimitHeaders(w, result)
+				if !result.Allowed {
+					writeProblem(w, r, http.StatusTooManyRequests,
+						fmt.Sprintf("rate limit of %d requests per %s exceeded", limit.Limit, limit.Period))
+					return
+				}
+				next.ServeHTTP(w, r)
+			},
+		)
+	}, nil
+}
@@ -0,0 +1,158 @@
+package firebasetools_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInMemoryRateLimitStore_Take(t *testing.T) {
+	ctx := context.Background()
+	store := firebasetools.NewInMemoryRateLimitStore()
+	limit := firebasetools.RateLimit{Limit: 2, Period: time.Hour}
+
+	first, err := store.Take(ctx, "uid:a", limit)
+	assert.Nil(t, err)
+	assert.True(t, first.Allowed)
+	assert.Equal(t, 1, first.Remaining)
+
+	second, err := store.Take(ctx, "uid:a", limit)
+	assert.Nil(t, err)
+	assert.True(t, second.Allowed)
+	assert.Equal(t, 0, second.Remaining)
+
+	third, err := store.Take(ctx, "uid:a", limit)
+	assert.Nil(t, err)
+	assert.False(t, third.Allowed)
+	assert.Equal(t, 30*time.Minute, third.RetryAfter)
+
+	// buckets are independent
+	other, err := store.Take(ctx, "uid:b", limit)
+	assert.Nil(t, err)
+	assert.True(t, other.Allowed)
+
+	_, err = store.Take(ctx, "uid:a", firebasetools.RateLimit{})
+	assert.NotNil(t, err)
+}
+
+func TestInMemoryRateLimitStore_EvictsIdleBuckets(t *testing.T) {
+	ctx := context.Background()
+	store := firebasetools.NewInMemoryRateLimitStore()
+	store.SweepInterval = time.Nanosecond
+	short := firebasetools.RateLimit{Limit: 1, Period: 10 * time.Millisecond}
+	long := firebasetools.RateLimit{Limit: 1, Period: time.Hour}
+
+	for _, key := range []string{"ip:1", "ip:2", "ip:3"} {
+		_, err := store.Take(ctx, key, short)
+		assert.Nil(t, err)
+	}
+	_, err := store.Take(ctx, "uid:a", long)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, store.Len())
+
+	time.Sleep(20 * time.Millisecond)
+	result, err := store.Take(ctx, "uid:a", long)
+	assert.Nil(t, err)
+	assert.False(t, result.Allowed, "buckets that have not refilled are kept")
+	assert.Equal(t, 1, store.Len())
+}
+
+func TestRateLimitMiddleware_InvalidConfig(t *testing.T) {
+	store := firebasetools.NewInMemoryRateLimitStore()
+	_, err := firebasetools.RateLimitMiddleware(store, firebasetools.RateLimitConfig{})
+	assert.NotNil(t, err, "a zero default limit is rejected")
+
+	_, err = firebasetools.RateLimitMiddleware(store, firebasetools.RateLimitConfig{
+		Default: firebasetools.RateLimit{Limit: 1, Period: time.Minute},
+		Rules:   []firebasetools.RateLimitRule{{Name: "login", PathPrefix: "/login"}},
+	})
+	assert.EqualError(t, err, "invalid rate limit config: rule login: invalid rate limit 0 per 0s: both must be positive")
+
+	_, err = firebasetools.RateLimitMiddleware(nil, firebasetools.RateLimitConfig{
+		Default: firebasetools.RateLimit{Limit: 1, Period: time.Minute},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	config := firebasetools.RateLimitConfig{
+		Rules: []firebasetools.RateLimitRule{
+			{
+				Name:       "premium-login",
+				PathPrefix: "/login",
+				Claim:      "premium",
+				Limit:      firebasetools.RateLimit{Limit: 3, Period: time.Minute},
+			},
+			{
+				Name:       "login",
+				PathPrefix: "/login",
+				Limit:      firebasetools.RateLimit{Limit: 1, Period: time.Minute},
+			},
+		},
+		Default: firebasetools.RateLimit{Limit: 2, Period: time.Minute},
+	}
+	middleware, err := firebasetools.RateLimitMiddleware(firebasetools.NewInMemoryRateLimitStore(), config)
+	assert.Nil(t, err)
+	h := middleware(next)
+
+	request := func(path string, principal *firebasetools.Principal) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if principal != nil {
+			req = req.WithContext(firebasetools.WithPrincipal(req.Context(), principal))
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+
+	// unauthenticated requests are keyed by IP and use the route rule
+	rw := request("/login", nil)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", rw.Header().Get("RateLimit-Remaining"))
+
+	rw = request("/login", nil)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "60", rw.Header().Get("Retry-After"))
+	assert.Equal(t, firebasetools.ProblemJSONContentType, rw.Header().Get("Content-Type"))
+
+	// authenticated users on the same IP have their own buckets
+	user := &firebasetools.Principal{UID: "a-uid"}
+	assert.Equal(t, http.StatusOK, request("/login", user).Code)
+	assert.Equal(t, http.StatusTooManyRequests, request("/login", user).Code)
+
+	// claim tiers get a higher limit
+	premium := &firebasetools.Principal{UID: "b-uid", Claims: map[string]interface{}{"premium": true}}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, request("/login", premium).Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, request("/login", premium).Code)
+
+	// other routes use the default limit with separate buckets
+	rw = request("/graphql", user)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "2", rw.Header().Get("RateLimit-Limit"))
+}
+
+func TestRateLimitMiddleware_RuleNamedDefault(t *testing.T) {
+	config := firebasetools.RateLimitConfig{
+		Rules:   []firebasetools.RateLimitRule{{Name: "default", PathPrefix: "/login", Limit: firebasetools.RateLimit{Limit: 1, Period: time.Minute}}},
+		Default: firebasetools.RateLimit{Limit: 1, Period: time.Minute},
+	}
+	middleware, err := firebasetools.RateLimitMiddleware(firebasetools.NewInMemoryRateLimitStore(), config)
+	assert.Nil(t, err)
+	h := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, path := range []string{"/login", "/graphql"} {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusOK, rw.Code, "a rule named default has its own bucket")
+	}
+}
@@ -0,0 +1,364 @@
+package firebasetools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/serverutils"
+)
+
+// e164PhoneNumber matches phone numbers in the E.164 format that Firebase Auth expects
+var e164PhoneNumber = regexp.MustCompile(`^\+[1-9]\d{6,14}$`)
+
+// PasswordPolicy sets the rules that new passwords must follow
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+// DefaultPasswordPolicy requires passwords of 8 to 128 characters with upper and lower case letters and a digit
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:    8,
+		MaxLength:    128,
+		RequireUpper: true,
+		RequireLower: true,
+		RequireDigit: true,
+	}
+}
+
+// Validate returns the rules that the password breaks, as a sentence, or an empty string
+func (p PasswordPolicy) Validate(password string) string {
+	problems := []string{}
+	length := len([]rune(password))
+	if length < p.MinLength {
+		problems = append(problems, fmt.Sprintf("be at least %d characters long", p.MinLength))
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		problems = append(problems, fmt.Sprintf("be at most %d characters long", p.MaxLength))
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			hasSymbol = true
+		}
+	}
+	if p.RequireUpper && !hasUpper {
+		problems = append(problems, "contain an uppercase letter")
+	}
+	if p.RequireLower && !hasLower {
+		problems = append(problems, "contain a lowercase letter")
+	}
+	if p.RequireDigit && !hasDigit {
+		problems = append(problems, "contain a digit")
+	}
+	if p.RequireSymbol && !hasSymbol {
+		problems = append(problems, "contain a symbol")
+	}
+
+	if len(problems) == 0 {
+		return ""
+	}
+	return "the password must " + strings.Join(problems, ", ")
+}
+
+// RegistrationInput is the unmarshalling target for registration requests
+type RegistrationInput struct {
+	Email       string `json:"email,omitempty"`
+	PhoneNumber string `json:"phoneNumber,omitempty"`
+	Password    string `json:"password"`
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+// FieldValidationError is returned when some fields of a request are invalid.
+// Fields maps each invalid field's JSON name to what is wrong with it.
+type FieldValidationError struct {
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields"`
+}
+
+func (e *FieldValidationError) Error() string {
+	if len(e.Fields) == 0 {
+		return e.Message
+	}
+	problems := []string{}
+	for field, problem := range e.Fields {
+		problems = append(problems, field+": "+problem)
+	}
+	sort.Strings(problems)
+	return fmt.Sprintf("%s (%s)", e.Message, strings.Join(problems, "; "))
+}
+
+// ValidateRegistrationInput checks that the registration details supplied in the
+// indicated request are valid. Invalid details get a 400 response listing the
+// problem with each field.
+func ValidateRegistrationInput(
+	w http.ResponseWriter,
+	r *http.Request,
+	policy PasswordPolicy,
+) (*RegistrationInput, error) {
+	input := &RegistrationInput{}
+	if r.Body == nil || json.NewDecoder(r.Body).Decode(input) != nil {
+		err := &FieldValidationError{Message: "invalid registration details, expected a JSON object"}
+		serverutils.WriteJSONResponse(w, err, http.StatusBadRequest)
+		return nil, err
+	}
+	input.Email = strings.TrimSpace(input.Email)
+	input.PhoneNumber = strings.TrimSpace(input.PhoneNumber)
+	input.DisplayName = strings.TrimSpace(input.DisplayName)
+
+	fields := map[string]string{}
+	if input.Email == "" && input.PhoneNumber == "" {
+		fields["email"] = "an email or phone number is required"
+		fields["phoneNumber"] = "an email or phone number is required"
+	}
+	if input.Email != "" {
+		if addr, err := mail.ParseAddress(input.Email); err != nil || addr.Address != input.Email {
+			fields["email"] = "invalid email address"
+		}
+	}
+	if input.PhoneNumber != "" && !e164PhoneNumber.MatchString(input.PhoneNumber) {
+		fields["phoneNumber"] = "invalid phone number, expected the international format e.g +254700000000"
+	}
+	if input.Password == "" {
+		fields["password"] = "a password is required"
+	} else if problem := policy.Validate(input.Password); problem != "" {
+		fields["password"] = problem
+	}
+
+	if len(fields) > 0 {
+		err := &FieldValidationError{Message: "invalid registration details", Fields: fields}
+		serverutils.WriteJSONResponse(w, err, http.StatusBadRequest)
+		return nil, err
+	}
+	return input, nil
+}
+
+// RegistrationConfig configures the registration handler
+type RegistrationConfig struct {
+	// PasswordPolicy defaults to DefaultPasswordPolicy when left empty
+	PasswordPolicy PasswordPolicy
+
+	// SendVerificationEmail emails new users with an email address a verification link
+	SendVerificationEmail bool
+
+	// DefaultClaims are set as custom claims on every new user
+	DefaultClaims map[string]interface{}
+
+	// SignupPolicy decides who may register. A nil policy lets everyone register.
+	SignupPolicy *SignupPolicy
+
+	// MFA, when set, gives new users who must pass a second factor (e.g because
+	// of their DefaultClaims, see RequireMFAForClaim) an MFA challenge instead of
+	// tokens
+	MFA *MFAConfig
+
+	// CreateUser defaults to creating a Firebase Auth user in the request's tenant, if any
+	CreateUser func(ctx context.Context, tenantID string, user *auth.UserToCreate) (*auth.UserRecord, error)
+
+	// SetCustomClaims defaults to merging the claims into the Firebase Auth custom
+	// claims, with the updates of a ClaimsManager
+	SetCustomClaims func(ctx context.Context, tenantID string, uid string, claims map[string]interface{}) error
+
+	// DeleteUser removes users whose registration could not be completed.
+	// It defaults to a Firebase Auth deletion.
+	DeleteUser func(ctx context.Context, tenantID string, uid string) error
+
+	// IssueTokens defaults to IssueFirebaseLoginTokens
+	IssueTokens func(ctx context.Context, user *auth.UserRecord) (*LoginResult, error)
+
+	// SendEmailVerification defaults to the Firebase Auth REST API
+	SendEmailVerification func(ctx context.Context, idToken string) error
+
+	// ProfileSync, when set, creates the profile of every new user
+	ProfileSync *ProfileSync
+}
+
+func createFirebaseUser(ctx context.Context, tenantID string, user *auth.UserToCreate) (*auth.UserRecord, error) {
+	if tenantID != "" {
+		authClient, err := GetTenantAuthClient(ctx, tenantID)
+		if err != nil {
+			return nil, err
+		}
+		return authClient.CreateUser(ctx, user)
+	}
+	authClient, err := GetFirebaseAuthClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get or create Firebase client: %w", err)
+	}
+	return authClient.CreateUser(ctx, user)
+}
+
+func setFirebaseCustomClaims(ctx context.Context, tenantID string, uid string, claims map[string]interface{}) error {
+	if tenantID != "" {
+		authClient, err := GetTenantAuthClient(ctx, tenantID)
+		if err != nil {
+			return err
+		}
+		return authClient.SetCustomUserClaims(ctx, uid, claims)
+	}
+	authClient, err := GetFirebaseAuthClient(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get or create Firebase client: %w", err)
+	}
+	return authClient.SetCustomUserClaims(ctx, uid, claims)
+}
+
+// SendFirebaseEmailVerification emails the user who owns the ID token a link that verifies their email address
+func SendFirebaseEmailVerification(ctx context.Context, idToken string) error {
+	payload := map[string]interface{}{
+		"requestType": "VERIFY_EMAIL",
+		"idToken":     idToken,
+	}
+	resp := map[string]interface{}{}
+	if err := postIdentityToolkit(ctx, FirebaseSendOobCodeURL, payload, &resp); err != nil {
+		return fmt.Errorf("unable to send a verification email: %w", err)
+	}
+	return nil
+}
+
+// GetRegistrationFunc returns a handler that creates a Firebase user with an email
+// and/or phone number and a password, then signs them in. New users get a 201
+// response with the same body as a login, or a 202 MFA challenge when they
+// must pass a second factor. Users whose default claims can't be set are
+// deleted so that they can register again.
+func GetRegistrationFunc(config RegistrationConfig) http.HandlerFunc {
+	policy := config.PasswordPolicy
+	if policy == (PasswordPolicy{}) {
+		policy = DefaultPasswordPolicy()
+	}
+	createUser := config.CreateUser
+	if createUser == nil {
+		createUser = createFirebaseUser
+	}
+	setCustomClaims := config.SetCustomClaims
+	if setCustomClaims == nil {
+		setCustomClaims = mergeFirebaseCustomClaims
+	}
+	deleteUser := config.DeleteUser
+	if deleteUser == nil {
+		deleteUser = deleteFirebaseUser
+	}
+	issueTokens := config.IssueTokens
+	if issueTokens == nil {
+		issueTokens = IssueFirebaseLoginTokens
+	}
+	sendEmailVerification := config.SendEmailVerification
+	if sendEmailVerification == nil {
+		sendEmailVerification = SendFirebaseEmailVerification
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		input, err := ValidateRegistrationInput(w, r, policy)
+		if err != nil {
+			return // ValidateRegistrationInput has already written the error response
+		}
+		ctx := r.Context()
+		tenantID, _ := GetTenantIDFromContext(ctx)
+
+		err = config.SignupPolicy.Check(ctx, &SignupCandidate{
+			Email:       input.Email,
+			PhoneNumber: input.PhoneNumber,
+			TenantID:    tenantID,
+		})
+		if err != nil {
+			WriteLoginError(w, err)
+			return
+		}
+
+		params := (&auth.UserToCreate{}).
+			Password(input.Password).
+			EmailVerified(false).
+			Disabled(false)
+		if input.Email != "" {
+			params = params.Email(input.Email)
+		}
+		if input.PhoneNumber != "" {
+			params = params.PhoneNumber(input.PhoneNumber)
+		}
+		if input.DisplayName != "" {
+			params = params.DisplayName(input.DisplayName)
+		}
+		user, err := createUser(ctx, tenantID, params)
+		switch {
+		case auth.IsEmailAlreadyExists(err):
+			serverutils.WriteJSONResponse(w, &FieldValidationError{
+				Message: "unable to register",
+				Fields:  map[string]string{"email": "an account with this email address already exists"},
+			}, http.StatusConflict)
+			return
+		case auth.IsPhoneNumberAlreadyExists(err):
+			serverutils.WriteJSONResponse(w, &FieldValidationError{
+				Message: "unable to register",
+				Fields:  map[string]string{"phoneNumber": "an account with this phone number already exists"},
+			}, http.StatusConflict)
+			return
+		case err != nil:
+			WriteLoginError(w, fmt.Errorf("unable to create user: %w", err))
+			return
+		}
+
+		if len(config.DefaultClaims) > 0 {
+			// claims are set before tokens are issued so that the first ID token carries them
+			if err := setCustomClaims(ctx, tenantID, user.UID, config.DefaultClaims); err != nil {
+				// without its claims the account would miss e.g its role, so it is removed
+				if deleteErr := deleteUser(ctx, tenantID, user.UID); deleteErr != nil {
+					log.Printf("unable to delete %s after failing to set its custom claims: %s", user.UID, deleteErr)
+				}
+				WriteLoginError(w, fmt.Errorf("unable to set the custom claims of %s: %w", user.UID, err))
+				return
+			}
+			user.CustomClaims = config.DefaultClaims
+		}
+
+		result, err := issueTokens(ctx, user)
+		if err != nil {
+			// the client never learns of the account, so a retry would conflict with it
+			if deleteErr := deleteUser(ctx, tenantID, user.UID); deleteErr != nil {
+				log.Printf("unable to delete %s after failing to issue its tokens: %s", user.UID, deleteErr)
+			}
+			WriteLoginError(w, err)
+			return
+		}
+
+		config.ProfileSync.syncAfterLogin(ctx, user)
+
+		if config.SendVerificationEmail && user.Email != "" {
+			if err := sendEmailVerification(ctx, result.Tokens.IDToken); err != nil {
+				log.Printf("unable to send a verification email to %s: %s", user.UID, err)
+			}
+		}
+
+		if config.MFA != nil && config.MFA.challenge(ctx, w, user) {
+			return // the tokens only served to send the verification email
+		}
+
+		loginResp, err := NewLoginResponse(result)
+		if err != nil {
+			WriteLoginError(w, err)
+			return
+		}
+		serverutils.WriteJSONResponse(w, loginResp, http.StatusCreated)
+	}
+}
@@ -0,0 +1,233 @@
+package firebasetools_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordPolicy_Validate(t *testing.T) {
+	policy := firebasetools.DefaultPasswordPolicy()
+	tests := []struct {
+		name     string
+		password string
+		want     string
+	}{
+		{name: "valid", password: "Correct1Horse", want: ""},
+		{name: "too short", password: "Ab1", want: "the password must be at least 8 characters long"},
+		{
+			name:     "no uppercase or digit",
+			password: "correcthorse",
+			want:     "the password must contain an uppercase letter, contain a digit",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, policy.Validate(tt.password))
+		})
+	}
+
+	symbols := firebasetools.PasswordPolicy{MinLength: 4, RequireSymbol: true}
+	assert.NotEmpty(t, symbols.Validate("abcd"))
+	assert.Empty(t, symbols.Validate("ab!d"))
+}
+
+func TestValidateRegistrationInput(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantFields []string
+	}{
+		{name: "email and password", body: `{"email": "a@example.com", "password": "Correct1Horse"}`},
+		{name: "phone and password", body: `{"phoneNumber": "+254700000000", "password": "Correct1Horse"}`},
+		{
+			name:       "no identifier",
+			body:       `{"password": "Correct1Horse"}`,
+			wantFields: []string{"email", "phoneNumber"},
+		},
+		{
+			name:       "invalid email and weak password",
+			body:       `{"email": "not an email", "password": "weak"}`,
+			wantFields: []string{"email", "password"},
+		},
+		{
+			name:       "local phone number",
+			body:       `{"phoneNumber": "0700000000", "password": "Correct1Horse"}`,
+			wantFields: []string{"phoneNumber"},
+		},
+		{name: "not JSON", body: `{`, wantFields: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/register", bytes.NewBufferString(tt.body))
+			input, err := firebasetools.ValidateRegistrationInput(rw, r, firebasetools.DefaultPasswordPolicy())
+			if tt.wantFields == nil {
+				assert.Nil(t, err)
+				assert.NotNil(t, input)
+				return
+			}
+			assert.NotNil(t, err)
+			assert.Equal(t, http.StatusBadRequest, rw.Code)
+			resp := firebasetools.FieldValidationError{}
+			assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &resp))
+			assert.Len(t, resp.Fields, len(tt.wantFields))
+			for _, field := range tt.wantFields {
+				assert.Contains(t, resp.Fields, field)
+			}
+		})
+	}
+}
+
+func TestGetRegistrationFunc(t *testing.T) {
+	var (
+		gotClaims       map[string]interface{}
+		verificationFor string
+	)
+	register := firebasetools.GetRegistrationFunc(firebasetools.RegistrationConfig{
+		SendVerificationEmail: true,
+		DefaultClaims:         map[string]interface{}{"role": "patient"},
+		CreateUser: func(ctx context.Context, tenantID string, user *auth.UserToCreate) (*auth.UserRecord, error) {
+			return &auth.UserRecord{UserInfo: &auth.UserInfo{UID: "new-uid", Email: "a@example.com"}}, nil
+		},
+		SetCustomClaims: func(ctx context.Context, tenantID string, uid string, claims map[string]interface{}) error {
+			gotClaims = claims
+			return nil
+		},
+		IssueTokens: func(ctx context.Context, user *auth.UserRecord) (*firebasetools.LoginResult, error) {
+			assert.Equal(t, "patient", user.CustomClaims["role"], "claims are set before tokens are issued")
+			result := testLoginResult(user.UID)
+			result.User = user
+			return result, nil
+		},
+		SendEmailVerification: func(ctx context.Context, idToken string) error {
+			verificationFor = idToken
+			return fmt.Errorf("email sending failures don't fail registration")
+		},
+	})
+
+	rw := httptest.NewRecorder()
+	register(rw, httptest.NewRequest(http.MethodPost, "/register",
+		bytes.NewBufferString(`{"email": "a@example.com", "password": "Correct1Horse"}`)))
+	assert.Equal(t, http.StatusCreated, rw.Code)
+	resp := firebasetools.LoginResponse{}
+	assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &resp))
+	assert.Equal(t, "new-uid", resp.UID)
+	assert.Equal(t, "id-token", resp.IDToken)
+	assert.Equal(t, "patient", gotClaims["role"])
+	assert.Equal(t, "id-token", verificationFor)
+
+	rw = httptest.NewRecorder()
+	register(rw, httptest.NewRequest(http.MethodPost, "/register",
+		bytes.NewBufferString(`{"email": "a@example.com", "password": "weak"}`)))
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func TestGetRegistrationFunc_CreateUserFailure(t *testing.T) {
+	register := firebasetools.GetRegistrationFunc(firebasetools.RegistrationConfig{
+		CreateUser: func(ctx context.Context, tenantID string, user *auth.UserToCreate) (*auth.UserRecord, error) {
+			return nil, fmt.Errorf("unable to create user")
+		},
+	})
+	rw := httptest.NewRecorder()
+	register(rw, httptest.NewRequest(http.MethodPost, "/register",
+		bytes.NewBufferString(`{"email": "a@example.com", "password": "Correct1Horse"}`)))
+	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+}
+
+func TestGetRegistrationFunc_ClaimsFailure(t *testing.T) {
+	deleted := ""
+	register := firebasetools.GetRegistrationFunc(firebasetools.RegistrationConfig{
+		DefaultClaims: map[string]interface{}{"role": "patient"},
+		CreateUser: func(ctx context.Context, tenantID string, user *auth.UserToCreate) (*auth.UserRecord, error) {
+			return &auth.UserRecord{UserInfo: &auth.UserInfo{UID: "new-uid", Email: "a@example.com"}}, nil
+		},
+		SetCustomClaims: func(ctx context.Context, tenantID string, uid string, claims map[string]interface{}) error {
+			return fmt.Errorf("unavailable")
+		},
+		DeleteUser: func(ctx context.Context, tenantID string, uid string) error {
+			deleted = uid
+			return nil
+		},
+	})
+	rw := httptest.NewRecorder()
+	register(rw, httptest.NewRequest(http.MethodPost, "/register",
+		bytes.NewBufferString(`{"email": "a@example.com", "password": "Correct1Horse"}`)))
+	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+	assert.Equal(t, "new-uid", deleted, "users without their claims are removed")
+}
+
+func TestGetRegistrationFunc_TokenFailure(t *testing.T) {
+	deleted := ""
+	register := firebasetools.GetRegistrationFunc(firebasetools.RegistrationConfig{
+		CreateUser: func(ctx context.Context, tenantID string, user *auth.UserToCreate) (*auth.UserRecord, error) {
+			return &auth.UserRecord{UserInfo: &auth.UserInfo{UID: "new-uid", Email: "a@example.com"}}, nil
+		},
+		IssueTokens: func(ctx context.Context, user *auth.UserRecord) (*firebasetools.LoginResult, error) {
+			return nil, fmt.Errorf("unavailable")
+		},
+		DeleteUser: func(ctx context.Context, tenantID string, uid string) error {
+			deleted = uid
+			return nil
+		},
+	})
+	rw := httptest.NewRecorder()
+	register(rw, httptest.NewRequest(http.MethodPost, "/register",
+		bytes.NewBufferString(`{"email": "a@example.com", "password": "Correct1Horse"}`)))
+	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+	assert.Equal(t, "new-uid", deleted, "users that didn't get their tokens are removed")
+}
+
+func TestGetRegistrationFunc_SignupPolicy(t *testing.T) {
+	register := firebasetools.GetRegistrationFunc(firebasetools.RegistrationConfig{
+		SignupPolicy: &firebasetools.SignupPolicy{
+			Mode:           firebasetools.SignupAllowedDomains,
+			AllowedDomains: []string{"example.com"},
+		},
+		CreateUser: func(ctx context.Context, tenantID string, user *auth.UserToCreate) (*auth.UserRecord, error) {
+			t.Errorf("the signup policy should have stopped the registration")
+			return nil, fmt.Errorf("unexpected")
+		},
+	})
+	for _, email := range []string{"a@elsewhere.com", "a@example.com"} {
+		rw := httptest.NewRecorder()
+		register(rw, httptest.NewRequest(http.MethodPost, "/register",
+			bytes.NewBufferString(`{"email": "`+email+`", "password": "Correct1Horse"}`)))
+		assert.Equal(t, http.StatusForbidden, rw.Code, "registered addresses are unverified")
+	}
+}
+
+func TestGetRegistrationFunc_MFARequired(t *testing.T) {
+	mfa := newTestMFAConfig(t, nil)
+	mfa.Required = firebasetools.RequireMFAForClaim(mfa.TOTP, "clinician")
+	register := firebasetools.GetRegistrationFunc(firebasetools.RegistrationConfig{
+		DefaultClaims: map[string]interface{}{"clinician": true},
+		MFA:           mfa,
+		CreateUser: func(ctx context.Context, tenantID string, user *auth.UserToCreate) (*auth.UserRecord, error) {
+			return &auth.UserRecord{UserInfo: &auth.UserInfo{UID: "new-uid", Email: "a@example.com"}}, nil
+		},
+		SetCustomClaims: func(ctx context.Context, tenantID string, uid string, claims map[string]interface{}) error {
+			return nil
+		},
+		IssueTokens: func(ctx context.Context, user *auth.UserRecord) (*firebasetools.LoginResult, error) {
+			return testLoginResult(user.UID), nil
+		},
+	})
+	rw := httptest.NewRecorder()
+	register(rw, httptest.NewRequest(http.MethodPost, "/register",
+		bytes.NewBufferString(`{"email": "a@example.com", "password": "Correct1Horse"}`)))
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+	challenge := firebasetools.MFAChallengeResponse{}
+	assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &challenge))
+	assert.True(t, challenge.EnrollmentRequired)
+	assert.NotEmpty(t, challenge.ChallengeToken)
+	assert.NotContains(t, rw.Body.String(), "id-token")
+}
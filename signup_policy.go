@@ -0,0 +1,173 @@
+package firebasetools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// SignupMode decides who may create an account by logging in for the first time
+type SignupMode string
+
+// signup modes
+const (
+	SignupOpen           SignupMode = "open"
+	SignupDisabled       SignupMode = "disabled"
+	SignupAllowedDomains SignupMode = "allowed_domains"
+	SignupInviteOnly     SignupMode = "invite_only"
+	SignupCustom         SignupMode = "custom"
+)
+
+// ErrSignupNotAllowed is wrapped by the errors returned when a signup policy
+// stops an unknown user from creating an account
+var ErrSignupNotAllowed = errors.New("sign up is not allowed")
+
+// SignupCandidate describes an unknown user who is about to be created
+type SignupCandidate struct {
+	Email       string
+	PhoneNumber string
+	TenantID    string
+
+	// EmailVerified is set when the identity provider vouches for the email
+	// address. Addresses typed in at registration or login are unverified.
+	EmailVerified bool
+}
+
+func (c *SignupCandidate) identifier() string {
+	return firstNonEmpty(c.Email, c.PhoneNumber)
+}
+
+// SignupPolicy is consulted before users that don't exist yet are created on login
+type SignupPolicy struct {
+	Mode SignupMode
+
+	// AllowedDomains lists the email domains that may sign up in the
+	// `allowed_domains` mode e.g `example.com`. Subdomains must be listed separately.
+	// Only verified addresses count, so in this mode users sign up through an
+	// identity provider (e.g IdPLoginProvider) rather than with a password.
+	AllowedDomains []string
+
+	// IsInvited reports whether the candidate has been invited, in the `invite_only` mode
+	IsInvited func(ctx context.Context, candidate *SignupCandidate) (bool, error)
+
+	// Allow decides whether the candidate may sign up, in the `custom` mode
+	Allow func(ctx context.Context, candidate *SignupCandidate) (bool, error)
+
+	// DeleteUser removes the users that a login provider created before the
+	// policy could turn them away e.g on their first IdP sign in. It defaults to
+	// a Firebase Auth deletion.
+	DeleteUser func(ctx context.Context, tenantID string, uid string) error
+}
+
+// OpenSignupPolicy lets anyone create an account by logging in
+func OpenSignupPolicy() *SignupPolicy {
+	return &SignupPolicy{Mode: SignupOpen}
+}
+
+// Check returns nil when the candidate may sign up. Candidates that are turned
+// away get a 403 login error that wraps ErrSignupNotAllowed.
+// A nil policy is open.
+func (p *SignupPolicy) Check(ctx context.Context, candidate *SignupCandidate) error {
+	if p == nil {
+		return nil
+	}
+	var (
+		allowed bool
+		reason  string
+	)
+	switch p.Mode {
+	case SignupOpen, "":
+		return nil
+	case SignupDisabled:
+		reason = "new sign ups are disabled"
+	case SignupAllowedDomains:
+		allowed = candidate.EmailVerified && p.domainAllowed(candidate.Email)
+		reason = "sign ups are limited to verified addresses from approved email domains"
+	case SignupInviteOnly:
+		if p.IsInvited == nil {
+			return fmt.Errorf("the invite only signup policy has no invite check")
+		}
+		invited, err := p.IsInvited(ctx, candidate)
+		if err != nil {
+			return fmt.Errorf("unable to check the invitation of %s: %w", candidate.identifier(), err)
+		}
+		allowed = invited
+		reason = "sign ups are by invitation only"
+	case SignupCustom:
+		if p.Allow == nil {
+			return fmt.Errorf("the custom signup policy has no predicate")
+		}
+		ok, err := p.Allow(ctx, candidate)
+		if err != nil {
+			return fmt.Errorf("unable to check whether %s may sign up: %w", candidate.identifier(), err)
+		}
+		allowed = ok
+		reason = "this account is not allowed to sign up"
+	default:
+		return fmt.Errorf("unknown signup mode %q", p.Mode)
+	}
+	if allowed {
+		return nil
+	}
+	return NewLoginError(
+		http.StatusForbidden,
+		fmt.Sprintf("no account exists for %s and %s", candidate.identifier(), reason),
+		ErrSignupNotAllowed,
+	)
+}
+
+func (p *SignupPolicy) domainAllowed(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, allowed := range p.AllowedDomains {
+		if domain == strings.ToLower(strings.TrimPrefix(allowed, "@")) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithSignupPolicy makes login handlers consult the policy before creating users
+// that don't exist yet. Without it, logins keep creating accounts for any
+// email address or phone number.
+//
+// Providers that can only tell that they created a user after the fact (e.g
+// IdPLoginProvider, on first sign in) report it with LoginResult.IsNewUser.
+// Those users are deleted if the policy turns them away.
+func WithSignupPolicy(policy *SignupPolicy) LoginOption {
+	return func(c *loginConfig) {
+		c.signup = policy
+	}
+}
+
+// checkNewUser applies the signup policy to a user that the login created,
+// deleting them if the policy turns them away or can't be applied
+func (c *loginConfig) checkNewUser(ctx context.Context, tenantID string, result *LoginResult) error {
+	if c.signup == nil || result == nil || result.User == nil || !result.IsNewUser || result.signupChecked {
+		return nil
+	}
+	user := result.User
+	tenantID = firstNonEmpty(user.TenantID, tenantID)
+	err := c.signup.Check(ctx, &SignupCandidate{
+		Email:         user.Email,
+		PhoneNumber:   user.PhoneNumber,
+		TenantID:      tenantID,
+		EmailVerified: user.EmailVerified,
+	})
+	if err == nil {
+		return nil
+	}
+	deleteUser := c.signup.DeleteUser
+	if deleteUser == nil {
+		deleteUser = deleteFirebaseUser
+	}
+	if deleteErr := deleteUser(ctx, tenantID, user.UID); deleteErr != nil {
+		return fmt.Errorf("unable to delete %s, whom the signup policy turned away: %w", user.UID, deleteErr)
+	}
+	return err
+}
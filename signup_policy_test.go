@@ -0,0 +1,175 @@
+package firebasetools_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignupPolicy_Check(t *testing.T) {
+	invited := func(ctx context.Context, c *firebasetools.SignupCandidate) (bool, error) {
+		return c.Email == "invited@example.com", nil
+	}
+	tests := []struct {
+		name       string
+		policy     *firebasetools.SignupPolicy
+		candidate  firebasetools.SignupCandidate
+		wantStatus int
+		wantErr    bool
+	}{
+		{name: "nil policy", policy: nil, candidate: firebasetools.SignupCandidate{Email: "a@example.com"}},
+		{name: "open", policy: firebasetools.OpenSignupPolicy(), candidate: firebasetools.SignupCandidate{Email: "a@example.com"}},
+		{
+			name:       "disabled",
+			policy:     &firebasetools.SignupPolicy{Mode: firebasetools.SignupDisabled},
+			candidate:  firebasetools.SignupCandidate{PhoneNumber: "+254700000000"},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "allowed domain",
+			policy: &firebasetools.SignupPolicy{
+				Mode: firebasetools.SignupAllowedDomains, AllowedDomains: []string{"@Example.com"},
+			},
+			candidate: firebasetools.SignupCandidate{Email: "a@EXAMPLE.com", EmailVerified: true},
+		},
+		{
+			name: "unverified address from an allowed domain",
+			policy: &firebasetools.SignupPolicy{
+				Mode: firebasetools.SignupAllowedDomains, AllowedDomains: []string{"example.com"},
+			},
+			candidate:  firebasetools.SignupCandidate{Email: "a@example.com"},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "subdomains are not allowed domains",
+			policy: &firebasetools.SignupPolicy{
+				Mode: firebasetools.SignupAllowedDomains, AllowedDomains: []string{"example.com"},
+			},
+			candidate:  firebasetools.SignupCandidate{Email: "a@evil.example.com", EmailVerified: true},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "phone numbers have no domain",
+			policy: &firebasetools.SignupPolicy{
+				Mode: firebasetools.SignupAllowedDomains, AllowedDomains: []string{"example.com"},
+			},
+			candidate:  firebasetools.SignupCandidate{PhoneNumber: "+254700000000"},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:      "invited",
+			policy:    &firebasetools.SignupPolicy{Mode: firebasetools.SignupInviteOnly, IsInvited: invited},
+			candidate: firebasetools.SignupCandidate{Email: "invited@example.com"},
+		},
+		{
+			name:       "not invited",
+			policy:     &firebasetools.SignupPolicy{Mode: firebasetools.SignupInviteOnly, IsInvited: invited},
+			candidate:  firebasetools.SignupCandidate{Email: "stranger@example.com"},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "invite check failure",
+			policy: &firebasetools.SignupPolicy{
+				Mode: firebasetools.SignupInviteOnly,
+				IsInvited: func(ctx context.Context, c *firebasetools.SignupCandidate) (bool, error) {
+					return false, fmt.Errorf("firestore is down")
+				},
+			},
+			candidate: firebasetools.SignupCandidate{Email: "a@example.com"},
+			wantErr:   true,
+		},
+		{
+			name: "custom predicate",
+			policy: &firebasetools.SignupPolicy{
+				Mode: firebasetools.SignupCustom,
+				Allow: func(ctx context.Context, c *firebasetools.SignupCandidate) (bool, error) {
+					return c.TenantID == "tenant-a", nil
+				},
+			},
+			candidate:  firebasetools.SignupCandidate{Email: "a@example.com", TenantID: "tenant-b"},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:      "custom mode without a predicate",
+			policy:    &firebasetools.SignupPolicy{Mode: firebasetools.SignupCustom},
+			candidate: firebasetools.SignupCandidate{Email: "a@example.com"},
+			wantErr:   true,
+		},
+		{
+			name:      "unknown mode",
+			policy:    &firebasetools.SignupPolicy{Mode: "sometimes"},
+			candidate: firebasetools.SignupCandidate{Email: "a@example.com"},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			candidate := tt.candidate
+			err := tt.policy.Check(context.Background(), &candidate)
+			switch {
+			case tt.wantStatus != 0:
+				assert.Equal(t, tt.wantStatus, loginErrorStatus(err))
+				assert.True(t, errors.Is(err, firebasetools.ErrSignupNotAllowed))
+				assert.Contains(t, err.Error(), "no account exists for")
+			case tt.wantErr:
+				assert.NotNil(t, err)
+				assert.False(t, errors.Is(err, firebasetools.ErrSignupNotAllowed))
+			default:
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestNewLoginHandler_SignupPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		uid         string
+		email       string
+		verified    bool
+		isNewUser   bool
+		wantStatus  int
+		wantDeleted bool
+	}{
+		{"existing user outside the allowed domains", "someone", "", false, false, http.StatusOK, false},
+		{"new user from an allowed domain", "nurse", "nurse@hospital.org", true, true, http.StatusOK, false},
+		{"new user with an unverified address", "impostor", "impostor@hospital.org", false, true, http.StatusForbidden, true},
+		{"new user outside the allowed domains", "stranger", "", false, true, http.StatusForbidden, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deleted := ""
+			policy := &firebasetools.SignupPolicy{
+				Mode:           firebasetools.SignupAllowedDomains,
+				AllowedDomains: []string{"hospital.org"},
+				DeleteUser: func(ctx context.Context, tenantID string, uid string) error {
+					deleted = uid
+					return nil
+				},
+			}
+			result := testLoginResult(tt.uid)
+			if tt.email != "" {
+				result.User.Email = tt.email
+				result.User.EmailVerified = tt.verified
+			}
+			result.IsNewUser = tt.isNewUser
+			idp := &stubLoginProvider{name: firebasetools.LoginProviderIdP, result: result}
+			login := firebasetools.NewLoginHandler(
+				[]firebasetools.LoginProvider{idp}, firebasetools.WithSignupPolicy(policy))
+
+			status := postJSON(t, login, map[string]string{"providerId": "google.com", "idToken": "token"}, nil)
+			assert.Equal(t, tt.wantStatus, status)
+			assert.Equal(t, policy, idp.got.SignupPolicy, "providers get the handler's policy")
+			if tt.wantDeleted {
+				assert.Equal(t, tt.uid, deleted, "users that the policy turns away are removed")
+			} else {
+				assert.Empty(t, deleted)
+			}
+		})
+	}
+}
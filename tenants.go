@@ -0,0 +1,304 @@
+package firebasetools
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"firebase.google.com/go/auth"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// TenantIDContextKey is used to add/retrieve the resolved Identity Platform tenant ID on the context
+	TenantIDContextKey = ContextKey("TenantID")
+
+	// TenantIDHeaderName is the default request header used to select a tenant
+	TenantIDHeaderName = "X-Tenant-ID"
+)
+
+// TenantInput is used to create or update an Identity Platform tenant
+type TenantInput struct {
+	DisplayName           string `json:"displayName"`
+	AllowPasswordSignUp   bool   `json:"allowPasswordSignUp"`
+	EnableEmailLinkSignIn bool   `json:"enableEmailLinkSignIn"`
+}
+
+// TenantUpdateInput is used to update an Identity Platform tenant. Only the
+// fields that are set are changed.
+type TenantUpdateInput struct {
+	DisplayName           string `json:"displayName,omitempty"`
+	AllowPasswordSignUp   *bool  `json:"allowPasswordSignUp,omitempty"`
+	EnableEmailLinkSignIn *bool  `json:"enableEmailLinkSignIn,omitempty"`
+}
+
+// GetTenantManager initializes a Firebase Authentication tenant manager
+func GetTenantManager(ctx context.Context) (*auth.TenantManager, error) {
+	authClient, err := GetFirebaseAuthClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get tenant manager: %w", err)
+	}
+	if authClient.TenantManager == nil {
+		return nil, fmt.Errorf("the Firebase Auth client has no tenant manager")
+	}
+	return authClient.TenantManager, nil
+}
+
+// GetTenantAuthClient initializes a Firebase Authentication client scoped to the indicated tenant
+func GetTenantAuthClient(ctx context.Context, tenantID string) (*auth.TenantClient, error) {
+	if tenantID == "" {
+		return nil, fmt.Errorf("a tenant ID is required")
+	}
+	tenantManager, err := GetTenantManager(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client, err := tenantManager.AuthForTenant(tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize Firebase auth client for tenant %s: %w", tenantID, err)
+	}
+	return client, nil
+}
+
+// CreateTenant creates an Identity Platform tenant
+func CreateTenant(ctx context.Context, input TenantInput) (*auth.Tenant, error) {
+	if input.DisplayName == "" {
+		return nil, fmt.Errorf("a tenant display name is required")
+	}
+	tenantManager, err := GetTenantManager(ctx)
+	if err != nil {
+		return nil, err
+	}
+	params := (&auth.TenantToCreate{}).
+		DisplayName(input.DisplayName).
+		AllowPasswordSignUp(input.AllowPasswordSignUp).
+		EnableEmailLinkSignIn(input.EnableEmailLinkSignIn)
+	tenant, err := tenantManager.CreateTenant(ctx, params)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create tenant %s: %w", input.DisplayName, err)
+	}
+	return tenant, nil
+}
+
+// GetTenant retrieves the Identity Platform tenant with the indicated ID
+func GetTenant(ctx context.Context, tenantID string) (*auth.Tenant, error) {
+	if tenantID == "" {
+		return nil, fmt.Errorf("a tenant ID is required")
+	}
+	tenantManager, err := GetTenantManager(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tenant, err := tenantManager.Tenant(ctx, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get tenant %s: %w", tenantID, err)
+	}
+	return tenant, nil
+}
+
+// UpdateTenant updates the set fields of the Identity Platform tenant with the indicated ID
+func UpdateTenant(ctx context.Context, tenantID string, input TenantUpdateInput) (*auth.Tenant, error) {
+	if tenantID == "" {
+		return nil, fmt.Errorf("a tenant ID is required")
+	}
+	if input.DisplayName == "" && input.AllowPasswordSignUp == nil && input.EnableEmailLinkSignIn == nil {
+		return nil, fmt.Errorf("no tenant fields to update")
+	}
+	tenantManager, err := GetTenantManager(ctx)
+	if err != nil {
+		return nil, err
+	}
+	params := &auth.TenantToUpdate{}
+	if input.DisplayName != "" {
+		params = params.DisplayName(input.DisplayName)
+	}
+	if input.AllowPasswordSignUp != nil {
+		params = params.AllowPasswordSignUp(*input.AllowPasswordSignUp)
+	}
+	if input.EnableEmailLinkSignIn != nil {
+		params = params.EnableEmailLinkSignIn(*input.EnableEmailLinkSignIn)
+	}
+	tenant, err := tenantManager.UpdateTenant(ctx, tenantID, params)
+	if err != nil {
+		return nil, fmt.Errorf("unable to update tenant %s: %w", tenantID, err)
+	}
+	return tenant, nil
+}
+
+// DeleteTenant deletes the Identity Platform tenant with the indicated ID
+func DeleteTenant(ctx context.Context, tenantID string) error {
+	if tenantID == "" {
+		return fmt.Errorf("a tenant ID is required")
+	}
+	tenantManager, err := GetTenantManager(ctx)
+	if err != nil {
+		return err
+	}
+	err = tenantManager.DeleteTenant(ctx, tenantID)
+	if err != nil {
+		return fmt.Errorf("unable to delete tenant %s: %w", tenantID, err)
+	}
+	return nil
+}
+
+// ListTenants retrieves all the Identity Platform tenants in the project
+func ListTenants(ctx context.Context) ([]*auth.Tenant, error) {
+	tenantManager, err := GetTenantManager(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tenants := []*auth.Tenant{}
+	iter := tenantManager.Tenants(ctx, "")
+	for {
+		tenant, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to list tenants: %w", err)
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, nil
+}
+
+// GetOrCreateTenantFirebaseUser retrieves the user record of the tenant user with the
+// given email or creates a new one if no user in the tenant has the specified email
+func GetOrCreateTenantFirebaseUser(ctx context.Context, tenantID string, email string) (*auth.UserRecord, error) {
+	authClient, err := GetTenantAuthClient(ctx, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get or create tenant Firebase client: %w", err)
+	}
+	return getOrCreateUserByEmail(ctx, authClient, email, nil)
+}
+
+// GetOrCreateTenantFirebaseUserWithPolicy retrieves the user record of the tenant
+// user with the given email or, if the signup policy allows it, creates a new one
+func GetOrCreateTenantFirebaseUserWithPolicy(
+	ctx context.Context,
+	tenantID string,
+	email string,
+	policy *SignupPolicy,
+) (*auth.UserRecord, error) {
+	authClient, err := GetTenantAuthClient(ctx, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get or create tenant Firebase client: %w", err)
+	}
+	ctx = context.WithValue(ctx, TenantIDContextKey, tenantID)
+	return getOrCreateUserByEmail(ctx, authClient, email, policy)
+}
+
+// CreateTenantFirebaseCustomToken creates a custom auth token for the tenant user
+// with the indicated UID
+func CreateTenantFirebaseCustomToken(ctx context.Context, tenantID string, uid string) (string, error) {
+	authClient, err := GetTenantAuthClient(ctx, tenantID)
+	if err != nil {
+		return "", fmt.Errorf("unable to create custom tenant Firebase token: %w", err)
+	}
+	return authClient.CustomToken(ctx, uid)
+}
+
+// CreateTenantFirebaseCustomTokenWithClaims creates a custom auth token for the tenant
+// user with the indicated UID with additional claims
+func CreateTenantFirebaseCustomTokenWithClaims(
+	ctx context.Context,
+	tenantID string,
+	uid string,
+	claims map[string]interface{},
+) (string, error) {
+	authClient, err := GetTenantAuthClient(ctx, tenantID)
+	if err != nil {
+		return "", fmt.Errorf("unable to create custom tenant Firebase token: %w", err)
+	}
+	return authClient.CustomTokenWithClaims(ctx, uid, claims)
+}
+
+// AuthenticateTenantCustomFirebaseToken exchanges a tenant custom token for ID tokens
+func AuthenticateTenantCustomFirebaseToken(tenantID string, customAuthToken string) (*FirebaseUserTokens, error) {
+	if tenantID == "" {
+		return nil, fmt.Errorf("a tenant ID is required")
+	}
+	return exchangeCustomFirebaseToken(FirebaseTokenExchangePayload{
+		Token:             customAuthToken,
+		ReturnSecureToken: true,
+		TenantID:          tenantID,
+	})
+}
+
+// TenantResolver determines which tenant a request is addressed to.
+// An empty tenant ID means the request is addressed to the project itself.
+type TenantResolver func(r *http.Request) (string, error)
+
+// TenantFromHeader resolves the tenant from the indicated request header
+func TenantFromHeader(header string) TenantResolver {
+	return func(r *http.Request) (string, error) {
+		return strings.TrimSpace(r.Header.Get(header)), nil
+	}
+}
+
+// TenantFromHost resolves the tenant from the request's host name using the supplied
+// host to tenant ID mapping. Requests to unknown hosts are rejected.
+func TenantFromHost(hostTenants map[string]string) TenantResolver {
+	return func(r *http.Request) (string, error) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		tenantID, ok := hostTenants[strings.ToLower(host)]
+		if !ok {
+			return "", fmt.Errorf("no tenant is configured for host %s", host)
+		}
+		return tenantID, nil
+	}
+}
+
+// TenantMiddleware verifies that the `firebase.tenant` claim of the authenticated
+// user's token matches the tenant resolved from the request and packs the tenant ID
+// into the context. It should run after AuthenticationMiddleware.
+func TenantMiddleware(resolver TenantResolver, opts ...AuthenticationOption) func(http.Handler) http.Handler {
+	config := newAuthenticationConfig(opts...)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				tenantID, err := resolver(r)
+				if err != nil {
+					config.errorRenderer(w, r, NewAuthError(AuthErrorInvalidRequest, err.Error()))
+					return
+				}
+
+				authToken, err := GetUserTokenFromContext(r.Context())
+				if err != nil {
+					config.errorRenderer(w, r, NewAuthError("", err.Error()))
+					return
+				}
+				if authToken.Firebase.Tenant != tenantID {
+					config.errorRenderer(w, r, NewAuthError(
+						AuthErrorInvalidToken,
+						fmt.Sprintf("the auth token was not issued for tenant %q", tenantID),
+					))
+					return
+				}
+
+				ctx := context.WithValue(r.Context(), TenantIDContextKey, tenantID)
+				next.ServeHTTP(w, r.WithContext(ctx))
+			},
+		)
+	}
+}
+
+// GetTenantIDFromContext retrieves the resolved tenant ID from the supplied context
+func GetTenantIDFromContext(ctx context.Context) (string, error) {
+	val := ctx.Value(TenantIDContextKey)
+	if val == nil {
+		return "", fmt.Errorf(
+			"unable to get tenant ID from context with key %#v", TenantIDContextKey)
+	}
+
+	tenantID, ok := val.(string)
+	if !ok {
+		return "", fmt.Errorf("wrong tenant ID type, got %#v, expected a string", val)
+	}
+	return tenantID, nil
+}
@@ -0,0 +1,99 @@
+package firebasetools_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantFromHost(t *testing.T) {
+	resolver := firebasetools.TenantFromHost(map[string]string{
+		"clinic-a.example.com": "clinic-a-x1y2z",
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "https://Clinic-A.example.com:8443/", nil)
+	tenantID, err := resolver(req)
+	assert.Nil(t, err)
+	assert.Equal(t, "clinic-a-x1y2z", tenantID)
+
+	req = httptest.NewRequest(http.MethodGet, "https://unknown.example.com/", nil)
+	_, err = resolver(req)
+	assert.NotNil(t, err)
+}
+
+func TestTenantMiddleware(t *testing.T) {
+	withToken := func(r *http.Request, tenantID string) *http.Request {
+		token := &auth.Token{UID: "a-uid", Firebase: auth.FirebaseInfo{Tenant: tenantID}}
+		ctx := context.WithValue(r.Context(), firebasetools.AuthTokenContextKey, token)
+		return r.WithContext(ctx)
+	}
+	withHeader := func(tenantID string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(firebasetools.TenantIDHeaderName, tenantID)
+		return r
+	}
+
+	tests := []struct {
+		name       string
+		r          *http.Request
+		wantStatus int
+		wantTenant string
+	}{
+		{
+			name:       "matching tenant",
+			r:          withToken(withHeader("tenant-a"), "tenant-a"),
+			wantStatus: http.StatusOK,
+			wantTenant: "tenant-a",
+		},
+		{
+			name:       "project level user on project level request",
+			r:          withToken(httptest.NewRequest(http.MethodGet, "/", nil), ""),
+			wantStatus: http.StatusOK,
+			wantTenant: "",
+		},
+		{
+			name:       "token issued for another tenant",
+			r:          withToken(withHeader("tenant-a"), "tenant-b"),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "unauthenticated request",
+			r:          withHeader("tenant-a"),
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tenantID, err := firebasetools.GetTenantIDFromContext(r.Context())
+				assert.Nil(t, err)
+				assert.Equal(t, tt.wantTenant, tenantID)
+			})
+			mw := firebasetools.TenantMiddleware(firebasetools.TenantFromHeader(firebasetools.TenantIDHeaderName))
+			rw := httptest.NewRecorder()
+			mw(next).ServeHTTP(rw, tt.r)
+			assert.Equal(t, tt.wantStatus, rw.Code)
+		})
+	}
+}
+
+func TestGetTenantAuthClient_EmptyTenant(t *testing.T) {
+	_, err := firebasetools.GetTenantAuthClient(context.Background(), "")
+	assert.NotNil(t, err)
+
+	_, err = firebasetools.AuthenticateTenantCustomFirebaseToken("", "a-custom-token")
+	assert.NotNil(t, err)
+}
+
+func TestUpdateTenant_Validation(t *testing.T) {
+	_, err := firebasetools.UpdateTenant(context.Background(), "", firebasetools.TenantUpdateInput{DisplayName: "Clinic"})
+	assert.NotNil(t, err)
+
+	_, err = firebasetools.UpdateTenant(context.Background(), "tenant-1", firebasetools.TenantUpdateInput{})
+	assert.EqualError(t, err, "no tenant fields to update")
+}
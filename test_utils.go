@@ -67,7 +67,8 @@ func getAuthTokenAndBearerToken(ctx context.Context, t *testing.T) (*auth.Token,
 	return authToken, bearerToken
 }
 
-// GetOrCreateAnonymousUser creates an anonymous user
+// GetOrCreateAnonymousUser creates an anonymous user, marked with the
+// AnonymousUserClaim. An existing shared anonymous user is returned unchanged.
 // For documentation and test purposes only
 func GetOrCreateAnonymousUser(ctx context.Context) (*auth.UserRecord, error) {
 	authClient, err := GetFirebaseAuthClient(ctx)
@@ -79,6 +80,7 @@ func GetOrCreateAnonymousUser(ctx context.Context) (*auth.UserRecord, error) {
 	existingUser, userErr := authClient.GetUser(ctx, anonymousUserUID)
 
 	if userErr == nil {
+		// the shared account is left as it is, and is only marked when it's created
 		return existingUser, nil
 	}
 
@@ -87,7 +89,22 @@ func GetOrCreateAnonymousUser(ctx context.Context) (*auth.UserRecord, error) {
 	if createErr != nil {
 		return nil, createErr
 	}
-	return newUser, nil
+	return markAnonymousUser(ctx, newUser)
+}
+
+// markAnonymousUser sets the AnonymousUserClaim so that the user's tokens say they are anonymous
+func markAnonymousUser(ctx context.Context, user *auth.UserRecord) (*auth.UserRecord, error) {
+	if marked, _ := user.CustomClaims[AnonymousUserClaim].(bool); marked {
+		return user, nil
+	}
+	claims, err := (&ClaimsManager{}).updateTenantClaims(ctx, user.TenantID, user.UID, func(current map[string]interface{}) {
+		current[AnonymousUserClaim] = true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to mark %s as anonymous: %w", user.UID, err)
+	}
+	user.CustomClaims = claims
+	return user, nil
 }
 
 // GetAnonymousContext returns an anonymous logged in context, useful for test purposes
@@ -103,7 +120,9 @@ func getAnonymousAuthToken(ctx context.Context, t *testing.T) *auth.Token {
 	assert.Nil(t, userErr)
 	assert.NotNil(t, user)
 
-	customToken, tokenErr := CreateFirebaseCustomToken(ctx, user.UID)
+	// the token carries the claim, whether or not the shared account is marked
+	customToken, tokenErr := CreateFirebaseCustomTokenWithClaims(
+		ctx, user.UID, map[string]interface{}{AnonymousUserClaim: true})
 	assert.Nil(t, tokenErr)
 	assert.NotNil(t, customToken)
 
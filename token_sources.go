@@ -0,0 +1,222 @@
+package firebasetools
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"firebase.google.com/go/auth"
+)
+
+const (
+	// DefaultTokenQueryParam is the query parameter read by QueryTokenSource when none is set
+	DefaultTokenQueryParam = "access_token"
+
+	// DefaultWebSocketTokenProtocol is the `Sec-WebSocket-Protocol` entry that precedes
+	// the token when none is set on WebSocketProtocolTokenSource
+	DefaultWebSocketTokenProtocol = "access_token"
+
+	redactedValue = "REDACTED"
+)
+
+// TokenSource extracts a Firebase ID token from part of a request.
+//
+// When the request does not carry a token in that part, implementations return
+// an *AuthError with an empty code so that the next source can be tried.
+type TokenSource interface {
+	ExtractToken(r *http.Request) (string, error)
+}
+
+// HeaderTokenSource reads a token with the indicated prefix from a request header
+// e.g `Authorization: Bearer <token>`
+type HeaderTokenSource struct {
+	Header string
+	Prefix string
+}
+
+// ExtractToken reads the token from the header
+func (s HeaderTokenSource) ExtractToken(r *http.Request) (string, error) {
+	return ExtractToken(r, s.Header, s.Prefix)
+}
+
+// CookieTokenSource reads a token from the named cookie
+type CookieTokenSource struct {
+	Name string
+}
+
+// ExtractToken reads the token from the cookie
+func (s CookieTokenSource) ExtractToken(r *http.Request) (string, error) {
+	if r == nil {
+		return "", NewAuthError(AuthErrorInvalidRequest, "nil request")
+	}
+	cookie, err := r.Cookie(s.Name)
+	if err != nil || cookie.Value == "" {
+		return "", NewAuthError("", fmt.Sprintf("expected a `%s` cookie", s.Name))
+	}
+	return cookie.Value, nil
+}
+
+// QueryTokenSource reads a token from a query parameter. It exists for browser
+// APIs such as EventSource that cannot set headers.
+//
+// Query strings end up in access logs and browser history, so the authentication
+// middleware removes the parameter from the request URL once it has been read.
+type QueryTokenSource struct {
+	Param string
+}
+
+func (s QueryTokenSource) param() string {
+	if s.Param == "" {
+		return DefaultTokenQueryParam
+	}
+	return s.Param
+}
+
+// ExtractToken reads the token from the query parameter
+func (s QueryTokenSource) ExtractToken(r *http.Request) (string, error) {
+	if r == nil || r.URL == nil {
+		return "", NewAuthError(AuthErrorInvalidRequest, "nil request")
+	}
+	token := r.URL.Query().Get(s.param())
+	if token == "" {
+		return "", NewAuthError("", fmt.Sprintf("expected a `%s` query parameter", s.param()))
+	}
+	return token, nil
+}
+
+// WebSocketProtocolTokenSource reads a token from the `Sec-WebSocket-Protocol` header,
+// which browsers let WebSocket clients set e.g
+// `new WebSocket(url, ["access_token", token])`.
+//
+// The token is the entry that follows the marker protocol. The server should
+// only echo the marker protocol back when accepting the connection.
+type WebSocketProtocolTokenSource struct {
+	Protocol string
+}
+
+// ExtractToken reads the token from the WebSocket subprotocols
+func (s WebSocketProtocolTokenSource) ExtractToken(r *http.Request) (string, error) {
+	if r == nil {
+		return "", NewAuthError(AuthErrorInvalidRequest, "nil request")
+	}
+	marker := s.Protocol
+	if marker == "" {
+		marker = DefaultWebSocketTokenProtocol
+	}
+
+	protocols := []string{}
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			protocols = append(protocols, strings.TrimSpace(protocol))
+		}
+	}
+	for i, protocol := range protocols {
+		if protocol != marker {
+			continue
+		}
+		if i+1 >= len(protocols) || protocols[i+1] == "" {
+			return "", NewAuthError(
+				AuthErrorInvalidRequest,
+				fmt.Sprintf("expected a token after the `%s` WebSocket protocol", marker),
+			)
+		}
+		return protocols[i+1], nil
+	}
+	return "", NewAuthError("", fmt.Sprintf("expected a `%s` WebSocket protocol", marker))
+}
+
+// ExtractTokenFromSources tries the supplied sources in priority order and returns
+// the first token found. A malformed token stops the search.
+func ExtractTokenFromSources(r *http.Request, sources ...TokenSource) (string, error) {
+	missing := []string{}
+	for _, source := range sources {
+		token, err := source.ExtractToken(r)
+		if err == nil {
+			return token, nil
+		}
+		var authErr *AuthError
+		if !errors.As(err, &authErr) || authErr.Code != "" {
+			return "", err
+		}
+		missing = append(missing, authErr.Description)
+	}
+	return "", NewAuthError("", fmt.Sprintf("no auth token found: %s", strings.Join(missing, "; ")))
+}
+
+// FirebaseTokenCheck returns an auth check that validates a Firebase ID token
+// read from the supplied sources, in priority order
+func FirebaseTokenCheck(sources ...TokenSource) authCheckFn {
+	return func(r *http.Request, firebaseApp IFirebaseApp) (bool, map[string]string, *auth.Token) {
+		token, err := ExtractTokenFromSources(r, sources...)
+		if err != nil {
+			return false, authErrorMap(err, ""), nil
+		}
+
+		validToken, err := ValidateBearerToken(r.Context(), token)
+		if err != nil {
+			return false, authErrorMap(err, AuthErrorInvalidToken), nil
+		}
+		return true, nil, validToken
+	}
+}
+
+// WithTokenSources makes the authentication middleware read Firebase ID tokens
+// from the supplied sources, in priority order, instead of only the
+// `Authorization` header. Combined with WithAuthChecks, the token check runs
+// after those checks regardless of the order of the options.
+func WithTokenSources(sources ...TokenSource) AuthenticationOption {
+	return func(c *authenticationConfig) {
+		c.tokenSources = sources
+		c.tokenQueryParams = []string{}
+		for _, source := range sources {
+			if querySource, ok := source.(QueryTokenSource); ok {
+				c.tokenQueryParams = append(c.tokenQueryParams, querySource.param())
+			}
+		}
+	}
+}
+
+// RedactURL returns the supplied URL with the values of the indicated query
+// parameters replaced, for use when logging requests
+func RedactURL(u *url.URL, params ...string) string {
+	if u == nil {
+		return ""
+	}
+	redacted := *u
+	query := redacted.Query()
+	for _, param := range params {
+		if _, ok := query[param]; ok {
+			query.Set(param, redactedValue)
+		}
+	}
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+// stripTokenQueryParams returns a shallow copy of the request without the
+// indicated query parameters so that handlers and loggers do not see the token
+func stripTokenQueryParams(r *http.Request, params []string) *http.Request {
+	if len(params) == 0 || r.URL == nil {
+		return r
+	}
+	query := r.URL.Query()
+	found := false
+	for _, param := range params {
+		if _, ok := query[param]; ok {
+			query.Del(param)
+			found = true
+		}
+	}
+	if !found {
+		return r
+	}
+
+	stripped := r.WithContext(r.Context())
+	strippedURL := *r.URL
+	strippedURL.RawQuery = query.Encode()
+	stripped.URL = &strippedURL
+	stripped.RequestURI = strippedURL.RequestURI()
+	return stripped
+}
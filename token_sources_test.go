@@ -0,0 +1,173 @@
+package firebasetools_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractTokenFromSources(t *testing.T) {
+	sources := []firebasetools.TokenSource{
+		firebasetools.HeaderTokenSource{Header: "Authorization", Prefix: "Bearer"},
+		firebasetools.CookieTokenSource{Name: "__session"},
+		firebasetools.WebSocketProtocolTokenSource{},
+		firebasetools.QueryTokenSource{},
+	}
+
+	withHeader := httptest.NewRequest(http.MethodGet, "/?access_token=from-query", nil)
+	withHeader.Header.Set("Authorization", "Bearer from-header")
+
+	withCookie := httptest.NewRequest(http.MethodGet, "/?access_token=from-query", nil)
+	withCookie.AddCookie(&http.Cookie{Name: "__session", Value: "from-cookie"})
+
+	withProtocol := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	withProtocol.Header.Set("Sec-WebSocket-Protocol", "graphql-ws, access_token, from-protocol")
+
+	withDanglingProtocol := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	withDanglingProtocol.Header.Set("Sec-WebSocket-Protocol", "graphql-ws, access_token")
+
+	withMalformedHeader := httptest.NewRequest(http.MethodGet, "/?access_token=from-query", nil)
+	withMalformedHeader.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+
+	tests := []struct {
+		name     string
+		r        *http.Request
+		want     string
+		wantErr  bool
+		wantCode string
+	}{
+		{
+			name: "header has the highest priority",
+			r:    withHeader,
+			want: "from-header",
+		},
+		{
+			name: "cookie before query",
+			r:    withCookie,
+			want: "from-cookie",
+		},
+		{
+			name: "websocket protocol",
+			r:    withProtocol,
+			want: "from-protocol",
+		},
+		{
+			name: "query parameter",
+			r:    httptest.NewRequest(http.MethodGet, "/events?access_token=from-query", nil),
+			want: "from-query",
+		},
+		{
+			name:     "websocket marker without a token",
+			r:        withDanglingProtocol,
+			wantErr:  true,
+			wantCode: firebasetools.AuthErrorInvalidRequest,
+		},
+		{
+			name:     "malformed header stops the search",
+			r:        withMalformedHeader,
+			wantErr:  true,
+			wantCode: firebasetools.AuthErrorInvalidRequest,
+		},
+		{
+			name:     "no token anywhere",
+			r:        httptest.NewRequest(http.MethodGet, "/", nil),
+			wantErr:  true,
+			wantCode: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := firebasetools.ExtractTokenFromSources(tt.r, sources...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ExtractTokenFromSources() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				authErr, ok := err.(*firebasetools.AuthError)
+				assert.True(t, ok)
+				assert.Equal(t, tt.wantCode, authErr.Code)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/events?access_token=secret&channel=vitals", nil)
+	assert.Equal(
+		t,
+		"/events?access_token=REDACTED&channel=vitals",
+		firebasetools.RedactURL(req.URL, firebasetools.DefaultTokenQueryParam),
+	)
+	assert.Equal(t, "", firebasetools.RedactURL(nil))
+}
+
+func TestAuthenticationMiddleware_StripsQueryTokens(t *testing.T) {
+	var gotURI, gotQuery string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotURI = r.RequestURI
+		gotQuery = r.URL.RawQuery
+	})
+	check := func(r *http.Request, fa firebasetools.IFirebaseApp) (bool, map[string]string, *auth.Token) {
+		return true, nil, &auth.Token{UID: "a-uid"}
+	}
+	h := firebasetools.AuthenticationMiddleware(
+		&firebasetools.MockFirebaseApp{},
+		firebasetools.WithTokenSources(firebasetools.QueryTokenSource{}),
+		// replace the Firebase check so that the test runs offline
+		firebasetools.WithAuthChecks(check),
+	)(next)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/events?access_token=secret&channel=vitals", nil))
+
+	assert.Equal(t, "/events?channel=vitals", gotURI)
+	assert.Equal(t, "channel=vitals", gotQuery)
+}
+
+func TestAuthenticationMiddleware_WithTokenSources(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("the next handler should not be called for unauthenticated requests")
+	})
+	h := firebasetools.AuthenticationMiddleware(
+		&firebasetools.MockFirebaseApp{},
+		firebasetools.WithTokenSources(
+			firebasetools.HeaderTokenSource{Header: "Authorization", Prefix: "Bearer"},
+			firebasetools.QueryTokenSource{},
+		),
+	)(next)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/events", nil))
+
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.Equal(t, "Bearer", rw.Header().Get("WWW-Authenticate"))
+}
+
+func TestAuthenticationMiddleware_TokenSourcesWithAuthChecks(t *testing.T) {
+	var gotUID string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := firebasetools.GetUserTokenFromContext(r.Context())
+		assert.Nil(t, err)
+		gotUID = token.UID
+	})
+	serviceCheck := func(r *http.Request, fa firebasetools.IFirebaseApp) (bool, map[string]string, *auth.Token) {
+		return true, nil, &auth.Token{UID: "service"}
+	}
+	sources := firebasetools.WithTokenSources(firebasetools.QueryTokenSource{})
+
+	// the custom check is kept whichever option comes first
+	for _, opts := range [][]firebasetools.AuthenticationOption{
+		{firebasetools.WithAuthChecks(serviceCheck), sources},
+		{sources, firebasetools.WithAuthChecks(serviceCheck)},
+	} {
+		gotUID = ""
+		h := firebasetools.AuthenticationMiddleware(&firebasetools.MockFirebaseApp{}, opts...)(next)
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/events", nil))
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, "service", gotUID)
+	}
+}
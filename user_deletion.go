@@ -0,0 +1,288 @@
+package firebasetools
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"firebase.google.com/go/auth"
+)
+
+// AnonymizedUserUID replaces the owner UID of documents that are kept after their owner is forgotten
+const AnonymizedUserUID = "deleted-user"
+
+// UserDataCollection registers a collection that holds documents owned by users
+type UserDataCollection struct {
+	// Collection is the (suffixed) collection name
+	Collection string `json:"collection"`
+
+	// OwnerField is the field that holds the owner's UID. It defaults to `createdByUID`.
+	OwnerField string `json:"ownerField"`
+
+	// UIDFields are other fields that can hold the user's UID e.g `updatedByUID`.
+	// They are replaced with AnonymizedUserUID in the documents that the user
+	// doesn't own. They default to `updatedByUID` when OwnerField is defaulted.
+	UIDFields []string `json:"uidFields,omitempty"`
+
+	// Anonymize keeps the documents but replaces their owner with AnonymizedUserUID
+	// and overwrites AnonymizedFields. Documents are deleted otherwise.
+	Anonymize        bool                   `json:"anonymize"`
+	AnonymizedFields map[string]interface{} `json:"-"`
+}
+
+// UserDataRegistry lists the collections that hold user data
+type UserDataRegistry []UserDataCollection
+
+// DefaultUserDataRegistry lists the collections where this package keeps user
+// data, under their default names. Audit logs are anonymized, the rest deleted:
+// the entries keep their type, operation and time but lose their snapshot and
+// record ID, which for user records is derived from the UID.
+// Login attempts are only registered when they were made for a known user e.g
+// MFA codes; attempts keyed by username expire on their own.
+func DefaultUserDataRegistry() UserDataRegistry {
+	return UserDataRegistry{
+		{Collection: GetCollectionName(&User{}), OwnerField: "uid"},
+		{Collection: SuffixCollection(MFAEnrollmentsCollectionName), OwnerField: "uid"},
+		{Collection: SuffixCollection(LoginEventsCollectionName), OwnerField: "uid"},
+		{Collection: SuffixCollection(LoginAttemptsCollectionName), OwnerField: "uid"},
+		{Collection: SuffixCollection(RevokedSessionsCollectionName), OwnerField: "uid"},
+		{Collection: SuffixCollection(ClaimsUpdatesCollectionName), OwnerField: "uid"},
+		{
+			Collection: SuffixCollection(AuditLogCollectionName),
+			OwnerField: "uid",
+			Anonymize:  true,
+			AnonymizedFields: map[string]interface{}{
+				"json":     nil,
+				"recordID": nil,
+			},
+		},
+	}
+}
+
+// validated returns the registry with default owner and UID fields filled in
+func (r UserDataRegistry) validated() (UserDataRegistry, error) {
+	collections := UserDataRegistry{}
+	for _, c := range r {
+		if c.Collection == "" {
+			return nil, fmt.Errorf("registered user data collections must be named")
+		}
+		if c.OwnerField == "" {
+			c.OwnerField = CreatedByUIDField
+			if c.UIDFields == nil {
+				c.UIDFields = []string{UpdatedByUIDField}
+			}
+		}
+		fields := []string{}
+		for _, field := range c.UIDFields {
+			if field != "" && field != c.OwnerField && !containsString(fields, field) {
+				fields = append(fields, field)
+			}
+		}
+		c.UIDFields = fields
+		collections = append(collections, c)
+	}
+	return collections, nil
+}
+
+// UserDataCollectionReport counts what happened to a collection's documents
+type UserDataCollectionReport struct {
+	Collection string `json:"collection"`
+	OwnerField string `json:"ownerField"`
+	Deleted    int    `json:"deleted"`
+	Anonymized int    `json:"anonymized"`
+
+	// Rewritten counts, per UID field, the documents of other owners whose field
+	// was replaced with AnonymizedUserUID
+	Rewritten map[string]int `json:"rewritten,omitempty"`
+}
+
+// UserDeletionReport records the completion of a user deletion
+type UserDeletionReport struct {
+	UID             string                      `json:"uid"`
+	TenantID        string                      `json:"tenantID,omitempty"`
+	Collections     []*UserDataCollectionReport `json:"collections"`
+	AuthUserDeleted bool                        `json:"authUserDeleted"`
+	CompletedAt     time.Time                   `json:"completedAt"`
+
+	// Signature is an HMAC of the rest of the report, set by UserDeletionReportSigner
+	Signature string `json:"signature,omitempty"`
+}
+
+// UserDeletionReportSigner signs deletion reports so that they can serve as proof of deletion
+type UserDeletionReportSigner struct {
+	key []byte
+}
+
+// NewUserDeletionReportSigner creates a report signer with a secret key of at least 32 bytes
+func NewUserDeletionReportSigner(key []byte) (*UserDeletionReportSigner, error) {
+	if len(key) < 32 {
+		return nil, fmt.Errorf("the deletion report key must be at least 32 bytes long")
+	}
+	return &UserDeletionReportSigner{key: key}, nil
+}
+
+func (s *UserDeletionReportSigner) signature(report *UserDeletionReport) (string, error) {
+	unsigned := *report
+	unsigned.Signature = ""
+	payload, err := json.Marshal(unsigned)
+	if err != nil {
+		return "", fmt.Errorf("unable to serialize the deletion report: %w", err)
+	}
+	mac := hmac.New(sha256.New, s.key)
+	_, _ = mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Sign sets the report's signature
+func (s *UserDeletionReportSigner) Sign(report *UserDeletionReport) error {
+	signature, err := s.signature(report)
+	if err != nil {
+		return err
+	}
+	report.Signature = signature
+	return nil
+}
+
+// Verify checks that the report was signed with this key and has not been changed since
+func (s *UserDeletionReportSigner) Verify(report *UserDeletionReport) error {
+	signature, err := s.signature(report)
+	if err != nil {
+		return err
+	}
+	if report.Signature == "" || !hmac.Equal([]byte(signature), []byte(report.Signature)) {
+		return fmt.Errorf("invalid deletion report signature")
+	}
+	return nil
+}
+
+// UserDataDeleter forgets users: their documents are deleted or anonymized,
+// then their Auth account is deleted
+type UserDataDeleter struct {
+	Documents OwnedDocumentStore
+
+	// Registry lists the application's collections. The collections of
+	// DefaultUserDataRegistry are always cleaned up too, unless the registry
+	// registers them itself.
+	Registry UserDataRegistry
+
+	// Signer signs the completion reports, if set
+	Signer *UserDeletionReportSigner
+
+	// DeleteUser defaults to a (tenant aware) Firebase Auth deletion
+	DeleteUser func(ctx context.Context, tenantID string, uid string) error
+}
+
+// DeleteUserData forgets the user with a deleter that cleans up the package's own
+// collections in Firestore, and signs the report with the signer
+func DeleteUserData(ctx context.Context, uid string, signer *UserDeletionReportSigner) (*UserDeletionReport, error) {
+	if signer == nil {
+		return nil, fmt.Errorf("a signer is required to prove the deletion of user data")
+	}
+	client, err := GetFirestoreClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deleter := &UserDataDeleter{Documents: NewFirestoreOwnedDocumentStore(client), Signer: signer}
+	return deleter.DeleteUserData(ctx, uid)
+}
+
+// withDefaults returns the default collections, unless they are registered, followed
+// by the registered ones
+func (r UserDataRegistry) withDefaults() UserDataRegistry {
+	registered := map[string]bool{}
+	for _, c := range r {
+		registered[c.Collection] = true
+	}
+	registry := UserDataRegistry{}
+	for _, c := range DefaultUserDataRegistry() {
+		if !registered[c.Collection] {
+			registry = append(registry, c)
+		}
+	}
+	return append(registry, r...)
+}
+
+// DeleteUserData deletes or anonymizes the user's documents in every registered
+// collection and then deletes their Auth account. Documents go first so that a
+// failed run can be retried while the account still exists. Users whose Auth
+// account is already gone still have their documents cleaned up.
+func (d *UserDataDeleter) DeleteUserData(ctx context.Context, uid string) (*UserDeletionReport, error) {
+	if uid == "" {
+		return nil, fmt.Errorf("a UID is required to delete user data")
+	}
+	registry, err := d.Registry.withDefaults().validated()
+	if err != nil {
+		return nil, err
+	}
+	if d.Documents == nil {
+		return nil, fmt.Errorf("a document store is required to delete user data")
+	}
+	deleteUser := d.DeleteUser
+	if deleteUser == nil {
+		deleteUser = deleteFirebaseUser
+	}
+	tenantID, _ := GetTenantIDFromContext(ctx)
+
+	report := &UserDeletionReport{UID: uid, TenantID: tenantID, Collections: []*UserDataCollectionReport{}}
+	for _, c := range registry {
+		docs, err := d.Documents.ListOwnedDocuments(ctx, c.Collection, c.OwnerField, uid)
+		if err != nil {
+			return nil, err
+		}
+		collectionReport := &UserDataCollectionReport{Collection: c.Collection, OwnerField: c.OwnerField}
+		report.Collections = append(report.Collections, collectionReport)
+		switch {
+		case len(docs) == 0:
+		case c.Anonymize:
+			fields := map[string]interface{}{c.OwnerField: AnonymizedUserUID}
+			for field, value := range c.AnonymizedFields {
+				fields[field] = value
+			}
+			if err := d.Documents.UpdateOwnedDocuments(ctx, docs, fields); err != nil {
+				return nil, fmt.Errorf("unable to anonymize the %s documents of %s: %w", c.Collection, uid, err)
+			}
+			collectionReport.Anonymized = len(docs)
+		default:
+			if err := d.Documents.DeleteOwnedDocuments(ctx, docs); err != nil {
+				return nil, fmt.Errorf("unable to delete the %s documents of %s: %w", c.Collection, uid, err)
+			}
+			collectionReport.Deleted = len(docs)
+		}
+
+		// the owned documents are gone or anonymized, so what is left belongs to others
+		for _, field := range c.UIDFields {
+			docs, err := d.Documents.ListOwnedDocuments(ctx, c.Collection, field, uid)
+			if err != nil {
+				return nil, err
+			}
+			if len(docs) == 0 {
+				continue
+			}
+			if err := d.Documents.UpdateOwnedDocuments(ctx, docs, map[string]interface{}{field: AnonymizedUserUID}); err != nil {
+				return nil, fmt.Errorf("unable to anonymize the %s of %s documents: %w", field, c.Collection, err)
+			}
+			if collectionReport.Rewritten == nil {
+				collectionReport.Rewritten = map[string]int{}
+			}
+			collectionReport.Rewritten[field] = len(docs)
+		}
+	}
+
+	err = deleteUser(ctx, tenantID, uid)
+	if err != nil && !auth.IsUserNotFound(err) {
+		return nil, fmt.Errorf("unable to delete the account of %s: %w", uid, err)
+	}
+	report.AuthUserDeleted = err == nil
+	report.CompletedAt = time.Now().UTC()
+
+	if d.Signer != nil {
+		if err := d.Signer.Sign(report); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
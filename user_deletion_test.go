@@ -0,0 +1,111 @@
+package firebasetools_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserDataDeleter_DeleteUserData(t *testing.T) {
+	ctx := context.Background()
+	docs := firebasetools.NewInMemoryOwnedDocumentStore()
+	docs.Put("notes", "n1", map[string]interface{}{"createdByUID": "gone", "text": "private"})
+	docs.Put("notes", "n2", map[string]interface{}{"createdByUID": "kept", "updatedByUID": "gone"})
+	docs.Put("visits", "v1", map[string]interface{}{"createdByUID": "gone", "patientName": "Jane", "facility": "f1"})
+	docs.Put("messages", "m1", map[string]interface{}{"senderUID": "gone", "readByUID": "kept"})
+	docs.Put("messages", "m2", map[string]interface{}{"senderUID": "kept", "readByUID": "gone"})
+	profiles := firebasetools.GetCollectionName(&firebasetools.User{})
+	audit := firebasetools.SuffixCollection(firebasetools.AuditLogCollectionName)
+	docs.Put(profiles, "gone", map[string]interface{}{"uid": "gone"})
+	docs.Put(audit, "a1", map[string]interface{}{
+		"uid": "gone", "operation": "merge", "recordID": "record", "json": `{"email": "gone@example.com"}`,
+	})
+
+	signer, err := firebasetools.NewUserDeletionReportSigner([]byte(strings.Repeat("k", 32)))
+	assert.Nil(t, err)
+	deleted := []string{}
+	deleter := &firebasetools.UserDataDeleter{
+		Documents: docs,
+		Registry: firebasetools.UserDataRegistry{
+			{Collection: "notes"},
+			{Collection: "visits", Anonymize: true, AnonymizedFields: map[string]interface{}{"patientName": ""}},
+			{Collection: "messages", OwnerField: "senderUID", UIDFields: []string{"readByUID"}},
+		},
+		Signer: signer,
+		DeleteUser: func(ctx context.Context, tenantID string, uid string) error {
+			deleted = append(deleted, uid)
+			return nil
+		},
+	}
+
+	report, err := deleter.DeleteUserData(ctx, "gone")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"gone"}, deleted)
+	assert.True(t, report.AuthUserDeleted)
+	assert.False(t, report.CompletedAt.IsZero())
+	defaults := len(firebasetools.DefaultUserDataRegistry())
+	assert.Len(t, report.Collections, defaults+3, "the package's own collections are cleaned up too")
+	assert.Equal(t, &firebasetools.UserDataCollectionReport{Collection: profiles, OwnerField: "uid", Deleted: 1},
+		report.Collections[0])
+	assert.Equal(t, []*firebasetools.UserDataCollectionReport{
+		{Collection: "notes", OwnerField: "createdByUID", Deleted: 1, Rewritten: map[string]int{"updatedByUID": 1}},
+		{Collection: "visits", OwnerField: "createdByUID", Anonymized: 1},
+		{Collection: "messages", OwnerField: "senderUID", Deleted: 1, Rewritten: map[string]int{"readByUID": 1}},
+	}, report.Collections[defaults:])
+
+	assert.Nil(t, docs.Get("notes", "n1"))
+	assert.Equal(t, map[string]interface{}{
+		"createdByUID": "kept", "updatedByUID": firebasetools.AnonymizedUserUID,
+	}, docs.Get("notes", "n2"))
+	assert.Nil(t, docs.Get("messages", "m1"))
+	assert.Equal(t, firebasetools.AnonymizedUserUID, docs.Get("messages", "m2")["readByUID"])
+	assert.Nil(t, docs.Get(profiles, "gone"))
+	assert.Equal(t, map[string]interface{}{
+		"uid": firebasetools.AnonymizedUserUID, "operation": "merge", "recordID": nil, "json": nil,
+	}, docs.Get(audit, "a1"), "audit logs are kept without their snapshots")
+	assert.Equal(t, map[string]interface{}{
+		"createdByUID": firebasetools.AnonymizedUserUID, "patientName": "", "facility": "f1",
+	}, docs.Get("visits", "v1"))
+
+	assert.Nil(t, signer.Verify(report))
+	report.Collections[0].Deleted = 0
+	assert.NotNil(t, signer.Verify(report), "tampered reports fail verification")
+}
+
+func TestUserDataDeleter_Errors(t *testing.T) {
+	ctx := context.Background()
+	docs := firebasetools.NewInMemoryOwnedDocumentStore()
+	docs.Put("notes", "n1", map[string]interface{}{"createdByUID": "uid"})
+	failingDelete := func(ctx context.Context, tenantID string, uid string) error {
+		return fmt.Errorf("boom")
+	}
+
+	tests := []struct {
+		name    string
+		deleter *firebasetools.UserDataDeleter
+		uid     string
+	}{
+		{"missing uid", &firebasetools.UserDataDeleter{Documents: docs}, ""},
+		{"unnamed collection", &firebasetools.UserDataDeleter{Documents: docs, Registry: firebasetools.UserDataRegistry{{}}}, "uid"},
+		{"no document store", &firebasetools.UserDataDeleter{Registry: firebasetools.UserDataRegistry{{Collection: "notes"}}}, "uid"},
+		{"auth deletion fails", &firebasetools.UserDataDeleter{Documents: docs, DeleteUser: failingDelete}, "uid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := tt.deleter.DeleteUserData(ctx, tt.uid)
+			assert.NotNil(t, err)
+			assert.Nil(t, report)
+		})
+	}
+	assert.NotNil(t, docs.Get("notes", "n1"))
+
+	_, err := firebasetools.NewUserDeletionReportSigner([]byte("short"))
+	assert.NotNil(t, err)
+
+	_, err = firebasetools.DeleteUserData(ctx, "uid", nil)
+	assert.NotNil(t, err, "deletion reports must be signed")
+}
@@ -0,0 +1,305 @@
+package firebasetools
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"firebase.google.com/go/auth"
+	"github.com/vmihailenco/msgpack"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// authListPageSize is the most users that Firebase Auth lists per page
+	authListPageSize = 1000
+
+	// maxUserLookupIdentifiers is the most identifiers that Firebase Auth looks up per call
+	maxUserLookupIdentifiers = 100
+)
+
+// UserFilter narrows down user listings. Empty fields match every user.
+type UserFilter struct {
+	// EmailDomain matches users whose email address is in the domain e.g `example.com`
+	EmailDomain string
+
+	Disabled *bool
+
+	// ProviderID matches users who can sign in with the provider e.g `google.com`,
+	// `password` or `phone`
+	ProviderID string
+
+	// Claim matches users who have the custom claim, whatever its value
+	Claim string
+}
+
+func (f *UserFilter) matches(user *auth.UserRecord) bool {
+	if f == nil {
+		return true
+	}
+	if f.EmailDomain != "" {
+		domain := strings.ToLower(strings.TrimPrefix(f.EmailDomain, "@"))
+		if user.UserInfo == nil || !strings.HasSuffix(strings.ToLower(user.Email), "@"+domain) {
+			return false
+		}
+	}
+	if f.Disabled != nil && user.Disabled != *f.Disabled {
+		return false
+	}
+	if f.ProviderID != "" {
+		linked := false
+		for _, info := range user.ProviderUserInfo {
+			if info.ProviderID == f.ProviderID {
+				linked = true
+				break
+			}
+		}
+		if !linked {
+			return false
+		}
+	}
+	if f.Claim != "" {
+		if _, ok := user.CustomClaims[f.Claim]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// userPageCursor is a position in a user listing: the Auth page token of the page
+// that holds the next user, and that user's offset in the page
+type userPageCursor struct {
+	PageToken string `msgpack:"t"`
+	Offset    int    `msgpack:"o"`
+}
+
+func encodeUserPageCursor(cursor userPageCursor) (string, error) {
+	b, err := msgpack.Marshal(cursor)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode cursor: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func decodeUserPageCursor(encoded string) (userPageCursor, error) {
+	cursor := userPageCursor{}
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, fmt.Errorf("invalid cursor: %w", err)
+	}
+	if err := msgpack.Unmarshal(b, &cursor); err != nil {
+		return cursor, fmt.Errorf("invalid cursor: %w", err)
+	}
+	if cursor.Offset < 0 {
+		return cursor, fmt.Errorf("invalid cursor: negative offset")
+	}
+	return cursor, nil
+}
+
+// newUserInfo copies a user record's profile
+func newUserInfo(user *auth.UserRecord) *UserInfo {
+	info := &UserInfo{}
+	if user.UserInfo != nil {
+		info.UID = user.UID
+		info.Email = user.Email
+		info.PhoneNumber = user.PhoneNumber
+		info.DisplayName = user.DisplayName
+		info.PhotoURL = user.PhotoURL
+		info.ProviderID = user.ProviderID
+	}
+	return info
+}
+
+// UserLookup lists the users to look up. Any combination of identifiers may be used.
+type UserLookup struct {
+	UIDs         []string
+	Emails       []string
+	PhoneNumbers []string
+}
+
+// UserLookupResult holds the users that were found, in no particular order, and
+// the identifiers that matched no user
+type UserLookupResult struct {
+	Users    []*UserInfo
+	NotFound []string
+}
+
+// UserDirectory lists and looks up Firebase Auth users
+type UserDirectory struct {
+	// FetchPage lists a page of users in UID order and returns the next page's
+	// token, which is empty on the last page. It defaults to listing the users
+	// of the project, or of the context's tenant.
+	FetchPage func(ctx context.Context, pageToken string, pageSize int) ([]*auth.ExportedUserRecord, string, error)
+
+	// GetUsers defaults to a Firebase Auth lookup in the project, or the context's tenant
+	GetUsers func(ctx context.Context, identifiers []auth.UserIdentifier) (*auth.GetUsersResult, error)
+}
+
+func fetchFirebaseUserPage(ctx context.Context, pageToken string, pageSize int) ([]*auth.ExportedUserRecord, string, error) {
+	authClient, err := getUserTransferClient(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	records := []*auth.ExportedUserRecord{}
+	pager := iterator.NewPager(authClient.Users(ctx, pageToken), pageSize, pageToken)
+	next, err := pager.NextPage(&records)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to list users: %w", err)
+	}
+	return records, next, nil
+}
+
+func getFirebaseUsers(ctx context.Context, identifiers []auth.UserIdentifier) (*auth.GetUsersResult, error) {
+	if tenantID, err := GetTenantIDFromContext(ctx); err == nil && tenantID != "" {
+		authClient, err := GetTenantAuthClient(ctx, tenantID)
+		if err != nil {
+			return nil, err
+		}
+		return authClient.GetUsers(ctx, identifiers)
+	}
+	authClient, err := GetFirebaseAuthClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get or create Firebase client: %w", err)
+	}
+	return authClient.GetUsers(ctx, identifiers)
+}
+
+// ListUsers returns a page of the project's, or the context's tenant's, users
+// that match the filter, in UID order
+func ListUsers(ctx context.Context, filter *UserFilter, pagination *PaginationInput) ([]*UserInfo, *PageInfo, error) {
+	return (&UserDirectory{}).ListUsers(ctx, filter, pagination)
+}
+
+// LookupUsers fetches several users at once by UID, email and/or phone number
+func LookupUsers(ctx context.Context, lookup UserLookup) (*UserLookupResult, error) {
+	return (&UserDirectory{}).LookupUsers(ctx, lookup)
+}
+
+// ListUsers returns a page of users that match the filter, in UID order.
+// Firebase Auth can only list users forwards, so `last` and `before` are not
+// supported. Filtering happens here, so selective filters may read many pages
+// of users to fill one.
+func (d *UserDirectory) ListUsers(ctx context.Context, filter *UserFilter, pagination *PaginationInput) ([]*UserInfo, *PageInfo, error) {
+	if err := ValidatePaginationParameters(pagination); err != nil {
+		return nil, nil, err
+	}
+	if pagination != nil && (pagination.Last > 0 || pagination.Before != "") {
+		return nil, nil, fmt.Errorf("users can only be listed forwards, use `first` and `after`")
+	}
+	fetchPage := d.FetchPage
+	if fetchPage == nil {
+		fetchPage = fetchFirebaseUserPage
+	}
+	size := DefaultPageSize
+	if pagination != nil && pagination.First > 0 {
+		size = pagination.First
+	}
+	position := userPageCursor{}
+	if pagination != nil && pagination.After != "" {
+		cursor, err := decodeUserPageCursor(pagination.After)
+		if err != nil {
+			return nil, nil, err
+		}
+		position = cursor
+	}
+
+	users := []*UserInfo{}
+	start, end := position, position
+	hasNextPage := false
+	for !hasNextPage {
+		records, nextToken, err := fetchPage(ctx, position.PageToken, authListPageSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := position.Offset; i < len(records); i++ {
+			if records[i].UserRecord == nil || !filter.matches(records[i].UserRecord) {
+				continue
+			}
+			if len(users) == size {
+				hasNextPage = true
+				break
+			}
+			if len(users) == 0 {
+				start = userPageCursor{PageToken: position.PageToken, Offset: i}
+			}
+			users = append(users, newUserInfo(records[i].UserRecord))
+			end = userPageCursor{PageToken: position.PageToken, Offset: i + 1}
+		}
+		if nextToken == "" {
+			break
+		}
+		position = userPageCursor{PageToken: nextToken}
+	}
+
+	pageInfo := &PageInfo{
+		HasNextPage:     hasNextPage,
+		HasPreviousPage: pagination != nil && pagination.After != "",
+		StartCursor:     new(string),
+		EndCursor:       new(string),
+	}
+	if len(users) > 0 {
+		startCursor, err := encodeUserPageCursor(start)
+		if err != nil {
+			return nil, nil, err
+		}
+		endCursor, err := encodeUserPageCursor(end)
+		if err != nil {
+			return nil, nil, err
+		}
+		pageInfo.StartCursor = &startCursor
+		pageInfo.EndCursor = &endCursor
+	}
+	return users, pageInfo, nil
+}
+
+// LookupUsers fetches several users at once by UID, email and/or phone number
+func (d *UserDirectory) LookupUsers(ctx context.Context, lookup UserLookup) (*UserLookupResult, error) {
+	getUsers := d.GetUsers
+	if getUsers == nil {
+		getUsers = getFirebaseUsers
+	}
+	identifiers := []auth.UserIdentifier{}
+	for _, uid := range lookup.UIDs {
+		identifiers = append(identifiers, auth.UIDIdentifier{UID: uid})
+	}
+	for _, email := range lookup.Emails {
+		identifiers = append(identifiers, auth.EmailIdentifier{Email: email})
+	}
+	for _, phoneNumber := range lookup.PhoneNumbers {
+		identifiers = append(identifiers, auth.PhoneIdentifier{PhoneNumber: phoneNumber})
+	}
+
+	result := &UserLookupResult{Users: []*UserInfo{}, NotFound: []string{}}
+	seen := map[string]bool{}
+	for len(identifiers) > 0 {
+		batch := identifiers
+		if len(batch) > maxUserLookupIdentifiers {
+			batch = batch[:maxUserLookupIdentifiers]
+		}
+		identifiers = identifiers[len(batch):]
+
+		found, err := getUsers(ctx, batch)
+		if err != nil {
+			return nil, fmt.Errorf("unable to look up users: %w", err)
+		}
+		for _, user := range found.Users {
+			if user.UserInfo == nil || seen[user.UID] {
+				continue // a user can match several identifiers
+			}
+			seen[user.UID] = true
+			result.Users = append(result.Users, newUserInfo(user))
+		}
+		for _, identifier := range found.NotFound {
+			switch id := identifier.(type) {
+			case auth.UIDIdentifier:
+				result.NotFound = append(result.NotFound, id.UID)
+			case auth.EmailIdentifier:
+				result.NotFound = append(result.NotFound, id.Email)
+			case auth.PhoneIdentifier:
+				result.NotFound = append(result.NotFound, id.PhoneNumber)
+			}
+		}
+	}
+	return result, nil
+}
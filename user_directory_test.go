@@ -0,0 +1,160 @@
+package firebasetools_test
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+// pagedUsers serves users in pages of three, with page tokens that are offsets
+func pagedUsers(users ...*auth.UserRecord) func(context.Context, string, int) ([]*auth.ExportedUserRecord, string, error) {
+	return func(ctx context.Context, pageToken string, pageSize int) ([]*auth.ExportedUserRecord, string, error) {
+		start := 0
+		if pageToken != "" {
+			start, _ = strconv.Atoi(pageToken)
+		}
+		end := start + 3
+		next := strconv.Itoa(end)
+		if end >= len(users) {
+			end, next = len(users), ""
+		}
+		records := []*auth.ExportedUserRecord{}
+		for _, user := range users[start:end] {
+			records = append(records, &auth.ExportedUserRecord{UserRecord: user})
+		}
+		return records, next, nil
+	}
+}
+
+func directoryUser(uid string, email string, disabled bool, claims map[string]interface{}, providers ...string) *auth.UserRecord {
+	user := &auth.UserRecord{
+		UserInfo:     &auth.UserInfo{UID: uid, Email: email},
+		Disabled:     disabled,
+		CustomClaims: claims,
+	}
+	for _, provider := range providers {
+		user.ProviderUserInfo = append(user.ProviderUserInfo, &auth.UserInfo{ProviderID: provider})
+	}
+	return user
+}
+
+func userInfoUIDs(users []*firebasetools.UserInfo) []string {
+	uids := []string{}
+	for _, user := range users {
+		uids = append(uids, user.UID)
+	}
+	return uids
+}
+
+func TestUserDirectory_ListUsers(t *testing.T) {
+	directory := &firebasetools.UserDirectory{FetchPage: pagedUsers(
+		directoryUser("u1", "a@example.com", false, nil, "password"),
+		directoryUser("u2", "b@other.com", false, nil, "google.com"),
+		directoryUser("u3", "c@Example.com", true, nil, "password"),
+		directoryUser("u4", "d@example.com", false, map[string]interface{}{"admin": false}, "google.com"),
+		directoryUser("u5", "e@other.com", false, map[string]interface{}{"admin": true}, "phone"),
+		directoryUser("u6", "f@example.com", false, nil, "password", "google.com"),
+		directoryUser("u7", "g@example.com", false, nil, "password"),
+	)}
+	ctx := context.Background()
+	enabled := false
+
+	tests := []struct {
+		name   string
+		filter *firebasetools.UserFilter
+		want   []string
+	}{
+		{name: "everyone", want: []string{"u1", "u2", "u3", "u4", "u5", "u6", "u7"}},
+		{name: "email domain", filter: &firebasetools.UserFilter{EmailDomain: "example.com"}, want: []string{"u1", "u3", "u4", "u6", "u7"}},
+		{name: "enabled", filter: &firebasetools.UserFilter{Disabled: &enabled}, want: []string{"u1", "u2", "u4", "u5", "u6", "u7"}},
+		{name: "provider", filter: &firebasetools.UserFilter{ProviderID: "google.com"}, want: []string{"u2", "u4", "u6"}},
+		{name: "claim present", filter: &firebasetools.UserFilter{Claim: "admin"}, want: []string{"u4", "u5"}},
+		{
+			name:   "combined",
+			filter: &firebasetools.UserFilter{EmailDomain: "@example.com", ProviderID: "password", Disabled: &enabled},
+			want:   []string{"u1", "u6", "u7"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// page through two users at a time, across Auth pages
+			got := []string{}
+			pagination := &firebasetools.PaginationInput{First: 2}
+			for pages := 0; pages < 10; pages++ {
+				users, pageInfo, err := directory.ListUsers(ctx, tt.filter, pagination)
+				assert.Nil(t, err)
+				assert.LessOrEqual(t, len(users), 2)
+				assert.Equal(t, pages > 0, pageInfo.HasPreviousPage)
+				got = append(got, userInfoUIDs(users)...)
+				if !pageInfo.HasNextPage {
+					break
+				}
+				pagination = &firebasetools.PaginationInput{First: 2, After: *pageInfo.EndCursor}
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	users, pageInfo, err := directory.ListUsers(ctx, &firebasetools.UserFilter{EmailDomain: "nowhere.com"}, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, users)
+	assert.False(t, pageInfo.HasNextPage)
+
+	_, _, err = directory.ListUsers(ctx, nil, &firebasetools.PaginationInput{Last: 2})
+	assert.NotNil(t, err, "users can't be listed backwards")
+	_, _, err = directory.ListUsers(ctx, nil, &firebasetools.PaginationInput{After: "not a cursor"})
+	assert.NotNil(t, err)
+
+	failing := &firebasetools.UserDirectory{
+		FetchPage: func(ctx context.Context, pageToken string, pageSize int) ([]*auth.ExportedUserRecord, string, error) {
+			return nil, "", fmt.Errorf("quota exceeded")
+		},
+	}
+	_, _, err = failing.ListUsers(ctx, nil, nil)
+	assert.NotNil(t, err)
+}
+
+func TestUserDirectory_LookupUsers(t *testing.T) {
+	calls := 0
+	directory := &firebasetools.UserDirectory{
+		GetUsers: func(ctx context.Context, identifiers []auth.UserIdentifier) (*auth.GetUsersResult, error) {
+			calls++
+			assert.LessOrEqual(t, len(identifiers), 100)
+			result := &auth.GetUsersResult{}
+			for _, identifier := range identifiers {
+				switch id := identifier.(type) {
+				case auth.UIDIdentifier:
+					if id.UID == "missing-uid" {
+						result.NotFound = append(result.NotFound, id)
+						continue
+					}
+					result.Users = append(result.Users, directoryUser(id.UID, "", false, nil))
+				case auth.EmailIdentifier:
+					result.Users = append(result.Users, directoryUser("u1", id.Email, false, nil))
+				case auth.PhoneIdentifier:
+					result.NotFound = append(result.NotFound, id)
+				}
+			}
+			return result, nil
+		},
+	}
+	uids := []string{"u1", "missing-uid"}
+	for i := 0; i < 120; i++ {
+		uids = append(uids, fmt.Sprintf("bulk-%d", i))
+	}
+
+	result, err := directory.LookupUsers(context.Background(), firebasetools.UserLookup{
+		UIDs:         uids,
+		Emails:       []string{"a@example.com"},
+		PhoneNumbers: []string{"+254700000000"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, calls, "lookups are batched")
+	assert.Len(t, result.Users, 121, "users matching several identifiers are listed once")
+	assert.ElementsMatch(t, []string{"missing-uid", "+254700000000"}, result.NotFound)
+}
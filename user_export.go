@@ -0,0 +1,150 @@
+package firebasetools
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"firebase.google.com/go/auth"
+)
+
+// names of the files that every user data export holds
+const (
+	UserDataExportManifestFile = "manifest.json"
+	UserDataExportAuthFile     = "auth_user.json"
+)
+
+// UserDataExportFile describes a file in a user data export
+type UserDataExportFile struct {
+	Name       string `json:"name"`
+	Collection string `json:"collection,omitempty"`
+	OwnerField string `json:"ownerField,omitempty"`
+	Documents  int    `json:"documents"`
+}
+
+// UserDataExportManifest lists the contents of a user data export
+type UserDataExportManifest struct {
+	UID        string                `json:"uid"`
+	TenantID   string                `json:"tenantID,omitempty"`
+	ExportedAt time.Time             `json:"exportedAt"`
+	Files      []*UserDataExportFile `json:"files"`
+}
+
+// UserDataExporter collects the data held on users for subject access requests
+type UserDataExporter struct {
+	Documents OwnedDocumentStore
+
+	// Registry lists the application's collections. The collections of
+	// DefaultUserDataRegistry are always exported too, unless the registry
+	// registers them itself.
+	Registry UserDataRegistry
+
+	// GetUser defaults to a (tenant aware) Firebase Auth lookup
+	GetUser func(ctx context.Context, tenantID string, uid string) (*auth.UserRecord, error)
+}
+
+// ExportUserData writes a zip archive of the user's Auth record and of every
+// document in the registered collections that they own or whose UID fields name
+// them, a file per field. Documents are streamed into the archive one at a time
+// and `manifest.json` is written last.
+func (e *UserDataExporter) ExportUserData(ctx context.Context, uid string, w io.Writer) (*UserDataExportManifest, error) {
+	if uid == "" {
+		return nil, fmt.Errorf("a UID is required to export user data")
+	}
+	registry, err := e.Registry.withDefaults().validated()
+	if err != nil {
+		return nil, err
+	}
+	if e.Documents == nil {
+		return nil, fmt.Errorf("a document store is required to export user data")
+	}
+	getUser := e.GetUser
+	if getUser == nil {
+		getUser = getTenantUser
+	}
+	tenantID, _ := GetTenantIDFromContext(ctx)
+
+	user, err := getUser(ctx, tenantID, uid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the account of %s: %w", uid, err)
+	}
+
+	manifest := &UserDataExportManifest{
+		UID:        uid,
+		TenantID:   tenantID,
+		ExportedAt: time.Now().UTC(),
+		Files:      []*UserDataExportFile{},
+	}
+	archive := zip.NewWriter(w)
+
+	if err := writeZipJSON(archive, UserDataExportAuthFile, NewExportedUser(&auth.ExportedUserRecord{UserRecord: user})); err != nil {
+		return nil, err
+	}
+	manifest.Files = append(manifest.Files, &UserDataExportFile{Name: UserDataExportAuthFile, Documents: 1})
+
+	for _, c := range registry {
+		for _, field := range append([]string{c.OwnerField}, c.UIDFields...) {
+			file := &UserDataExportFile{
+				Name:       fmt.Sprintf("collections/%s.%s.json", c.Collection, field),
+				Collection: c.Collection,
+				OwnerField: field,
+			}
+			if err := e.writeCollection(ctx, archive, file, uid); err != nil {
+				return nil, err
+			}
+			manifest.Files = append(manifest.Files, file)
+		}
+	}
+
+	if err := writeZipJSON(archive, UserDataExportManifestFile, manifest); err != nil {
+		return nil, err
+	}
+	if err := archive.Close(); err != nil {
+		return nil, fmt.Errorf("unable to finish the export archive: %w", err)
+	}
+	return manifest, nil
+}
+
+// writeCollection writes the user's documents in the collection as a JSON array
+func (e *UserDataExporter) writeCollection(ctx context.Context, archive *zip.Writer, file *UserDataExportFile, uid string) error {
+	f, err := archive.Create(file.Name)
+	if err != nil {
+		return fmt.Errorf("unable to add %s to the export: %w", file.Name, err)
+	}
+	if _, err := io.WriteString(f, "["); err != nil {
+		return fmt.Errorf("unable to write %s: %w", file.Name, err)
+	}
+	encoder := json.NewEncoder(f)
+	err = e.Documents.EachOwnedDocument(ctx, file.Collection, file.OwnerField, uid, func(doc *OwnedDocument) error {
+		if file.Documents > 0 {
+			if _, err := io.WriteString(f, ","); err != nil {
+				return err
+			}
+		}
+		file.Documents++
+		return encoder.Encode(doc)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to export the %s documents of %s: %w", file.Collection, uid, err)
+	}
+	if _, err := io.WriteString(f, "]"); err != nil {
+		return fmt.Errorf("unable to write %s: %w", file.Name, err)
+	}
+	return nil
+}
+
+func writeZipJSON(archive *zip.Writer, name string, value interface{}) error {
+	f, err := archive.Create(name)
+	if err != nil {
+		return fmt.Errorf("unable to add %s to the export: %w", name, err)
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		return fmt.Errorf("unable to write %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package firebasetools_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+func readZipJSON(t *testing.T, archive *zip.Reader, name string, target interface{}) {
+	for _, f := range archive.File {
+		if f.Name != name {
+			continue
+		}
+		r, err := f.Open()
+		assert.Nil(t, err)
+		defer r.Close()
+		bs, err := ioutil.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Nil(t, json.Unmarshal(bs, target), name)
+		return
+	}
+	t.Fatalf("%s is not in the export", name)
+}
+
+func TestUserDataExporter_ExportUserData(t *testing.T) {
+	ctx := context.Background()
+	docs := firebasetools.NewInMemoryOwnedDocumentStore()
+	docs.Put("notes", "n1", map[string]interface{}{"createdByUID": "nurse-uid", "text": "first"})
+	docs.Put("notes", "n2", map[string]interface{}{"createdByUID": "nurse-uid", "text": "second"})
+	docs.Put("notes", "n3", map[string]interface{}{"createdByUID": "other", "updatedByUID": "nurse-uid"})
+	docs.Put("messages", "m1", map[string]interface{}{"senderUID": "other"})
+	profiles := firebasetools.GetCollectionName(&firebasetools.User{})
+	docs.Put(profiles, "nurse-uid", map[string]interface{}{"uid": "nurse-uid"})
+
+	exporter := &firebasetools.UserDataExporter{
+		Documents: docs,
+		Registry: firebasetools.UserDataRegistry{
+			{Collection: "notes"},
+			{Collection: "messages", OwnerField: "senderUID"},
+		},
+		GetUser: func(ctx context.Context, tenantID string, uid string) (*auth.UserRecord, error) {
+			return testLoginResult(uid).User, nil
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	manifest, err := exporter.ExportUserData(ctx, "nurse-uid", buf)
+	assert.Nil(t, err)
+	defaults := len(firebasetools.DefaultUserDataRegistry())
+	assert.Len(t, manifest.Files, 1+defaults+3, "the package's own collections are exported too")
+	assert.Equal(t, &firebasetools.UserDataExportFile{
+		Name: "collections/" + profiles + ".uid.json", Collection: profiles, OwnerField: "uid", Documents: 1,
+	}, manifest.Files[1])
+	assert.Equal(t, []*firebasetools.UserDataExportFile{
+		{Name: "collections/notes.createdByUID.json", Collection: "notes", OwnerField: "createdByUID", Documents: 2},
+		{Name: "collections/notes.updatedByUID.json", Collection: "notes", OwnerField: "updatedByUID", Documents: 1},
+		{Name: "collections/messages.senderUID.json", Collection: "messages", OwnerField: "senderUID"},
+	}, manifest.Files[1+defaults:])
+
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(t, err)
+	assert.Len(t, archive.File, len(manifest.Files)+1)
+
+	saved := firebasetools.UserDataExportManifest{}
+	readZipJSON(t, archive, "manifest.json", &saved)
+	assert.Equal(t, "nurse-uid", saved.UID)
+	assert.Len(t, saved.Files, len(manifest.Files))
+
+	user := firebasetools.ExportedUser{}
+	readZipJSON(t, archive, "auth_user.json", &user)
+	assert.Equal(t, "nurse-uid@example.com", user.Email)
+
+	notes := []*firebasetools.OwnedDocument{}
+	readZipJSON(t, archive, "collections/notes.createdByUID.json", &notes)
+	assert.Equal(t, []*firebasetools.OwnedDocument{
+		{Collection: "notes", ID: "n1", Data: map[string]interface{}{"createdByUID": "nurse-uid", "text": "first"}},
+		{Collection: "notes", ID: "n2", Data: map[string]interface{}{"createdByUID": "nurse-uid", "text": "second"}},
+	}, notes)
+
+	updated := []*firebasetools.OwnedDocument{}
+	readZipJSON(t, archive, "collections/notes.updatedByUID.json", &updated)
+	assert.Equal(t, []*firebasetools.OwnedDocument{
+		{Collection: "notes", ID: "n3", Data: map[string]interface{}{"createdByUID": "other", "updatedByUID": "nurse-uid"}},
+	}, updated, "documents that name the user in a UID field are exported")
+
+	messages := []*firebasetools.OwnedDocument{}
+	readZipJSON(t, archive, "collections/messages.senderUID.json", &messages)
+	assert.Empty(t, messages)
+}
+
+func TestUserDataExporter_Errors(t *testing.T) {
+	ctx := context.Background()
+	missingUser := func(ctx context.Context, tenantID string, uid string) (*auth.UserRecord, error) {
+		return nil, fmt.Errorf("no user %s", uid)
+	}
+
+	tests := []struct {
+		name     string
+		exporter *firebasetools.UserDataExporter
+		uid      string
+	}{
+		{"missing uid", &firebasetools.UserDataExporter{GetUser: missingUser}, ""},
+		{"unknown user", &firebasetools.UserDataExporter{GetUser: missingUser}, "uid"},
+		{"no document store", &firebasetools.UserDataExporter{
+			GetUser:  missingUser,
+			Registry: firebasetools.UserDataRegistry{{Collection: "notes"}},
+		}, "uid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			_, err := tt.exporter.ExportUserData(ctx, tt.uid, buf)
+			assert.NotNil(t, err)
+			assert.Zero(t, buf.Len())
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package firebasetools
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/auth"
+)
+
+const (
+	// UserRecordLoaderContextKey is used to add/retrieve the request scoped *UserRecordLoader on the context
+	UserRecordLoaderContextKey = ContextKey("UserRecordLoader")
+
+	// MaxGetUsersBatchSize is the largest number of identifiers that Firebase Auth
+	// accepts in a single GetUsers call
+	MaxGetUsersBatchSize = 100
+
+	// DefaultUserRecordLoaderWait is how long a loader collects lookups into one batch
+	DefaultUserRecordLoaderWait = time.Millisecond
+)
+
+// UserRecordBatchFunc fetches the user records with the supplied UIDs.
+// UIDs that do not exist are left out of the returned map.
+type UserRecordBatchFunc func(ctx context.Context, uids []string) (map[string]*auth.UserRecord, error)
+
+// userLoaderEntry holds a user record that is being, or has been, loaded.
+// `done` is closed once user and err are set.
+type userLoaderEntry struct {
+	done chan struct{}
+	user *auth.UserRecord
+	err  error
+}
+
+// userLoaderBatch is a set of UIDs that are fetched together
+type userLoaderBatch struct {
+	ctx        context.Context
+	entries    map[string]*userLoaderEntry
+	uids       []string
+	dispatched bool
+}
+
+// UserRecordLoader fetches each user record at most once and serves repeated
+// lookups from memory. Lookups that are made within a short wait of each other,
+// e.g by the resolvers of one GraphQL query, are fetched in a single batch.
+// It is meant to live for a single request, so records are never refreshed.
+type UserRecordLoader struct {
+	fetch UserRecordBatchFunc
+
+	// Wait defaults to DefaultUserRecordLoaderWait. Full batches are fetched without waiting.
+	Wait time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*userLoaderEntry
+	batch   *userLoaderBatch
+}
+
+// NewUserRecordLoader creates a loader that fetches user records with the supplied function
+func NewUserRecordLoader(fetch UserRecordBatchFunc) *UserRecordLoader {
+	return &UserRecordLoader{
+		fetch:   fetch,
+		Wait:    DefaultUserRecordLoaderWait,
+		entries: map[string]*userLoaderEntry{},
+	}
+}
+
+// NewFirebaseUserRecordBatchFunc returns a batch function that fetches user records
+// from Firebase Auth using GetUsers, in batches of up to 100 UIDs.
+// The Auth client is only created when the first batch is fetched.
+func NewFirebaseUserRecordBatchFunc(firebaseApp IFirebaseApp) UserRecordBatchFunc {
+	var (
+		once       sync.Once
+		authClient *auth.Client
+		authErr    error
+	)
+	return func(ctx context.Context, uids []string) (map[string]*auth.UserRecord, error) {
+		once.Do(func() {
+			authClient, authErr = firebaseApp.Auth(ctx)
+		})
+		if authErr != nil {
+			return nil, fmt.Errorf("unable to initialize Firebase auth client: %w", authErr)
+		}
+
+		users := map[string]*auth.UserRecord{}
+		for start := 0; start < len(uids); start += MaxGetUsersBatchSize {
+			end := start + MaxGetUsersBatchSize
+			if end > len(uids) {
+				end = len(uids)
+			}
+			identifiers := []auth.UserIdentifier{}
+			for _, uid := range uids[start:end] {
+				identifiers = append(identifiers, auth.UIDIdentifier{UID: uid})
+			}
+			result, err := authClient.GetUsers(ctx, identifiers)
+			if err != nil {
+				return nil, fmt.Errorf("unable to get users: %w", err)
+			}
+			for _, user := range result.Users {
+				users[user.UID] = user
+			}
+		}
+		return users, nil
+	}
+}
+
+// Load returns the user record with the indicated UID
+func (l *UserRecordLoader) Load(ctx context.Context, uid string) (*auth.UserRecord, error) {
+	users, err := l.LoadMany(ctx, []string{uid})
+	if err != nil {
+		return nil, err
+	}
+	return users[0], nil
+}
+
+// LoadMany returns the user records with the indicated UIDs, in the same order.
+// Records that have not been loaded yet are queued for the next batch and
+// concurrent loads of the same UID share one fetch.
+func (l *UserRecordLoader) LoadMany(ctx context.Context, uids []string) ([]*auth.UserRecord, error) {
+	entries := make([]*userLoaderEntry, len(uids))
+	full := []*userLoaderBatch{}
+
+	l.mu.Lock()
+	for i, uid := range uids {
+		entry, ok := l.entries[uid]
+		if !ok {
+			entry = &userLoaderEntry{done: make(chan struct{})}
+			l.entries[uid] = entry
+			if batch := l.enqueue(ctx, uid, entry); batch != nil {
+				full = append(full, batch)
+			}
+		}
+		entries[i] = entry
+	}
+	l.mu.Unlock()
+
+	for _, batch := range full {
+		go l.dispatch(batch)
+	}
+
+	users := make([]*auth.UserRecord, len(uids))
+	for i, entry := range entries {
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if entry.err != nil {
+			return nil, fmt.Errorf("unable to get user %s: %w", uids[i], entry.err)
+		}
+		users[i] = entry.user
+	}
+	return users, nil
+}
+
+// enqueue adds the UID to the open batch, opening one if needed, and returns the
+// batch if it is full. The caller holds the lock.
+func (l *UserRecordLoader) enqueue(ctx context.Context, uid string, entry *userLoaderEntry) *userLoaderBatch {
+	if l.batch == nil {
+		batch := &userLoaderBatch{ctx: ctx, entries: map[string]*userLoaderEntry{}}
+		l.batch = batch
+		wait := l.Wait
+		if wait <= 0 {
+			wait = DefaultUserRecordLoaderWait
+		}
+		time.AfterFunc(wait, func() { l.dispatch(batch) })
+	}
+	batch := l.batch
+	batch.uids = append(batch.uids, uid)
+	batch.entries[uid] = entry
+	if len(batch.uids) < MaxGetUsersBatchSize {
+		return nil
+	}
+	l.batch = nil
+	return batch
+}
+
+// dispatch fetches the batch once. Every entry is settled even if the fetch
+// panics, so that no load waits forever.
+func (l *UserRecordLoader) dispatch(batch *userLoaderBatch) {
+	l.mu.Lock()
+	if batch.dispatched {
+		l.mu.Unlock()
+		return
+	}
+	batch.dispatched = true
+	if l.batch == batch {
+		l.batch = nil
+	}
+	l.mu.Unlock()
+
+	var (
+		users map[string]*auth.UserRecord
+		err   error
+	)
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while fetching users: %v", r)
+		}
+		l.settle(batch, users, err)
+	}()
+	users, err = l.fetch(batch.ctx, batch.uids)
+}
+
+func (l *UserRecordLoader) settle(batch *userLoaderBatch, users map[string]*auth.UserRecord, err error) {
+	if err != nil {
+		// failed fetches are not cached so that a later load can retry
+		l.mu.Lock()
+		for uid, entry := range batch.entries {
+			if l.entries[uid] == entry {
+				delete(l.entries, uid)
+			}
+		}
+		l.mu.Unlock()
+	}
+	for uid, entry := range batch.entries {
+		switch {
+		case err != nil:
+			entry.err = err
+		case users[uid] == nil:
+			entry.err = fmt.Errorf("no user record found for UID %s", uid)
+		default:
+			entry.user = users[uid]
+		}
+		close(entry.done)
+	}
+}
+
+// WithUserRecordLoader returns a copy of the supplied context that carries the loader
+func WithUserRecordLoader(ctx context.Context, loader *UserRecordLoader) context.Context {
+	return context.WithValue(ctx, UserRecordLoaderContextKey, loader)
+}
+
+// UserRecordLoaderFromContext retrieves the request scoped user record loader from the supplied context
+func UserRecordLoaderFromContext(ctx context.Context) (*UserRecordLoader, error) {
+	val := ctx.Value(UserRecordLoaderContextKey)
+	if val == nil {
+		return nil, fmt.Errorf(
+			"unable to get user record loader from context with key %#v", UserRecordLoaderContextKey)
+	}
+
+	loader, ok := val.(*UserRecordLoader)
+	if !ok || loader == nil {
+		return nil, fmt.Errorf("wrong user record loader type, got %#v, expected a *UserRecordLoader", val)
+	}
+	return loader, nil
+}
+
+// UserRecordLoaderMiddleware installs a new user record loader on every request so
+// that GetLoggedInUser and GetLoggedInUserCustomClaims fetch the logged in user's
+// record at most once per request. CheckIsAnonymousUser needs no record.
+func UserRecordLoaderMiddleware(firebaseApp IFirebaseApp) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				loader := NewUserRecordLoader(NewFirebaseUserRecordBatchFunc(firebaseApp))
+				next.ServeHTTP(w, r.WithContext(WithUserRecordLoader(r.Context(), loader)))
+			},
+		)
+	}
+}
+
+// getLoggedInUserRecord fetches the logged in user's record, from the request
+// scoped loader when one is installed
+func getLoggedInUserRecord(ctx context.Context) (*auth.UserRecord, error) {
+	authToken, err := GetUserTokenFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("user auth token not found in context: %w", err)
+	}
+
+	if loader, err := UserRecordLoaderFromContext(ctx); err == nil {
+		return loader.Load(ctx, authToken.UID)
+	}
+
+	authClient, err := GetFirebaseAuthClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get or create Firebase client: %w", err)
+	}
+
+	user, err := authClient.GetUser(ctx, authToken.UID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get user: %w", err)
+	}
+	return user, nil
+}
+
+// GetLoggedInUserCustomClaims retrieves the custom claims that are currently set on
+// the logged in user's account. Unlike GetLoggedInUserClaims, it reflects changes
+// made since the user's ID token was issued.
+func GetLoggedInUserCustomClaims(ctx context.Context) (map[string]interface{}, error) {
+	user, err := getLoggedInUserRecord(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if user.CustomClaims == nil {
+		return map[string]interface{}{}, nil
+	}
+	return user.CustomClaims, nil
+}
@@ -0,0 +1,193 @@
+package firebasetools_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/auth"
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingUserFetcher serves user records from memory and counts the fetches made
+type countingUserFetcher struct {
+	mu      sync.Mutex
+	calls   int
+	users   map[string]*auth.UserRecord
+	failErr error
+}
+
+func (f *countingUserFetcher) fetch(ctx context.Context, uids []string) (map[string]*auth.UserRecord, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.failErr != nil {
+		return nil, f.failErr
+	}
+	found := map[string]*auth.UserRecord{}
+	for _, uid := range uids {
+		if user, ok := f.users[uid]; ok {
+			found[uid] = user
+		}
+	}
+	return found, nil
+}
+
+func newCountingUserFetcher() *countingUserFetcher {
+	return &countingUserFetcher{
+		users: map[string]*auth.UserRecord{
+			"a-uid": {
+				UserInfo:     &auth.UserInfo{UID: "a-uid", Email: "a@example.com", ProviderID: "firebase"},
+				CustomClaims: map[string]interface{}{"role": "clinician"},
+			},
+			"b-uid": {
+				UserInfo: &auth.UserInfo{UID: "b-uid", ProviderID: "firebase"},
+			},
+		},
+	}
+}
+
+func TestUserRecordLoader_LoadMany(t *testing.T) {
+	ctx := context.Background()
+	fetcher := newCountingUserFetcher()
+	loader := firebasetools.NewUserRecordLoader(fetcher.fetch)
+
+	users, err := loader.LoadMany(ctx, []string{"b-uid", "a-uid"})
+	assert.Nil(t, err)
+	assert.Equal(t, "b-uid", users[0].UID)
+	assert.Equal(t, "a-uid", users[1].UID)
+	assert.Equal(t, 1, fetcher.calls)
+
+	// cached records are not fetched again
+	user, err := loader.Load(ctx, "a-uid")
+	assert.Nil(t, err)
+	assert.Equal(t, "a@example.com", user.Email)
+	assert.Equal(t, 1, fetcher.calls)
+
+	_, err = loader.Load(ctx, "missing-uid")
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, fetcher.calls)
+}
+
+func TestUserRecordLoader_ConcurrentLoads(t *testing.T) {
+	ctx := context.Background()
+	fetcher := newCountingUserFetcher()
+	loader := firebasetools.NewUserRecordLoader(fetcher.fetch)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, err := loader.Load(ctx, "a-uid")
+			assert.Nil(t, err)
+			assert.Equal(t, "a-uid", user.UID)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, fetcher.calls)
+}
+
+func TestUserRecordLoader_FailedFetchesAreRetried(t *testing.T) {
+	ctx := context.Background()
+	fetcher := newCountingUserFetcher()
+	fetcher.failErr = fmt.Errorf("unavailable")
+	loader := firebasetools.NewUserRecordLoader(fetcher.fetch)
+
+	_, err := loader.Load(ctx, "a-uid")
+	assert.NotNil(t, err)
+
+	fetcher.failErr = nil
+	user, err := loader.Load(ctx, "a-uid")
+	assert.Nil(t, err)
+	assert.Equal(t, "a-uid", user.UID)
+	assert.Equal(t, 2, fetcher.calls)
+}
+
+func TestLoggedInUserHelpers_UseLoader(t *testing.T) {
+	fetcher := newCountingUserFetcher()
+	ctx := context.WithValue(context.Background(), firebasetools.AuthTokenContextKey, &auth.Token{UID: "a-uid"})
+	ctx = firebasetools.WithUserRecordLoader(ctx, firebasetools.NewUserRecordLoader(fetcher.fetch))
+
+	userInfo, err := firebasetools.GetLoggedInUser(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "a@example.com", userInfo.Email)
+
+	isAnonymous, err := firebasetools.CheckIsAnonymousUser(ctx)
+	assert.Nil(t, err)
+	assert.False(t, isAnonymous)
+
+	claims, err := firebasetools.GetLoggedInUserCustomClaims(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "clinician", claims["role"])
+
+	assert.Equal(t, 1, fetcher.calls)
+}
+
+func TestUserRecordLoaderMiddleware(t *testing.T) {
+	var first, second *firebasetools.UserRecordLoader
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loader, err := firebasetools.UserRecordLoaderFromContext(r.Context())
+		assert.Nil(t, err)
+		if first == nil {
+			first = loader
+		} else {
+			second = loader
+		}
+	})
+	h := firebasetools.UserRecordLoaderMiddleware(&firebasetools.MockFirebaseApp{})(next)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.NotNil(t, first)
+	assert.NotNil(t, second)
+	assert.NotSame(t, first, second, "every request gets its own loader")
+
+	_, err := firebasetools.UserRecordLoaderFromContext(context.Background())
+	assert.NotNil(t, err)
+}
+
+func TestUserRecordLoader_BatchesAcrossCalls(t *testing.T) {
+	ctx := context.Background()
+	fetcher := newCountingUserFetcher()
+	loader := firebasetools.NewUserRecordLoader(fetcher.fetch)
+	loader.Wait = 20 * time.Millisecond
+
+	var wg sync.WaitGroup
+	for _, uid := range []string{"a-uid", "b-uid"} {
+		wg.Add(1)
+		go func(uid string) {
+			defer wg.Done()
+			user, err := loader.Load(ctx, uid)
+			assert.Nil(t, err)
+			assert.Equal(t, uid, user.UID)
+		}(uid)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, fetcher.calls, "separate loads share one fetch")
+}
+
+func TestUserRecordLoader_FetchPanics(t *testing.T) {
+	ctx := context.Background()
+	calls := 0
+	loader := firebasetools.NewUserRecordLoader(func(ctx context.Context, uids []string) (map[string]*auth.UserRecord, error) {
+		calls++
+		if calls == 1 {
+			panic("boom")
+		}
+		return map[string]*auth.UserRecord{"a-uid": {UserInfo: &auth.UserInfo{UID: "a-uid"}}}, nil
+	})
+
+	_, err := loader.Load(ctx, "a-uid")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "panic while fetching users: boom")
+
+	user, err := loader.Load(ctx, "a-uid")
+	assert.Nil(t, err, "failed fetches are retried")
+	assert.Equal(t, "a-uid", user.UID)
+}
@@ -0,0 +1,609 @@
+package firebasetools
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"firebase.google.com/go/auth"
+	"google.golang.org/api/iterator"
+)
+
+// MaxUserImportBatchSize is the most users that Firebase Auth imports in one call
+const MaxUserImportBatchSize = 1000
+
+// maxExportedUserLineBytes bounds the size of a single JSONL record
+const maxExportedUserLineBytes = 1 << 20
+
+// UserTransferFormat is the file format of user exports and imports
+type UserTransferFormat string
+
+// user transfer formats
+const (
+	UserTransferJSONL UserTransferFormat = "jsonl"
+	UserTransferCSV   UserTransferFormat = "csv"
+)
+
+// userTransferCSVHeader lists the CSV columns. Claims and provider data are JSON encoded.
+var userTransferCSVHeader = []string{
+	"uid", "email", "emailVerified", "phoneNumber", "displayName", "photoURL", "disabled",
+	"customClaims", "providerData", "passwordHash", "passwordSalt", "createdAt", "lastLoginAt",
+}
+
+// ExportedUserProvider is a federated identity that is linked to an exported user
+type ExportedUserProvider struct {
+	UID         string `json:"uid"`
+	ProviderID  string `json:"providerId"`
+	Email       string `json:"email,omitempty"`
+	DisplayName string `json:"displayName,omitempty"`
+	PhotoURL    string `json:"photoURL,omitempty"`
+	PhoneNumber string `json:"phoneNumber,omitempty"`
+}
+
+// ExportedUser is the portable form of a Firebase Auth user. The password hash and
+// salt are base64 encoded and can only be imported with the exporting project's
+// hash configuration.
+type ExportedUser struct {
+	UID           string                  `json:"uid"`
+	Email         string                  `json:"email,omitempty"`
+	EmailVerified bool                    `json:"emailVerified"`
+	PhoneNumber   string                  `json:"phoneNumber,omitempty"`
+	DisplayName   string                  `json:"displayName,omitempty"`
+	PhotoURL      string                  `json:"photoURL,omitempty"`
+	Disabled      bool                    `json:"disabled"`
+	CustomClaims  map[string]interface{}  `json:"customClaims,omitempty"`
+	ProviderData  []*ExportedUserProvider `json:"providerData,omitempty"`
+	PasswordHash  string                  `json:"passwordHash,omitempty"`
+	PasswordSalt  string                  `json:"passwordSalt,omitempty"`
+
+	// CreatedAt and LastLoginAt are in milliseconds since the epoch
+	CreatedAt   int64 `json:"createdAt,omitempty"`
+	LastLoginAt int64 `json:"lastLoginAt,omitempty"`
+}
+
+// NewExportedUser converts an exported Firebase Auth user record
+func NewExportedUser(record *auth.ExportedUserRecord) *ExportedUser {
+	user := &ExportedUser{
+		CustomClaims:  record.CustomClaims,
+		Disabled:      record.Disabled,
+		EmailVerified: record.EmailVerified,
+		PasswordHash:  record.PasswordHash,
+		PasswordSalt:  record.PasswordSalt,
+	}
+	if record.UserRecord != nil && record.UserInfo != nil {
+		user.UID = record.UID
+		user.Email = record.Email
+		user.PhoneNumber = record.PhoneNumber
+		user.DisplayName = record.DisplayName
+		user.PhotoURL = record.PhotoURL
+	}
+	if record.UserRecord != nil && record.UserMetadata != nil {
+		user.CreatedAt = record.UserMetadata.CreationTimestamp
+		user.LastLoginAt = record.UserMetadata.LastLogInTimestamp
+	}
+	if record.UserRecord != nil {
+		for _, info := range record.ProviderUserInfo {
+			user.ProviderData = append(user.ProviderData, &ExportedUserProvider{
+				UID:         info.UID,
+				ProviderID:  info.ProviderID,
+				Email:       info.Email,
+				DisplayName: info.DisplayName,
+				PhotoURL:    info.PhotoURL,
+				PhoneNumber: info.PhoneNumber,
+			})
+		}
+	}
+	return user
+}
+
+// Validate returns the problems that would stop the user from being imported
+func (u *ExportedUser) Validate(withPasswordHash bool) error {
+	problems := []string{}
+	if u.UID == "" {
+		problems = append(problems, "a uid is required")
+	} else if len(u.UID) > 128 {
+		problems = append(problems, "the uid must be at most 128 characters long")
+	}
+	if u.Email != "" {
+		if addr, err := mail.ParseAddress(u.Email); err != nil || addr.Address != u.Email {
+			problems = append(problems, "invalid email address")
+		}
+	}
+	if u.PhoneNumber != "" && !e164PhoneNumber.MatchString(u.PhoneNumber) {
+		problems = append(problems, "invalid phone number")
+	}
+	if u.PasswordHash != "" {
+		if !withPasswordHash {
+			problems = append(problems, "a hash configuration is required to import password hashes")
+		}
+		if _, err := decodePasswordBytes(u.PasswordHash); err != nil {
+			problems = append(problems, "the password hash is not base64 encoded")
+		}
+	}
+	if u.PasswordSalt != "" {
+		if _, err := decodePasswordBytes(u.PasswordSalt); err != nil {
+			problems = append(problems, "the password salt is not base64 encoded")
+		}
+	}
+	for _, provider := range u.ProviderData {
+		if provider.UID == "" || provider.ProviderID == "" {
+			problems = append(problems, "linked providers need a uid AND provider ID")
+			break
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// toImport builds the Firebase Auth import record of a validated user
+func (u *ExportedUser) toImport() *auth.UserToImport {
+	user := (&auth.UserToImport{}).
+		UID(u.UID).
+		EmailVerified(u.EmailVerified).
+		Disabled(u.Disabled)
+	if u.Email != "" {
+		user = user.Email(u.Email)
+	}
+	if u.PhoneNumber != "" {
+		user = user.PhoneNumber(u.PhoneNumber)
+	}
+	if u.DisplayName != "" {
+		user = user.DisplayName(u.DisplayName)
+	}
+	if u.PhotoURL != "" {
+		user = user.PhotoURL(u.PhotoURL)
+	}
+	if len(u.CustomClaims) > 0 {
+		user = user.CustomClaims(u.CustomClaims)
+	}
+	if u.CreatedAt > 0 || u.LastLoginAt > 0 {
+		user = user.Metadata(&auth.UserMetadata{
+			CreationTimestamp:  u.CreatedAt,
+			LastLogInTimestamp: u.LastLoginAt,
+		})
+	}
+	if u.PasswordHash != "" {
+		hash, _ := decodePasswordBytes(u.PasswordHash) // checked by Validate
+		user = user.PasswordHash(hash)
+	}
+	if u.PasswordSalt != "" {
+		salt, _ := decodePasswordBytes(u.PasswordSalt)
+		user = user.PasswordSalt(salt)
+	}
+	providers := []*auth.UserProvider{}
+	for _, provider := range u.ProviderData {
+		if provider.ProviderID == "phone" {
+			continue // phone sign in comes with the phone number
+		}
+		providers = append(providers, &auth.UserProvider{
+			UID:         provider.UID,
+			ProviderID:  provider.ProviderID,
+			Email:       provider.Email,
+			DisplayName: provider.DisplayName,
+			PhotoURL:    provider.PhotoURL,
+		})
+	}
+	if len(providers) > 0 {
+		user = user.ProviderData(providers)
+	}
+	return user
+}
+
+// decodePasswordBytes accepts password hashes and salts in any base64 alphabet
+func decodePasswordBytes(value string) ([]byte, error) {
+	var err error
+	for _, encoding := range []*base64.Encoding{
+		base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding,
+	} {
+		var decoded []byte
+		if decoded, err = encoding.DecodeString(value); err == nil {
+			return decoded, nil
+		}
+	}
+	return nil, err
+}
+
+// UserRecordIterator yields exported users until it returns iterator.Done.
+// *auth.UserIterator is one.
+type UserRecordIterator interface {
+	Next() (*auth.ExportedUserRecord, error)
+}
+
+// userTransferClient is implemented by both project level and tenant clients
+type userTransferClient interface {
+	Users(ctx context.Context, nextPageToken string) *auth.UserIterator
+	ImportUsers(ctx context.Context, users []*auth.UserToImport, opts ...auth.UserImportOption) (*auth.UserImportResult, error)
+}
+
+// getUserTransferClient returns the auth client of the context's tenant, if any
+func getUserTransferClient(ctx context.Context) (userTransferClient, error) {
+	if tenantID, err := GetTenantIDFromContext(ctx); err == nil && tenantID != "" {
+		return GetTenantAuthClient(ctx, tenantID)
+	}
+	authClient, err := GetFirebaseAuthClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get or create Firebase client: %w", err)
+	}
+	return authClient, nil
+}
+
+// ExportUsers streams every Firebase Auth user of the project, or of the context's
+// tenant, to w and returns how many were written. Password hashes are only
+// included when the service account may read them.
+func ExportUsers(ctx context.Context, w io.Writer, format UserTransferFormat) (int, error) {
+	authClient, err := getUserTransferClient(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return WriteUsers(authClient.Users(ctx, ""), w, format)
+}
+
+// WriteUsers writes the users that the iterator yields to w, one at a time
+func WriteUsers(it UserRecordIterator, w io.Writer, format UserTransferFormat) (int, error) {
+	var (
+		writeUser func(user *ExportedUser) error
+		flush     = func() error { return nil }
+	)
+	switch format {
+	case UserTransferJSONL:
+		encoder := json.NewEncoder(w)
+		writeUser = func(user *ExportedUser) error {
+			return encoder.Encode(user)
+		}
+	case UserTransferCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(userTransferCSVHeader); err != nil {
+			return 0, fmt.Errorf("unable to write the CSV header: %w", err)
+		}
+		writeUser = func(user *ExportedUser) error {
+			row, err := user.csvRow()
+			if err != nil {
+				return err
+			}
+			return writer.Write(row)
+		}
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	default:
+		return 0, fmt.Errorf("unknown user transfer format %q", format)
+	}
+
+	count := 0
+	for {
+		record, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return count, fmt.Errorf("unable to list users: %w", err)
+		}
+		if err := writeUser(NewExportedUser(record)); err != nil {
+			return count, fmt.Errorf("unable to write user %s: %w", record.UID, err)
+		}
+		count++
+	}
+	if err := flush(); err != nil {
+		return count, fmt.Errorf("unable to write users: %w", err)
+	}
+	return count, nil
+}
+
+func (u *ExportedUser) csvRow() ([]string, error) {
+	claims, providers := "", ""
+	if len(u.CustomClaims) > 0 {
+		bs, err := json.Marshal(u.CustomClaims)
+		if err != nil {
+			return nil, err
+		}
+		claims = string(bs)
+	}
+	if len(u.ProviderData) > 0 {
+		bs, err := json.Marshal(u.ProviderData)
+		if err != nil {
+			return nil, err
+		}
+		providers = string(bs)
+	}
+	return []string{
+		u.UID, u.Email, strconv.FormatBool(u.EmailVerified), u.PhoneNumber, u.DisplayName, u.PhotoURL,
+		strconv.FormatBool(u.Disabled), claims, providers, u.PasswordHash, u.PasswordSalt,
+		formatMillis(u.CreatedAt), formatMillis(u.LastLoginAt),
+	}, nil
+}
+
+func formatMillis(millis int64) string {
+	if millis == 0 {
+		return ""
+	}
+	return strconv.FormatInt(millis, 10)
+}
+
+// exportedUserFromCSV parses a CSV row, using the header to find columns
+func exportedUserFromCSV(columns map[string]int, row []string) (*ExportedUser, error) {
+	get := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	var err error
+	parseBool := func(name string) bool {
+		value := get(name)
+		if value == "" {
+			return false
+		}
+		b, parseErr := strconv.ParseBool(value)
+		if parseErr != nil && err == nil {
+			err = fmt.Errorf("invalid %s: %w", name, parseErr)
+		}
+		return b
+	}
+	parseInt := func(name string) int64 {
+		value := get(name)
+		if value == "" {
+			return 0
+		}
+		i, parseErr := strconv.ParseInt(value, 10, 64)
+		if parseErr != nil && err == nil {
+			err = fmt.Errorf("invalid %s: %w", name, parseErr)
+		}
+		return i
+	}
+
+	user := &ExportedUser{
+		UID:           get("uid"),
+		Email:         get("email"),
+		EmailVerified: parseBool("emailVerified"),
+		PhoneNumber:   get("phoneNumber"),
+		DisplayName:   get("displayName"),
+		PhotoURL:      get("photoURL"),
+		Disabled:      parseBool("disabled"),
+		PasswordHash:  get("passwordHash"),
+		PasswordSalt:  get("passwordSalt"),
+		CreatedAt:     parseInt("createdAt"),
+		LastLoginAt:   parseInt("lastLoginAt"),
+	}
+	if claims := get("customClaims"); claims != "" && err == nil {
+		if jsonErr := json.Unmarshal([]byte(claims), &user.CustomClaims); jsonErr != nil {
+			err = fmt.Errorf("invalid customClaims: %w", jsonErr)
+		}
+	}
+	if providers := get("providerData"); providers != "" && err == nil {
+		if jsonErr := json.Unmarshal([]byte(providers), &user.ProviderData); jsonErr != nil {
+			err = fmt.Errorf("invalid providerData: %w", jsonErr)
+		}
+	}
+	return user, err
+}
+
+// exportedUserReader reads users one at a time. It returns io.EOF at the end,
+// and per-record errors that don't stop the reading as *userRecordError.
+type exportedUserReader func() (*ExportedUser, int, error)
+
+// userRecordError is a record that could not be parsed
+type userRecordError struct {
+	err error
+}
+
+func (e *userRecordError) Error() string {
+	return e.err.Error()
+}
+
+func newExportedUserReader(r io.Reader, format UserTransferFormat) (exportedUserReader, error) {
+	switch format {
+	case UserTransferJSONL:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), maxExportedUserLineBytes)
+		line := 0
+		return func() (*ExportedUser, int, error) {
+			for scanner.Scan() {
+				line++
+				if strings.TrimSpace(scanner.Text()) == "" {
+					continue
+				}
+				user := &ExportedUser{}
+				if err := json.Unmarshal(scanner.Bytes(), user); err != nil {
+					return nil, line, &userRecordError{err: fmt.Errorf("invalid JSON: %w", err)}
+				}
+				return user, line, nil
+			}
+			if err := scanner.Err(); err != nil {
+				return nil, line, fmt.Errorf("unable to read users: %w", err)
+			}
+			return nil, line, io.EOF
+		}, nil
+	case UserTransferCSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		header, err := reader.Read()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the CSV header: %w", err)
+		}
+		columns := map[string]int{}
+		for i, name := range header {
+			columns[strings.TrimSpace(name)] = i
+		}
+		if _, ok := columns["uid"]; !ok {
+			return nil, fmt.Errorf("the CSV header has no uid column")
+		}
+		line := 1
+		return func() (*ExportedUser, int, error) {
+			row, err := reader.Read()
+			line++
+			if errors.Is(err, io.EOF) {
+				return nil, line, io.EOF
+			}
+			if err != nil {
+				parseErr := &csv.ParseError{}
+				if errors.As(err, &parseErr) {
+					return nil, line, &userRecordError{err: err}
+				}
+				return nil, line, fmt.Errorf("unable to read users: %w", err)
+			}
+			user, err := exportedUserFromCSV(columns, row)
+			if err != nil {
+				return nil, line, &userRecordError{err: err}
+			}
+			return user, line, nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown user transfer format %q", format)
+	}
+}
+
+// UserImportConfig configures user imports
+type UserImportConfig struct {
+	// Hash is the password hash configuration of the project that the users were
+	// exported from. It is required to import password hashes.
+	Hash auth.UserImportHash
+
+	// DryRun validates the users without importing them
+	DryRun bool
+
+	// BatchSize defaults to, and can't exceed, MaxUserImportBatchSize
+	BatchSize int
+
+	// ImportUsers defaults to importing into the project, or the context's tenant
+	ImportUsers func(ctx context.Context, users []*auth.UserToImport, opts ...auth.UserImportOption) (*auth.UserImportResult, error)
+}
+
+// UserImportError is a user that was not imported
+type UserImportError struct {
+	// Line is the user's line in the import file
+	Line   int    `json:"line"`
+	UID    string `json:"uid,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// UserImportReport summarizes an import
+type UserImportReport struct {
+	DryRun   bool               `json:"dryRun"`
+	Total    int                `json:"total"`
+	Imported int                `json:"imported"`
+	Failed   int                `json:"failed"`
+	Errors   []*UserImportError `json:"errors,omitempty"`
+}
+
+func (report *UserImportReport) fail(line int, uid string, reason string) {
+	report.Failed++
+	report.Errors = append(report.Errors, &UserImportError{Line: line, UID: uid, Reason: reason})
+}
+
+// ImportUsers reads users exported by ExportUsers and imports them into Firebase Auth
+// in batches. Users that are invalid or that Firebase rejects are listed in the
+// report, and don't stop the import.
+func ImportUsers(
+	ctx context.Context,
+	r io.Reader,
+	format UserTransferFormat,
+	config UserImportConfig,
+) (*UserImportReport, error) {
+	batchSize := config.BatchSize
+	if batchSize <= 0 || batchSize > MaxUserImportBatchSize {
+		batchSize = MaxUserImportBatchSize
+	}
+	importUsers := config.ImportUsers
+	if importUsers == nil && !config.DryRun {
+		authClient, err := getUserTransferClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		importUsers = authClient.ImportUsers
+	}
+	opts := []auth.UserImportOption{}
+	if config.Hash != nil {
+		opts = append(opts, auth.WithHash(config.Hash))
+	}
+	next, err := newExportedUserReader(r, format)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &UserImportReport{DryRun: config.DryRun}
+	type pendingUser struct {
+		line int
+		user *ExportedUser
+	}
+	batch := []pendingUser{}
+	importBatch := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		defer func() { batch = batch[:0] }()
+		if config.DryRun {
+			report.Imported += len(batch)
+			return nil
+		}
+		users := make([]*auth.UserToImport, len(batch))
+		for i, pending := range batch {
+			users[i] = pending.user.toImport()
+		}
+		result, err := importUsers(ctx, users, opts...)
+		if err != nil {
+			return fmt.Errorf("unable to import the users on lines %d to %d: %w",
+				batch[0].line, batch[len(batch)-1].line, err)
+		}
+		failed := map[int]bool{}
+		for _, info := range result.Errors {
+			if info.Index < 0 || info.Index >= len(batch) {
+				continue
+			}
+			failed[info.Index] = true
+			pending := batch[info.Index]
+			report.fail(pending.line, pending.user.UID, info.Reason)
+		}
+		report.Imported += len(batch) - len(failed)
+		return nil
+	}
+
+	seen := map[string]int{}
+	for {
+		user, line, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		recordErr := &userRecordError{}
+		if errors.As(err, &recordErr) {
+			report.Total++
+			report.fail(line, "", recordErr.Error())
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+
+		report.Total++
+		if err := user.Validate(config.Hash != nil); err != nil {
+			report.fail(line, user.UID, err.Error())
+			continue
+		}
+		if first, ok := seen[user.UID]; ok {
+			report.fail(line, user.UID, fmt.Sprintf("duplicate uid, first seen on line %d", first))
+			continue
+		}
+		seen[user.UID] = line
+
+		batch = append(batch, pendingUser{line: line, user: user})
+		if len(batch) == batchSize {
+			if err := importBatch(); err != nil {
+				return report, err
+			}
+		}
+	}
+	if err := importBatch(); err != nil {
+		return report, err
+	}
+	return report, nil
+}
@@ -0,0 +1,184 @@
+package firebasetools_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"firebase.google.com/go/auth"
+	"firebase.google.com/go/auth/hash"
+	"github.com/savannahghi/firebasetools"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/iterator"
+)
+
+type stubUserIterator struct {
+	records []*auth.ExportedUserRecord
+	err     error
+}
+
+func (it *stubUserIterator) Next() (*auth.ExportedUserRecord, error) {
+	if len(it.records) == 0 {
+		if it.err != nil {
+			return nil, it.err
+		}
+		return nil, iterator.Done
+	}
+	record := it.records[0]
+	it.records = it.records[1:]
+	return record, nil
+}
+
+func testExportedUserRecords() []*auth.ExportedUserRecord {
+	return []*auth.ExportedUserRecord{
+		{
+			UserRecord: &auth.UserRecord{
+				UserInfo:      &auth.UserInfo{UID: "nurse-uid", Email: "nurse@example.com", DisplayName: "Nurse, Jane"},
+				CustomClaims:  map[string]interface{}{"role": "nurse"},
+				EmailVerified: true,
+				ProviderUserInfo: []*auth.UserInfo{
+					{UID: "google-id", ProviderID: "google.com", Email: "nurse@example.com"},
+				},
+				UserMetadata: &auth.UserMetadata{CreationTimestamp: 1600000000000, LastLogInTimestamp: 1600000100000},
+			},
+			PasswordHash: "aGFzaA==",
+			PasswordSalt: "c2FsdA==",
+		},
+		{
+			UserRecord: &auth.UserRecord{
+				UserInfo: &auth.UserInfo{UID: "patient-uid", PhoneNumber: "+254700000000"},
+				Disabled: true,
+			},
+		},
+	}
+}
+
+func TestWriteUsers(t *testing.T) {
+	for _, format := range []firebasetools.UserTransferFormat{firebasetools.UserTransferJSONL, firebasetools.UserTransferCSV} {
+		t.Run(string(format), func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			count, err := firebasetools.WriteUsers(&stubUserIterator{records: testExportedUserRecords()}, buf, format)
+			assert.Nil(t, err)
+			assert.Equal(t, 2, count)
+
+			// exports can be imported back as they are
+			var imported []*auth.UserToImport
+			report, err := firebasetools.ImportUsers(context.Background(), buf, format, firebasetools.UserImportConfig{
+				Hash: hash.StandardScrypt{},
+				ImportUsers: func(ctx context.Context, users []*auth.UserToImport, opts ...auth.UserImportOption) (*auth.UserImportResult, error) {
+					assert.Len(t, opts, 1, "the hash configuration is passed on")
+					imported = users
+					return &auth.UserImportResult{SuccessCount: len(users)}, nil
+				},
+			})
+			assert.Nil(t, err)
+			assert.Equal(t, 2, report.Total)
+			assert.Equal(t, 2, report.Imported)
+			assert.Empty(t, report.Errors)
+			assert.Len(t, imported, 2)
+		})
+	}
+
+	buf := &bytes.Buffer{}
+	_, err := firebasetools.WriteUsers(&stubUserIterator{records: testExportedUserRecords()}, buf, "xml")
+	assert.NotNil(t, err)
+
+	count, err := firebasetools.WriteUsers(&stubUserIterator{
+		records: testExportedUserRecords(),
+		err:     fmt.Errorf("quota exceeded"),
+	}, buf, firebasetools.UserTransferJSONL)
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestWriteUsers_CSV(t *testing.T) {
+	buf := &bytes.Buffer{}
+	_, err := firebasetools.WriteUsers(&stubUserIterator{records: testExportedUserRecords()}, buf, firebasetools.UserTransferCSV)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 3)
+	assert.True(t, strings.HasPrefix(lines[0], "uid,email,emailVerified"))
+	assert.Contains(t, lines[1], `"Nurse, Jane"`)
+	assert.Contains(t, lines[1], `"{""role"":""nurse""}"`)
+	assert.Contains(t, lines[1], "aGFzaA==")
+}
+
+func TestImportUsers(t *testing.T) {
+	input := strings.Join([]string{
+		`{"uid": "a-uid", "email": "a@example.com"}`,
+		`{"uid": "b-uid", "email": "b@example.com"}`,
+		``,
+		`{"uid": "c-uid", "email": "not an email"}`,
+		`not json`,
+		`{"uid": "a-uid", "email": "a2@example.com"}`,
+		`{"uid": "d-uid", "passwordHash": "aGFzaA=="}`,
+		`{"uid": "e-uid", "phoneNumber": "+254700000001"}`,
+	}, "\n")
+
+	batches := [][]*auth.UserToImport{}
+	config := firebasetools.UserImportConfig{
+		BatchSize: 2,
+		ImportUsers: func(ctx context.Context, users []*auth.UserToImport, opts ...auth.UserImportOption) (*auth.UserImportResult, error) {
+			batches = append(batches, users)
+			if len(batches) == 1 {
+				return &auth.UserImportResult{
+					SuccessCount: 1,
+					FailureCount: 1,
+					Errors:       []*auth.ErrorInfo{{Index: 1, Reason: "email already exists"}},
+				}, nil
+			}
+			return &auth.UserImportResult{SuccessCount: len(users)}, nil
+		},
+	}
+	report, err := firebasetools.ImportUsers(context.Background(), strings.NewReader(input), firebasetools.UserTransferJSONL, config)
+	assert.Nil(t, err)
+	assert.Len(t, batches, 2)
+	assert.Equal(t, 7, report.Total)
+	assert.Equal(t, 2, report.Imported)
+	assert.Equal(t, 5, report.Failed)
+
+	failures := map[int]string{}
+	for _, e := range report.Errors {
+		failures[e.Line] = e.Reason
+	}
+	assert.Equal(t, "email already exists", failures[2])
+	assert.Equal(t, "invalid email address", failures[4])
+	assert.Contains(t, failures[5], "invalid JSON")
+	assert.Equal(t, "duplicate uid, first seen on line 1", failures[6])
+	assert.Equal(t, "a hash configuration is required to import password hashes", failures[7])
+
+	// dry runs validate without importing
+	config.DryRun = true
+	batches = nil
+	report, err = firebasetools.ImportUsers(context.Background(), strings.NewReader(input), firebasetools.UserTransferJSONL, config)
+	assert.Nil(t, err)
+	assert.Empty(t, batches)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, 3, report.Imported)
+	assert.Equal(t, 4, report.Failed)
+}
+
+func TestImportUsers_Failures(t *testing.T) {
+	config := firebasetools.UserImportConfig{
+		ImportUsers: func(ctx context.Context, users []*auth.UserToImport, opts ...auth.UserImportOption) (*auth.UserImportResult, error) {
+			return nil, fmt.Errorf("permission denied")
+		},
+	}
+	_, err := firebasetools.ImportUsers(context.Background(), strings.NewReader(`{"uid": "a-uid"}`), firebasetools.UserTransferJSONL, config)
+	assert.NotNil(t, err)
+
+	_, err = firebasetools.ImportUsers(context.Background(), strings.NewReader("email\na@example.com\n"), firebasetools.UserTransferCSV, config)
+	assert.NotNil(t, err, "CSV imports need a uid column")
+
+	report, err := firebasetools.ImportUsers(
+		context.Background(),
+		strings.NewReader("uid,disabled\na-uid,maybe\n"),
+		firebasetools.UserTransferCSV,
+		firebasetools.UserImportConfig{DryRun: true},
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Failed)
+	assert.Equal(t, 2, report.Errors[0].Line)
+}